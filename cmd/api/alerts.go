@@ -0,0 +1,815 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mqtt/data"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Alert topics published on the event bus
+const (
+	TopicAlertOpened       = "alert.opened"
+	TopicAlertAcknowledged = "alert.acknowledged"
+	TopicAlertResolved     = "alert.resolved"
+)
+
+const maxAlertRuleDuration = 7 * 24 * time.Hour
+
+// Rule expressions such as "battery_voltage < 11.5 for 10m" or
+// "door_open_counter increased"
+var (
+	comparisonExpressionPattern = regexp.MustCompile(`^([a-z0-9_]+)\s*(<=|>=|==|!=|<|>)\s*(-?\d+(?:\.\d+)?)(?:\s+for\s+(\S+))?$`)
+	changeExpressionPattern     = regexp.MustCompile(`^([a-z0-9_]+)\s+(increased|decreased)(?:\s+by\s+(\d+(?:\.\d+)?))?(?:\s+for\s+(\S+))?$`)
+)
+
+// alertMetricNames holds the numeric telemetry fields rules can test
+var alertMetricNames = func() map[string]struct{} {
+	names := make(map[string]struct{})
+	for name, value := range telemetryFields(&data.DeviceData{}) {
+		if _, ok := value.(float64); ok && name != "id" && name != "device_id" {
+			names[name] = struct{}{}
+		}
+	}
+	return names
+}()
+
+// AlertEvent is the payload of alert topics on the event bus
+type AlertEvent struct {
+	Alert *data.Alert     `json:"alert"`
+	Rule  *data.AlertRule `json:"rule"`
+}
+
+// ruleRefreshInterval is how often each instance reloads the alert rules,
+// so that rule changes made through another instance apply within it
+const ruleRefreshInterval = 10 * time.Second
+
+// AlertService evaluates alert rules against every saved reading. Active
+// alerts and what each rule remembers of a device, since when its condition
+// has held and the previous value, are kept in the database, so any
+// instance can evaluate a device's next reading and a restart loses
+// nothing. Rules are cached and reloaded by Refresh.
+type AlertService struct {
+	models *data.Models
+	log    *slog.Logger
+	events *EventBus
+
+	mu    sync.Mutex
+	rules []*data.AlertRule
+}
+
+// NewAlertService loads the rules and subscribes the service to saved
+// telemetry and device deletions
+func NewAlertService(models *data.Models, events *EventBus, logger *slog.Logger) (*AlertService, error) {
+	s := &AlertService{
+		models: models,
+		log:    logger.With("component", "alerts"),
+		events: events,
+	}
+	if err := s.loadRules(); err != nil {
+		return nil, err
+	}
+
+	events.Subscribe("alerts", []string{TopicTelemetrySaved, TopicDeviceDeleted}, 0, s.handleEvent)
+	return s, nil
+}
+
+// Refresh reloads the rules every ruleRefreshInterval until the process
+// exits
+func (s *AlertService) Refresh() {
+	ticker := time.NewTicker(ruleRefreshInterval)
+	for range ticker.C {
+		if err := s.loadRules(); err != nil {
+			s.log.Error("failed to reload alert rules", "error", err)
+		}
+	}
+}
+
+// loadRules refreshes the cached rules
+func (s *AlertService) loadRules() error {
+	rules, err := s.models.Alert.GetRules()
+	if err != nil {
+		return fmt.Errorf("failed to load alert rules: %v", err)
+	}
+	s.mu.Lock()
+	s.rules = rules
+	s.mu.Unlock()
+	return nil
+}
+
+// cachedRules returns the cached rules, which must not be modified
+func (s *AlertService) cachedRules() []*data.AlertRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rules
+}
+
+func (s *AlertService) handleEvent(event Event) error {
+	switch payload := event.Payload.(type) {
+	case *data.DeviceData:
+		return s.models.Alert.LockDevice(payload.DeviceID, func() error {
+			return s.evaluate(payload)
+		})
+	case DeviceEvent:
+		if payload.Purged {
+			// The device-scoped rules were deleted with the device
+			return s.loadRules()
+		}
+	}
+	return nil
+}
+
+// evaluate runs every matching rule against a reading and saves the state
+// the rules keep for the device. The caller must hold the device's alert
+// lock.
+func (s *AlertService) evaluate(entry *data.DeviceData) error {
+	deviceType := ""
+	device, err := s.models.Device.GetByID(entry.DeviceID)
+	switch {
+	case err == nil:
+		deviceType = device.DeviceType
+	case !errors.Is(err, data.ErrNotFound):
+		return fmt.Errorf("failed to load device: %w", err)
+	}
+
+	var rules []*data.AlertRule
+	for _, rule := range s.cachedRules() {
+		if rule.Enabled && ruleMatchesDevice(rule, entry.DeviceID, deviceType) {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	states, err := s.models.Alert.GetAlertStates(entry.DeviceID)
+	if err != nil {
+		return fmt.Errorf("failed to load alert state: %w", err)
+	}
+	stateByRule := make(map[uint]*data.AlertState, len(states))
+	for _, state := range states {
+		stateByRule[state.RuleID] = state
+	}
+	alerts, err := s.models.Alert.GetAlerts(data.AlertFilter{Status: "active", DeviceID: entry.DeviceID})
+	if err != nil {
+		return fmt.Errorf("failed to load active alerts: %w", err)
+	}
+	active := make(map[uint]*data.Alert, len(alerts))
+	for _, alert := range alerts {
+		active[alert.RuleID] = alert
+	}
+
+	fields := telemetryFields(entry)
+	now := time.Now()
+	for _, rule := range rules {
+		value, ok := fields[rule.Metric].(float64)
+		if !ok {
+			continue
+		}
+		state, ok := stateByRule[rule.ID]
+		if !ok {
+			state = &data.AlertState{RuleID: rule.ID, DeviceID: entry.DeviceID}
+		}
+		pending, previous := state.PendingSince, state.LastValue
+
+		last, hasLast := 0.0, previous != nil
+		if hasLast {
+			last = *previous
+		}
+		breached := ruleBreached(rule, value, last, hasLast)
+
+		if alert, ok := active[rule.ID]; ok {
+			state.PendingSince = nil
+			if ruleCleared(rule, value, breached) {
+				s.resolve(alert, rule, &value)
+			}
+		} else if !breached {
+			state.PendingSince = nil
+		} else {
+			if state.PendingSince == nil {
+				state.PendingSince = &now
+			}
+			if now.Sub(*state.PendingSince) >= time.Duration(rule.DurationSeconds)*time.Second {
+				state.PendingSince = nil
+				s.open(rule, entry, value, last)
+			}
+		}
+		if rule.Operator == data.AlertOperatorIncreased || rule.Operator == data.AlertOperatorDecreased {
+			state.LastValue = &value
+		}
+
+		if samePointee(pending, state.PendingSince) && samePointee(previous, state.LastValue) {
+			continue
+		}
+		if err := s.models.Alert.SaveAlertState(state); err != nil {
+			s.log.Error("failed to save alert state", "rule_id", rule.ID, "imei", entry.SerialNumber, "error", err)
+		}
+	}
+	return nil
+}
+
+// samePointee reports whether two optional values are both unset or equal
+func samePointee[T comparable](a, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// ruleMatchesDevice reports whether a device is in a rule's scope
+func ruleMatchesDevice(rule *data.AlertRule, deviceID uint, deviceType string) bool {
+	if rule.DeviceID != nil && *rule.DeviceID != deviceID {
+		return false
+	}
+	return rule.DeviceType == "" || rule.DeviceType == deviceType
+}
+
+// ruleBreached reports whether a reading meets a rule's condition
+func ruleBreached(rule *data.AlertRule, value, last float64, hasLast bool) bool {
+	switch rule.Operator {
+	case data.AlertOperatorIncreased:
+		return hasLast && value-last > rule.Threshold
+	case data.AlertOperatorDecreased:
+		return hasLast && last-value > rule.Threshold
+	}
+	return compare(rule.Operator, value, rule.Threshold)
+}
+
+// ruleCleared reports whether an active alert's condition has gone away.
+// With a clear threshold the value has to move past it, not just back over
+// the threshold, so a value hovering around the threshold does not flap.
+func ruleCleared(rule *data.AlertRule, value float64, breached bool) bool {
+	if rule.ClearThreshold != nil {
+		return !compare(rule.Operator, value, *rule.ClearThreshold)
+	}
+	return !breached
+}
+
+func compare(operator string, value, threshold float64) bool {
+	switch operator {
+	case data.AlertOperatorLess:
+		return value < threshold
+	case data.AlertOperatorLessEqual:
+		return value <= threshold
+	case data.AlertOperatorGreater:
+		return value > threshold
+	case data.AlertOperatorGreaterEqual:
+		return value >= threshold
+	case data.AlertOperatorEqual:
+		return value == threshold
+	case data.AlertOperatorNotEqual:
+		return value != threshold
+	}
+	return false
+}
+
+// open raises an alert. The caller must hold the device's alert lock.
+func (s *AlertService) open(rule *data.AlertRule, entry *data.DeviceData, value, last float64) {
+	message := fmt.Sprintf("%s: %s is %g (%s %g)", rule.Name, rule.Metric, value, rule.Operator, rule.Threshold)
+	if rule.Operator == data.AlertOperatorIncreased || rule.Operator == data.AlertOperatorDecreased {
+		message = fmt.Sprintf("%s: %s %s from %g to %g", rule.Name, rule.Metric, rule.Operator, last, value)
+	}
+
+	alert := &data.Alert{
+		RuleID:       rule.ID,
+		DeviceID:     entry.DeviceID,
+		SerialNumber: entry.SerialNumber,
+		Severity:     rule.Severity,
+		Status:       data.AlertStatusOpen,
+		Message:      message,
+		Value:        value,
+		OpenedAt:     time.Now(),
+	}
+	if err := s.models.Alert.CreateAlert(alert); err != nil {
+		if errors.Is(err, data.ErrConflict) {
+			// The rule already has an active alert for the device
+			return
+		}
+		s.log.Error("failed to open alert", "rule_id", rule.ID, "imei", entry.SerialNumber, "error", err)
+		return
+	}
+	s.publish(TopicAlertOpened, alert, rule)
+}
+
+// resolve closes an active alert. value is the reading that cleared it, or
+// nil when it was resolved by hand or by a rule change. An alert resolved
+// elsewhere first is reported as a conflict.
+func (s *AlertService) resolve(alert *data.Alert, rule *data.AlertRule, value *float64) error {
+	now := time.Now()
+	alert.Status = data.AlertStatusResolved
+	alert.ResolvedAt = &now
+	alert.ResolvedValue = value
+	err := s.models.Alert.UpdateAlertStatus(alert, data.AlertStatusOpen, data.AlertStatusAcknowledged)
+	if err != nil && !errors.Is(err, data.ErrPreconditionFailed) {
+		s.log.Error("failed to resolve alert", "alert_id", alert.ID, "error", err)
+		return err
+	}
+	if err != nil {
+		return s.alertConflict(alert)
+	}
+	s.publish(TopicAlertResolved, alert, rule)
+	return nil
+}
+
+// alertConflict reloads an alert that another request changed first and
+// reports the status it has now
+func (s *AlertService) alertConflict(alert *data.Alert) error {
+	if current, err := s.models.Alert.GetAlert(alert.ID); err == nil {
+		*alert = *current
+	}
+	return fmt.Errorf("%w: alert is %s", data.ErrConflict, alert.Status)
+}
+
+// publish sends an alert change on the bus. Consumers run asynchronously,
+// so they get copies the service will not modify later.
+func (s *AlertService) publish(topic string, alert *data.Alert, rule *data.AlertRule) {
+	event := AlertEvent{Alert: new(data.Alert)}
+	*event.Alert = *alert
+	if rule != nil {
+		event.Rule = new(data.AlertRule)
+		*event.Rule = *rule
+	}
+	s.events.Publish(topic, alert.SerialNumber, event)
+}
+
+// rule returns a cached rule by ID, or nil
+func (s *AlertService) rule(id uint) *data.AlertRule {
+	for _, rule := range s.cachedRules() {
+		if rule.ID == id {
+			return rule
+		}
+	}
+	return nil
+}
+
+// SaveRule creates or replaces a rule. Disabling a rule resolves its active
+// alerts, and changing it restarts any condition it was timing.
+func (s *AlertService) SaveRule(rule *data.AlertRule) error {
+	var err error
+	if rule.ID == 0 {
+		err = s.models.Alert.CreateRule(rule)
+	} else {
+		err = s.models.Alert.UpdateRule(rule)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.models.Alert.ResetAlertStates(rule.ID); err != nil {
+		s.log.Error("failed to reset alert state", "rule_id", rule.ID, "error", err)
+	}
+	if !rule.Enabled {
+		s.resolveRule(rule)
+	}
+	return s.loadRules()
+}
+
+// DeleteRule removes a rule and resolves its active alerts
+func (s *AlertService) DeleteRule(rule *data.AlertRule) error {
+	if err := s.models.Alert.DeleteRule(rule.ID); err != nil {
+		return err
+	}
+	s.resolveRule(rule)
+	return s.loadRules()
+}
+
+// resolveRule resolves the active alerts of a rule that was disabled or
+// deleted
+func (s *AlertService) resolveRule(rule *data.AlertRule) {
+	alerts, err := s.models.Alert.GetAlerts(data.AlertFilter{Status: "active", RuleID: rule.ID})
+	if err != nil {
+		s.log.Error("failed to load active alerts", "rule_id", rule.ID, "error", err)
+		return
+	}
+	for _, alert := range alerts {
+		s.resolve(alert, rule, nil)
+	}
+}
+
+// Acknowledge marks an open alert as being handled by someone
+func (s *AlertService) Acknowledge(alert *data.Alert, by string) error {
+	if alert.Status != data.AlertStatusOpen {
+		return fmt.Errorf("%w: alert is %s", data.ErrConflict, alert.Status)
+	}
+	now := time.Now()
+	alert.Status = data.AlertStatusAcknowledged
+	alert.AcknowledgedAt = &now
+	alert.AcknowledgedBy = by
+	err := s.models.Alert.UpdateAlertStatus(alert, data.AlertStatusOpen)
+	if errors.Is(err, data.ErrPreconditionFailed) {
+		return s.alertConflict(alert)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.publish(TopicAlertAcknowledged, alert, s.rule(alert.RuleID))
+	return nil
+}
+
+// Resolve closes an active alert by hand. If the condition still holds, a
+// new alert opens once it has held for the rule's duration again.
+func (s *AlertService) Resolve(alert *data.Alert) error {
+	if !alert.IsActive() {
+		return fmt.Errorf("%w: alert is %s", data.ErrConflict, alert.Status)
+	}
+	return s.resolve(alert, s.rule(alert.RuleID), nil)
+}
+
+// alertRuleInput is the body of POST and PUT /alert-rules. A rule is given
+// either as an expression or as metric, operator and threshold.
+type alertRuleInput struct {
+	Name            string   `json:"name"`
+	Description     string   `json:"description"`
+	Expression      string   `json:"expression"`
+	Metric          string   `json:"metric"`
+	Operator        string   `json:"operator"`
+	Threshold       *float64 `json:"threshold"`
+	DurationSeconds int      `json:"duration_seconds"`
+	ClearThreshold  *float64 `json:"clear_threshold"`
+	Severity        string   `json:"severity"`
+	DeviceID        *uint    `json:"device_id"`
+	DeviceType      string   `json:"device_type"`
+	Enabled         *bool    `json:"enabled"`
+}
+
+// normalize trims the input, expands the expression and fills in defaults.
+// Expression syntax errors are reported like field errors.
+func (in *alertRuleInput) normalize() fieldErrors {
+	errs := fieldErrors{}
+	in.Name = strings.TrimSpace(in.Name)
+	in.Description = strings.TrimSpace(in.Description)
+	in.Expression = strings.TrimSpace(in.Expression)
+	in.Metric = strings.TrimSpace(in.Metric)
+	in.Operator = strings.TrimSpace(in.Operator)
+	in.Severity = strings.ToLower(strings.TrimSpace(in.Severity))
+	in.DeviceType = strings.TrimSpace(in.DeviceType)
+	if in.Severity == "" {
+		in.Severity = data.AlertSeverityWarning
+	}
+	if in.Enabled == nil {
+		enabled := true
+		in.Enabled = &enabled
+	}
+
+	if in.Expression == "" {
+		return errs
+	}
+	if in.Metric != "" || in.Operator != "" || in.Threshold != nil {
+		errs["expression"] = "cannot be combined with metric, operator or threshold"
+		return errs
+	}
+
+	var duration string
+	threshold := 0.0
+	if m := comparisonExpressionPattern.FindStringSubmatch(in.Expression); m != nil {
+		in.Metric, in.Operator, duration = m[1], m[2], m[4]
+		threshold, _ = strconv.ParseFloat(m[3], 64)
+	} else if m := changeExpressionPattern.FindStringSubmatch(in.Expression); m != nil {
+		in.Metric, in.Operator, duration = m[1], m[2], m[4]
+		if m[3] != "" {
+			threshold, _ = strconv.ParseFloat(m[3], 64)
+		}
+	} else {
+		errs["expression"] = `must look like "battery_voltage < 11.5 for 10m" or "door_open_counter increased"`
+		return errs
+	}
+	in.Threshold = &threshold
+
+	if duration != "" {
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			errs["expression"] = fmt.Sprintf("invalid duration %q", duration)
+			return errs
+		}
+		in.DurationSeconds = int(d.Seconds())
+	}
+	return errs
+}
+
+// validate checks the normalized input
+func (in *alertRuleInput) validate() fieldErrors {
+	errs := fieldErrors{}
+
+	switch {
+	case in.Name == "":
+		errs["name"] = "is required"
+	case len(in.Name) > 100:
+		errs["name"] = "must be at most 100 characters"
+	}
+	if len(in.Description) > 500 {
+		errs["description"] = "must be at most 500 characters"
+	}
+
+	if _, ok := alertMetricNames[in.Metric]; !ok {
+		names := make([]string, 0, len(alertMetricNames))
+		for name := range alertMetricNames {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		errs["metric"] = fmt.Sprintf("must be one of %s", strings.Join(names, ", "))
+	}
+
+	isChange := in.Operator == data.AlertOperatorIncreased || in.Operator == data.AlertOperatorDecreased
+	if !slices.Contains(data.AlertOperators, in.Operator) {
+		errs["operator"] = fmt.Sprintf("must be one of %s", strings.Join(data.AlertOperators, ", "))
+	}
+	switch {
+	case in.Threshold == nil && !isChange:
+		errs["threshold"] = "is required"
+	case in.Threshold != nil && isChange && *in.Threshold < 0:
+		errs["threshold"] = "must not be negative for increased and decreased"
+	}
+
+	if in.DurationSeconds < 0 || time.Duration(in.DurationSeconds)*time.Second > maxAlertRuleDuration {
+		errs["duration_seconds"] = fmt.Sprintf("must be between 0 and %d", int(maxAlertRuleDuration.Seconds()))
+	}
+
+	if in.ClearThreshold != nil && in.Threshold != nil {
+		switch in.Operator {
+		case data.AlertOperatorLess, data.AlertOperatorLessEqual:
+			if *in.ClearThreshold < *in.Threshold {
+				errs["clear_threshold"] = "must not be below the threshold"
+			}
+		case data.AlertOperatorGreater, data.AlertOperatorGreaterEqual:
+			if *in.ClearThreshold > *in.Threshold {
+				errs["clear_threshold"] = "must not be above the threshold"
+			}
+		default:
+			errs["clear_threshold"] = "is only supported with <, <=, > and >="
+		}
+	}
+
+	if !slices.Contains(data.AlertSeverities, in.Severity) {
+		errs["severity"] = fmt.Sprintf("must be one of %s", strings.Join(data.AlertSeverities, ", "))
+	}
+	if len(in.DeviceType) > 50 {
+		errs["device_type"] = "must be at most 50 characters"
+	}
+
+	return errs
+}
+
+// applyTo copies the input onto a rule
+func (in *alertRuleInput) applyTo(rule *data.AlertRule) {
+	rule.Name = in.Name
+	rule.Description = in.Description
+	rule.Metric = in.Metric
+	rule.Operator = in.Operator
+	rule.Threshold = 0
+	if in.Threshold != nil {
+		rule.Threshold = *in.Threshold
+	}
+	rule.DurationSeconds = in.DurationSeconds
+	rule.ClearThreshold = in.ClearThreshold
+	rule.Severity = in.Severity
+	rule.DeviceID = in.DeviceID
+	rule.DeviceType = in.DeviceType
+	rule.Enabled = *in.Enabled
+}
+
+// getAlertRules lists all alert rules
+func (h *APIHandler) getAlertRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := h.modelsFor(r).Alert.GetRules()
+	if err != nil {
+		writeDataError(w, r, err, "Failed to get alert rules")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"rules": rules,
+		"count": len(rules),
+	})
+}
+
+// getAlertRule returns one alert rule
+func (h *APIHandler) getAlertRule(w http.ResponseWriter, r *http.Request) {
+	rule, ok := h.alertRuleFromURL(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, rule)
+}
+
+// createAlertRule creates an alert rule
+func (h *APIHandler) createAlertRule(w http.ResponseWriter, r *http.Request) {
+	rule := &data.AlertRule{}
+	if !h.saveAlertRule(w, r, rule) {
+		return
+	}
+	writeJSON(w, http.StatusCreated, rule)
+}
+
+// updateAlertRule replaces an alert rule
+func (h *APIHandler) updateAlertRule(w http.ResponseWriter, r *http.Request) {
+	rule, ok := h.alertRuleFromURL(w, r)
+	if !ok {
+		return
+	}
+	if !h.saveAlertRule(w, r, rule) {
+		return
+	}
+	writeJSON(w, http.StatusOK, rule)
+}
+
+// saveAlertRule decodes and validates a rule from the request body and
+// saves it. It writes the error response and returns false if that fails.
+func (h *APIHandler) saveAlertRule(w http.ResponseWriter, r *http.Request, rule *data.AlertRule) bool {
+	var input alertRuleInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return false
+	}
+
+	errs := input.normalize()
+	if len(errs) == 0 {
+		errs = input.validate()
+	}
+	if input.DeviceID != nil && errs["device_id"] == "" {
+		if _, err := h.modelsFor(r).Device.GetByID(*input.DeviceID); err != nil {
+			errs["device_id"] = "must name an existing device"
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, r, errs)
+		return false
+	}
+
+	input.applyTo(rule)
+	if err := h.alerts.SaveRule(rule); err != nil {
+		writeDataError(w, r, err, "Failed to save alert rule")
+		return false
+	}
+	return true
+}
+
+// deleteAlertRule removes an alert rule and resolves its active alerts
+func (h *APIHandler) deleteAlertRule(w http.ResponseWriter, r *http.Request) {
+	rule, ok := h.alertRuleFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.alerts.DeleteRule(rule); err != nil {
+		writeDataError(w, r, err, "Failed to delete alert rule")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Alert rule deleted successfully"})
+}
+
+// getAlerts lists alerts, newest first. ?status (open, acknowledged,
+// resolved or active), ?rule_id, ?device_id and ?limit filter the list.
+func (h *APIHandler) getAlerts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := data.AlertFilter{Status: query.Get("status"), Limit: 100}
+
+	switch filter.Status {
+	case "", "active", data.AlertStatusOpen, data.AlertStatusAcknowledged, data.AlertStatusResolved:
+	default:
+		writeError(w, r, http.StatusBadRequest, "status must be open, acknowledged, resolved or active")
+		return
+	}
+	for name, target := range map[string]*uint{"rule_id": &filter.RuleID, "device_id": &filter.DeviceID} {
+		if value := query.Get(name); value != "" {
+			id, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid %s", name))
+				return
+			}
+			*target = uint(id)
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 1000 {
+			writeError(w, r, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		filter.Limit = n
+	}
+
+	alerts, err := h.modelsFor(r).Alert.GetAlerts(filter)
+	if err != nil {
+		writeDataError(w, r, err, "Failed to get alerts")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"alerts": alerts,
+		"count":  len(alerts),
+	})
+}
+
+// getAlert returns one alert
+func (h *APIHandler) getAlert(w http.ResponseWriter, r *http.Request) {
+	alert, ok := h.alertFromURL(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, alert)
+}
+
+// acknowledgeAlert marks an open alert as acknowledged. The optional body
+// {"by": "name"} records who is handling it.
+func (h *APIHandler) acknowledgeAlert(w http.ResponseWriter, r *http.Request) {
+	alert, ok := h.alertFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		By string `json:"by"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+	if len(body.By) > 100 {
+		writeValidationError(w, r, fieldErrors{"by": "must be at most 100 characters"})
+		return
+	}
+
+	if err := h.alerts.Acknowledge(alert, strings.TrimSpace(body.By)); err != nil {
+		h.writeAlertChangeError(w, r, alert, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, alert)
+}
+
+// resolveAlert resolves an active alert by hand
+func (h *APIHandler) resolveAlert(w http.ResponseWriter, r *http.Request) {
+	alert, ok := h.alertFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.alerts.Resolve(alert); err != nil {
+		h.writeAlertChangeError(w, r, alert, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, alert)
+}
+
+func (h *APIHandler) writeAlertChangeError(w http.ResponseWriter, r *http.Request, alert *data.Alert, err error) {
+	if errors.Is(err, data.ErrConflict) {
+		writeError(w, r, http.StatusConflict, fmt.Sprintf("Alert is already %s", alert.Status))
+		return
+	}
+	writeDataError(w, r, err, "Failed to update alert")
+}
+
+// alertRuleFromURL loads the rule named by the ruleID URL parameter. It
+// writes the error response and returns false if that fails.
+func (h *APIHandler) alertRuleFromURL(w http.ResponseWriter, r *http.Request) (*data.AlertRule, bool) {
+	ruleID, err := strconv.ParseUint(chi.URLParam(r, "ruleID"), 10, 32)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid alert rule ID")
+		return nil, false
+	}
+
+	rule, err := h.modelsFor(r).Alert.GetRule(uint(ruleID))
+	if err != nil {
+		if errors.Is(err, data.ErrNotFound) {
+			writeError(w, r, http.StatusNotFound, "Alert rule not found")
+			return nil, false
+		}
+		writeDataError(w, r, err, "Failed to get alert rule")
+		return nil, false
+	}
+	return rule, true
+}
+
+// alertFromURL loads the alert named by the alertID URL parameter. It
+// writes the error response and returns false if that fails.
+func (h *APIHandler) alertFromURL(w http.ResponseWriter, r *http.Request) (*data.Alert, bool) {
+	alertID, err := strconv.ParseUint(chi.URLParam(r, "alertID"), 10, 32)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid alert ID")
+		return nil, false
+	}
+
+	alert, err := h.modelsFor(r).Alert.GetAlert(uint(alertID))
+	if err != nil {
+		if errors.Is(err, data.ErrNotFound) {
+			writeError(w, r, http.StatusNotFound, "Alert not found")
+			return nil, false
+		}
+		writeDataError(w, r, err, "Failed to get alert")
+		return nil, false
+	}
+	return alert, true
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"mqtt/data"
+)
+
+func TestAlertRuleExpression(t *testing.T) {
+	tests := []struct {
+		expression string
+		metric     string
+		operator   string
+		threshold  float64
+		duration   int
+		wantErr    bool
+	}{
+		{expression: "battery_voltage < 11.5", metric: "battery_voltage", operator: "<", threshold: 11.5},
+		{expression: "battery_voltage<11.5 for 10m", metric: "battery_voltage", operator: "<", threshold: 11.5, duration: 600},
+		{expression: "temp_room >= -5 for 1h30m", metric: "temp_room", operator: ">=", threshold: -5, duration: 5400},
+		{expression: "humidity != 0", metric: "humidity", operator: "!=", threshold: 0},
+		{expression: "door_open_counter increased", metric: "door_open_counter", operator: "increased"},
+		{expression: "supply_voltage decreased by 2.5 for 5m", metric: "supply_voltage", operator: "decreased", threshold: 2.5, duration: 300},
+		{expression: "battery_voltage < 11.5 for ever", wantErr: true},
+		{expression: "battery_voltage is low", wantErr: true},
+		{expression: "battery_voltage < eleven", wantErr: true},
+		{expression: "Battery < 11", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			in := alertRuleInput{Name: "rule", Expression: tt.expression}
+			errs := in.normalize()
+			if tt.wantErr {
+				if errs["expression"] == "" {
+					t.Fatalf("accepted, got metric %q operator %q", in.Metric, in.Operator)
+				}
+				return
+			}
+			if len(errs) > 0 {
+				t.Fatalf("errors = %v", errs)
+			}
+			if in.Metric != tt.metric || in.Operator != tt.operator || *in.Threshold != tt.threshold || in.DurationSeconds != tt.duration {
+				t.Fatalf("got %s %s %g for %ds", in.Metric, in.Operator, *in.Threshold, in.DurationSeconds)
+			}
+			if errs := in.validate(); len(errs) > 0 {
+				t.Fatalf("validate = %v", errs)
+			}
+		})
+	}
+
+	threshold := 3.0
+	in := alertRuleInput{Name: "rule", Expression: "humidity > 80", Threshold: &threshold}
+	if errs := in.normalize(); errs["expression"] == "" {
+		t.Fatal("an expression combined with a threshold was accepted")
+	}
+}
+
+func TestAlertRuleValidate(t *testing.T) {
+	float := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name     string
+		in       alertRuleInput
+		errField string
+	}{
+		{name: "valid", in: alertRuleInput{Name: "low", Metric: "battery_voltage", Operator: "<", Threshold: float(11.5), ClearThreshold: float(12)}},
+		{name: "unknown metric", in: alertRuleInput{Name: "low", Metric: "imei", Operator: "<", Threshold: float(1)}, errField: "metric"},
+		{name: "unknown operator", in: alertRuleInput{Name: "low", Metric: "humidity", Operator: "=~", Threshold: float(1)}, errField: "operator"},
+		{name: "missing threshold", in: alertRuleInput{Name: "low", Metric: "humidity", Operator: ">"}, errField: "threshold"},
+		{name: "negative change", in: alertRuleInput{Name: "low", Metric: "humidity", Operator: "increased", Threshold: float(-1)}, errField: "threshold"},
+		{name: "clear below a low threshold", in: alertRuleInput{Name: "low", Metric: "battery_voltage", Operator: "<", Threshold: float(11.5), ClearThreshold: float(11)}, errField: "clear_threshold"},
+		{name: "clear above a high threshold", in: alertRuleInput{Name: "hot", Metric: "temp_room", Operator: ">", Threshold: float(40), ClearThreshold: float(45)}, errField: "clear_threshold"},
+		{name: "clear with equality", in: alertRuleInput{Name: "eq", Metric: "humidity", Operator: "==", Threshold: float(0), ClearThreshold: float(1)}, errField: "clear_threshold"},
+		{name: "duration too long", in: alertRuleInput{Name: "low", Metric: "humidity", Operator: ">", Threshold: float(1), DurationSeconds: 8 * 24 * 3600}, errField: "duration_seconds"},
+		{name: "unknown severity", in: alertRuleInput{Name: "low", Metric: "humidity", Operator: ">", Threshold: float(1), Severity: "fatal"}, errField: "severity"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if errs := tt.in.normalize(); len(errs) > 0 {
+				t.Fatalf("normalize = %v", errs)
+			}
+			errs := tt.in.validate()
+			if tt.errField == "" {
+				if len(errs) > 0 {
+					t.Fatalf("errors = %v", errs)
+				}
+				return
+			}
+			if errs[tt.errField] == "" {
+				t.Fatalf("errors = %v, want one for %s", errs, tt.errField)
+			}
+		})
+	}
+}
+
+func TestRuleBreached(t *testing.T) {
+	tests := []struct {
+		operator  string
+		threshold float64
+		value     float64
+		last      float64
+		hasLast   bool
+		want      bool
+	}{
+		{operator: "<", threshold: 10, value: 9.9, want: true},
+		{operator: "<", threshold: 10, value: 10},
+		{operator: "<=", threshold: 10, value: 10, want: true},
+		{operator: ">", threshold: 10, value: 10},
+		{operator: ">=", threshold: 10, value: 10, want: true},
+		{operator: "==", threshold: 1, value: 1, want: true},
+		{operator: "!=", threshold: 1, value: 1},
+		{operator: "increased", value: 5, last: 4, hasLast: true, want: true},
+		{operator: "increased", value: 5, last: 5, hasLast: true},
+		{operator: "increased", value: 5},
+		{operator: "increased", threshold: 2, value: 6, last: 4, hasLast: true},
+		{operator: "increased", threshold: 2, value: 6.5, last: 4, hasLast: true, want: true},
+		{operator: "decreased", threshold: 1, value: 2, last: 4, hasLast: true, want: true},
+		{operator: "decreased", value: 4, last: 2, hasLast: true},
+	}
+	for _, tt := range tests {
+		rule := &data.AlertRule{Operator: tt.operator, Threshold: tt.threshold}
+		if got := ruleBreached(rule, tt.value, tt.last, tt.hasLast); got != tt.want {
+			t.Errorf("%g %s %g (last %g, %v) = %v, want %v", tt.value, tt.operator, tt.threshold, tt.last, tt.hasLast, got, tt.want)
+		}
+	}
+}
+
+func TestRuleCleared(t *testing.T) {
+	clear := 12.0
+	tests := []struct {
+		name  string
+		rule  data.AlertRule
+		value float64
+		want  bool
+	}{
+		{name: "still breached", rule: data.AlertRule{Operator: "<", Threshold: 11.5}, value: 11, want: false},
+		{name: "back over the threshold", rule: data.AlertRule{Operator: "<", Threshold: 11.5}, value: 11.6, want: true},
+		{name: "inside the hysteresis band", rule: data.AlertRule{Operator: "<", Threshold: 11.5, ClearThreshold: &clear}, value: 11.8, want: false},
+		{name: "at the clear threshold", rule: data.AlertRule{Operator: "<", Threshold: 11.5, ClearThreshold: &clear}, value: 12, want: true},
+		{name: "past the clear threshold", rule: data.AlertRule{Operator: "<", Threshold: 11.5, ClearThreshold: &clear}, value: 12.5, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breached := ruleBreached(&tt.rule, tt.value, 0, false)
+			if got := ruleCleared(&tt.rule, tt.value, breached); got != tt.want {
+				t.Fatalf("ruleCleared(%g) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeAlertStore keeps rules, alerts and alert state in memory. Like the
+// database, it changes alert status conditionally and allows one active
+// alert per rule and device.
+type fakeAlertStore struct {
+	data.AlertModel
+
+	// lock stands in for the per-device advisory lock
+	lock sync.Mutex
+
+	mu     sync.Mutex
+	rules  []*data.AlertRule
+	alerts map[uint]data.Alert
+	states map[[2]uint]data.AlertState
+}
+
+func (f *fakeAlertStore) GetRules() ([]*data.AlertRule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.rules), nil
+}
+
+func (f *fakeAlertStore) UpdateRule(rule *data.AlertRule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.rules {
+		if f.rules[i].ID == rule.ID {
+			copied := *rule
+			f.rules[i] = &copied
+			return nil
+		}
+	}
+	return data.ErrNotFound
+}
+
+func (f *fakeAlertStore) GetAlerts(filter data.AlertFilter) ([]*data.Alert, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var alerts []*data.Alert
+	for _, alert := range f.alerts {
+		if (filter.Status != "active" || alert.IsActive()) &&
+			(filter.RuleID == 0 || alert.RuleID == filter.RuleID) &&
+			(filter.DeviceID == 0 || alert.DeviceID == filter.DeviceID) {
+			alerts = append(alerts, &alert)
+		}
+	}
+	return alerts, nil
+}
+
+func (f *fakeAlertStore) GetAlert(id uint) (*data.Alert, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	alert, ok := f.alerts[id]
+	if !ok {
+		return nil, data.ErrNotFound
+	}
+	return &alert, nil
+}
+
+func (f *fakeAlertStore) CreateAlert(alert *data.Alert) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, existing := range f.alerts {
+		if existing.IsActive() && existing.RuleID == alert.RuleID && existing.DeviceID == alert.DeviceID {
+			return data.ErrConflict
+		}
+	}
+	alert.ID = uint(len(f.alerts) + 1)
+	f.alerts[alert.ID] = *alert
+	return nil
+}
+
+func (f *fakeAlertStore) UpdateAlertStatus(alert *data.Alert, from ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !slices.Contains(from, f.alerts[alert.ID].Status) {
+		return data.ErrPreconditionFailed
+	}
+	f.alerts[alert.ID] = *alert
+	return nil
+}
+
+func (f *fakeAlertStore) LockDevice(deviceID uint, fn func() error) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return fn()
+}
+
+func (f *fakeAlertStore) GetAlertStates(deviceID uint) ([]*data.AlertState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var states []*data.AlertState
+	for _, state := range f.states {
+		if state.DeviceID == deviceID {
+			states = append(states, &state)
+		}
+	}
+	return states, nil
+}
+
+func (f *fakeAlertStore) SaveAlertState(state *data.AlertState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.states[[2]uint{state.RuleID, state.DeviceID}] = *state
+	return nil
+}
+
+func (f *fakeAlertStore) ResetAlertStates(ruleID uint) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, state := range f.states {
+		if key[0] == ruleID {
+			state.PendingSince = nil
+			f.states[key] = state
+		}
+	}
+	return nil
+}
+
+// state returns the stored state of rule 1 for device 1
+func (f *fakeAlertStore) state() data.AlertState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.states[[2]uint{1, 1}]
+}
+
+// setPendingSince moves the start of rule 1's condition for device 1
+func (f *fakeAlertStore) setPendingSince(since time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	state := f.states[[2]uint{1, 1}]
+	state.PendingSince = &since
+	f.states[[2]uint{1, 1}] = state
+}
+
+func (f *fakeAlertStore) statuses() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var statuses []string
+	for id := uint(1); id <= uint(len(f.alerts)); id++ {
+		statuses = append(statuses, f.alerts[id].Status)
+	}
+	return statuses
+}
+
+func newFakeAlertStore(rules ...*data.AlertRule) *fakeAlertStore {
+	return &fakeAlertStore{
+		rules:  rules,
+		alerts: make(map[uint]data.Alert),
+		states: make(map[[2]uint]data.AlertState),
+	}
+}
+
+func newTestAlertService(t *testing.T, store *fakeAlertStore) *AlertService {
+	t.Helper()
+	devices := &fakeDeviceStore{devices: map[uint]*data.Device{1: {ID: 1, SerialNumber: "SN-1", DeviceType: "logger"}}}
+	s, err := NewAlertService(&data.Models{Alert: store, Device: devices}, NewEventBus(discardLogger()), discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// evaluateReading runs the rules against a reading of device 1 the way a
+// saved telemetry event does
+func evaluateReading(t *testing.T, s *AlertService, voltage float64) {
+	t.Helper()
+	event := Event{Topic: TopicTelemetrySaved, Payload: &data.DeviceData{DeviceID: 1, SerialNumber: "SN-1", BatteryVoltage: voltage}}
+	if err := s.handleEvent(event); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAlertDurationAndHysteresis(t *testing.T) {
+	clear := 12.0
+	store := newFakeAlertStore(&data.AlertRule{
+		ID: 1, Name: "low battery", Metric: "battery_voltage", Operator: "<", Threshold: 11.5,
+		ClearThreshold: &clear, DurationSeconds: 600, Enabled: true,
+	})
+	s := newTestAlertService(t, store)
+
+	evaluateReading(t, s, 11)
+	if len(store.statuses()) != 0 {
+		t.Fatal("alert opened before the condition held for its duration")
+	}
+	if store.state().PendingSince == nil {
+		t.Fatal("pending condition not stored")
+	}
+	// A reading back in range restarts the duration
+	evaluateReading(t, s, 11.7)
+	if store.state().PendingSince != nil {
+		t.Fatal("pending condition kept after it cleared")
+	}
+
+	evaluateReading(t, s, 11)
+	store.setPendingSince(time.Now().Add(-11 * time.Minute))
+	evaluateReading(t, s, 11.2)
+	if got := store.statuses(); !slices.Equal(got, []string{data.AlertStatusOpen}) {
+		t.Fatalf("alerts = %v, want one open", got)
+	}
+
+	evaluateReading(t, s, 11.8)
+	if got := store.statuses(); !slices.Equal(got, []string{data.AlertStatusOpen}) {
+		t.Fatalf("alerts = %v, want it still open inside the hysteresis band", got)
+	}
+	evaluateReading(t, s, 12.1)
+	if got := store.statuses(); !slices.Equal(got, []string{data.AlertStatusResolved}) {
+		t.Fatalf("alerts = %v, want it resolved", got)
+	}
+}
+
+func TestAlertStateSharedByInstances(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     *data.AlertRule
+		readings []float64
+		// age moves the stored start of the condition back before the last
+		// reading
+		age  time.Duration
+		want []string
+	}{
+		{
+			name:     "duration timed across instances",
+			rule:     &data.AlertRule{ID: 1, Metric: "battery_voltage", Operator: "<", Threshold: 11.5, DurationSeconds: 600, Enabled: true},
+			readings: []float64{11, 11.1, 11.2},
+			age:      11 * time.Minute,
+			want:     []string{data.AlertStatusOpen},
+		},
+		{
+			name:     "duration not yet reached",
+			rule:     &data.AlertRule{ID: 1, Metric: "battery_voltage", Operator: "<", Threshold: 11.5, DurationSeconds: 600, Enabled: true},
+			readings: []float64{11, 11.1, 11.2},
+		},
+		{
+			name:     "previous value from the other instance",
+			rule:     &data.AlertRule{ID: 1, Metric: "battery_voltage", Operator: "increased", Threshold: 0.5, Enabled: true},
+			readings: []float64{11, 12},
+			want:     []string{data.AlertStatusOpen},
+		},
+		{
+			name:     "change within the threshold",
+			rule:     &data.AlertRule{ID: 1, Metric: "battery_voltage", Operator: "increased", Threshold: 0.5, Enabled: true},
+			readings: []float64{11, 11.2, 11.4},
+		},
+		{
+			name:     "opened on one instance, resolved on the other",
+			rule:     &data.AlertRule{ID: 1, Metric: "battery_voltage", Operator: "<", Threshold: 11.5, Enabled: true},
+			readings: []float64{11, 11, 12},
+			want:     []string{data.AlertStatusResolved},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeAlertStore(tt.rule)
+			instances := []*AlertService{newTestAlertService(t, store), newTestAlertService(t, store)}
+			for i, voltage := range tt.readings {
+				if i == len(tt.readings)-1 && tt.age > 0 {
+					store.setPendingSince(time.Now().Add(-tt.age))
+				}
+				evaluateReading(t, instances[i%2], voltage)
+			}
+			if got := store.statuses(); !slices.Equal(got, tt.want) {
+				t.Fatalf("alerts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlertOpensOnceAcrossInstances(t *testing.T) {
+	store := newFakeAlertStore(&data.AlertRule{ID: 1, Metric: "battery_voltage", Operator: "<", Threshold: 11.5, Enabled: true})
+	var wg sync.WaitGroup
+	for range 4 {
+		s := newTestAlertService(t, store)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				evaluateReading(t, s, 11)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := store.statuses(); !slices.Equal(got, []string{data.AlertStatusOpen}) {
+		t.Fatalf("alerts = %v, want one open", got)
+	}
+}
+
+func TestSaveRuleResetsState(t *testing.T) {
+	store := newFakeAlertStore(&data.AlertRule{ID: 1, Metric: "battery_voltage", Operator: "<", Threshold: 11.5, DurationSeconds: 600, Enabled: true})
+	s := newTestAlertService(t, store)
+	other := newTestAlertService(t, store)
+
+	evaluateReading(t, s, 11)
+	store.alerts[1] = data.Alert{ID: 1, RuleID: 1, DeviceID: 1, Status: data.AlertStatusOpen}
+
+	if err := s.SaveRule(&data.AlertRule{ID: 1, Metric: "battery_voltage", Operator: "<", Threshold: 11.5, DurationSeconds: 600}); err != nil {
+		t.Fatal(err)
+	}
+	if store.state().PendingSince != nil {
+		t.Fatal("pending condition kept after the rule changed")
+	}
+	if got := store.statuses(); !slices.Equal(got, []string{data.AlertStatusResolved}) {
+		t.Fatalf("alerts = %v, want the disabled rule's alert resolved", got)
+	}
+
+	// The other instance picks up the disabled rule on its next refresh
+	if err := other.loadRules(); err != nil {
+		t.Fatal(err)
+	}
+	evaluateReading(t, other, 11)
+	if store.state().PendingSince != nil {
+		t.Fatal("disabled rule evaluated")
+	}
+}
+
+func TestAlertChangeConflicts(t *testing.T) {
+	store := newFakeAlertStore(&data.AlertRule{ID: 1, Metric: "battery_voltage", Operator: "<", Threshold: 11.5, Enabled: true})
+	store.alerts[1] = data.Alert{ID: 1, RuleID: 1, DeviceID: 1, Status: data.AlertStatusOpen}
+	s := newTestAlertService(t, store)
+
+	// Read by the API while open, then resolved by a reading
+	stale, _ := store.GetAlert(1)
+	evaluateReading(t, s, 12)
+
+	if err := s.Acknowledge(stale, "ops"); !errors.Is(err, data.ErrConflict) {
+		t.Fatalf("Acknowledge = %v, want ErrConflict", err)
+	}
+	if stale.Status != data.AlertStatusResolved {
+		t.Fatalf("alert status = %s after the conflict, want the stored resolved", stale.Status)
+	}
+	if got := store.statuses(); !slices.Equal(got, []string{data.AlertStatusResolved}) {
+		t.Fatalf("alerts = %v, want it to stay resolved", got)
+	}
+
+	stale.Status = data.AlertStatusAcknowledged
+	if err := s.Resolve(stale); !errors.Is(err, data.ErrConflict) {
+		t.Fatalf("Resolve = %v, want ErrConflict", err)
+	}
+}
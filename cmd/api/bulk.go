@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"mqtt/data"
+)
+
+const (
+	maxImportBodyBytes = 10 << 20
+	maxImportRows      = 5000
+)
+
+// Import row actions reported back to the caller
+const (
+	importActionCreate    = "create"
+	importActionUpdate    = "update"
+	importActionUnchanged = "unchanged"
+	importActionError     = "error"
+)
+
+// importColumns are the device fields that can be set through an import.
+// Read-only columns produced by the export are accepted and ignored so an
+// export can be edited and imported again.
+var (
+	importColumns   = []string{"serial_number", "device_type", "name", "description", "status", "tags"}
+	ignoredColumns  = []string{"id", "created_at", "updated_at", "deleted_at"}
+	exportCSVHeader = []string{"id", "serial_number", "device_type", "name", "description", "status", "tags", "created_at", "updated_at"}
+)
+
+// importRow is a single parsed row of an import; only the columns present
+// in the source are set
+type importRow struct {
+	Number int
+	Fields map[string]string
+}
+
+// importRowResult describes what happened (or would happen) to one row
+type importRowResult struct {
+	Row          int         `json:"row"`
+	SerialNumber string      `json:"serial_number"`
+	Action       string      `json:"action"`
+	DeviceID     uint        `json:"device_id,omitempty"`
+	Errors       fieldErrors `json:"errors,omitempty"`
+}
+
+// importReport is the response body of a bulk import
+type importReport struct {
+	DryRun    bool              `json:"dry_run"`
+	Upsert    bool              `json:"upsert"`
+	Total     int               `json:"total"`
+	Created   int               `json:"created"`
+	Updated   int               `json:"updated"`
+	Unchanged int               `json:"unchanged"`
+	Failed    int               `json:"failed"`
+	Rows      []importRowResult `json:"rows"`
+}
+
+// importDevices creates (and optionally updates) devices from a CSV file or
+// a JSON array. The import is all-or-nothing: if any row fails validation
+// nothing is written and the per-row errors are returned.
+func (h *APIHandler) importDevices(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	dryRun := parseBoolParam(query.Get("dry_run"))
+	upsert := parseBoolParam(query.Get("upsert"))
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBodyBytes)
+
+	var rows []importRow
+	var err error
+	switch importFormat(r) {
+	case "csv":
+		rows, err = parseCSVImport(r.Body)
+	case "json":
+		rows, err = parseJSONImport(r.Body)
+	default:
+		writeError(w, r, http.StatusUnsupportedMediaType, "Import must be text/csv or application/json")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid import file: %v", err))
+		return
+	}
+	if len(rows) == 0 {
+		writeError(w, r, http.StatusBadRequest, "Import file contains no rows")
+		return
+	}
+	if len(rows) > maxImportRows {
+		writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("Import is limited to %d rows", maxImportRows))
+		return
+	}
+
+	serials := make([]string, 0, len(rows))
+	for _, row := range rows {
+		if serial := strings.TrimSpace(row.Fields["serial_number"]); serial != "" {
+			serials = append(serials, serial)
+		}
+	}
+	existing, err := h.modelsFor(r).Device.GetBySerialNumbers(serials)
+	if err != nil {
+		writeDataError(w, r, err, "Failed to look up devices")
+		return
+	}
+	bySerial := make(map[string]*data.Device, len(existing))
+	for _, device := range existing {
+		bySerial[device.SerialNumber] = device
+	}
+
+	report := importReport{DryRun: dryRun, Upsert: upsert, Total: len(rows)}
+	var pending []*data.Device
+	seen := make(map[string]int, len(rows))
+
+	for _, row := range rows {
+		result, device := planImportRow(row, bySerial, seen, upsert)
+		switch result.Action {
+		case importActionCreate:
+			report.Created++
+			pending = append(pending, device)
+		case importActionUpdate:
+			report.Updated++
+			pending = append(pending, device)
+		case importActionUnchanged:
+			report.Unchanged++
+		case importActionError:
+			report.Failed++
+		}
+		report.Rows = append(report.Rows, result)
+	}
+
+	if report.Failed > 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, report)
+		return
+	}
+	if dryRun || len(pending) == 0 {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
+	if err := h.modelsFor(r).Device.SaveDevices(pending); err != nil {
+		writeDataError(w, r, err, "Failed to import devices")
+		return
+	}
+
+	// Fill in the IDs assigned to newly created devices
+	bySerialSaved := make(map[string]*data.Device, len(pending))
+	for _, device := range pending {
+		bySerialSaved[device.SerialNumber] = device
+	}
+	for i := range report.Rows {
+		row := &report.Rows[i]
+		device, ok := bySerialSaved[row.SerialNumber]
+		if !ok {
+			continue
+		}
+		row.DeviceID = device.ID
+		if row.Action == importActionCreate {
+			h.publishDeviceEvent(TopicDeviceCreated, device, EventSourceImport)
+		} else {
+			h.publishDeviceEvent(TopicDeviceUpdated, device, EventSourceImport)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// planImportRow validates a row against the existing devices and works out
+// the device to write, if any
+func planImportRow(row importRow, bySerial map[string]*data.Device, seen map[string]int, upsert bool) (importRowResult, *data.Device) {
+	result := importRowResult{Row: row.Number, SerialNumber: strings.TrimSpace(row.Fields["serial_number"])}
+
+	if first, ok := seen[result.SerialNumber]; ok && result.SerialNumber != "" {
+		result.Action = importActionError
+		result.Errors = fieldErrors{"serial_number": fmt.Sprintf("duplicates row %d", first)}
+		return result, nil
+	}
+	seen[result.SerialNumber] = row.Number
+
+	current, exists := bySerial[result.SerialNumber]
+	if exists && current.DeletedAt.Valid {
+		result.Action = importActionError
+		result.DeviceID = current.ID
+		result.Errors = fieldErrors{"serial_number": "belongs to a deleted device, restore or purge it first"}
+		return result, nil
+	}
+	if exists && !upsert {
+		result.Action = importActionError
+		result.DeviceID = current.ID
+		result.Errors = fieldErrors{"serial_number": "already exists"}
+		return result, nil
+	}
+
+	var input deviceInput
+	if exists {
+		input = deviceInputFrom(current)
+	}
+	for column, value := range row.Fields {
+		switch column {
+		case "serial_number":
+			input.SerialNumber = value
+		case "device_type":
+			input.DeviceType = value
+		case "name":
+			input.Name = value
+		case "description":
+			input.Description = value
+		case "status":
+			input.Status = value
+		case "tags":
+			input.Tags = splitList(value)
+		}
+	}
+	input.normalize()
+
+	if errs := input.validate(); len(errs) > 0 {
+		result.Action = importActionError
+		result.Errors = errs
+		return result, nil
+	}
+
+	if !exists {
+		device := &data.Device{}
+		input.applyTo(device)
+		result.Action = importActionCreate
+		return result, device
+	}
+
+	result.DeviceID = current.ID
+	if input.equal(deviceInputFrom(current)) {
+		result.Action = importActionUnchanged
+		return result, nil
+	}
+
+	device := *current
+	input.applyTo(&device)
+	result.Action = importActionUpdate
+	return result, &device
+}
+
+// exportDevices returns every device as CSV or JSON
+func (h *APIHandler) exportDevices(w http.ResponseWriter, r *http.Request) {
+	devices, err := h.modelsFor(r).Device.GetAllDevices()
+	if err != nil {
+		writeDataError(w, r, err, "Failed to get devices")
+		return
+	}
+
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		format = "json"
+	}
+
+	switch format {
+	case "json":
+		w.Header().Set("Content-Disposition", `attachment; filename="devices.json"`)
+		writeJSON(w, http.StatusOK, devices)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="devices.csv"`)
+		w.WriteHeader(http.StatusOK)
+
+		cw := csv.NewWriter(w)
+		cw.Write(exportCSVHeader)
+		for _, device := range devices {
+			cw.Write([]string{
+				strconv.FormatUint(uint64(device.ID), 10),
+				device.SerialNumber,
+				device.DeviceType,
+				device.Name,
+				device.Description,
+				device.Status,
+				strings.Join(device.Tags, ","),
+				device.CreatedAt.UTC().Format(time.RFC3339),
+				device.UpdatedAt.UTC().Format(time.RFC3339),
+			})
+		}
+		cw.Flush()
+	default:
+		writeError(w, r, http.StatusBadRequest, "Format must be csv or json")
+	}
+}
+
+// importFormat picks the import format from the format query parameter or
+// the request content type
+func importFormat(r *http.Request) string {
+	if format := strings.ToLower(r.URL.Query().Get("format")); format != "" {
+		return format
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv", "application/csv":
+		return "csv"
+	case "application/json", "":
+		return "json"
+	}
+	return ""
+}
+
+// parseCSVImport reads a CSV file whose first line names the columns
+func parseCSVImport(body io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]string, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if !containsString(importColumns, name) && !containsString(ignoredColumns, name) {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		columns[i] = name
+	}
+	if !containsString(columns, "serial_number") {
+		return nil, errors.New("missing serial_number column")
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		row := importRow{Number: len(rows) + 1, Fields: make(map[string]string)}
+		for i, value := range record {
+			if containsString(importColumns, columns[i]) {
+				row.Fields[columns[i]] = value
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// parseJSONImport reads a JSON array of device objects
+func parseJSONImport(body io.Reader) ([]importRow, error) {
+	var objects []map[string]interface{}
+	if err := json.NewDecoder(body).Decode(&objects); err != nil {
+		return nil, err
+	}
+
+	rows := make([]importRow, 0, len(objects))
+	for i, object := range objects {
+		row := importRow{Number: i + 1, Fields: make(map[string]string)}
+		for key, value := range object {
+			key = strings.ToLower(key)
+			if containsString(ignoredColumns, key) {
+				continue
+			}
+			if !containsString(importColumns, key) {
+				return nil, fmt.Errorf("row %d: unknown field %q", i+1, key)
+			}
+			switch v := value.(type) {
+			case string:
+				row.Fields[key] = v
+			case nil:
+				row.Fields[key] = ""
+			case []interface{}:
+				// Tags may be given as an array, as in the JSON export
+				tags, ok := stringArray(v)
+				if key != "tags" || !ok {
+					return nil, fmt.Errorf("row %d: field %q must be a string", i+1, key)
+				}
+				row.Fields[key] = strings.Join(tags, ",")
+			default:
+				return nil, fmt.Errorf("row %d: field %q must be a string", i+1, key)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// stringArray converts a decoded JSON array to strings, failing on any
+// element that is not a string
+func stringArray(values []interface{}) ([]string, bool) {
+	strs := make([]string, len(values))
+	for i, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			return nil, false
+		}
+		strs[i] = str
+	}
+	return strs, true
+}
+
+// parseBoolParam interprets a query parameter as a boolean flag
+func parseBoolParam(value string) bool {
+	b, _ := strconv.ParseBool(value)
+	return b
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"mqtt/data"
+
+	"gorm.io/gorm"
+)
+
+func TestPlanImportRow(t *testing.T) {
+	existing := &data.Device{ID: 7, SerialNumber: "SN-1", DeviceType: "logger", Name: "Pump", Status: data.DeviceStatusActive}
+	deleted := &data.Device{ID: 9, SerialNumber: "SN-2", DeviceType: "logger", Status: data.DeviceStatusActive,
+		DeletedAt: gorm.DeletedAt{Time: time.Now(), Valid: true}}
+	bySerial := map[string]*data.Device{"SN-1": existing, "SN-2": deleted}
+
+	tests := []struct {
+		name      string
+		fields    map[string]string
+		upsert    bool
+		action    string
+		errField  string
+		deviceID  uint
+		wantWrite bool
+	}{
+		{name: "new device", fields: map[string]string{"serial_number": "SN-3", "device_type": "logger"},
+			action: importActionCreate, wantWrite: true},
+		{name: "existing without upsert", fields: map[string]string{"serial_number": "SN-1", "device_type": "logger"},
+			action: importActionError, errField: "serial_number", deviceID: 7},
+		{name: "existing unchanged", fields: map[string]string{"serial_number": "SN-1", "name": "Pump"}, upsert: true,
+			action: importActionUnchanged, deviceID: 7},
+		{name: "existing updated", fields: map[string]string{"serial_number": "SN-1", "name": "Valve"}, upsert: true,
+			action: importActionUpdate, deviceID: 7, wantWrite: true},
+		{name: "soft-deleted serial", fields: map[string]string{"serial_number": "SN-2", "device_type": "logger"}, upsert: true,
+			action: importActionError, errField: "serial_number", deviceID: 9},
+		{name: "invalid device type", fields: map[string]string{"serial_number": "SN-4", "device_type": "bad type"},
+			action: importActionError, errField: "device_type"},
+		{name: "missing serial", fields: map[string]string{"device_type": "logger"},
+			action: importActionError, errField: "serial_number"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, device := planImportRow(importRow{Number: 1, Fields: tt.fields}, bySerial, map[string]int{}, tt.upsert)
+			if result.Action != tt.action {
+				t.Fatalf("action = %s, want %s (errors %v)", result.Action, tt.action, result.Errors)
+			}
+			if tt.errField != "" && result.Errors[tt.errField] == "" {
+				t.Errorf("errors = %v, want one for %s", result.Errors, tt.errField)
+			}
+			if result.DeviceID != tt.deviceID {
+				t.Errorf("device ID = %d, want %d", result.DeviceID, tt.deviceID)
+			}
+			if (device != nil) != tt.wantWrite {
+				t.Errorf("device to write = %v, want write %v", device, tt.wantWrite)
+			}
+		})
+	}
+}
+
+func TestPlanImportRowDuplicate(t *testing.T) {
+	seen := map[string]int{}
+	row := importRow{Number: 1, Fields: map[string]string{"serial_number": "SN-1", "device_type": "logger"}}
+	if result, _ := planImportRow(row, nil, seen, false); result.Action != importActionCreate {
+		t.Fatalf("first row action = %s", result.Action)
+	}
+	row.Number = 2
+	result, _ := planImportRow(row, nil, seen, false)
+	if result.Action != importActionError || !strings.Contains(result.Errors["serial_number"], "row 1") {
+		t.Fatalf("second row = %+v, want a duplicate of row 1", result)
+	}
+}
+
+func TestPlanImportRowUpdateKeepsExisting(t *testing.T) {
+	existing := &data.Device{ID: 7, SerialNumber: "SN-1", DeviceType: "logger", Name: "Pump", Description: "Basement"}
+	row := importRow{Number: 1, Fields: map[string]string{"serial_number": "SN-1", "tags": "b, A"}}
+	_, device := planImportRow(row, map[string]*data.Device{"SN-1": existing}, map[string]int{}, true)
+	if device == nil {
+		t.Fatal("expected an update")
+	}
+	if device.ID != 7 || device.Description != "Basement" || strings.Join(device.Tags, ",") != "a,b" {
+		t.Fatalf("device = %+v", device)
+	}
+	if existing.Tags != nil {
+		t.Fatal("the existing device was modified")
+	}
+}
+
+func TestParseCSVImport(t *testing.T) {
+	rows, err := parseCSVImport(strings.NewReader("\ufeffserial_number,device_type,id\nSN-1,logger,3\nSN-2,meter,\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[1].Number != 2 || rows[1].Fields["device_type"] != "meter" {
+		t.Fatalf("rows = %+v", rows)
+	}
+	if _, ok := rows[0].Fields["id"]; ok {
+		t.Fatal("read-only column was imported")
+	}
+
+	for _, input := range []string{"name\nPump\n", "serial_number,colour\nSN-1,red\n"} {
+		if _, err := parseCSVImport(strings.NewReader(input)); err == nil {
+			t.Errorf("parseCSVImport(%q) succeeded", input)
+		}
+	}
+}
+
+func TestParseJSONImport(t *testing.T) {
+	rows, err := parseJSONImport(strings.NewReader(`[{"serial_number":"SN-1","tags":["a","b"],"id":4,"name":null}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Fields["tags"] != "a,b" || rows[0].Fields["name"] != "" {
+		t.Fatalf("rows = %+v", rows)
+	}
+	if _, ok := rows[0].Fields["id"]; ok {
+		t.Fatal("read-only field was imported")
+	}
+
+	for _, input := range []string{`[{"colour":"red"}]`, `[{"name":3}]`, `[{"name":["a"]}]`, `{}`} {
+		if _, err := parseJSONImport(strings.NewReader(input)); err == nil {
+			t.Errorf("parseJSONImport(%s) succeeded", input)
+		}
+	}
+}
@@ -0,0 +1,724 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"mqtt/data"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// otaCommandType is the command devices receive to install firmware
+	otaCommandType = "ota"
+
+	campaignCheckInterval = 30 * time.Second
+
+	defaultCampaignFailureThreshold = 0.1
+	defaultCampaignUpdateTimeout    = 24 * time.Hour
+	maxCampaignUpdateTimeout        = 7 * 24 * time.Hour
+)
+
+// defaultCampaignWaves releases to 10%, then half, then every device
+var defaultCampaignWaves = []int{10, 50, 100}
+
+// Campaign topics published on the event bus
+const (
+	TopicCampaignStarted   = "campaign.started"
+	TopicCampaignWave      = "campaign.wave"
+	TopicCampaignHalted    = "campaign.halted"
+	TopicCampaignCompleted = "campaign.completed"
+)
+
+var errNoCampaignTargets = errors.New("campaign matches no devices")
+
+// campaignRequest is the body of POST /campaigns
+type campaignRequest struct {
+	Name                 string   `json:"name"`
+	ArtifactID           uint     `json:"artifact_id"`
+	DeviceType           string   `json:"device_type"`
+	FromVersions         []string `json:"from_versions"`
+	Tags                 []string `json:"tags"`
+	Waves                []int    `json:"waves"`
+	FailureThreshold     *float64 `json:"failure_threshold"`
+	UpdateTimeoutSeconds int      `json:"update_timeout_seconds"`
+}
+
+// validate checks the request against the artifact it rolls out
+func (req *campaignRequest) validate(artifact *data.FirmwareArtifact) fieldErrors {
+	errs := fieldErrors{}
+
+	req.Name = strings.TrimSpace(req.Name)
+	switch {
+	case req.Name == "":
+		errs["name"] = "is required"
+	case len(req.Name) > 100:
+		errs["name"] = "must be at most 100 characters"
+	}
+
+	if artifact == nil {
+		errs["artifact_id"] = "must name an uploaded firmware"
+	} else if req.DeviceType == "" {
+		req.DeviceType = artifact.DeviceType
+	} else if req.DeviceType != artifact.DeviceType {
+		errs["device_type"] = fmt.Sprintf("must match the firmware's device type %q", artifact.DeviceType)
+	}
+
+	for _, version := range req.FromVersions {
+		if !firmwareVersionPattern.MatchString(version) {
+			errs["from_versions"] = fmt.Sprintf("invalid version %q", version)
+			break
+		}
+	}
+
+	req.Tags = normalizeTags(req.Tags)
+	for _, tag := range req.Tags {
+		if !tagPattern.MatchString(tag) {
+			errs["tags"] = fmt.Sprintf("invalid tag %q", tag)
+			break
+		}
+	}
+
+	if len(req.Waves) == 0 {
+		req.Waves = defaultCampaignWaves
+	}
+	for i, percent := range req.Waves {
+		if percent < 1 || percent > 100 || (i > 0 && percent <= req.Waves[i-1]) {
+			errs["waves"] = "must be increasing percentages between 1 and 100"
+			break
+		}
+	}
+	if req.Waves[len(req.Waves)-1] != 100 {
+		errs["waves"] = "must end at 100"
+	}
+
+	if req.FailureThreshold == nil {
+		threshold := defaultCampaignFailureThreshold
+		req.FailureThreshold = &threshold
+	}
+	if *req.FailureThreshold < 0 || *req.FailureThreshold > 1 {
+		errs["failure_threshold"] = "must be between 0 and 1"
+	}
+
+	if req.UpdateTimeoutSeconds == 0 {
+		req.UpdateTimeoutSeconds = int(defaultCampaignUpdateTimeout.Seconds())
+	}
+	if req.UpdateTimeoutSeconds < 60 || time.Duration(req.UpdateTimeoutSeconds)*time.Second > maxCampaignUpdateTimeout {
+		errs["update_timeout_seconds"] = fmt.Sprintf("must be between 60 and %d", int(maxCampaignUpdateTimeout.Seconds()))
+	}
+
+	return errs
+}
+
+// campaignDocument is a campaign as returned by the API
+type campaignDocument struct {
+	*data.FirmwareCampaign
+	Progress *data.CampaignProgress `json:"progress"`
+}
+
+// otaPayload is the payload of the ota command sent to each device
+type otaPayload struct {
+	CampaignID uint   `json:"campaign_id"`
+	Version    string `json:"version"`
+	URL        string `json:"url"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+	Signature  string `json:"signature,omitempty"`
+}
+
+// Start resolves a draft campaign's target devices, assigns them to waves
+// and releases the first wave
+func (s *FirmwareService) Start(campaign *data.FirmwareCampaign) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if campaign.Status != data.CampaignStatusDraft {
+		return fmt.Errorf("%w: campaign is %s", data.ErrConflict, campaign.Status)
+	}
+
+	updates, err := s.resolveTargets(campaign)
+	if err != nil {
+		return err
+	}
+	if len(updates) == 0 {
+		return errNoCampaignTargets
+	}
+	if err := s.models.Firmware.CreateUpdates(updates); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	campaign.Status = data.CampaignStatusRunning
+	campaign.CurrentWave = 1
+	campaign.StartedAt = &now
+	_, err = s.models.Firmware.ChangeCampaign(campaign, []string{data.CampaignStatusDraft}, "current_wave", "started_at")
+	if err != nil {
+		return changeError(campaign, err)
+	}
+	s.events.Publish(TopicCampaignStarted, "", campaign)
+
+	s.advance(campaign)
+	return nil
+}
+
+// resolveTargets returns one pending update per device matching the
+// campaign, spread over its waves in a random but reproducible order.
+// Devices already running the new version are left out.
+func (s *FirmwareService) resolveTargets(campaign *data.FirmwareCampaign) ([]*data.FirmwareUpdate, error) {
+	devices, err := s.models.Device.GetDevicesByTypeAndTags(campaign.DeviceType, campaign.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint, len(devices))
+	for i, device := range devices {
+		ids[i] = device.ID
+	}
+	versions, err := s.reportedVersions(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var updates []*data.FirmwareUpdate
+	for _, device := range devices {
+		version := versions[device.ID]
+		if version == campaign.Artifact.Version {
+			continue
+		}
+		if len(campaign.FromVersions) > 0 && !slices.Contains(campaign.FromVersions, version) {
+			continue
+		}
+		updates = append(updates, &data.FirmwareUpdate{
+			CampaignID:   campaign.ID,
+			DeviceID:     device.ID,
+			SerialNumber: device.SerialNumber,
+			FromVersion:  version,
+			Status:       data.FirmwareUpdatePending,
+		})
+	}
+
+	rand.New(rand.NewSource(int64(campaign.ID))).Shuffle(len(updates), func(i, j int) {
+		updates[i], updates[j] = updates[j], updates[i]
+	})
+	for i, update := range updates {
+		update.Wave = waveFor(i, len(updates), campaign.Waves)
+	}
+	return updates, nil
+}
+
+// reportedVersions returns the firmware version each device last reported,
+// as kept in its shadow
+func (s *FirmwareService) reportedVersions(deviceIDs []uint) (map[uint]string, error) {
+	shadows, err := s.models.Shadow.GetShadows(deviceIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(map[uint]string, len(shadows))
+	for _, shadow := range shadows {
+		var reported struct {
+			FirmwareVersion string `json:"firmware_version"`
+		}
+		if !shadow.Reported.IsNull() && json.Unmarshal(shadow.Reported, &reported) == nil {
+			versions[shadow.DeviceID] = reported.FirmwareVersion
+		}
+	}
+	return versions, nil
+}
+
+// waveFor returns the 1-based wave of the i-th of n devices given
+// cumulative wave percentages
+func waveFor(i, n int, waves []int) int {
+	for wave, percent := range waves {
+		if i < int(math.Ceil(float64(n)*float64(percent)/100)) {
+			return wave + 1
+		}
+	}
+	return len(waves)
+}
+
+// Pause stops a running campaign from sending further updates. Updates
+// still queued for sleeping devices are withdrawn and sent on resume.
+func (s *FirmwareService) Pause(campaign *data.FirmwareCampaign) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	campaign.Status = data.CampaignStatusPaused
+	withdrawn, err := s.models.Firmware.ChangeCampaign(campaign, []string{data.CampaignStatusRunning})
+	if err != nil {
+		return changeError(campaign, err)
+	}
+	s.publishWithdrawn(withdrawn)
+	return nil
+}
+
+// Resume continues a paused or halted campaign. A halted campaign is
+// resumed with a new failure threshold if one is given, as it would
+// otherwise halt again straight away.
+func (s *FirmwareService) Resume(campaign *data.FirmwareCampaign, failureThreshold *float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	columns := []string{"halt_reason"}
+	if failureThreshold != nil {
+		campaign.FailureThreshold = *failureThreshold
+		columns = append(columns, "failure_threshold")
+	}
+	campaign.Status = data.CampaignStatusRunning
+	campaign.HaltReason = ""
+	from := []string{data.CampaignStatusPaused, data.CampaignStatusHalted}
+	if _, err := s.models.Firmware.ChangeCampaign(campaign, from, columns...); err != nil {
+		return changeError(campaign, err)
+	}
+
+	s.advance(campaign)
+	return nil
+}
+
+// Cancel ends a campaign. Updates still queued for sleeping devices are
+// withdrawn; those already sent are still tracked by their commands but no
+// further devices are released.
+func (s *FirmwareService) Cancel(campaign *data.FirmwareCampaign) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	campaign.Status = data.CampaignStatusCancelled
+	campaign.CompletedAt = &now
+	from := []string{data.CampaignStatusDraft, data.CampaignStatusRunning, data.CampaignStatusPaused, data.CampaignStatusHalted}
+	withdrawn, err := s.models.Firmware.ChangeCampaign(campaign, from, "completed_at")
+	if err != nil {
+		return changeError(campaign, err)
+	}
+	s.publishWithdrawn(withdrawn)
+	return nil
+}
+
+// changeError reports a campaign that another request or instance changed
+// first as a conflict with the status it has now
+func changeError(campaign *data.FirmwareCampaign, err error) error {
+	if errors.Is(err, data.ErrPreconditionFailed) {
+		return fmt.Errorf("%w: campaign is %s", data.ErrConflict, campaign.Status)
+	}
+	return err
+}
+
+// publishWithdrawn announces the ota commands expired when a campaign
+// stopped
+func (s *FirmwareService) publishWithdrawn(commands []*data.Command) {
+	for _, command := range commands {
+		s.events.Publish(TopicCommandExpired, command.SerialNumber, command)
+	}
+}
+
+// Run checks running campaigns for timed-out updates and finished waves
+// while this instance is the leader, until the process exits
+func (s *FirmwareService) Run(leader Leadership) {
+	ticker := time.NewTicker(campaignCheckInterval)
+	for range ticker.C {
+		if !leader.IsLeader() {
+			continue
+		}
+		campaigns, err := s.models.Firmware.GetCampaignsByStatus(data.CampaignStatusRunning)
+		if err != nil {
+			s.log.Error("failed to load running campaigns", "error", err)
+			continue
+		}
+
+		s.mu.Lock()
+		for _, campaign := range campaigns {
+			s.advance(campaign)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// advance moves a running campaign forward: it sends the released updates,
+// fails the ones that timed out, halts the campaign if too many failed and
+// opens the next wave once the current one has finished. The caller must
+// hold s.mu.
+func (s *FirmwareService) advance(campaign *data.FirmwareCampaign) {
+	for campaign.Status == data.CampaignStatusRunning {
+		s.sendPending(campaign)
+		s.failTimedOut(campaign)
+
+		progress, err := s.models.Firmware.GetProgress(campaign.ID, campaign.CurrentWave)
+		if err != nil {
+			s.log.Error("failed to get campaign progress", "campaign_id", campaign.ID, "error", err)
+			return
+		}
+
+		released := progress.Total - progress.Skipped
+		if released > 0 && float64(progress.Failed)/float64(released) > campaign.FailureThreshold {
+			s.finish(campaign, data.CampaignStatusHalted, fmt.Sprintf(
+				"%d of %d devices failed to update, above the %.0f%% threshold",
+				progress.Failed, released, campaign.FailureThreshold*100,
+			))
+			return
+		}
+
+		if progress.Pending > 0 || progress.Sent > 0 {
+			return
+		}
+		if campaign.CurrentWave >= len(campaign.Waves) {
+			s.finish(campaign, data.CampaignStatusCompleted, "")
+			return
+		}
+
+		if err := s.models.Firmware.AdvanceCampaignWave(campaign); err != nil {
+			// A paused campaign, or one another instance moved on, is left
+			// as it is now
+			if !errors.Is(err, data.ErrPreconditionFailed) {
+				s.log.Error("failed to update campaign", "campaign_id", campaign.ID, "error", err)
+			}
+			return
+		}
+		s.events.Publish(TopicCampaignWave, "", campaign)
+	}
+}
+
+// finish moves a running campaign to a final (or halted) status. Halting
+// withdraws the updates still queued for sleeping devices.
+func (s *FirmwareService) finish(campaign *data.FirmwareCampaign, status, reason string) {
+	campaign.Status = status
+	campaign.HaltReason = reason
+	topic := TopicCampaignHalted
+	if status == data.CampaignStatusCompleted {
+		now := time.Now()
+		campaign.CompletedAt = &now
+		topic = TopicCampaignCompleted
+	}
+	withdrawn, err := s.models.Firmware.ChangeCampaign(campaign, []string{data.CampaignStatusRunning}, "halt_reason", "completed_at")
+	if err != nil {
+		if !errors.Is(err, data.ErrPreconditionFailed) {
+			s.log.Error("failed to update campaign", "campaign_id", campaign.ID, "error", err)
+		}
+		return
+	}
+	s.publishWithdrawn(withdrawn)
+	s.events.Publish(topic, "", campaign)
+}
+
+// sendPending sends the ota command to every pending device in the
+// released waves. Commands are queued for devices that are asleep.
+func (s *FirmwareService) sendPending(campaign *data.FirmwareCampaign) {
+	pending, err := s.models.Firmware.GetUpdatesByWave(campaign.ID, campaign.CurrentWave, data.FirmwareUpdatePending)
+	if err != nil {
+		s.log.Error("failed to load pending updates", "campaign_id", campaign.ID, "error", err)
+		return
+	}
+
+	payload, err := json.Marshal(otaPayload{
+		CampaignID: campaign.ID,
+		Version:    campaign.Artifact.Version,
+		URL:        s.downloadURL(&campaign.Artifact),
+		Size:       campaign.Artifact.Size,
+		SHA256:     campaign.Artifact.SHA256,
+		Signature:  campaign.Artifact.Signature,
+	})
+	if err != nil {
+		return
+	}
+
+	for _, update := range pending {
+		device, err := s.models.Device.GetByID(update.DeviceID)
+		if errors.Is(err, data.ErrNotFound) {
+			update.Status = data.FirmwareUpdateSkipped
+			update.Error = "device was deleted"
+			s.saveUpdate(update)
+			continue
+		}
+		if err != nil {
+			s.log.Error("failed to load device for campaign", "device_id", update.DeviceID, "campaign_id", campaign.ID, "error", err)
+			continue
+		}
+
+		command, _, err := s.commands.Create(context.Background(), device, commandRequest{
+			Type:       otaCommandType,
+			Payload:    data.JSON(payload),
+			TTLSeconds: campaign.UpdateTimeoutSeconds,
+			DedupKey:   fmt.Sprintf("ota-campaign-%d", campaign.ID),
+		})
+		if err != nil {
+			// Typically a full command queue; retried on the next check
+			s.log.Warn("failed to send firmware update", "imei", device.SerialNumber, "campaign_id", campaign.ID, "error", err)
+			continue
+		}
+
+		now := time.Now()
+		update.Status = data.FirmwareUpdateSent
+		update.CommandID = command.ID
+		update.SentAt = &now
+		s.saveUpdate(update)
+	}
+}
+
+// failTimedOut fails sent updates whose device has not reported the new
+// version within the campaign's update timeout
+func (s *FirmwareService) failTimedOut(campaign *data.FirmwareCampaign) {
+	sent, err := s.models.Firmware.GetUpdatesByWave(campaign.ID, campaign.CurrentWave, data.FirmwareUpdateSent)
+	if err != nil {
+		s.log.Error("failed to load sent updates", "campaign_id", campaign.ID, "error", err)
+		return
+	}
+
+	deadline := time.Now().Add(-time.Duration(campaign.UpdateTimeoutSeconds) * time.Second)
+	for _, update := range sent {
+		if update.SentAt != nil && update.SentAt.Before(deadline) {
+			s.completeUpdate(update, data.FirmwareUpdateFailed, "new version not reported before the update timeout")
+		}
+	}
+}
+
+// handleEvent tracks updates from the device side: telemetry carrying the
+// new firmware version completes an update, a failed or expired ota
+// command fails it
+func (s *FirmwareService) handleEvent(event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch payload := event.Payload.(type) {
+	case *data.DeviceData:
+		if payload.FirmwareVersion == "" {
+			return nil
+		}
+		updates, err := s.models.Firmware.GetSentUpdatesBySerialNumber(payload.SerialNumber)
+		if err != nil {
+			return err
+		}
+		for _, update := range updates {
+			campaign, err := s.models.Firmware.GetCampaign(update.CampaignID)
+			if err != nil {
+				return err
+			}
+			if payload.FirmwareVersion != campaign.Artifact.Version {
+				continue
+			}
+			s.completeUpdate(update, data.FirmwareUpdateUpdated, "")
+			s.advance(campaign)
+		}
+
+	case *data.Command:
+		if payload.Type != otaCommandType {
+			return nil
+		}
+		update, err := s.models.Firmware.GetUpdateByCommandID(payload.ID)
+		if errors.Is(err, data.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if update.IsFinal() {
+			return nil
+		}
+		reason := payload.Error
+		if payload.Status == data.CommandStatusExpired {
+			reason = "update command expired before delivery"
+		}
+		s.completeUpdate(update, data.FirmwareUpdateFailed, reason)
+
+		campaign, err := s.models.Firmware.GetCampaign(update.CampaignID)
+		if err != nil {
+			return err
+		}
+		s.advance(campaign)
+	}
+	return nil
+}
+
+// completeUpdate records the outcome of one device's update
+func (s *FirmwareService) completeUpdate(update *data.FirmwareUpdate, status, reason string) {
+	now := time.Now()
+	update.Status = status
+	update.Error = reason
+	update.CompletedAt = &now
+	s.saveUpdate(update)
+}
+
+func (s *FirmwareService) saveUpdate(update *data.FirmwareUpdate) {
+	if err := s.models.Firmware.UpdateUpdate(update); err != nil {
+		s.log.Error("failed to save firmware update", "update_id", update.ID, "campaign_id", update.CampaignID, "error", err)
+	}
+}
+
+// createCampaign creates a draft campaign; it does nothing until started
+func (h *APIHandler) createCampaign(w http.ResponseWriter, r *http.Request) {
+	var req campaignRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	artifact, err := h.modelsFor(r).Firmware.GetArtifact(req.ArtifactID)
+	if err != nil && !errors.Is(err, data.ErrNotFound) {
+		writeDataError(w, r, err, "Failed to get firmware")
+		return
+	}
+	if errs := req.validate(artifact); len(errs) > 0 {
+		writeValidationError(w, r, errs)
+		return
+	}
+
+	campaign := &data.FirmwareCampaign{
+		Name:                 req.Name,
+		ArtifactID:           artifact.ID,
+		DeviceType:           req.DeviceType,
+		FromVersions:         req.FromVersions,
+		Tags:                 req.Tags,
+		Waves:                req.Waves,
+		FailureThreshold:     *req.FailureThreshold,
+		UpdateTimeoutSeconds: req.UpdateTimeoutSeconds,
+		Status:               data.CampaignStatusDraft,
+	}
+	if err := h.modelsFor(r).Firmware.CreateCampaign(campaign); err != nil {
+		writeDataError(w, r, err, "Failed to create campaign")
+		return
+	}
+	campaign.Artifact = *artifact
+
+	writeJSON(w, http.StatusCreated, campaign)
+}
+
+// getCampaigns lists all campaigns, newest first
+func (h *APIHandler) getCampaigns(w http.ResponseWriter, r *http.Request) {
+	campaigns, err := h.modelsFor(r).Firmware.GetCampaigns()
+	if err != nil {
+		writeDataError(w, r, err, "Failed to get campaigns")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"campaigns": campaigns,
+		"count":     len(campaigns),
+	})
+}
+
+// getCampaign returns a campaign with its progress across all waves
+func (h *APIHandler) getCampaign(w http.ResponseWriter, r *http.Request) {
+	campaign, ok := h.campaignFromURL(w, r)
+	if !ok {
+		return
+	}
+	h.writeCampaign(w, r, campaign)
+}
+
+// getCampaignDevices lists a campaign's devices, optionally by ?status=
+func (h *APIHandler) getCampaignDevices(w http.ResponseWriter, r *http.Request) {
+	campaign, ok := h.campaignFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	updates, err := h.modelsFor(r).Firmware.GetUpdates(campaign.ID, r.URL.Query().Get("status"))
+	if err != nil {
+		writeDataError(w, r, err, "Failed to get campaign devices")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"devices": updates,
+		"count":   len(updates),
+	})
+}
+
+// startCampaign starts a draft campaign
+func (h *APIHandler) startCampaign(w http.ResponseWriter, r *http.Request) {
+	h.changeCampaign(w, r, h.firmware.Start)
+}
+
+// pauseCampaign pauses a running campaign
+func (h *APIHandler) pauseCampaign(w http.ResponseWriter, r *http.Request) {
+	h.changeCampaign(w, r, h.firmware.Pause)
+}
+
+// resumeCampaign resumes a paused or halted campaign. The optional body
+// {"failure_threshold": 0.2} raises the threshold of a halted campaign.
+func (h *APIHandler) resumeCampaign(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		FailureThreshold *float64 `json:"failure_threshold"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+	if body.FailureThreshold != nil && (*body.FailureThreshold < 0 || *body.FailureThreshold > 1) {
+		writeValidationError(w, r, fieldErrors{"failure_threshold": "must be between 0 and 1"})
+		return
+	}
+
+	h.changeCampaign(w, r, func(campaign *data.FirmwareCampaign) error {
+		return h.firmware.Resume(campaign, body.FailureThreshold)
+	})
+}
+
+// cancelCampaign cancels a campaign that has not finished
+func (h *APIHandler) cancelCampaign(w http.ResponseWriter, r *http.Request) {
+	h.changeCampaign(w, r, h.firmware.Cancel)
+}
+
+// changeCampaign loads the campaign in the URL, applies change and returns
+// the updated campaign
+func (h *APIHandler) changeCampaign(w http.ResponseWriter, r *http.Request, change func(*data.FirmwareCampaign) error) {
+	campaign, ok := h.campaignFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	if err := change(campaign); err != nil {
+		switch {
+		case errors.Is(err, errNoCampaignTargets):
+			writeError(w, r, http.StatusUnprocessableEntity, "Campaign matches no devices that need this firmware")
+		case errors.Is(err, data.ErrConflict):
+			writeError(w, r, http.StatusConflict, fmt.Sprintf("Campaign cannot be changed while %s", campaign.Status))
+		default:
+			writeDataError(w, r, err, "Failed to update campaign")
+		}
+		return
+	}
+
+	h.writeCampaign(w, r, campaign)
+}
+
+// writeCampaign responds with a campaign and its progress
+func (h *APIHandler) writeCampaign(w http.ResponseWriter, r *http.Request, campaign *data.FirmwareCampaign) {
+	progress, err := h.modelsFor(r).Firmware.GetProgress(campaign.ID, -1)
+	if err != nil {
+		writeDataError(w, r, err, "Failed to get campaign progress")
+		return
+	}
+	writeJSON(w, http.StatusOK, campaignDocument{FirmwareCampaign: campaign, Progress: progress})
+}
+
+// campaignFromURL loads the campaign named by the campaignID URL parameter.
+// It writes the error response and returns false if that fails.
+func (h *APIHandler) campaignFromURL(w http.ResponseWriter, r *http.Request) (*data.FirmwareCampaign, bool) {
+	campaignID, err := strconv.ParseUint(chi.URLParam(r, "campaignID"), 10, 32)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid campaign ID")
+		return nil, false
+	}
+
+	campaign, err := h.modelsFor(r).Firmware.GetCampaign(uint(campaignID))
+	if err != nil {
+		if errors.Is(err, data.ErrNotFound) {
+			writeError(w, r, http.StatusNotFound, "Campaign not found")
+			return nil, false
+		}
+		writeDataError(w, r, err, "Failed to get campaign")
+		return nil, false
+	}
+	return campaign, true
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"mqtt/data"
+)
+
+func TestWaveFor(t *testing.T) {
+	tests := []struct {
+		n     int
+		waves []int
+		want  []int
+	}{
+		{n: 10, waves: []int{10, 50, 100}, want: []int{1, 2, 2, 2, 2, 3, 3, 3, 3, 3}},
+		{n: 3, waves: []int{10, 50, 100}, want: []int{1, 2, 3}},
+		{n: 1, waves: []int{5, 25, 100}, want: []int{1}},
+		{n: 4, waves: []int{100}, want: []int{1, 1, 1, 1}},
+		{n: 5, waves: []int{20, 40, 60, 80, 100}, want: []int{1, 2, 3, 4, 5}},
+	}
+	for _, tt := range tests {
+		got := make([]int, tt.n)
+		for i := range got {
+			got[i] = waveFor(i, tt.n, tt.waves)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("waves of %d devices over %v = %v, want %v", tt.n, tt.waves, got, tt.want)
+		}
+	}
+}
+
+func TestCampaignRequestValidate(t *testing.T) {
+	artifact := &data.FirmwareArtifact{ID: 1, DeviceType: "logger", Version: "2.0.0"}
+	threshold := 1.5
+	tests := []struct {
+		name     string
+		req      campaignRequest
+		artifact *data.FirmwareArtifact
+		errField string
+	}{
+		{name: "defaults", req: campaignRequest{Name: "Rollout"}, artifact: artifact},
+		{name: "missing artifact", req: campaignRequest{Name: "Rollout"}, errField: "artifact_id"},
+		{name: "missing name", req: campaignRequest{Name: "  "}, artifact: artifact, errField: "name"},
+		{name: "other device type", req: campaignRequest{Name: "Rollout", DeviceType: "meter"}, artifact: artifact, errField: "device_type"},
+		{name: "bad from version", req: campaignRequest{Name: "Rollout", FromVersions: []string{"latest!"}}, artifact: artifact, errField: "from_versions"},
+		{name: "decreasing waves", req: campaignRequest{Name: "Rollout", Waves: []int{50, 10, 100}}, artifact: artifact, errField: "waves"},
+		{name: "waves short of 100", req: campaignRequest{Name: "Rollout", Waves: []int{10, 50}}, artifact: artifact, errField: "waves"},
+		{name: "threshold above 1", req: campaignRequest{Name: "Rollout", FailureThreshold: &threshold}, artifact: artifact, errField: "failure_threshold"},
+		{name: "timeout too short", req: campaignRequest{Name: "Rollout", UpdateTimeoutSeconds: 30}, artifact: artifact, errField: "update_timeout_seconds"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := tt.req.validate(tt.artifact)
+			if tt.errField == "" {
+				if len(errs) > 0 {
+					t.Fatalf("errors = %v", errs)
+				}
+				return
+			}
+			if errs[tt.errField] == "" {
+				t.Fatalf("errors = %v, want one for %s", errs, tt.errField)
+			}
+		})
+	}
+
+	req := campaignRequest{Name: "Rollout"}
+	req.validate(artifact)
+	if req.DeviceType != "logger" || !slices.Equal(req.Waves, defaultCampaignWaves) ||
+		*req.FailureThreshold != defaultCampaignFailureThreshold || req.UpdateTimeoutSeconds != int(defaultCampaignUpdateTimeout.Seconds()) {
+		t.Fatalf("defaults not applied: %+v", req)
+	}
+}
+
+// fakeShadowStore serves shadows from memory
+type fakeShadowStore struct {
+	data.ShadowModel
+
+	shadows []*data.DeviceShadow
+}
+
+func (f *fakeShadowStore) GetShadows(deviceIDs []uint) ([]*data.DeviceShadow, error) {
+	var shadows []*data.DeviceShadow
+	for _, shadow := range f.shadows {
+		if slices.Contains(deviceIDs, shadow.DeviceID) {
+			shadows = append(shadows, shadow)
+		}
+	}
+	return shadows, nil
+}
+
+// fakeTargetStore returns every device as a campaign target
+type fakeTargetStore struct {
+	data.DeviceModel
+
+	devices []*data.Device
+}
+
+func (f *fakeTargetStore) GetDevicesByTypeAndTags(deviceType string, tags []string) ([]*data.Device, error) {
+	return f.devices, nil
+}
+
+func TestResolveTargets(t *testing.T) {
+	devices := &fakeTargetStore{}
+	shadows := &fakeShadowStore{}
+	for id := uint(1); id <= 20; id++ {
+		devices.devices = append(devices.devices, &data.Device{ID: id, SerialNumber: fmt.Sprintf("SN-%d", id)})
+		version := "1.0.0"
+		switch {
+		case id <= 2:
+			version = "2.0.0"
+		case id <= 4:
+			version = "0.9.0"
+		}
+		shadows.shadows = append(shadows.shadows, &data.DeviceShadow{DeviceID: id, Reported: data.JSON(`{"firmware_version":"` + version + `"}`)})
+	}
+	s := &FirmwareService{models: &data.Models{Device: devices, Shadow: shadows}}
+
+	campaign := &data.FirmwareCampaign{
+		ID:           7,
+		Artifact:     data.FirmwareArtifact{Version: "2.0.0"},
+		FromVersions: data.StringList{"1.0.0"},
+		Waves:        data.IntList{25, 50, 100},
+	}
+	updates, err := s.resolveTargets(campaign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 16 {
+		t.Fatalf("got %d updates, want the 16 devices on 1.0.0", len(updates))
+	}
+
+	perWave := map[int]int{}
+	for _, update := range updates {
+		if update.DeviceID <= 4 || update.FromVersion != "1.0.0" || update.Status != data.FirmwareUpdatePending {
+			t.Fatalf("unexpected update %+v", update)
+		}
+		perWave[update.Wave]++
+	}
+	if perWave[1] != 4 || perWave[2] != 4 || perWave[3] != 8 {
+		t.Fatalf("devices per wave = %v, want 4, 4 and 8", perWave)
+	}
+
+	again, _ := s.resolveTargets(campaign)
+	for i := range updates {
+		if updates[i].DeviceID != again[i].DeviceID {
+			t.Fatal("device order is not reproducible")
+		}
+	}
+}
+
+// fakeCampaignStore keeps one campaign and changes it conditionally, like
+// the database does
+type fakeCampaignStore struct {
+	data.FirmwareModel
+
+	campaign  data.FirmwareCampaign
+	withdrawn []*data.Command
+}
+
+func (f *fakeCampaignStore) ChangeCampaign(campaign *data.FirmwareCampaign, from []string, columns ...string) ([]*data.Command, error) {
+	if !slices.Contains(from, f.campaign.Status) {
+		*campaign = f.campaign
+		return nil, data.ErrPreconditionFailed
+	}
+	f.campaign = *campaign
+	return f.withdrawn, nil
+}
+
+func TestChangeCampaign(t *testing.T) {
+	tests := []struct {
+		name   string
+		stored string
+		change func(*FirmwareService, *data.FirmwareCampaign) error
+		want   string
+		// withdrawn is whether queued commands are withdrawn
+		withdrawn bool
+	}{
+		{name: "pause", stored: data.CampaignStatusRunning, change: (*FirmwareService).Pause, want: data.CampaignStatusPaused, withdrawn: true},
+		{name: "pause after cancel", stored: data.CampaignStatusCancelled, change: (*FirmwareService).Pause, want: data.CampaignStatusCancelled},
+		{name: "cancel", stored: data.CampaignStatusPaused, change: (*FirmwareService).Cancel, want: data.CampaignStatusCancelled, withdrawn: true},
+		{name: "cancel completed", stored: data.CampaignStatusCompleted, change: (*FirmwareService).Cancel, want: data.CampaignStatusCompleted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeCampaignStore{
+				campaign:  data.FirmwareCampaign{ID: 1, Status: tt.stored},
+				withdrawn: []*data.Command{{ID: 9, SerialNumber: "SN-1", Status: data.CommandStatusExpired}},
+			}
+			events := NewEventBus(discardLogger())
+			expired := make(chan Event, 1)
+			events.Subscribe("test", []string{TopicCommandExpired}, 0, func(event Event) error {
+				expired <- event
+				return nil
+			})
+			s := &FirmwareService{models: &data.Models{Firmware: store}, events: events, log: discardLogger()}
+
+			// The caller's copy was read while the campaign was running
+			campaign := &data.FirmwareCampaign{ID: 1, Status: data.CampaignStatusRunning}
+			err := tt.change(s, campaign)
+			if tt.want == tt.stored {
+				if !errors.Is(err, data.ErrConflict) {
+					t.Fatalf("error = %v, want ErrConflict", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if campaign.Status != tt.want || store.campaign.Status != tt.want {
+				t.Fatalf("status = %s, stored %s, want %s", campaign.Status, store.campaign.Status, tt.want)
+			}
+
+			if tt.withdrawn {
+				if event := <-expired; event.Device != "SN-1" {
+					t.Fatalf("expired event for %s", event.Device)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"mqtt/data"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Commands go to device/{serial}/commands. Devices acknowledge them on the
+// command_ack subscription and announce that they have woken up on the
+// birth subscription (device/{serial}/commands/ack and device/{serial}/birth
+// by default).
+const (
+	commandTopicFormat = "device/%s/commands"
+
+	commandRetryInterval = 10 * time.Second
+	maxCommandTTL        = 7 * 24 * time.Hour
+)
+
+// Command topics published on the event bus
+const (
+	TopicCommandQueued  = "command.queued"
+	TopicCommandSent    = "command.sent"
+	TopicCommandFailed  = "command.failed"
+	TopicCommandExpired = "command.expired"
+)
+
+var (
+	commandTypePattern = regexp.MustCompile(`^[a-z][a-z0-9_.-]{0,49}$`)
+
+	errMQTTUnavailable  = errors.New("MQTT client not connected")
+	errCommandQueueFull = errors.New("command queue is full")
+)
+
+// commandRequest is the body of POST /devices/{id}/commands
+type commandRequest struct {
+	Type       string    `json:"type"`
+	Payload    data.JSON `json:"payload"`
+	QoS        *int      `json:"qos"`
+	TTLSeconds int       `json:"ttl_seconds"`
+	DedupKey   string    `json:"dedup_key"`
+}
+
+func (req *commandRequest) validate() fieldErrors {
+	errs := fieldErrors{}
+	if !commandTypePattern.MatchString(req.Type) {
+		errs["type"] = "must be 1-50 lowercase letters, digits, '.', '_' or '-', starting with a letter"
+	}
+	if !req.Payload.IsNull() {
+		var object map[string]interface{}
+		if err := json.Unmarshal(req.Payload, &object); err != nil {
+			errs["payload"] = "must be a JSON object"
+		}
+	}
+	if req.QoS != nil && (*req.QoS < 0 || *req.QoS > 2) {
+		errs["qos"] = "must be 0, 1 or 2"
+	}
+	if req.TTLSeconds < 0 || time.Duration(req.TTLSeconds)*time.Second > maxCommandTTL {
+		errs["ttl_seconds"] = fmt.Sprintf("must be between 0 and %d", int(maxCommandTTL.Seconds()))
+	}
+	if len(req.DedupKey) > 100 {
+		errs["dedup_key"] = "must be at most 100 characters"
+	}
+	return errs
+}
+
+// commandMessage is the JSON document published to the device
+type commandMessage struct {
+	ID        uint       `json:"id"`
+	Type      string     `json:"type"`
+	Payload   data.JSON  `json:"payload,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// commandAck is the JSON document a device publishes to acknowledge a command
+type commandAck struct {
+	ID     uint      `json:"id"`
+	Status string    `json:"status"`
+	Result data.JSON `json:"result"`
+	Error  string    `json:"error"`
+}
+
+// CommandService creates, delivers and tracks downlink commands. Commands
+// are persisted first and queued per device until the device is awake; a
+// background loop republishes unacknowledged commands and expires stale
+// ones.
+type CommandService struct {
+	models      *data.Models
+	log         *slog.Logger
+	events      *EventBus
+	broker      Broker
+	qos         byte
+	ackTimeout  time.Duration
+	maxAttempts int
+	defaultTTL  time.Duration
+
+	queueDepth  int
+	awakeWindow time.Duration
+}
+
+// NewCommandService creates a command service from the configuration and
+// subscribes it to saved telemetry, which wakes up a device's queue
+func NewCommandService(models *data.Models, events *EventBus, broker Broker, cfg Config, logger *slog.Logger) *CommandService {
+	s := &CommandService{
+		models:      models,
+		log:         logger.With("component", "commands"),
+		events:      events,
+		broker:      broker,
+		qos:         cfg.CommandQoS,
+		ackTimeout:  cfg.CommandAckTimeout,
+		maxAttempts: cfg.CommandMaxAttempts,
+		defaultTTL:  cfg.CommandDefaultTTL,
+		queueDepth:  cfg.CommandQueueDepth,
+		awakeWindow: cfg.CommandAwakeWindow,
+	}
+	events.Subscribe("commands", []string{TopicTelemetrySaved}, 0, s.handleTelemetry)
+	return s
+}
+
+// Create stores a new command for device. Commands for a device that is
+// awake are published straight away; otherwise they wait in the device's
+// queue until its next telemetry or birth message. A request whose dedup
+// key matches a command still in flight returns that command instead, with
+// created set to false. The trace in ctx is stored with the command.
+//
+// Queue changes and flushes hold the device's queue lock, which every
+// instance shares, so the depth limit holds and commands go out in order.
+func (s *CommandService) Create(ctx context.Context, device *data.Device, req commandRequest) (command *data.Command, created bool, err error) {
+	lockErr := s.models.Command.LockQueue(device.SerialNumber, func() error {
+		command, created, err = s.create(ctx, device, req)
+		return nil
+	})
+	if lockErr != nil {
+		return nil, false, lockErr
+	}
+	return command, created, err
+}
+
+// create does the work of Create. The caller must hold the device's queue
+// lock.
+func (s *CommandService) create(ctx context.Context, device *data.Device, req commandRequest) (command *data.Command, created bool, err error) {
+	if req.DedupKey != "" {
+		existing, err := s.models.Command.GetActiveCommandByDedupKey(device.ID, req.DedupKey)
+		if err == nil {
+			return existing, false, nil
+		}
+		if !errors.Is(err, data.ErrNotFound) {
+			return nil, false, err
+		}
+	}
+
+	depth, err := s.models.Command.CountQueuedCommands(device.SerialNumber)
+	if err != nil {
+		return nil, false, err
+	}
+	if int(depth) >= s.queueDepth {
+		return nil, false, errCommandQueueFull
+	}
+
+	qos := s.qos
+	if req.QoS != nil {
+		qos = byte(*req.QoS)
+	}
+	ttl := s.defaultTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	expiresAt := time.Now().Add(ttl)
+
+	command = &data.Command{
+		DeviceID:     device.ID,
+		SerialNumber: device.SerialNumber,
+		Type:         req.Type,
+		Payload:      req.Payload,
+		Status:       data.CommandStatusQueued,
+		QoS:          qos,
+		DedupKey:     req.DedupKey,
+		ExpiresAt:    &expiresAt,
+		TraceParent:  injectTraceParent(ctx),
+	}
+	if err := s.models.Command.CreateCommand(command); err != nil {
+		return nil, false, err
+	}
+	s.events.Publish(TopicCommandQueued, command.SerialNumber, command)
+
+	if s.isAwake(device) {
+		// Flushing rather than delivering keeps the command behind any
+		// older ones still in the queue
+		s.flush(device.SerialNumber)
+	}
+	return command, true, nil
+}
+
+// DeviceAwake delivers the queued commands of a device that has just been
+// heard from, in order
+func (s *CommandService) DeviceAwake(serialNumber string) {
+	err := s.models.Command.LockQueue(serialNumber, func() error {
+		s.flush(serialNumber)
+		return nil
+	})
+	if err != nil {
+		s.log.Error("failed to lock command queue", "imei", serialNumber, "error", err)
+	}
+}
+
+// isAwake reports whether a device sent a message within the awake window.
+// It goes by the last_seen_at the presence service stores, so every
+// instance agrees on it.
+func (s *CommandService) isAwake(device *data.Device) bool {
+	return device.LastSeenAt != nil && time.Since(*device.LastSeenAt) < s.awakeWindow
+}
+
+// flush delivers a device's queued commands, oldest first. It stops at the
+// first failure so later commands never overtake earlier ones. The caller
+// must hold the device's queue lock.
+func (s *CommandService) flush(serialNumber string) {
+	queued, err := s.models.Command.GetQueuedCommands(serialNumber)
+	if err != nil {
+		s.log.Error("failed to load command queue", "imei", serialNumber, "error", err)
+		return
+	}
+
+	now := time.Now()
+	for _, command := range queued {
+		if command.ExpiresAt != nil && command.ExpiresAt.Before(now) {
+			// Left for the expiry loop, which publishes command.expired
+			continue
+		}
+		if err := s.deliver(command); err != nil {
+			if !errors.Is(err, data.ErrPreconditionFailed) {
+				s.log.Warn("command left queued", "command_id", command.ID, "imei", serialNumber, "error", err)
+			}
+			return
+		}
+	}
+}
+
+// handleTelemetry treats saved telemetry as a sign that the device is awake
+func (s *CommandService) handleTelemetry(event Event) error {
+	s.DeviceAwake(event.Device)
+	return nil
+}
+
+// deliver publishes a command to its device and records the attempt. The
+// command is first claimed by moving it from the status it was read with to
+// sent, so when another caller has delivered, acknowledged or expired it in
+// the meantime, data.ErrPreconditionFailed is returned and nothing is
+// published. Each attempt is a span in the trace of the request that
+// created the command.
+func (s *CommandService) deliver(command *data.Command) (err error) {
+	if !s.broker.IsConnected() {
+		return errMQTTUnavailable
+	}
+
+	topic := fmt.Sprintf(commandTopicFormat, command.SerialNumber)
+	_, span := tracer.Start(extractTraceParent(context.Background(), command.TraceParent), "send command",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "mqtt"),
+			attribute.String("messaging.destination.name", topic),
+			attribute.Int("command.id", int(command.ID)),
+			attribute.Int("command.attempt", command.Attempts+1),
+			attribute.String("imei", command.SerialNumber),
+		))
+	defer func() { endSpan(span, err) }()
+
+	// The trace context stops here. Sending it to the device needs MQTT 5
+	// user properties, which the 3.1.1 client cannot set, and the command
+	// document stays in the format devices expect.
+	message, err := json.Marshal(commandMessage{
+		ID:        command.ID,
+		Type:      command.Type,
+		Payload:   command.Payload,
+		ExpiresAt: command.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	previous := *command
+	now := time.Now()
+	command.Status = data.CommandStatusSent
+	command.Attempts++
+	command.SentAt = &now
+	command.Error = ""
+	if err := s.models.Command.UpdateCommandStatus(command, previous.Status); err != nil {
+		*command = previous
+		return err
+	}
+
+	if err := s.broker.PublishMessage(topic, command.QoS, false, message); err != nil {
+		// Hand the command back to the queue or the retry loop
+		claimed := *command
+		*command = previous
+		command.Error = err.Error()
+		if err := s.models.Command.UpdateCommandStatus(command, claimed.Status); err != nil {
+			s.log.Error("failed to record failed delivery", "command_id", command.ID, "error", err)
+		}
+		return err
+	}
+
+	s.events.Publish(TopicCommandSent, command.SerialNumber, command)
+	return nil
+}
+
+// HandleAck correlates an acknowledgement from a device with its command.
+// Only a sent command can be acknowledged; acks for any other non-final
+// status return ErrConflict.
+func (s *CommandService) HandleAck(serialNumber string, payload []byte) error {
+	var ack commandAck
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		return fmt.Errorf("invalid ack: %v", err)
+	}
+	if ack.ID == 0 {
+		return errors.New("ack without command id")
+	}
+
+	command, err := s.models.Command.GetCommand(ack.ID)
+	if err != nil {
+		return fmt.Errorf("failed to load command %d: %w", ack.ID, err)
+	}
+	if command.SerialNumber != serialNumber {
+		return fmt.Errorf("command %d does not belong to device %s", ack.ID, serialNumber)
+	}
+	if command.IsFinal() {
+		// Duplicate ack, e.g. after a retry; the first one wins
+		return nil
+	}
+	if command.Status != data.CommandStatusSent {
+		// Never published, or queued again for a sleeping device, so this
+		// ack cannot be for the delivery being tracked
+		return fmt.Errorf("%w: command %d is %s, not sent", data.ErrConflict, command.ID, command.Status)
+	}
+
+	now := time.Now()
+	command.AckedAt = &now
+	command.Result = ack.Result
+	topic := TopicCommandAcked
+	if ack.Status == "" || ack.Status == "ok" {
+		command.Status = data.CommandStatusAcked
+	} else {
+		command.Status = data.CommandStatusFailed
+		command.Error = ack.Error
+		if command.Error == "" {
+			command.Error = ack.Status
+		}
+		topic = TopicCommandFailed
+	}
+
+	err = s.models.Command.UpdateCommandStatus(command, data.CommandStatusSent)
+	if errors.Is(err, data.ErrPreconditionFailed) {
+		// Acknowledged, expired or queued again since it was read
+		return fmt.Errorf("%w: command %d is no longer sent", data.ErrConflict, command.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update command %d: %w", command.ID, err)
+	}
+
+	s.events.Publish(topic, command.SerialNumber, command)
+	return nil
+}
+
+// Run expires stale commands and redelivers unacknowledged ones while this
+// instance is the leader, until the process exits
+func (s *CommandService) Run(leader Leadership) {
+	ticker := time.NewTicker(commandRetryInterval)
+	for range ticker.C {
+		if !leader.IsLeader() {
+			continue
+		}
+		s.expire()
+		s.retry()
+	}
+}
+
+func (s *CommandService) expire() {
+	expired, err := s.models.Command.ExpireCommands(time.Now())
+	if err != nil {
+		s.log.Error("failed to expire commands", "error", err)
+		return
+	}
+	for _, command := range expired {
+		s.events.Publish(TopicCommandExpired, command.SerialNumber, command)
+	}
+}
+
+func (s *CommandService) retry() {
+	commands, err := s.models.Command.GetRetryableCommands(time.Now().Add(-s.ackTimeout))
+	if err != nil {
+		s.log.Error("failed to load commands for retry", "error", err)
+		return
+	}
+
+	for _, command := range commands {
+		var retryErr error
+		err := s.models.Command.LockQueue(command.SerialNumber, func() error {
+			retryErr = s.retryCommand(command)
+			return nil
+		})
+		if err != nil {
+			s.log.Error("failed to lock command queue", "imei", command.SerialNumber, "error", err)
+			return
+		}
+		if errors.Is(retryErr, errMQTTUnavailable) {
+			return
+		}
+	}
+}
+
+// retryCommand fails, requeues or redelivers one command. It returns
+// errMQTTUnavailable when the broker is down, which ends the retry run. The
+// caller must hold the device's queue lock.
+func (s *CommandService) retryCommand(command *data.Command) error {
+	if command.Status == data.CommandStatusSent && command.Attempts >= s.maxAttempts {
+		command.Status = data.CommandStatusFailed
+		command.Error = fmt.Sprintf("no acknowledgement after %d attempts", command.Attempts)
+		if err := s.models.Command.UpdateCommandStatus(command, data.CommandStatusSent); err != nil {
+			if !errors.Is(err, data.ErrPreconditionFailed) {
+				s.log.Error("failed to update command", "command_id", command.ID, "error", err)
+			}
+			return nil
+		}
+		s.events.Publish(TopicCommandFailed, command.SerialNumber, command)
+		return nil
+	}
+
+	if command.Status == data.CommandStatusSent && !s.deviceAwake(command) {
+		// The device went back to sleep before acknowledging; resend
+		// when it next wakes up
+		command.Status = data.CommandStatusQueued
+		err := s.models.Command.UpdateCommandStatus(command, data.CommandStatusSent)
+		if err != nil && !errors.Is(err, data.ErrPreconditionFailed) {
+			s.log.Error("failed to requeue command", "command_id", command.ID, "error", err)
+		}
+		return nil
+	}
+
+	if err := s.deliver(command); err != nil {
+		if errors.Is(err, errMQTTUnavailable) {
+			return err
+		}
+		if !errors.Is(err, data.ErrPreconditionFailed) {
+			s.log.Error("failed to redeliver command", "command_id", command.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// deviceAwake reports whether the device a command is for is awake. A
+// device that was deleted, or could not be loaded, counts as asleep.
+func (s *CommandService) deviceAwake(command *data.Command) bool {
+	device, err := s.models.Device.GetByID(command.DeviceID)
+	if err != nil {
+		if !errors.Is(err, data.ErrNotFound) {
+			s.log.Error("failed to load device", "imei", command.SerialNumber, "error", err)
+		}
+		return false
+	}
+	return s.isAwake(device)
+}
+
+// handleCommandAck processes acknowledgements published by devices. Acks
+// that could not be saved because the database was unavailable are left
+// for the broker to deliver again.
+func (m *MQTTClient) handleCommandAck(ctx context.Context, msg *deviceMessage) error {
+	if err := m.commands.HandleAck(msg.SerialNumber, msg.Payload()); err != nil {
+		m.msgLog.Warn("failed to process command ack", "topic", msg.Topic(), "imei", msg.SerialNumber, "error", err)
+		return retryableMessageError(err)
+	}
+	return nil
+}
+
+// createDeviceCommand queues a command for a device and publishes it
+func (h *APIHandler) createDeviceCommand(w http.ResponseWriter, r *http.Request) {
+	device, ok := h.deviceFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	var req commandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		writeValidationError(w, r, errs)
+		return
+	}
+
+	command, created, err := h.commands.Create(r.Context(), device, req)
+	if err != nil {
+		if errors.Is(err, errCommandQueueFull) {
+			writeError(w, r, http.StatusConflict, fmt.Sprintf("Command queue for device is full (%d commands)", h.commands.queueDepth))
+			return
+		}
+		writeDataError(w, r, err, "Failed to create command")
+		return
+	}
+
+	if !created {
+		// Deduplicated: the command already in flight is returned as is
+		writeJSON(w, http.StatusOK, command)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, command)
+}
+
+// getDeviceCommandQueue returns the commands waiting for a device to wake up,
+// in delivery order
+func (h *APIHandler) getDeviceCommandQueue(w http.ResponseWriter, r *http.Request) {
+	device, ok := h.deviceFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	queued, err := h.modelsFor(r).Command.GetQueuedCommands(device.SerialNumber)
+	if err != nil {
+		writeDataError(w, r, err, "Failed to get command queue")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"commands":  queued,
+		"depth":     len(queued),
+		"max_depth": h.commands.queueDepth,
+		"awake":     h.commands.isAwake(device),
+	})
+}
+
+// getDeviceCommands returns the command history of a device
+func (h *APIHandler) getDeviceCommands(w http.ResponseWriter, r *http.Request) {
+	device, ok := h.deviceFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 1000 {
+			writeError(w, r, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		limit = n
+	}
+
+	commands, err := h.modelsFor(r).Command.GetCommandsByDevice(device.ID, r.URL.Query().Get("status"), limit)
+	if err != nil {
+		writeDataError(w, r, err, "Failed to get commands")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"commands": commands,
+		"count":    len(commands),
+	})
+}
+
+// getDeviceCommand returns a single command of a device
+func (h *APIHandler) getDeviceCommand(w http.ResponseWriter, r *http.Request) {
+	device, ok := h.deviceFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	commandID, err := strconv.ParseUint(chi.URLParam(r, "commandID"), 10, 32)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid command ID")
+		return
+	}
+
+	command, err := h.modelsFor(r).Command.GetCommand(uint(commandID))
+	if err == nil && command.DeviceID != device.ID {
+		err = data.ErrNotFound
+	}
+	if err != nil {
+		if errors.Is(err, data.ErrNotFound) {
+			writeError(w, r, http.StatusNotFound, "Command not found")
+			return
+		}
+		writeDataError(w, r, err, "Failed to get command")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, command)
+}
+
+// deviceFromURL loads the device named by the deviceID URL parameter. It
+// writes the error response and returns false if that fails.
+func (h *APIHandler) deviceFromURL(w http.ResponseWriter, r *http.Request) (*data.Device, bool) {
+	deviceID, err := strconv.ParseUint(chi.URLParam(r, "deviceID"), 10, 32)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid device ID")
+		return nil, false
+	}
+
+	device, err := h.modelsFor(r).Device.GetByID(uint(deviceID))
+	if err != nil {
+		writeDeviceError(w, r, err, "Failed to get device")
+		return nil, false
+	}
+	return device, true
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mqtt/data"
+)
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// fakeCommandStore keeps commands in memory and applies status updates
+// conditionally, like the database does
+type fakeCommandStore struct {
+	data.CommandModel
+
+	// queueLock stands in for the per-device advisory lock
+	queueLock sync.Mutex
+
+	mu       sync.Mutex
+	commands map[uint]data.Command
+}
+
+func newFakeCommandStore(commands ...data.Command) *fakeCommandStore {
+	f := &fakeCommandStore{commands: make(map[uint]data.Command)}
+	for _, command := range commands {
+		f.commands[command.ID] = command
+	}
+	return f
+}
+
+func (f *fakeCommandStore) get(id uint) data.Command {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.commands[id]
+}
+
+func (f *fakeCommandStore) GetCommand(id uint) (*data.Command, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	command, ok := f.commands[id]
+	if !ok {
+		return nil, data.ErrNotFound
+	}
+	return &command, nil
+}
+
+func (f *fakeCommandStore) UpdateCommandStatus(command *data.Command, from ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !slices.Contains(from, f.commands[command.ID].Status) {
+		return data.ErrPreconditionFailed
+	}
+	f.commands[command.ID] = *command
+	return nil
+}
+
+func (f *fakeCommandStore) CreateCommand(command *data.Command) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	command.ID = uint(len(f.commands) + 1)
+	f.commands[command.ID] = *command
+	return nil
+}
+
+func (f *fakeCommandStore) GetQueuedCommands(serialNumber string) ([]*data.Command, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var commands []*data.Command
+	for _, command := range f.commands {
+		if command.SerialNumber == serialNumber && command.Status == data.CommandStatusQueued {
+			commands = append(commands, &command)
+		}
+	}
+	slices.SortFunc(commands, func(a, b *data.Command) int { return int(a.ID) - int(b.ID) })
+	return commands, nil
+}
+
+func (f *fakeCommandStore) CountQueuedCommands(serialNumber string) (int64, error) {
+	commands, err := f.GetQueuedCommands(serialNumber)
+	return int64(len(commands)), err
+}
+
+func (f *fakeCommandStore) LockQueue(serialNumber string, fn func() error) error {
+	f.queueLock.Lock()
+	defer f.queueLock.Unlock()
+	return fn()
+}
+
+func (f *fakeCommandStore) GetRetryableCommands(sentBefore time.Time) ([]*data.Command, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var commands []*data.Command
+	for _, command := range f.commands {
+		if command.Status == data.CommandStatusPending ||
+			(command.Status == data.CommandStatusSent && command.SentAt.Before(sentBefore)) {
+			commands = append(commands, &command)
+		}
+	}
+	return commands, nil
+}
+
+// fakeDeviceStore serves devices from memory
+type fakeDeviceStore struct {
+	data.DeviceModel
+
+	devices map[uint]*data.Device
+}
+
+func (f *fakeDeviceStore) GetByID(id uint) (*data.Device, error) {
+	device, ok := f.devices[id]
+	if !ok {
+		return nil, data.ErrNotFound
+	}
+	return device, nil
+}
+
+func (f *fakeDeviceStore) GetBySerialNumber(serialNumber string) (*data.Device, error) {
+	for _, device := range f.devices {
+		if device.SerialNumber == serialNumber {
+			return device, nil
+		}
+	}
+	return nil, data.ErrNotFound
+}
+
+// fakeBroker records published topics. onPublish, if set, runs while the
+// message is being published.
+type fakeBroker struct {
+	connected bool
+	err       error
+	onPublish func()
+
+	mu        sync.Mutex
+	published []string
+	payloads  []interface{}
+}
+
+func (b *fakeBroker) Publish(topic string, payload interface{}) error {
+	return b.PublishMessage(topic, 1, false, payload)
+}
+
+func (b *fakeBroker) PublishMessage(topic string, qos byte, retained bool, payload interface{}) error {
+	if b.err != nil {
+		return b.err
+	}
+	if b.onPublish != nil {
+		b.onPublish()
+	}
+	b.mu.Lock()
+	b.published = append(b.published, topic)
+	b.payloads = append(b.payloads, payload)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *fakeBroker) IsConnected() bool                   { return b.connected }
+func (b *fakeBroker) Subscriptions() []SubscriptionStatus { return nil }
+func (b *fakeBroker) LastMessageAt() time.Time            { return time.Time{} }
+
+func newTestCommandService(store *fakeCommandStore, broker *fakeBroker, devices ...*data.Device) *CommandService {
+	cfg := Config{
+		CommandQoS:         1,
+		CommandAckTimeout:  time.Minute,
+		CommandMaxAttempts: 3,
+		CommandDefaultTTL:  time.Hour,
+		CommandQueueDepth:  10,
+		CommandAwakeWindow: time.Minute,
+	}
+	deviceStore := &fakeDeviceStore{devices: make(map[uint]*data.Device)}
+	for _, device := range devices {
+		deviceStore.devices[device.ID] = device
+	}
+	models := &data.Models{Command: store, Device: deviceStore}
+	return NewCommandService(models, NewEventBus(discardLogger()), broker, cfg, discardLogger())
+}
+
+func TestDeliverAckDuringPublish(t *testing.T) {
+	store := newFakeCommandStore(data.Command{ID: 1, SerialNumber: "SN-1", Status: data.CommandStatusQueued})
+	broker := &fakeBroker{connected: true}
+	s := newTestCommandService(store, broker)
+	// The device acknowledges before the publish call returns
+	broker.onPublish = func() {
+		if err := s.HandleAck("SN-1", []byte(`{"id":1,"status":"ok"}`)); err != nil {
+			t.Errorf("HandleAck: %v", err)
+		}
+	}
+
+	command, _ := store.GetCommand(1)
+	if err := s.deliver(command); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	if got := store.get(1); got.Status != data.CommandStatusAcked || got.Attempts != 1 {
+		t.Fatalf("stored command = %s after %d attempts, want acked after 1", got.Status, got.Attempts)
+	}
+}
+
+func TestCommandMessage(t *testing.T) {
+	expires := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := newFakeCommandStore(data.Command{
+		ID: 1, SerialNumber: "SN-1", Type: "reboot", Payload: data.JSON(`{"delay":5}`), ExpiresAt: &expires,
+		Status:      data.CommandStatusQueued,
+		TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	})
+	broker := &fakeBroker{connected: true}
+	s := newTestCommandService(store, broker)
+
+	command := store.get(1)
+	if err := s.deliver(&command); err != nil {
+		t.Fatal(err)
+	}
+	if len(broker.payloads) != 1 {
+		t.Fatalf("published %d messages", len(broker.payloads))
+	}
+	// The document devices parse; the trace context stays on the server
+	want := `{"id":1,"type":"reboot","payload":{"delay":5},"expires_at":"2024-05-01T12:00:00Z"}`
+	if got := string(broker.payloads[0].([]byte)); got != want {
+		t.Fatalf("message = %s\nwant      %s", got, want)
+	}
+}
+
+func TestDeliverStaleCommand(t *testing.T) {
+	store := newFakeCommandStore(data.Command{ID: 1, SerialNumber: "SN-1", Status: data.CommandStatusExpired})
+	broker := &fakeBroker{connected: true}
+	s := newTestCommandService(store, broker)
+
+	stale := &data.Command{ID: 1, SerialNumber: "SN-1", Status: data.CommandStatusQueued}
+	if err := s.deliver(stale); !errors.Is(err, data.ErrPreconditionFailed) {
+		t.Fatalf("deliver = %v, want ErrPreconditionFailed", err)
+	}
+	if len(broker.published) != 0 {
+		t.Fatalf("published %v for an expired command", broker.published)
+	}
+	if got := store.get(1); got.Status != data.CommandStatusExpired {
+		t.Fatalf("stored status = %s, want expired", got.Status)
+	}
+}
+
+func TestDeliverPublishFailure(t *testing.T) {
+	store := newFakeCommandStore(data.Command{ID: 1, SerialNumber: "SN-1", Status: data.CommandStatusQueued})
+	broker := &fakeBroker{connected: true, err: errors.New("not connected")}
+	s := newTestCommandService(store, broker)
+
+	command, _ := store.GetCommand(1)
+	if err := s.deliver(command); err == nil {
+		t.Fatal("deliver succeeded")
+	}
+	got := store.get(1)
+	if got.Status != data.CommandStatusQueued || got.Attempts != 0 || got.SentAt != nil || got.Error != "not connected" {
+		t.Fatalf("stored command = %+v, want it queued again with the error", got)
+	}
+}
+
+func TestHandleAck(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   string
+		ack      string
+		want     string
+		wantErr  bool
+		conflict bool
+	}{
+		{name: "ok", status: data.CommandStatusSent, ack: `{"id":1}`, want: data.CommandStatusAcked},
+		{name: "failed", status: data.CommandStatusSent, ack: `{"id":1,"status":"busy"}`, want: data.CommandStatusFailed},
+		{name: "queued", status: data.CommandStatusQueued, ack: `{"id":1,"status":"ok"}`, want: data.CommandStatusQueued, wantErr: true, conflict: true},
+		{name: "pending", status: data.CommandStatusPending, ack: `{"id":1}`, want: data.CommandStatusPending, wantErr: true, conflict: true},
+		{name: "duplicate", status: data.CommandStatusAcked, ack: `{"id":1,"status":"busy"}`, want: data.CommandStatusAcked},
+		{name: "after expiry", status: data.CommandStatusExpired, ack: `{"id":1}`, want: data.CommandStatusExpired},
+		{name: "unknown command", status: data.CommandStatusSent, ack: `{"id":2}`, want: data.CommandStatusSent, wantErr: true},
+		{name: "no id", status: data.CommandStatusSent, ack: `{}`, want: data.CommandStatusSent, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeCommandStore(data.Command{ID: 1, SerialNumber: "SN-1", Status: tt.status})
+			s := newTestCommandService(store, &fakeBroker{connected: true})
+			err := s.HandleAck("SN-1", []byte(tt.ack))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("HandleAck = %v, want error %v", err, tt.wantErr)
+			}
+			if errors.Is(err, data.ErrConflict) != tt.conflict {
+				t.Fatalf("HandleAck = %v, want conflict %v", err, tt.conflict)
+			}
+			if got := store.get(1).Status; got != tt.want {
+				t.Fatalf("status = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleAckOtherDevice(t *testing.T) {
+	store := newFakeCommandStore(data.Command{ID: 1, SerialNumber: "SN-1", Status: data.CommandStatusSent})
+	s := newTestCommandService(store, &fakeBroker{connected: true})
+	if err := s.HandleAck("SN-2", []byte(`{"id":1}`)); err == nil {
+		t.Fatal("ack from another device was accepted")
+	}
+	if got := store.get(1).Status; got != data.CommandStatusSent {
+		t.Fatalf("status = %s, want sent", got)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	sentAt := time.Now().Add(-time.Hour)
+	store := newFakeCommandStore(data.Command{ID: 1, SerialNumber: "SN-1", Status: data.CommandStatusSent, Attempts: 3, SentAt: &sentAt})
+	broker := &fakeBroker{connected: true}
+	s := newTestCommandService(store, broker)
+
+	s.retry()
+	if got := store.get(1); got.Status != data.CommandStatusFailed || got.Error == "" {
+		t.Fatalf("stored command = %+v, want failed", got)
+	}
+	if len(broker.published) != 0 {
+		t.Fatalf("published %v", broker.published)
+	}
+}
+
+func TestRetryRequeuesForSleepingDevice(t *testing.T) {
+	sentAt := time.Now().Add(-time.Hour)
+	recently := time.Now().Add(-10 * time.Second)
+	tests := []struct {
+		name      string
+		lastSeen  *time.Time
+		want      string
+		published int
+	}{
+		{name: "asleep", lastSeen: &sentAt, want: data.CommandStatusQueued},
+		{name: "never seen", want: data.CommandStatusQueued},
+		{name: "awake", lastSeen: &recently, want: data.CommandStatusSent, published: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeCommandStore(data.Command{ID: 1, DeviceID: 5, SerialNumber: "SN-1", Status: data.CommandStatusSent, Attempts: 1, SentAt: &sentAt})
+			broker := &fakeBroker{connected: true}
+			s := newTestCommandService(store, broker, &data.Device{ID: 5, SerialNumber: "SN-1", LastSeenAt: tt.lastSeen})
+
+			s.retry()
+			if got := store.get(1).Status; got != tt.want {
+				t.Fatalf("status = %s, want %s", got, tt.want)
+			}
+			if len(broker.published) != tt.published {
+				t.Fatalf("published %v, want %d messages", broker.published, tt.published)
+			}
+		})
+	}
+}
+
+func TestCreateAcrossInstances(t *testing.T) {
+	recently := time.Now().Add(-10 * time.Second)
+	tests := []struct {
+		name      string
+		lastSeen  *time.Time
+		created   int
+		published int
+	}{
+		{name: "asleep", created: 3},
+		{name: "awake", lastSeen: &recently, created: 10, published: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeCommandStore()
+			broker := &fakeBroker{connected: true}
+			device := &data.Device{ID: 5, SerialNumber: "SN-1", LastSeenAt: tt.lastSeen}
+			var instances []*CommandService
+			for range 2 {
+				s := newTestCommandService(store, broker, device)
+				s.queueDepth = 3
+				instances = append(instances, s)
+			}
+
+			var wg sync.WaitGroup
+			var created atomic.Int32
+			for i := range 10 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, ok, err := instances[i%2].Create(context.Background(), device, commandRequest{Type: "reboot"})
+					if err != nil && !errors.Is(err, errCommandQueueFull) {
+						t.Errorf("Create: %v", err)
+					}
+					if ok {
+						created.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if n := int(created.Load()); n != tt.created {
+				t.Fatalf("created %d commands, want %d", n, tt.created)
+			}
+			if len(broker.payloads) != tt.published {
+				t.Fatalf("published %d commands, want %d", len(broker.payloads), tt.published)
+			}
+			// Flushes never overlap, so commands go out in the order they
+			// were queued
+			var last uint
+			for _, payload := range broker.payloads {
+				var message commandMessage
+				if err := json.Unmarshal(payload.([]byte), &message); err != nil {
+					t.Fatal(err)
+				}
+				if message.ID <= last {
+					t.Fatalf("command %d published after %d", message.ID, last)
+				}
+				last = message.ID
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds settings read from the environment
+type Config struct {
+	// APIToken protects streaming endpoints; empty disables the check
+	APIToken string
+
+	// DatabaseDSN is the PostgreSQL connection string; it has no default
+	DatabaseDSN string
+
+	// DBSlowQuery is the duration above which queries are logged
+	DBSlowQuery time.Duration
+
+	// TracingExporter is where spans go: "otlp", "stdout" or "none"
+	TracingExporter string
+
+	// MQTTBroker is the broker URL, with a tcp, ssl, tls, mqtts, ws or wss
+	// scheme
+	MQTTBroker   string
+	MQTTUsername string
+	MQTTPassword string
+	// TLS for ssl, tls, mqtts and wss brokers. The CA bundle replaces the
+	// system roots; the certificate and key enable mutual TLS; pins are
+	// base64 SHA-256 hashes of public keys, one of which must be in the
+	// broker's chain.
+	MQTTTLSCAFile     string
+	MQTTTLSCertFile   string
+	MQTTTLSKeyFile    string
+	MQTTTLSServerName string
+	MQTTTLSPins       []string
+
+	// MQTTClientID identifies this instance to the broker. Replicas need
+	// different IDs, or the broker disconnects one when the other connects.
+	MQTTClientID string
+	// MQTTSharedGroup, if set, makes every subscription a shared one in this
+	// group, so replicas split the messages instead of each getting a copy
+	MQTTSharedGroup string
+	// MQTTSubscriptions is the table of topic filters to subscribe to and
+	// the handler and decoder for each
+	MQTTSubscriptions []SubscriptionConfig
+	// MQTTPublishQoS is the QoS of messages published without an explicit one
+	MQTTPublishQoS byte
+	// MQTTSpoolDir is where readings are kept while the database is
+	// unavailable; empty holds up ingestion until it is back instead
+	MQTTSpoolDir string
+
+	// HealthMaxMessageAge is how long the broker may stay silent before
+	// readiness is reported as degraded; zero disables the check
+	HealthMaxMessageAge time.Duration
+
+	// Downlink commands
+	CommandQoS         byte
+	CommandAckTimeout  time.Duration
+	CommandMaxAttempts int
+	CommandDefaultTTL  time.Duration
+	CommandQueueDepth  int
+	// CommandAwakeWindow is how long after its last message a device is
+	// treated as awake and sent commands directly instead of queueing them
+	CommandAwakeWindow time.Duration
+
+	// Firmware images are stored on local disk ("local") or in an
+	// S3-compatible bucket ("s3")
+	FirmwareStorage     string
+	FirmwareDir         string
+	FirmwareS3Endpoint  string
+	FirmwareS3Bucket    string
+	FirmwareS3Region    string
+	FirmwareS3AccessKey string
+	FirmwareS3SecretKey string
+	FirmwareMaxSize     int64
+	// FirmwareBaseURL is the public URL of this API, used to build the
+	// download links sent to devices
+	FirmwareBaseURL string
+	// FirmwareSigningKey is a base64 Ed25519 public key; when set, uploads
+	// must carry a valid signature of the image
+	FirmwareSigningKey string
+
+	// Presence: a device is offline once it has missed PresenceMissedReports
+	// reports at the expected interval for its type
+	PresenceDefaultInterval time.Duration
+	PresenceIntervals       map[string]time.Duration
+	PresenceMissedReports   int
+
+	// Alert notifications. Email channels send through the SMTP server;
+	// failed deliveries are retried with backoff up to
+	// NotificationMaxAttempts times.
+	SMTPHost                string
+	SMTPPort                int
+	SMTPUsername            string
+	SMTPPassword            string
+	SMTPFrom                string
+	NotificationMaxAttempts int
+
+	// Outbound webhooks. A subscription's circuit opens for
+	// WebhookBreakerCooldown after WebhookBreakerThreshold consecutive
+	// failures; finished deliveries are purged after WebhookLogRetention.
+	WebhookMaxAttempts      int
+	WebhookBreakerThreshold int
+	WebhookBreakerCooldown  time.Duration
+	WebhookLogRetention     time.Duration
+}
+
+// loadConfig reads the configuration from environment variables
+func loadConfig() Config {
+	return Config{
+		APIToken:        envString("API_TOKEN", ""),
+		DatabaseDSN:     envString("POSTGRES_DSN", ""),
+		DBSlowQuery:     envDuration("DB_SLOW_QUERY_THRESHOLD", 200*time.Millisecond),
+		TracingExporter: envString("OTEL_TRACES_EXPORTER", "none"),
+
+		MQTTBroker:        envString("MQTT_BROKER", "tcp://localhost:1883"),
+		MQTTUsername:      envString("MQTT_USERNAME", ""),
+		MQTTPassword:      envString("MQTT_PASSWORD", ""),
+		MQTTTLSCAFile:     envString("MQTT_TLS_CA_FILE", ""),
+		MQTTTLSCertFile:   envString("MQTT_TLS_CERT_FILE", ""),
+		MQTTTLSKeyFile:    envString("MQTT_TLS_KEY_FILE", ""),
+		MQTTTLSServerName: envString("MQTT_TLS_SERVER_NAME", ""),
+		MQTTTLSPins:       envList("MQTT_TLS_PINS"),
+		MQTTClientID:      envString("MQTT_CLIENT_ID", defaultClientID()),
+		MQTTSharedGroup:   envString("MQTT_SHARED_GROUP", ""),
+		MQTTSubscriptions: envSubscriptions("MQTT_SUBSCRIPTIONS"),
+		MQTTPublishQoS:    byte(envInt("MQTT_PUBLISH_QOS", 0)),
+		MQTTSpoolDir:      envString("MQTT_SPOOL_DIR", ""),
+
+		HealthMaxMessageAge: envDuration("HEALTH_MAX_MESSAGE_AGE", 15*time.Minute),
+
+		CommandQoS:         byte(envInt("COMMAND_QOS", 1)),
+		CommandAckTimeout:  envDuration("COMMAND_ACK_TIMEOUT", 30*time.Second),
+		CommandMaxAttempts: envInt("COMMAND_MAX_ATTEMPTS", 3),
+		CommandDefaultTTL:  envDuration("COMMAND_DEFAULT_TTL", time.Hour),
+		CommandQueueDepth:  envInt("COMMAND_QUEUE_DEPTH", 50),
+		CommandAwakeWindow: envDuration("COMMAND_AWAKE_WINDOW", 30*time.Second),
+
+		FirmwareStorage:     envString("FIRMWARE_STORAGE", "local"),
+		FirmwareDir:         envString("FIRMWARE_DIR", "./firmware"),
+		FirmwareS3Endpoint:  envString("FIRMWARE_S3_ENDPOINT", ""),
+		FirmwareS3Bucket:    envString("FIRMWARE_S3_BUCKET", ""),
+		FirmwareS3Region:    envString("FIRMWARE_S3_REGION", "us-east-1"),
+		FirmwareS3AccessKey: envString("FIRMWARE_S3_ACCESS_KEY", ""),
+		FirmwareS3SecretKey: envString("FIRMWARE_S3_SECRET_KEY", ""),
+		FirmwareMaxSize:     int64(envInt("FIRMWARE_MAX_SIZE_MB", 16)) << 20,
+		FirmwareBaseURL:     envString("FIRMWARE_BASE_URL", "http://localhost:9005"),
+		FirmwareSigningKey:  envString("FIRMWARE_SIGNING_KEY", ""),
+
+		PresenceDefaultInterval: envDuration("PRESENCE_DEFAULT_INTERVAL", 15*time.Minute),
+		PresenceIntervals:       envDurationMap("PRESENCE_REPORT_INTERVALS"),
+		PresenceMissedReports:   envInt("PRESENCE_MISSED_REPORTS", 2),
+
+		SMTPHost:                envString("SMTP_HOST", ""),
+		SMTPPort:                envInt("SMTP_PORT", 587),
+		SMTPUsername:            envString("SMTP_USERNAME", ""),
+		SMTPPassword:            envString("SMTP_PASSWORD", ""),
+		SMTPFrom:                envString("SMTP_FROM", ""),
+		NotificationMaxAttempts: envInt("NOTIFICATION_MAX_ATTEMPTS", 5),
+
+		WebhookMaxAttempts:      envInt("WEBHOOK_MAX_ATTEMPTS", 8),
+		WebhookBreakerThreshold: envInt("WEBHOOK_BREAKER_THRESHOLD", 5),
+		WebhookBreakerCooldown:  envDuration("WEBHOOK_BREAKER_COOLDOWN", 5*time.Minute),
+		WebhookLogRetention:     envDuration("WEBHOOK_LOG_RETENTION", 7*24*time.Hour),
+	}
+}
+
+// envString returns the value of an environment variable or a fallback
+func envString(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envInt returns an integer environment variable or a fallback
+func envInt(key string, fallback int) int {
+	value := envString(key, "")
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("invalid setting, using default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return n
+}
+
+// envDuration returns a duration environment variable (e.g. "30s") or a fallback
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value := envString(key, "")
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("invalid setting, using default", "key", key, "value", value, "default", fallback.String())
+		return fallback
+	}
+	return d
+}
+
+// envDurationMap reads a comma-separated list of key=duration pairs, e.g.
+// "solar=1h,gateway=5m". Invalid entries are skipped with a warning.
+func envDurationMap(key string) map[string]time.Duration {
+	values := make(map[string]time.Duration)
+	for _, pair := range strings.Split(envString(key, ""), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if !ok || err != nil || d <= 0 {
+			slog.Warn("invalid setting entry, skipping", "key", key, "entry", pair)
+			continue
+		}
+		values[strings.TrimSpace(name)] = d
+	}
+	return values
+}
+
+// envList reads a comma-separated list, skipping empty entries
+func envList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(envString(key, ""), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// envSubscriptions reads the MQTT subscription table as a JSON array of
+// {"topic", "qos", "handler", "decoder"} objects, or returns the default
+// table. A table that does not parse is returned empty, which fails startup.
+func envSubscriptions(key string) []SubscriptionConfig {
+	value := envString(key, "")
+	if value == "" {
+		return defaultSubscriptions
+	}
+	var table []SubscriptionConfig
+	if err := json.Unmarshal([]byte(value), &table); err != nil {
+		slog.Error("invalid setting", "key", key, "error", err)
+		return nil
+	}
+	return table
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mqtt/data"
+)
+
+// Topics published on the event bus
+const (
+	TopicTelemetrySaved = "telemetry.saved"
+	TopicDeviceCreated  = "device.created"
+	TopicDeviceUpdated  = "device.updated"
+	TopicDeviceDeleted  = "device.deleted"
+	TopicDeviceRestored = "device.restored"
+	TopicDeviceOnline   = "device.online"
+	TopicDeviceOffline  = "device.offline"
+	TopicCommandAcked   = "command.acked"
+)
+
+// Sources of device lifecycle events
+const (
+	EventSourceAPI    = "api"
+	EventSourceImport = "import"
+	EventSourceMQTT   = "mqtt"
+)
+
+const defaultSubscriberQueue = 256
+
+// Event is a single message on the event bus. Payload is typed per topic:
+// *data.DeviceData for telemetry.saved and DeviceEvent for device.* topics.
+type Event struct {
+	ID      uint64      `json:"id"`
+	Topic   string      `json:"topic"`
+	Device  string      `json:"device,omitempty"`
+	Time    time.Time   `json:"time"`
+	Payload interface{} `json:"payload"`
+}
+
+// DeviceEvent is the payload of device lifecycle topics
+type DeviceEvent struct {
+	Device *data.Device `json:"device"`
+	Source string       `json:"source"`
+	Purged bool         `json:"purged,omitempty"`
+}
+
+// EventHandler processes one event for a subscriber. Returned errors are
+// logged and counted but never affect other subscribers.
+type EventHandler func(Event) error
+
+// EventBus is an in-process publish/subscribe bus. Every subscription gets
+// its own bounded queue and goroutine, so a slow or failing consumer only
+// loses its own events and never blocks the publisher.
+type EventBus struct {
+	mu            sync.RWMutex
+	nextID        uint64
+	subscriptions map[*Subscription]struct{}
+
+	statsMu   sync.Mutex
+	published map[string]uint64
+
+	// log is sampled, since a failing subscriber can fail on every event
+	log *slog.Logger
+}
+
+// NewEventBus creates an empty bus. Event IDs are seeded from the clock so
+// they keep increasing across restarts.
+func NewEventBus(logger *slog.Logger) *EventBus {
+	return &EventBus{
+		nextID:        uint64(time.Now().UnixMicro()),
+		subscriptions: make(map[*Subscription]struct{}),
+		published:     make(map[string]uint64),
+		log:           sampled(logger.With("component", "events")),
+	}
+}
+
+// Publish delivers an event to every subscription interested in topic
+func (b *EventBus) Publish(topic, device string, payload interface{}) Event {
+	event := Event{
+		ID:      atomic.AddUint64(&b.nextID, 1),
+		Topic:   topic,
+		Device:  device,
+		Time:    time.Now().UTC(),
+		Payload: payload,
+	}
+
+	b.statsMu.Lock()
+	b.published[topic]++
+	b.statsMu.Unlock()
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subscriptions {
+		if sub.wants(topic) {
+			sub.enqueue(event)
+		}
+	}
+	return event
+}
+
+// Subscribe registers handler for the given topics. A topic may be exact,
+// a prefix wildcard such as "device.*", or "*" for everything. queueSize
+// bounds the events waiting for the handler; 0 picks a default.
+func (b *EventBus) Subscribe(name string, topics []string, queueSize int, handler EventHandler) *Subscription {
+	if queueSize <= 0 {
+		queueSize = defaultSubscriberQueue
+	}
+
+	sub := &Subscription{
+		bus:     b,
+		name:    name,
+		topics:  topics,
+		queue:   make(chan Event, queueSize),
+		handler: handler,
+		done:    make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	b.subscriptions[sub] = struct{}{}
+	b.mu.Unlock()
+
+	go sub.run()
+	return sub
+}
+
+// Subscription is a registered consumer of the bus
+type Subscription struct {
+	bus     *EventBus
+	name    string
+	topics  []string
+	queue   chan Event
+	handler EventHandler
+	done    chan struct{}
+	once    sync.Once
+
+	delivered uint64
+	dropped   uint64
+	failed    uint64
+}
+
+// wants reports whether the subscription listens to topic
+func (s *Subscription) wants(topic string) bool {
+	for _, pattern := range s.topics {
+		if topicMatches(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue hands the event to the subscriber, dropping it if the queue is full
+func (s *Subscription) enqueue(event Event) {
+	select {
+	case s.queue <- event:
+	default:
+		if atomic.AddUint64(&s.dropped, 1)%100 == 1 {
+			s.bus.log.Warn("subscriber is falling behind, dropping events", "subscriber", s.name, "topic", event.Topic)
+		}
+	}
+}
+
+// run feeds queued events to the handler until the subscription is closed
+func (s *Subscription) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case event := <-s.queue:
+			if err := s.handle(event); err != nil {
+				atomic.AddUint64(&s.failed, 1)
+				s.bus.log.Error("subscriber failed", "subscriber", s.name, "topic", event.Topic, "event_id", event.ID, "error", err)
+				continue
+			}
+			atomic.AddUint64(&s.delivered, 1)
+		}
+	}
+}
+
+// handle calls the handler, turning a panic into an error
+func (s *Subscription) handle(event Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return s.handler(event)
+}
+
+// Close unsubscribes; events still queued are discarded
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.bus.mu.Lock()
+		delete(s.bus.subscriptions, s)
+		s.bus.mu.Unlock()
+		close(s.done)
+	})
+}
+
+// topicMatches matches a topic against an exact, "prefix.*" or "*" pattern
+func topicMatches(pattern, topic string) bool {
+	if pattern == "*" || pattern == topic {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, ".*"); ok {
+		return strings.HasPrefix(topic, prefix+".")
+	}
+	return false
+}
+
+// SubscriberStats reports the state of one subscription
+type SubscriberStats struct {
+	Name       string   `json:"name"`
+	Topics     []string `json:"topics"`
+	QueueDepth int      `json:"queue_depth"`
+	QueueSize  int      `json:"queue_size"`
+	Delivered  uint64   `json:"delivered"`
+	Dropped    uint64   `json:"dropped"`
+	Failed     uint64   `json:"failed"`
+}
+
+// BusStats reports event counts per topic and per subscriber
+type BusStats struct {
+	Published   map[string]uint64 `json:"published"`
+	Subscribers []SubscriberStats `json:"subscribers"`
+}
+
+// Stats returns a snapshot of the bus counters
+func (b *EventBus) Stats() BusStats {
+	stats := BusStats{Published: make(map[string]uint64)}
+
+	b.statsMu.Lock()
+	for topic, count := range b.published {
+		stats.Published[topic] = count
+	}
+	b.statsMu.Unlock()
+
+	b.mu.RLock()
+	for sub := range b.subscriptions {
+		stats.Subscribers = append(stats.Subscribers, SubscriberStats{
+			Name:       sub.name,
+			Topics:     sub.topics,
+			QueueDepth: len(sub.queue),
+			QueueSize:  cap(sub.queue),
+			Delivered:  atomic.LoadUint64(&sub.delivered),
+			Dropped:    atomic.LoadUint64(&sub.dropped),
+			Failed:     atomic.LoadUint64(&sub.failed),
+		})
+	}
+	b.mu.RUnlock()
+
+	sort.Slice(stats.Subscribers, func(i, j int) bool {
+		return stats.Subscribers[i].Name < stats.Subscribers[j].Name
+	})
+	return stats
+}
+
+// publishDeviceEvent emits a device lifecycle event from the REST API
+func (h *APIHandler) publishDeviceEvent(topic string, device *data.Device, source string) {
+	h.events.Publish(topic, device.SerialNumber, DeviceEvent{Device: device, Source: source})
+}
+
+// getEventStats returns the event bus counters
+func (h *APIHandler) getEventStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.events.Stats())
+}
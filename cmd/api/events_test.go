@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{pattern: "*", topic: TopicTelemetrySaved, want: true},
+		{pattern: TopicDeviceOnline, topic: TopicDeviceOnline, want: true},
+		{pattern: TopicDeviceOnline, topic: TopicDeviceOffline},
+		{pattern: "device.*", topic: TopicDeviceCreated, want: true},
+		{pattern: "device.*", topic: "device"},
+		{pattern: "device.*", topic: "devices.created"},
+		{pattern: "command.*", topic: TopicCommandAcked, want: true},
+		{pattern: "device.cre*", topic: TopicDeviceCreated},
+	}
+	for _, tt := range tests {
+		if got := topicMatches(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("topicMatches(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+// receive waits for the next event on ch
+func receive(t *testing.T, ch <-chan Event) Event {
+	t.Helper()
+	select {
+	case event := <-ch:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+		return Event{}
+	}
+}
+
+func TestEventBusRouting(t *testing.T) {
+	bus := NewEventBus(discardLogger())
+	devices := make(chan Event, 10)
+	everything := make(chan Event, 10)
+	bus.Subscribe("devices", []string{"device.*"}, 0, func(event Event) error {
+		devices <- event
+		return nil
+	})
+	bus.Subscribe("everything", []string{"*"}, 0, func(event Event) error {
+		everything <- event
+		return nil
+	})
+
+	first := bus.Publish(TopicDeviceCreated, "SN-1", nil)
+	second := bus.Publish(TopicTelemetrySaved, "SN-1", nil)
+	if second.ID <= first.ID {
+		t.Fatalf("event IDs %d then %d do not increase", first.ID, second.ID)
+	}
+
+	if event := receive(t, devices); event.ID != first.ID || event.Device != "SN-1" {
+		t.Fatalf("devices got %+v", event)
+	}
+	for _, want := range []uint64{first.ID, second.ID} {
+		if event := receive(t, everything); event.ID != want {
+			t.Fatalf("everything got event %d, want %d in order", event.ID, want)
+		}
+	}
+	select {
+	case event := <-devices:
+		t.Fatalf("devices got %s", event.Topic)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stats := bus.Stats()
+	if stats.Published[TopicDeviceCreated] != 1 || stats.Published[TopicTelemetrySaved] != 1 {
+		t.Fatalf("published = %v", stats.Published)
+	}
+	if len(stats.Subscribers) != 2 || stats.Subscribers[0].Name != "devices" || stats.Subscribers[0].Delivered != 1 {
+		t.Fatalf("subscribers = %+v", stats.Subscribers)
+	}
+}
+
+func TestEventBusIsolatesSubscribers(t *testing.T) {
+	bus := NewEventBus(discardLogger())
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	// A stuck subscriber with room for one queued event
+	bus.Subscribe("stuck", []string{"*"}, 1, func(event Event) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+	failures := 0
+	failing := bus.Subscribe("failing", []string{"*"}, 0, func(event Event) error {
+		failures++
+		if failures == 1 {
+			panic("boom")
+		}
+		return errors.New("failed")
+	})
+	healthy := make(chan Event, 10)
+	bus.Subscribe("healthy", []string{"*"}, 0, func(event Event) error {
+		healthy <- event
+		return nil
+	})
+
+	bus.Publish(TopicTelemetrySaved, "SN-1", nil)
+	<-started
+	done := make(chan struct{})
+	go func() {
+		for range 4 {
+			bus.Publish(TopicTelemetrySaved, "SN-1", nil)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stuck subscriber blocked the publisher")
+	}
+	for range 5 {
+		receive(t, healthy)
+	}
+
+	failed := func() uint64 {
+		for _, sub := range bus.Stats().Subscribers {
+			if sub.Name == "failing" {
+				return sub.Failed
+			}
+		}
+		return 0
+	}
+	for deadline := time.Now().Add(5 * time.Second); failed() != 5; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("failing subscriber failed %d times, want 5", failed())
+		}
+	}
+	for _, sub := range bus.Stats().Subscribers {
+		// One event is being handled and one queued; the rest are dropped
+		if sub.Name == "stuck" && sub.Dropped != 3 {
+			t.Fatalf("stuck subscriber dropped %d events, want 3", sub.Dropped)
+		}
+	}
+
+	failing.Close()
+	failing.Close()
+	if n := len(bus.Stats().Subscribers); n != 2 {
+		t.Fatalf("%d subscribers after Close, want 2", n)
+	}
+}
+
+func TestEventFeedReplay(t *testing.T) {
+	feed := newEventFeed(NewEventBus(discardLogger()), 3)
+	for id := uint64(1); id <= 5; id++ {
+		feed.handle(Event{ID: id, Topic: TopicTelemetrySaved})
+	}
+
+	tests := []struct {
+		name    string
+		lastID  uint64
+		want    []uint64
+		resumed bool
+	}{
+		{name: "no last ID", lastID: 0, resumed: true},
+		{name: "latest", lastID: 5, resumed: true},
+		{name: "within the ring", lastID: 4, want: []uint64{5}, resumed: true},
+		{name: "oldest in the ring", lastID: 3, want: []uint64{4, 5}, resumed: true},
+		{name: "evicted", lastID: 2},
+		{name: "from another instance", lastID: 99},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replay, resumed, _, cancel := feed.subscribe(tt.lastID)
+			defer cancel()
+			if resumed != tt.resumed {
+				t.Fatalf("resumed = %v, want %v", resumed, tt.resumed)
+			}
+			var got []uint64
+			for _, event := range replay {
+				got = append(got, event.ID)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("replayed %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("replayed %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	// A new instance has nothing to resume from
+	empty := newEventFeed(NewEventBus(discardLogger()), 3)
+	_, resumed, _, cancel := empty.subscribe(5)
+	cancel()
+	if resumed {
+		t.Fatal("resumed from an empty feed")
+	}
+	if id := empty.latestID(); id != 0 {
+		t.Fatalf("latestID = %d, want 0", id)
+	}
+}
+
+func TestEventFeedClients(t *testing.T) {
+	feed := newEventFeed(NewEventBus(discardLogger()), eventReplaySize)
+	_, _, live, cancel := feed.subscribe(0)
+	_, _, slow, _ := feed.subscribe(0)
+
+	// The slow connection never reads, so it is closed once its queue is
+	// full while the live one keeps receiving
+	for id := uint64(1); id <= sseConnectionQueue+1; id++ {
+		feed.handle(Event{ID: id, Topic: TopicDeviceOnline, Device: "SN-1"})
+		if event := receive(t, live); event.ID != id {
+			t.Fatalf("got %+v", event)
+		}
+	}
+	for range sseConnectionQueue {
+		<-slow
+	}
+	if _, ok := <-slow; ok {
+		t.Fatal("slow connection was not dropped")
+	}
+
+	cancel()
+	cancel()
+	if _, ok := <-live; ok {
+		t.Fatal("channel still open after cancel")
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	feed := newEventFeed(NewEventBus(discardLogger()), eventReplaySize)
+	feed.handle(Event{ID: 1, Topic: TopicTelemetrySaved, Device: "SN-1"})
+	feed.handle(Event{ID: 2, Topic: TopicDeviceOnline, Device: "SN-1"})
+	feed.handle(Event{ID: 3, Topic: TopicTelemetrySaved, Device: "SN-2"})
+	h := &APIHandler{feed: feed}
+	first := "1"
+
+	tests := []struct {
+		name        string
+		query       string
+		lastEventID string
+		status      int
+		want        []string
+	}{
+		{name: "no resume", status: http.StatusOK},
+		{name: "resume", lastEventID: first, status: http.StatusOK, want: []string{"event: device.online\n", "event: telemetry.saved\n"}},
+		{name: "resume by parameter", query: "?last_event_id=" + first, status: http.StatusOK, want: []string{"event: device.online\n", "event: telemetry.saved\n"}},
+		{name: "types", query: "?types=telemetry.saved", lastEventID: first, status: http.StatusOK, want: []string{"event: telemetry.saved\n"}},
+		{name: "type wildcard", query: "?types=device.*", lastEventID: first, status: http.StatusOK, want: []string{"event: device.online\n"}},
+		{name: "devices", query: "?devices=SN-1", lastEventID: first, status: http.StatusOK, want: []string{"event: device.online\n"}},
+		{name: "unknown id", lastEventID: "99", status: http.StatusOK, want: []string{"id: 3\nevent: resync\ndata: {\"last_event_id\":\"99\"}\n"}},
+		{name: "unknown id with types", query: "?types=device.*", lastEventID: "99", status: http.StatusOK, want: []string{"event: resync\n"}},
+		{name: "invalid id", lastEventID: "x", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The request is already cancelled, so the handler writes the
+			// replay and returns
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/events"+tt.query, nil).WithContext(ctx)
+			if tt.lastEventID != "" {
+				r.Header.Set("Last-Event-ID", tt.lastEventID)
+			}
+			w := httptest.NewRecorder()
+			h.streamEvents(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			body := w.Body.String()
+			if !strings.HasPrefix(body, "retry: ") {
+				t.Fatalf("body = %q", body)
+			}
+			if n := strings.Count(body, "id: "); n != len(tt.want) {
+				t.Fatalf("body = %q, want %d events", body, len(tt.want))
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Fatalf("body = %q, want %q", body, want)
+				}
+			}
+		})
+	}
+}
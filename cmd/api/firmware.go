@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"mqtt/data"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var firmwareVersionPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.+-]{0,19}$`)
+
+// FirmwareService stores firmware images and runs update campaigns
+type FirmwareService struct {
+	models     *data.Models
+	log        *slog.Logger
+	events     *EventBus
+	commands   *CommandService
+	store      firmwareStore
+	maxSize    int64
+	baseURL    string
+	signingKey ed25519.PublicKey
+
+	// mu serialises campaign state changes between the API, bus events and
+	// the rollout loop
+	mu sync.Mutex
+}
+
+// NewFirmwareService creates the firmware service from the configuration
+// and subscribes it to the events that drive campaign progress
+func NewFirmwareService(models *data.Models, events *EventBus, commands *CommandService, cfg Config, logger *slog.Logger) (*FirmwareService, error) {
+	store, err := newFirmwareStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FirmwareService{
+		models:   models,
+		log:      logger.With("component", "firmware"),
+		events:   events,
+		commands: commands,
+		store:    store,
+		maxSize:  cfg.FirmwareMaxSize,
+		baseURL:  strings.TrimSuffix(cfg.FirmwareBaseURL, "/"),
+	}
+	if cfg.FirmwareSigningKey != "" {
+		key, err := base64.StdEncoding.DecodeString(cfg.FirmwareSigningKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("FIRMWARE_SIGNING_KEY must be a base64 Ed25519 public key")
+		}
+		s.signingKey = ed25519.PublicKey(key)
+	}
+
+	events.Subscribe("campaigns", []string{TopicTelemetrySaved, TopicCommandFailed, TopicCommandExpired}, 0, s.handleEvent)
+	return s, nil
+}
+
+// downloadURL returns the URL devices fetch an artifact from
+func (s *FirmwareService) downloadURL(artifact *data.FirmwareArtifact) string {
+	return fmt.Sprintf("%s/api/v1/firmware/%d/download", s.baseURL, artifact.ID)
+}
+
+// uploadFirmware stores a firmware image sent as multipart/form-data with
+// the fields device_type, version, file and optionally sha256, signature
+// and notes
+func (h *APIHandler) uploadFirmware(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, h.firmware.maxSize+1<<20)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("Firmware images are limited to %d bytes", h.firmware.maxSize))
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, "Expected a multipart/form-data body")
+		return
+	}
+
+	artifact := &data.FirmwareArtifact{
+		DeviceType: strings.TrimSpace(r.FormValue("device_type")),
+		Version:    strings.TrimSpace(r.FormValue("version")),
+		Signature:  strings.TrimSpace(r.FormValue("signature")),
+		Notes:      strings.TrimSpace(r.FormValue("notes")),
+	}
+	errs := fieldErrors{}
+	if !deviceTypePattern.MatchString(artifact.DeviceType) || len(artifact.DeviceType) > 50 {
+		errs["device_type"] = "is required and may only contain letters, digits, '.', '_' and '-'"
+	}
+	if !firmwareVersionPattern.MatchString(artifact.Version) {
+		errs["version"] = "is required and must be at most 20 letters, digits, '.', '_', '+' or '-'"
+	}
+	if len(artifact.Notes) > 1000 {
+		errs["notes"] = "must be at most 1000 characters"
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		errs["file"] = "is required"
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, r, errs)
+		return
+	}
+	defer file.Close()
+
+	image, err := io.ReadAll(io.LimitReader(file, h.firmware.maxSize+1))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Failed to read firmware image")
+		return
+	}
+	switch {
+	case len(image) == 0:
+		errs["file"] = "must not be empty"
+	case int64(len(image)) > h.firmware.maxSize:
+		errs["file"] = fmt.Sprintf("must be at most %d bytes", h.firmware.maxSize)
+	}
+
+	sum := sha256.Sum256(image)
+	artifact.SHA256 = hex.EncodeToString(sum[:])
+	if expected := strings.ToLower(strings.TrimSpace(r.FormValue("sha256"))); expected != "" && expected != artifact.SHA256 {
+		errs["sha256"] = "does not match the uploaded file"
+	}
+
+	if h.firmware.signingKey != nil {
+		signature, err := base64.StdEncoding.DecodeString(artifact.Signature)
+		if artifact.Signature == "" {
+			errs["signature"] = "is required"
+		} else if err != nil || !ed25519.Verify(h.firmware.signingKey, image, signature) {
+			errs["signature"] = "is not a valid signature of the file"
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, r, errs)
+		return
+	}
+
+	artifact.Filename = header.Filename
+	artifact.Size = int64(len(image))
+	artifact.StorageKey = fmt.Sprintf("%s/%s/firmware.bin", artifact.DeviceType, artifact.Version)
+
+	// Store the metadata first so a duplicate version is rejected before
+	// the existing image is overwritten
+	if err := h.modelsFor(r).Firmware.CreateArtifact(artifact); err != nil {
+		if errors.Is(err, data.ErrConflict) {
+			writeError(w, r, http.StatusConflict, fmt.Sprintf("Firmware %s already exists for %s", artifact.Version, artifact.DeviceType))
+			return
+		}
+		writeDataError(w, r, err, "Failed to save firmware")
+		return
+	}
+	if err := h.firmware.store.Put(r.Context(), artifact.StorageKey, image); err != nil {
+		h.modelsFor(r).Firmware.DeleteArtifact(artifact.ID)
+		writeDataError(w, r, err, "Failed to store firmware image")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, artifact)
+}
+
+// getFirmwareArtifacts lists uploaded firmware, optionally for one device_type
+func (h *APIHandler) getFirmwareArtifacts(w http.ResponseWriter, r *http.Request) {
+	artifacts, err := h.modelsFor(r).Firmware.GetArtifacts(r.URL.Query().Get("device_type"))
+	if err != nil {
+		writeDataError(w, r, err, "Failed to get firmware")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"firmware": artifacts,
+		"count":    len(artifacts),
+	})
+}
+
+// getFirmwareArtifact returns the metadata of one firmware image
+func (h *APIHandler) getFirmwareArtifact(w http.ResponseWriter, r *http.Request) {
+	artifact, ok := h.artifactFromURL(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, artifact)
+}
+
+// downloadFirmware serves a firmware image to devices
+func (h *APIHandler) downloadFirmware(w http.ResponseWriter, r *http.Request) {
+	artifact, ok := h.artifactFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	image, err := h.firmware.store.Open(r.Context(), artifact.StorageKey)
+	if errors.Is(err, data.ErrNotFound) {
+		writeError(w, r, http.StatusNotFound, "Firmware image not found")
+		return
+	}
+	if err != nil {
+		writeDataError(w, r, err, "Failed to open firmware image")
+		return
+	}
+	defer image.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(artifact.Size, 10))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.bin"`, artifact.DeviceType, artifact.Version))
+	w.Header().Set("ETag", `"`+artifact.SHA256+`"`)
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, image)
+}
+
+// deleteFirmwareArtifact removes a firmware image that no campaign uses
+func (h *APIHandler) deleteFirmwareArtifact(w http.ResponseWriter, r *http.Request) {
+	artifact, ok := h.artifactFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.modelsFor(r).Firmware.DeleteArtifact(artifact.ID); err != nil {
+		if errors.Is(err, data.ErrConflict) {
+			writeError(w, r, http.StatusConflict, "Firmware is used by a campaign")
+			return
+		}
+		writeDataError(w, r, err, "Failed to delete firmware")
+		return
+	}
+	if err := h.firmware.store.Delete(r.Context(), artifact.StorageKey); err != nil {
+		requestLogger(r).Warn("failed to delete firmware image", "storage_key", artifact.StorageKey, "error", err)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Firmware deleted successfully"})
+}
+
+// artifactFromURL loads the artifact named by the artifactID URL parameter.
+// It writes the error response and returns false if that fails.
+func (h *APIHandler) artifactFromURL(w http.ResponseWriter, r *http.Request) (*data.FirmwareArtifact, bool) {
+	artifactID, err := strconv.ParseUint(chi.URLParam(r, "artifactID"), 10, 32)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid firmware ID")
+		return nil, false
+	}
+
+	artifact, err := h.modelsFor(r).Firmware.GetArtifact(uint(artifactID))
+	if err != nil {
+		if errors.Is(err, data.ErrNotFound) {
+			writeError(w, r, http.StatusNotFound, "Firmware not found")
+			return nil, false
+		}
+		writeDataError(w, r, err, "Failed to get firmware")
+		return nil, false
+	}
+	return artifact, true
+}
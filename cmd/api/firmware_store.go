@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"mqtt/data"
+)
+
+// firmwareStore keeps firmware images. Keys are chosen by the server and
+// look like "{device_type}/{version}/firmware.bin".
+type firmwareStore interface {
+	Put(ctx context.Context, key string, image []byte) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// newFirmwareStore creates the store selected by FIRMWARE_STORAGE
+func newFirmwareStore(cfg Config) (firmwareStore, error) {
+	switch cfg.FirmwareStorage {
+	case "local", "":
+		if err := os.MkdirAll(cfg.FirmwareDir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create firmware directory: %v", err)
+		}
+		return &localFirmwareStore{dir: cfg.FirmwareDir}, nil
+	case "s3":
+		if cfg.FirmwareS3Endpoint == "" || cfg.FirmwareS3Bucket == "" {
+			return nil, errors.New("FIRMWARE_S3_ENDPOINT and FIRMWARE_S3_BUCKET are required for s3 storage")
+		}
+		endpoint, err := url.Parse(cfg.FirmwareS3Endpoint)
+		if err != nil || endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid FIRMWARE_S3_ENDPOINT %q", cfg.FirmwareS3Endpoint)
+		}
+		return &s3FirmwareStore{
+			endpoint:  endpoint,
+			bucket:    cfg.FirmwareS3Bucket,
+			region:    cfg.FirmwareS3Region,
+			accessKey: cfg.FirmwareS3AccessKey,
+			secretKey: cfg.FirmwareS3SecretKey,
+			client:    &http.Client{Timeout: 5 * time.Minute},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown FIRMWARE_STORAGE %q (use local or s3)", cfg.FirmwareStorage)
+}
+
+// localFirmwareStore keeps images in a directory on local disk
+type localFirmwareStore struct {
+	dir string
+}
+
+func (s *localFirmwareStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s *localFirmwareStore) Put(ctx context.Context, key string, image []byte) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a reader never sees half an image
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(image); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localFirmwareStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	image, err := os.Open(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: firmware image %s", data.ErrNotFound, key)
+	}
+	return image, err
+}
+
+func (s *localFirmwareStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// s3FirmwareStore keeps images in an S3-compatible bucket (AWS S3, MinIO,
+// DigitalOcean Spaces, ...) using path-style requests signed with AWS
+// Signature Version 4
+type s3FirmwareStore struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func (s *s3FirmwareStore) Put(ctx context.Context, key string, image []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, key, image)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3FirmwareStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3FirmwareStore) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a signed request for an object and fails on non-2xx responses,
+// with data.ErrNotFound for a missing object
+func (s *s3FirmwareStore) do(ctx context.Context, method, key string, body []byte) (*http.Response, error) {
+	objectURL := *s.endpoint
+	objectURL.Path = strings.TrimSuffix(objectURL.Path, "/") + "/" + s.bucket + "/" + key
+	objectURL.RawPath = s3EscapePath(objectURL.Path)
+
+	req, err := http.NewRequestWithContext(ctx, method, objectURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if method == http.MethodPut {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: s3 object %s", data.ErrNotFound, key)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+// sign adds AWS Signature Version 4 headers to req
+func (s *s3FirmwareStore) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+// s3EscapePath percent-encodes an object key as SigV4 expects, keeping the
+// slashes between segments
+func s3EscapePath(key string) string {
+	var b strings.Builder
+	for _, c := range []byte(key) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
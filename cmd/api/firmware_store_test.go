@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"mqtt/data"
+)
+
+func TestLocalFirmwareStore(t *testing.T) {
+	store := &localFirmwareStore{dir: t.TempDir()}
+	ctx := context.Background()
+
+	if _, err := store.Open(ctx, "logger/1.0.0/firmware.bin"); !errors.Is(err, data.ErrNotFound) {
+		t.Fatalf("Open of a missing image = %v, want ErrNotFound", err)
+	}
+	if err := store.Put(ctx, "logger/1.0.0/firmware.bin", []byte("image")); err != nil {
+		t.Fatal(err)
+	}
+	image, err := store.Open(ctx, "logger/1.0.0/firmware.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(image)
+	image.Close()
+	if string(content) != "image" {
+		t.Fatalf("content = %q", content)
+	}
+	if err := store.Delete(ctx, "logger/1.0.0/firmware.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(ctx, "logger/1.0.0/firmware.bin"); err != nil {
+		t.Fatalf("deleting a missing image = %v", err)
+	}
+}
+
+func TestS3Sign(t *testing.T) {
+	endpoint, _ := url.Parse("https://s3.example.com")
+	store := &s3FirmwareStore{
+		endpoint:  endpoint,
+		bucket:    "firmware",
+		region:    "us-east-1",
+		accessKey: "AKIDEXAMPLE",
+		secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://s3.example.com/firmware/logger/1.0.0/firmware.bin", nil)
+	store.sign(req, nil, time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC))
+
+	emptyHash := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	if got := req.Header.Get("X-Amz-Content-Sha256"); got != emptyHash {
+		t.Errorf("payload hash = %s", got)
+	}
+	if got := req.Header.Get("X-Amz-Date"); got != "20240501T123000Z" {
+		t.Errorf("date = %s", got)
+	}
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240501/us-east-1/s3/aws4_request, " +
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date, " +
+		"Signature=49e6479c33ed99ac1cff3ba91a5d6d2f2dbfeb38b933e8c92edd97ccceaf3f47"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization = %s\nwant            %s", got, want)
+	}
+}
+
+func TestS3EscapePath(t *testing.T) {
+	tests := map[string]string{
+		"/firmware/logger/1.0.0/firmware.bin": "/firmware/logger/1.0.0/firmware.bin",
+		"/firmware/my logger/a+b/x~y_z.bin":   "/firmware/my%20logger/a%2Bb/x~y_z.bin",
+		"/firmware/ü":                         "/firmware/%C3%BC",
+	}
+	for key, want := range tests {
+		if got := s3EscapePath(key); got != want {
+			t.Errorf("s3EscapePath(%q) = %s, want %s", key, got, want)
+		}
+	}
+}
+
+func TestS3FirmwareStore(t *testing.T) {
+	objects := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+			http.Error(w, "unsigned request", http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = string(body)
+		case http.MethodGet:
+			object, ok := objects[r.URL.Path]
+			if !ok {
+				http.Error(w, "NoSuchKey", http.StatusNotFound)
+				return
+			}
+			io.WriteString(w, object)
+		case http.MethodDelete:
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	endpoint, _ := url.Parse(server.URL)
+	store := &s3FirmwareStore{endpoint: endpoint, bucket: "firmware", region: "us-east-1", accessKey: "key", secretKey: "secret", client: server.Client()}
+	ctx := context.Background()
+
+	if err := store.Put(ctx, "logger/1.0.0/firmware.bin", []byte("image")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := objects["/firmware/logger/1.0.0/firmware.bin"]; !ok {
+		t.Fatalf("objects = %v", objects)
+	}
+	image, err := store.Open(ctx, "logger/1.0.0/firmware.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(image)
+	image.Close()
+	if string(content) != "image" {
+		t.Fatalf("content = %q", content)
+	}
+	if err := store.Delete(ctx, "logger/1.0.0/firmware.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Open(ctx, "logger/1.0.0/firmware.bin"); !errors.Is(err, data.ErrNotFound) {
+		t.Fatalf("Open of a missing object = %v, want ErrNotFound", err)
+	}
+
+	store.accessKey = "other"
+	if err := store.Put(ctx, "logger/1.0.0/firmware.bin", nil); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("Put with a rejected signature = %v, want a 403 error", err)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"mqtt/data"
+)
+
+// Health states, from best to worst. A degraded service still serves
+// traffic; an unhealthy one is not ready.
+const (
+	HealthHealthy   = "healthy"
+	HealthDegraded  = "degraded"
+	HealthUnhealthy = "unhealthy"
+)
+
+const (
+	// healthDBTimeout bounds the database ping
+	healthDBTimeout = 2 * time.Second
+	// healthQueueHighWater is the fraction of an event queue that may fill
+	// before ingestion is reported as degraded
+	healthQueueHighWater = 0.8
+)
+
+// ComponentHealth is the state of one dependency
+type ComponentHealth struct {
+	Status  string                 `json:"status"`
+	Message string                 `json:"message,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// HealthReport is the readiness of the service as a whole, which is the
+// worst state of its components
+type HealthReport struct {
+	Status     string                     `json:"status"`
+	Service    string                     `json:"service"`
+	Timestamp  time.Time                  `json:"timestamp"`
+	Components map[string]ComponentHealth `json:"components"`
+}
+
+// HealthChecker checks whether the service can ingest telemetry: the
+// database answers, the broker connection is up, the telemetry subscription
+// is in place, event queues are draining and messages are arriving.
+type HealthChecker struct {
+	models        *data.Models
+	events        *EventBus
+	broker        BrokerStatus
+	log           *slog.Logger
+	maxMessageAge time.Duration
+
+	mu         sync.Mutex
+	lastStatus string
+}
+
+// NewHealthChecker creates a health checker. Silence on the broker for
+// longer than cfg.HealthMaxMessageAge degrades readiness.
+func NewHealthChecker(models *data.Models, events *EventBus, broker BrokerStatus, cfg Config, logger *slog.Logger) *HealthChecker {
+	return &HealthChecker{
+		models:        models,
+		events:        events,
+		broker:        broker,
+		log:           logger.With("component", "health"),
+		maxMessageAge: cfg.HealthMaxMessageAge,
+		lastStatus:    HealthHealthy,
+	}
+}
+
+// Check runs every component check and logs when the overall state changes
+func (c *HealthChecker) Check(ctx context.Context) HealthReport {
+	report := HealthReport{
+		Status:    HealthHealthy,
+		Service:   "mqtt-backend",
+		Timestamp: time.Now().UTC(),
+		Components: map[string]ComponentHealth{
+			"database":      c.checkDatabase(ctx),
+			"mqtt":          c.checkMQTT(),
+			"subscriptions": c.checkSubscriptions(),
+			"ingest_queue":  c.checkIngestQueue(),
+			"last_message":  c.checkLastMessage(),
+		},
+	}
+	for _, component := range report.Components {
+		report.Status = worseHealth(report.Status, component.Status)
+	}
+
+	c.mu.Lock()
+	changed := report.Status != c.lastStatus
+	c.lastStatus = report.Status
+	c.mu.Unlock()
+	if changed {
+		attrs := []any{"status", report.Status}
+		for name, component := range report.Components {
+			if component.Status != HealthHealthy {
+				attrs = append(attrs, name, component.Message)
+			}
+		}
+		if report.Status == HealthHealthy {
+			c.log.Info("health changed", attrs...)
+		} else {
+			c.log.Warn("health changed", attrs...)
+		}
+	}
+	return report
+}
+
+func (c *HealthChecker) checkDatabase(ctx context.Context) ComponentHealth {
+	ctx, cancel := context.WithTimeout(ctx, healthDBTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := c.models.Ping(ctx); err != nil {
+		return ComponentHealth{Status: HealthUnhealthy, Message: fmt.Sprintf("ping failed: %v", err)}
+	}
+	return ComponentHealth{
+		Status:  HealthHealthy,
+		Details: map[string]interface{}{"ping_ms": float64(time.Since(start).Microseconds()) / 1000},
+	}
+}
+
+func (c *HealthChecker) checkMQTT() ComponentHealth {
+	if !c.broker.IsConnected() {
+		return ComponentHealth{Status: HealthUnhealthy, Message: "not connected to broker"}
+	}
+	return ComponentHealth{Status: HealthHealthy}
+}
+
+// checkSubscriptions requires at least one telemetry subscription; losing
+// any other subscription degrades the service
+func (c *HealthChecker) checkSubscriptions() ComponentHealth {
+	health := ComponentHealth{Status: HealthHealthy, Details: make(map[string]interface{})}
+	telemetry := false
+	for _, sub := range c.broker.Subscriptions() {
+		if sub.Err != nil {
+			health.Details[sub.Topic] = sub.Err.Error()
+			health.Status = worseHealth(health.Status, HealthDegraded)
+			continue
+		}
+		health.Details[sub.Topic] = "subscribed"
+		if sub.Handler == HandlerTelemetry {
+			telemetry = true
+		}
+	}
+	if !telemetry {
+		health.Status = HealthUnhealthy
+		health.Message = "not subscribed to any telemetry topic"
+	} else if health.Status != HealthHealthy {
+		health.Message = "some subscriptions failed"
+	}
+	return health
+}
+
+// checkIngestQueue reports event bus consumers whose queues are nearly full,
+// since events are dropped once a queue fills up
+func (c *HealthChecker) checkIngestQueue() ComponentHealth {
+	health := ComponentHealth{Status: HealthHealthy, Details: make(map[string]interface{})}
+	var backedUp []string
+	for _, sub := range c.events.Stats().Subscribers {
+		health.Details[sub.Name] = map[string]int{"queue_depth": sub.QueueDepth, "queue_size": sub.QueueSize}
+		if float64(sub.QueueDepth) >= healthQueueHighWater*float64(sub.QueueSize) {
+			backedUp = append(backedUp, sub.Name)
+		}
+	}
+	if len(backedUp) > 0 {
+		sort.Strings(backedUp)
+		health.Status = HealthDegraded
+		health.Message = fmt.Sprintf("event queues nearly full: %v", backedUp)
+	}
+	return health
+}
+
+// checkLastMessage degrades the service when nothing has arrived from the
+// broker for too long. It does not make it unhealthy, since every device
+// may legitimately be asleep.
+func (c *HealthChecker) checkLastMessage() ComponentHealth {
+	lastMessage := c.broker.LastMessageAt()
+	age := time.Since(lastMessage)
+	health := ComponentHealth{
+		Status: HealthHealthy,
+		Details: map[string]interface{}{
+			"last_message_at": lastMessage.UTC(),
+			"age_seconds":     int(age.Seconds()),
+		},
+	}
+	if c.maxMessageAge > 0 && age > c.maxMessageAge {
+		health.Status = HealthDegraded
+		health.Message = fmt.Sprintf("no message received for %s", age.Truncate(time.Second))
+	}
+	return health
+}
+
+// worseHealth returns the worse of two health states
+func worseHealth(a, b string) string {
+	rank := map[string]int{HealthHealthy: 0, HealthDegraded: 1, HealthUnhealthy: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// liveness reports that the process is up and serving requests. It checks
+// no dependencies, so a broken database never gets the process restarted.
+func (h *APIHandler) liveness(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    HealthHealthy,
+		"service":   "mqtt-backend",
+		"timestamp": time.Now().UTC(),
+	})
+}
+
+// readiness reports the health of every dependency, with 503 Service
+// Unavailable when any is unhealthy
+func (h *APIHandler) readiness(w http.ResponseWriter, r *http.Request) {
+	report := h.health.Check(r.Context())
+	status := http.StatusOK
+	if report.Status == HealthUnhealthy {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"mqtt/data"
+)
+
+const (
+	// leaderLockName names the advisory lock held by the leader
+	leaderLockName = "mqtt-backend/singleton-jobs"
+	// leaderCheckInterval is how often the lock is taken or checked, and so
+	// how long a new leader may take to step in
+	leaderCheckInterval = 10 * time.Second
+)
+
+// Leadership tells background jobs that must run on one instance at a
+// time whether this instance runs them
+type Leadership interface {
+	IsLeader() bool
+}
+
+// leaderLock is the lock instances compete for to lead; a
+// *data.AdvisoryLock outside tests
+type leaderLock interface {
+	TryAcquire(ctx context.Context) (bool, error)
+	Release()
+}
+
+// LeaderElector elects one of the running instances, through a Postgres
+// advisory lock, to run the singleton background jobs: command retries and
+// expiry, campaigns, the presence sweep and notification and webhook
+// delivery. When the leader stops or loses its database connection, another
+// instance takes the lock within leaderCheckInterval.
+type LeaderElector struct {
+	lock   leaderLock
+	log    *slog.Logger
+	leader atomic.Bool
+}
+
+// NewLeaderElector creates an elector. It does not try to lead until Run
+// is called.
+func NewLeaderElector(models *data.Models, logger *slog.Logger) *LeaderElector {
+	return &LeaderElector{
+		lock: models.AdvisoryLock(leaderLockName),
+		log:  logger.With("component", "leader"),
+	}
+}
+
+// IsLeader reports whether this instance runs the singleton jobs
+func (e *LeaderElector) IsLeader() bool {
+	return e.leader.Load()
+}
+
+// Run takes the lead whenever it is free and checks that it is still held
+// until the process exits
+func (e *LeaderElector) Run() {
+	e.check()
+	ticker := time.NewTicker(leaderCheckInterval)
+	for range ticker.C {
+		e.check()
+	}
+}
+
+func (e *LeaderElector) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), leaderCheckInterval/2)
+	defer cancel()
+	held, err := e.lock.TryAcquire(ctx)
+	if err != nil {
+		e.log.Error("failed to check leader lock", "error", err)
+	}
+	if held == e.leader.Swap(held) {
+		return
+	}
+	if held {
+		leaderGauge.Set(1)
+		e.log.Info("became leader, running singleton jobs")
+	} else {
+		leaderGauge.Set(0)
+		e.log.Warn("lost leadership, stopping singleton jobs")
+	}
+}
+
+// Resign gives up the lead so another instance can take over straight
+// away, for use on shutdown
+func (e *LeaderElector) Resign() {
+	if e.leader.Swap(false) {
+		leaderGauge.Set(0)
+		e.log.Info("resigned leadership")
+	}
+	e.lock.Release()
+}
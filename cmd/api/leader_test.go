@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// fakeLockServer grants one lock to one holder at a time, like Postgres
+// does for advisory locks
+type fakeLockServer struct {
+	mu     sync.Mutex
+	holder *fakeLock
+}
+
+// fakeLock is one instance's handle on the lock. down makes its session
+// fail, as when the instance loses its database connection.
+type fakeLock struct {
+	server *fakeLockServer
+	down   bool
+}
+
+func (l *fakeLock) TryAcquire(ctx context.Context) (bool, error) {
+	l.server.mu.Lock()
+	defer l.server.mu.Unlock()
+	if l.down {
+		if l.server.holder == l {
+			// The database ends the session and frees the lock
+			l.server.holder = nil
+		}
+		return false, errors.New("connection refused")
+	}
+	if l.server.holder == nil {
+		l.server.holder = l
+	}
+	return l.server.holder == l, nil
+}
+
+func (l *fakeLock) Release() {
+	l.server.mu.Lock()
+	defer l.server.mu.Unlock()
+	if l.server.holder == l {
+		l.server.holder = nil
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	// Each step acts on instance a or b, then every running instance checks
+	// the lock in turn, a first. Resigning is how an instance shuts down,
+	// so it stops checking.
+	tests := []struct {
+		name  string
+		steps []string
+		want  [2]bool
+	}{
+		{name: "first to check leads", want: [2]bool{true, false}},
+		{name: "leader keeps the lead", steps: []string{"check", "check"}, want: [2]bool{true, false}},
+		{name: "resign hands over", steps: []string{"resign a"}, want: [2]bool{false, true}},
+		{name: "lost connection hands over", steps: []string{"down a"}, want: [2]bool{false, true}},
+		{name: "old leader waits its turn", steps: []string{"down a", "up a"}, want: [2]bool{false, true}},
+		{name: "both down", steps: []string{"down a", "down b"}, want: [2]bool{false, false}},
+		{name: "back after an outage", steps: []string{"down a", "down b", "up a"}, want: [2]bool{true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &fakeLockServer{}
+			locks := [2]*fakeLock{{server: server}, {server: server}}
+			var electors [2]*LeaderElector
+			for i, lock := range locks {
+				electors[i] = &LeaderElector{lock: lock, log: discardLogger()}
+			}
+			var stopped [2]bool
+			check := func() {
+				for i, elector := range electors {
+					if !stopped[i] {
+						elector.check()
+					}
+				}
+			}
+
+			check()
+			for _, step := range tt.steps {
+				i := 0
+				if step[len(step)-1] == 'b' {
+					i = 1
+				}
+				switch step[:len(step)-2] {
+				case "resign":
+					electors[i].Resign()
+					stopped[i] = true
+				case "down":
+					locks[i].down = true
+				case "up":
+					locks[i].down = false
+				}
+				check()
+			}
+
+			for i, elector := range electors {
+				if elector.IsLeader() != tt.want[i] {
+					t.Fatalf("instance %d leading = %v, want %v", i, elector.IsLeader(), tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are log attribute keys whose values are never written
+var sensitiveKeys = map[string]bool{
+	"password":      true,
+	"secret":        true,
+	"token":         true,
+	"api_token":     true,
+	"access_token":  true,
+	"authorization": true,
+	"dsn":           true,
+}
+
+// passwordPattern matches the password of a key/value connection string,
+// e.g. "host=db password=secret" or "password='two words'"
+var passwordPattern = regexp.MustCompile(`(?i)(\bpassword\s*=\s*)('(?:[^'\\]|\\.)*'|[^\s&]+)`)
+
+// newLogger returns the JSON logger passed to every component. level is
+// debug, info, warn or error; anything else means info.
+func newLogger(w io.Writer, level string) *slog.Logger {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		lvl = slog.LevelInfo
+	}
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       lvl,
+		ReplaceAttr: redactAttr,
+	}))
+}
+
+// redactAttr hides sensitive attributes and passwords embedded in URLs or
+// key/value connection strings
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+	if a.Value.Kind() != slog.KindString {
+		return a
+	}
+	value := a.Value.String()
+	if strings.Contains(value, "://") {
+		value = redactURL(value)
+	}
+	if passwordPattern.MatchString(value) {
+		value = passwordPattern.ReplaceAllString(value, "${1}"+redacted)
+	}
+	if value != a.Value.String() {
+		return slog.String(a.Key, value)
+	}
+	return a
+}
+
+// redactURL masks the password of a URL such as a DSN or broker address
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Redacted()
+}
+
+// databaseTarget returns the host and database name of a PostgreSQL
+// connection string, in URL or key/value form, as log attributes. Nothing
+// else from it is logged.
+func databaseTarget(dsn string) []any {
+	cfg, err := pgconn.ParseConfig(dsn)
+	if err != nil {
+		return []any{"host", "unknown"}
+	}
+	return []any{"host", cfg.Host, "port", cfg.Port, "database", cfg.Database}
+}
+
+// redactPayload hides the device token in a URL-encoded telemetry payload
+// and shortens it for logging
+func redactPayload(payload []byte) string {
+	const maxLen = 512
+	s := string(payload)
+	if i := strings.Index(s, "tkn="); i >= 0 && (i == 0 || s[i-1] == '&') {
+		end := strings.IndexByte(s[i:], '&')
+		if end < 0 {
+			end = len(s) - i
+		}
+		s = s[:i] + "tkn=" + redacted + s[i+end:]
+	}
+	if len(s) > maxLen {
+		s = s[:maxLen] + "..."
+	}
+	return s
+}
+
+// Sampling: in every period, the first logSampleFirst records with the same
+// message are written, then one in logSampleThereafter
+const (
+	logSamplePeriod     = time.Second
+	logSampleFirst      = 10
+	logSampleThereafter = 100
+)
+
+// sampled returns a logger for high-volume paths, such as per-message
+// ingestion, that drops repeated records. Errors are never dropped.
+func sampled(logger *slog.Logger) *slog.Logger {
+	return slog.New(&samplingHandler{
+		Handler: logger.Handler(),
+		sampler: &logSampler{counts: make(map[string]int)},
+	})
+}
+
+type samplingHandler struct {
+	slog.Handler
+	sampler *logSampler
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelError && !h.sampler.allow(r.Message, r.Time) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithAttrs(attrs), sampler: h.sampler}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithGroup(name), sampler: h.sampler}
+}
+
+// logSampler counts records per message in the current period
+type logSampler struct {
+	mu     sync.Mutex
+	start  time.Time
+	counts map[string]int
+}
+
+func (s *logSampler) allow(message string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.start) >= logSamplePeriod {
+		s.start = now
+		clear(s.counts)
+	}
+	s.counts[message]++
+	n := s.counts[message]
+	return n <= logSampleFirst || (n-logSampleFirst)%logSampleThereafter == 0
+}
+
+type loggerKey struct{}
+
+// requestLogger returns the logger for a request, carrying its request_id
+func requestLogger(r *http.Request) *slog.Logger {
+	if logger, ok := r.Context().Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// logRequests adds a request logger to the context and logs every request
+// when it finishes. Only the path is logged, since query strings may carry
+// access tokens.
+func (h *APIHandler) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		logger := h.log.With("request_id", middleware.GetReqID(r.Context())).With(traceAttrs(r.Context())...)
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), loggerKey{}, logger)))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		route := ""
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			route = rctx.RoutePattern()
+		}
+		logger.Log(r.Context(), level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", route,
+			"status", status,
+			"bytes", ww.BytesWritten(),
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"remote_addr", r.RemoteAddr)
+	})
+}
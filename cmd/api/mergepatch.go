@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// mergePatchContentType is the media type of RFC 7396 JSON Merge Patch bodies
+const mergePatchContentType = "application/merge-patch+json"
+
+// applyMergePatch applies an RFC 7396 JSON Merge Patch to a JSON document
+// and returns the patched document
+func applyMergePatch(document, patch []byte) ([]byte, error) {
+	var target interface{}
+	if len(document) > 0 {
+		if err := json.Unmarshal(document, &target); err != nil {
+			return nil, err
+		}
+	}
+
+	var p interface{}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, err
+	}
+	if _, ok := p.(map[string]interface{}); !ok {
+		return nil, errors.New("merge patch must be a JSON object")
+	}
+
+	return json.Marshal(mergePatch(target, p))
+}
+
+// mergePatch implements the MergePatch algorithm from RFC 7396 section 2
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = mergePatch(targetObject[key], value)
+	}
+	return targetObject
+}
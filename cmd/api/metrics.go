@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"mqtt/data"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics served on /metrics. Database query latency is recorded by the
+// data package.
+var (
+	mqttConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mqtt_connected",
+		Help: "1 while the MQTT broker connection is up, 0 otherwise.",
+	})
+	mqttReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_reconnects_total",
+		Help: "Reconnections to the MQTT broker after a lost connection.",
+	})
+	mqttMessagesDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_messages_dropped_total",
+		Help: "QoS 0 MQTT messages dropped because the handler queue was full.",
+	})
+	mqttMessagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_messages_received_total",
+		Help: "MQTT messages received, by subscription topic filter.",
+	}, []string{"topic"})
+	telemetryParseFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "telemetry_parse_failures_total",
+		Help: "Telemetry messages dropped because they could not be parsed, by reason.",
+	}, []string{"reason"})
+	telemetryIngestDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "telemetry_ingest_duration_seconds",
+		Help:    "Time from receiving a telemetry message to publishing the saved reading.",
+		Buckets: prometheus.DefBuckets,
+	})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request duration, by method, route pattern and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+	leaderGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "leader",
+		Help: "1 while this instance runs the singleton background jobs, 0 otherwise.",
+	})
+)
+
+// Reasons counted by telemetry_parse_failures_total
+const (
+	parseFailureMalformed      = "malformed"
+	parseFailureMissingSerial  = "missing_serial"
+	parseFailureSerialMismatch = "serial_mismatch"
+)
+
+// registerDeviceMetrics adds the gauges that read the database on scrape
+func registerDeviceMetrics(models *data.Models) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "devices_online",
+		Help: "Devices currently online.",
+	}, func() float64 {
+		count, err := models.Device.CountDevicesByPresence(true)
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(count)
+	})
+}
+
+// registerSpoolMetrics adds the gauge for readings waiting in the spool
+func registerSpoolMetrics(spool *telemetrySpool) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "telemetry_spool_entries",
+		Help: "Telemetry readings spooled to disk while the database was unavailable.",
+	}, func() float64 {
+		return float64(spool.Len())
+	})
+}
+
+// instrumentRequests records the duration of every request under its chi
+// route pattern, so path parameters do not create new series
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequestDuration.WithLabelValues(r.Method, route, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestInstrumentRequests(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(instrumentRequests)
+	r.Get("/test/devices/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	for _, path := range []string{"/test/devices/1", "/test/devices/2", "/test/nothing"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(w.Body)
+	for _, want := range []string{
+		`http_request_duration_seconds_count{method="GET",route="/test/devices/{id}",status="418"} 2`,
+		`http_request_duration_seconds_count{method="GET",route="unmatched",status="404"} 1`,
+		"# TYPE mqtt_connected gauge",
+		"# TYPE leader gauge",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics do not contain %q", want)
+		}
+	}
+}
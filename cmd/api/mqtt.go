@@ -1,60 +1,167 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"mqtt/data"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const (
-	clientID = "devices_api_render"
-	topic    = "device/logs"
-)
+// clientIDPrefix starts the default client ID, which ends with the host name
+// so that replicas do not take over each other's connection
+const clientIDPrefix = "devices_api_render"
 
-// MQTT Topics
+// Waits between attempts at a message whose handler fails
 const (
-	mqttTopicLED  = "led_control"
-	mqttTopicData = "sensor_data"
+	messageRetryBaseBackoff = time.Second
+	messageRetryMaxBackoff  = 30 * time.Second
 )
 
-var brokerURL = "tcp://localhost:1883"
-var mqttUser = "hassan"
-var mqttPass = "ha55an"
+// messageQueueSize bounds the received messages waiting for the handler
+// worker. It is well above common broker inflight limits for QoS 1 and 2
+// (Mosquitto's default is 20), so normally only QoS 0 messages can find it
+// full, and those are dropped.
+const messageQueueSize = 1024
 
 type MQTTClient struct {
-	client     mqtt.Client
-	topicRoot  string
-	bufferSize int
-	models     *data.Models
+	client mqtt.Client
+	// routes is the subscription table; messages go to the first match
+	routes []*subscription
+	// tls is nil for a plain broker connection
+	tls *brokerTLS
+	// sharedGroup is the shared subscription group, or "" to subscribe
+	// normally
+	sharedGroup string
+	// publishQoS is the QoS of Publish
+	publishQoS byte
+	// spool holds readings received while the database was unavailable,
+	// or is nil if MQTT_SPOOL_DIR is not set
+	spool *telemetrySpool
+	// messageRetry is the first wait before a failed message is handled
+	// again
+	messageRetry time.Duration
+	// queue holds received messages for the handler worker, so the paho
+	// callback never waits on a handler
+	queue chan mqtt.Message
+	// stopped is closed by CloseConnection and ends the handler worker and
+	// message retries
+	stopped chan struct{}
+
+	models   *data.Models
+	events   *EventBus
+	commands *CommandService
+	shadows  *ShadowService
+	presence *PresenceService
+	log      *slog.Logger
+	// msgLog is sampled, for logging on every received message
+	msgLog *slog.Logger
+
+	// subscriptions holds the result of the last subscribe to each topic
+	// filter, reported by the readiness check
+	subscriptionsMu sync.Mutex
+	subscriptions   []SubscriptionStatus
+	// lastMessage is when a message was last received, in Unix nanoseconds;
+	// it starts when the client is created
+	lastMessage atomic.Int64
 }
 
-// Message buffer for reassembling multi-part messages
-type messageBuffer struct {
-	Parts        map[int][]byte
-	TotalParts   int
-	ReceivedTime time.Time
-	IsComplete   bool
+// Publisher publishes messages to devices through the broker
+type Publisher interface {
+	Publish(topic string, payload interface{}) error
+	PublishMessage(topic string, qos byte, retained bool, payload interface{}) error
 }
 
-// Map to store message buffers by device serial number
-var messageBuffers = make(map[string]*messageBuffer)
+// BrokerStatus reports the state of the broker connection
+type BrokerStatus interface {
+	IsConnected() bool
+	Subscriptions() []SubscriptionStatus
+	LastMessageAt() time.Time
+}
+
+// Broker is a broker connection, implemented by MQTTClient
+type Broker interface {
+	Publisher
+	BrokerStatus
+}
 
-func NewMQTTClient(models *data.Models) (*MQTTClient, error) {
-	// Connect to external MQTT server
-	mqttBroker := "tcp://157.230.113.253:1883"
+// NewMQTTClient creates a client for the broker with the subscription
+// table in cfg. It does not connect until Start is called.
+func NewMQTTClient(models *data.Models, events *EventBus, cfg Config, logger *slog.Logger) (*MQTTClient, error) {
+	mqttBroker := cfg.MQTTBroker
+	logger = logger.With("component", "mqtt")
+
+	m := &MQTTClient{
+		sharedGroup:  cfg.MQTTSharedGroup,
+		publishQoS:   cfg.MQTTPublishQoS,
+		messageRetry: messageRetryBaseBackoff,
+		queue:        make(chan mqtt.Message, messageQueueSize),
+		stopped:      make(chan struct{}),
+		models:       models,
+		events:       events,
+		log:          logger,
+		msgLog:       sampled(logger),
+	}
+	if cfg.MQTTClientID == "" {
+		return nil, errors.New("MQTT_CLIENT_ID is empty")
+	}
+	if strings.ContainsAny(m.sharedGroup, "/+#") {
+		return nil, fmt.Errorf("invalid MQTT_SHARED_GROUP %q, it may not contain /, + or #", m.sharedGroup)
+	}
+	secure, err := newBrokerTLS(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	m.tls = secure
+	if m.publishQoS > 2 {
+		return nil, fmt.Errorf("invalid MQTT_PUBLISH_QOS %d", m.publishQoS)
+	}
+	if cfg.MQTTSpoolDir != "" {
+		spool, err := newTelemetrySpool(cfg.MQTTSpoolDir)
+		if err != nil {
+			return nil, err
+		}
+		m.spool = spool
+		registerSpoolMetrics(spool)
+	}
+	m.lastMessage.Store(time.Now().UnixNano())
+
+	routes, err := newSubscriptions(cfg.MQTTSubscriptions, map[string]messageHandlerSpec{
+		HandlerTelemetry:      {handle: m.handleDeviceData},
+		HandlerLEDControl:     {handle: m.handleLEDControl},
+		HandlerCommandAck:     {handle: m.handleCommandAck, needsSerial: true},
+		HandlerBirth:          {handle: m.handleBirth, needsSerial: true},
+		HandlerLWT:            {handle: m.handleLWT, needsSerial: true},
+		HandlerShadowReported: {handle: m.handleShadowReported, needsSerial: true},
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.routes = routes
 
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(mqttBroker)
-	opts.SetClientID(clientID)
-	opts.SetUsername("hassan")
-	opts.SetPassword("ha55an")
+	opts.SetClientID(cfg.MQTTClientID)
+	opts.SetUsername(cfg.MQTTUsername)
+	opts.SetPassword(cfg.MQTTPassword)
+	if m.tls != nil {
+		opts.SetTLSConfig(m.tls.Config())
+	}
 	opts.SetKeepAlive(20 * time.Second)  // More frequent keep-alive
 	opts.SetPingTimeout(5 * time.Second) // Shorter ping timeout
 	opts.SetConnectTimeout(20 * time.Second)
@@ -64,49 +171,115 @@ func NewMQTTClient(models *data.Models) (*MQTTClient, error) {
 	opts.SetConnectRetry(true)
 	opts.SetConnectRetryInterval(3 * time.Second) // Faster retry
 	opts.SetResumeSubs(true)                      // Resume subscriptions after reconnect
+	// Messages are acknowledged by the handler worker once they are saved,
+	// so a crash before then gets them delivered again
+	opts.SetAutoAckDisabled(true)
+	opts.SetDefaultPublishHandler(m.dispatch)
 	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
-		fmt.Printf("MQTT connection lost: %v", err)
+		mqttConnected.Set(0)
+		logger.Warn("connection lost", "broker", mqttBroker, "error", err)
 	})
 
+	// Subscriptions are made on every connection, since the first one may
+	// only succeed long after startup
+	var connectedBefore atomic.Bool
 	opts.SetOnConnectHandler(func(client mqtt.Client) {
-		fmt.Printf("MQTT connection established successfully")
+		mqttConnected.Set(1)
+		if connectedBefore.Swap(true) {
+			mqttReconnects.Inc()
+		}
+		logger.Info("connected", "broker", mqttBroker, "client_id", cfg.MQTTClientID)
+		m.subscribe()
 	})
 
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		return nil, fmt.Errorf("failed to connect: %v", token.Error())
-	}
+	m.client = mqtt.NewClient(opts)
+	return m, nil
+}
 
-	return &MQTTClient{
-		client:     client,
-		topicRoot:  topic,
-		bufferSize: 4096,
-		models:     models,
-	}, nil
+// defaultClientID returns a client ID unique to this host. Where the host
+// name is unknown, a random suffix is used, which starts a new session on
+// every restart.
+func defaultClientID() string {
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return clientIDPrefix + "-" + hostname
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return clientIDPrefix + "-" + hex.EncodeToString(suffix)
 }
 
-func (m *MQTTClient) Subscribe(topic string, handler mqtt.MessageHandler) error {
-	if token := m.client.Subscribe(topic, 0, handler); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("subscribe error: %v", token.Error())
+// Start connects to the broker in the background, retrying until it is
+// reachable, so the API keeps serving while the broker is down. Command
+// acknowledgements, birth and last will messages and shadow reports are
+// handed to the given services.
+func (m *MQTTClient) Start(commands *CommandService, shadows *ShadowService, presence *PresenceService) {
+	m.commands = commands
+	m.shadows = shadows
+	m.presence = presence
+
+	// Handle received messages in order, off the client's callback goroutine
+	go m.processMessages()
+
+	token := m.client.Connect()
+	go func() {
+		// With connect retry on, this only fails once the client is closed
+		if token.Wait() && token.Error() != nil {
+			m.log.Warn("stopped connecting to broker", "error", token.Error())
+		}
+	}()
+
+	// Start a goroutine to monitor MQTT connection health
+	go m.monitorConnection()
+
+	// Start a goroutine to pick up rotated certificates
+	if m.tls != nil {
+		go m.tls.watch()
+	}
+
+	// Start a goroutine to save spooled readings once the database is back
+	if m.spool != nil {
+		go m.replaySpool()
 	}
-	return nil
 }
 
+// Subscriptions returns the result of the last subscribe to each filter in
+// the subscription table, or nothing before the first connection
+func (m *MQTTClient) Subscriptions() []SubscriptionStatus {
+	m.subscriptionsMu.Lock()
+	defer m.subscriptionsMu.Unlock()
+	return append([]SubscriptionStatus(nil), m.subscriptions...)
+}
+
+// LastMessageAt returns when a message was last received, or when the
+// client was created if none has been
+func (m *MQTTClient) LastMessageAt() time.Time {
+	return time.Unix(0, m.lastMessage.Load())
+}
+
+// Publish publishes with the QoS set by MQTT_PUBLISH_QOS
 func (m *MQTTClient) Publish(topic string, payload interface{}) error {
-	if token := m.client.Publish(topic, 0, false, payload); token.Wait() && token.Error() != nil {
+	return m.PublishMessage(topic, m.publishQoS, false, payload)
+}
+
+// PublishMessage publishes with an explicit QoS and retain flag
+func (m *MQTTClient) PublishMessage(topic string, qos byte, retained bool, payload interface{}) error {
+	if token := m.client.Publish(topic, qos, retained, payload); token.Wait() && token.Error() != nil {
 		return fmt.Errorf("publish error: %v", token.Error())
 	}
 	return nil
 }
+
+// IsConnected reports whether the connection to the broker is up. Unlike
+// the paho client's IsConnected it is false while connecting or reconnecting.
 func (m *MQTTClient) IsConnected() bool {
-	return m.client != nil && m.client.IsConnected()
+	return m.client.IsConnectionOpen()
 }
 
-// CloseConnection gracefully closes the MQTT connection
+// CloseConnection gracefully closes the MQTT connection, or stops trying
+// to connect
 func (m *MQTTClient) CloseConnection() {
-	if m.client.IsConnected() {
-		m.client.Disconnect(250) // Wait 250ms for graceful disconnect
-	}
+	close(m.stopped)
+	m.client.Disconnect(250) // Wait 250ms for graceful disconnect
 }
 
 // parseDeviceData parses the URL-encoded device data format
@@ -333,122 +506,197 @@ func parseSensorArray(arrayStr string) [2]float64 {
 }
 
 // handleDeviceData processes incoming device data messages
-func (m *MQTTClient) handleDeviceData(client mqtt.Client, msg mqtt.Message) {
-	fmt.Printf("Received MQTT message on topic: %s\n", msg.Topic())
-	fmt.Printf("Message payload: %s\n", string(msg.Payload()))
+func (m *MQTTClient) handleDeviceData(ctx context.Context, msg *deviceMessage) error {
+	received := time.Now()
+	span := trace.SpanFromContext(ctx)
+	log := m.msgLog.With("topic", msg.Topic()).With(traceAttrs(ctx)...)
+	log.Debug("message received", "bytes", len(msg.Payload()), "payload", redactPayload(msg.Payload()))
 
-	// Try to parse as URL-encoded data first
-	deviceData, err := parseDeviceData(string(msg.Payload()))
+	deviceData, err := m.parseMessage(ctx, msg.decoder, msg.Payload())
 	if err != nil {
-		fmt.Printf("URL parsing failed, trying JSON: %v\n", err)
-		// If URL parsing fails, try JSON parsing
-		if err := json.Unmarshal(msg.Payload(), &deviceData); err != nil {
-			fmt.Printf("JSON parsing also failed: %v\n", err)
-			fmt.Printf("Raw message: %s\n", string(msg.Payload()))
-			return
+		log.Warn("dropping malformed device data", "error", err, "payload", redactPayload(msg.Payload()))
+		telemetryParseFailures.WithLabelValues(parseFailureMalformed).Inc()
+		endSpan(span, err)
+		return nil
+	}
+	// A serial number in the topic fills in or must agree with the payload
+	if msg.SerialNumber != "" {
+		switch deviceData.SerialNumber {
+		case "":
+			deviceData.SerialNumber = msg.SerialNumber
+			if deviceData.IMEI == "" {
+				deviceData.IMEI = msg.SerialNumber
+			}
+		case msg.SerialNumber:
+		default:
+			log.Warn("dropping device data for another device than its topic", "imei", deviceData.SerialNumber, "topic_serial", msg.SerialNumber)
+			telemetryParseFailures.WithLabelValues(parseFailureSerialMismatch).Inc()
+			endSpan(span, errors.New("device data serial number does not match its topic"))
+			return nil
 		}
 	}
+	if deviceData.SerialNumber == "" {
+		log.Warn("dropping device data without an IMEI or serial number")
+		telemetryParseFailures.WithLabelValues(parseFailureMissingSerial).Inc()
+		endSpan(span, errors.New("device data without an IMEI or serial number"))
+		return nil
+	}
 
-	fmt.Printf("Successfully parsed device data from IMEI: %s\n", deviceData.IMEI)
-
-	if err := m.processDeviceData(deviceData); err != nil {
-		fmt.Printf("Error processing device data: %v", err)
+	span.SetAttributes(attribute.String("imei", deviceData.SerialNumber))
+	log = log.With("imei", deviceData.SerialNumber)
+	if err := m.processDeviceData(ctx, deviceData); err != nil {
+		endSpan(span, err)
+		if !errors.Is(err, data.ErrUnavailable) {
+			// Retrying would fail the same way
+			log.Error("failed to process device data, dropping it", "error", err)
+			return nil
+		}
+		if m.spool == nil {
+			return err
+		}
+		if spoolErr := m.spool.Add(deviceData); spoolErr != nil {
+			return fmt.Errorf("%w; spooling failed: %v", err, spoolErr)
+		}
+		log.Warn("database unavailable, device data spooled", "error", err)
+		return nil
 	}
+	elapsed := time.Since(received)
+	telemetryIngestDuration.Observe(elapsed.Seconds())
+	log.Debug("device data saved", "duration_ms", float64(elapsed.Microseconds())/1000)
+	return nil
+}
+
+// parseMessage parses a telemetry payload with the subscription's decoder
+func (m *MQTTClient) parseMessage(ctx context.Context, decode telemetryDecoder, payload []byte) (*data.DeviceData, error) {
+	_, span := tracer.Start(ctx, "parse device data")
+	deviceData, err := decode(payload)
+	endSpan(span, err)
+	return deviceData, err
 }
 
 // handleLEDControl processes LED control messages
-func (m *MQTTClient) handleLEDControl(client mqtt.Client, msg mqtt.Message) {
-	fmt.Printf("Received MQTT message on topic: %s\n", msg.Topic())
-	fmt.Printf("LED control message payload: %s\n", string(msg.Payload()))
-	// TODO: Implement LED control processing
-	// You can add logic here to control LEDs based on the message content
+func (m *MQTTClient) handleLEDControl(ctx context.Context, msg *deviceMessage) error {
+	m.msgLog.Info("LED control message", "topic", msg.Topic(), "payload", redactPayload(msg.Payload()))
+	// LEDs and relays are controlled per device through the command API
+	// (POST /api/v1/devices/{id}/commands); this topic is only logged.
+	return nil
 }
 
-// processDeviceData processes device data and saves to database
-func (m *MQTTClient) processDeviceData(logEntry *data.DeviceData) error {
-	// Check if the device exists
-	device, err := m.models.Device.GetBySerialNumber(logEntry.SerialNumber)
+// processDeviceData processes device data and saves to database. The
+// lookup, registration and insert are traced under ctx.
+func (m *MQTTClient) processDeviceData(ctx context.Context, logEntry *data.DeviceData) error {
+	device, err := m.lookupDevice(ctx, logEntry.SerialNumber)
 	if err != nil {
-		// Auto-register the device
-		device = &data.Device{
-			DeviceType:   "auto_registered",
-			SerialNumber: logEntry.SerialNumber,
-		}
-		if err := m.models.Device.CreateDevice(device); err != nil {
-			return fmt.Errorf("failed to auto-register device: %v", err)
-		}
-		fmt.Printf("Auto-registered device: %s", logEntry.SerialNumber)
+		return err
 	}
 
 	// Link the log entry to the device
 	logEntry.DeviceID = device.ID
 
 	// Save the log entry
-	if err := m.models.DeviceData.CreateLog(logEntry); err != nil {
-		return fmt.Errorf("failed to save device data: %v", err)
+	insertCtx, span := tracer.Start(ctx, "insert device data")
+	err = m.models.WithContext(insertCtx).DeviceData.CreateLog(logEntry)
+	if err != nil {
+		err = fmt.Errorf("failed to save device data: %w", err)
+	} else {
+		span.SetAttributes(attribute.Int("device_data.id", int(logEntry.ID)))
+	}
+	endSpan(span, err)
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("Successfully logged data for device: %s", logEntry.SerialNumber)
+	// Hand the reading to streaming, alerting and other consumers
+	m.events.Publish(TopicTelemetrySaved, logEntry.SerialNumber, logEntry)
 	return nil
 }
-func (m *MQTTClient) StartDeviceDataListener() error {
-	// Subscribe to sensor data topic
-	if err := m.Subscribe(mqttTopicData, m.handleDeviceData); err != nil {
-		return fmt.Errorf("failed to subscribe to topic %s: %v", mqttTopicData, err)
-	}
-	fmt.Printf("MQTT client subscribed to topic: %s\n", mqttTopicData)
 
-	// Add a small delay between subscriptions to avoid overwhelming the connection
-	time.Sleep(1 * time.Second)
+// lookupDevice returns the device with a serial number, registering it if
+// it has not been seen before
+func (m *MQTTClient) lookupDevice(ctx context.Context, serialNumber string) (device *data.Device, err error) {
+	ctx, span := tracer.Start(ctx, "device lookup")
+	defer func() { endSpan(span, err) }()
 
-	// Subscribe to LED control topic
-	if err := m.Subscribe(mqttTopicLED, m.handleLEDControl); err != nil {
-		// Log the error but don't fail the entire process
-		fmt.Printf("Warning: Failed to subscribe to topic %s: %v\n", mqttTopicLED, err)
-		fmt.Printf("Continuing with sensor data subscription only...\n")
-	} else {
-		fmt.Printf("MQTT client subscribed to topic: %s\n", mqttTopicLED)
+	// Check if the device exists
+	device, err = m.models.WithContext(ctx).Device.GetBySerialNumber(serialNumber)
+	if err == nil {
+		return device, nil
 	}
+	if !errors.Is(err, data.ErrNotFound) {
+		return nil, fmt.Errorf("failed to look up device: %w", err)
+	}
+	span.SetAttributes(attribute.Bool("device.registered", true))
+	return m.registerDevice(ctx, serialNumber)
+}
 
-	// Start a goroutine to clean up stale message buffers
-	go m.cleanupStaleBuffers()
-
-	// Start a goroutine to monitor MQTT connection health
-	go m.monitorConnection()
+// registerDevice auto-registers a device seen for the first time. If the
+// serial number belongs to a soft-deleted device, that device is restored
+// instead so the unique serial index does not block it forever.
+func (m *MQTTClient) registerDevice(ctx context.Context, serialNumber string) (device *data.Device, err error) {
+	ctx, span := tracer.Start(ctx, "device register")
+	defer func() { endSpan(span, err) }()
+	models := m.models.WithContext(ctx)
+
+	deleted, err := models.Device.GetDeletedBySerialNumber(serialNumber)
+	if err == nil {
+		device, err := models.Device.RestoreDevice(deleted.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore deleted device: %w", err)
+		}
+		m.log.Info("restored soft-deleted device", "imei", serialNumber)
+		m.events.Publish(TopicDeviceRestored, serialNumber, DeviceEvent{Device: device, Source: EventSourceMQTT})
+		return device, nil
+	}
+	if !errors.Is(err, data.ErrNotFound) {
+		return nil, fmt.Errorf("failed to look up deleted device: %w", err)
+	}
 
-	return nil
+	device = &data.Device{
+		DeviceType:   "auto_registered",
+		SerialNumber: serialNumber,
+	}
+	if err := models.Device.CreateDevice(device); err != nil {
+		if errors.Is(err, data.ErrConflict) {
+			// Registered concurrently by another message
+			return models.Device.GetBySerialNumber(serialNumber)
+		}
+		return nil, fmt.Errorf("failed to auto-register device: %w", err)
+	}
+	m.log.Info("auto-registered device", "imei", serialNumber)
+	m.events.Publish(TopicDeviceCreated, serialNumber, DeviceEvent{Device: device, Source: EventSourceMQTT})
+	return device, nil
 }
 
-func (m *MQTTClient) cleanupStaleBuffers() {
-	ticker := time.NewTicker(10 * time.Minute)
+// replaySpool saves spooled readings once the database takes writes again
+func (m *MQTTClient) replaySpool() {
+	ticker := time.NewTicker(spoolReplayInterval)
 	for range ticker.C {
-		now := time.Now()
-		for serialNumber, buffer := range messageBuffers {
-			// If buffer is older than 1 hour and not complete, remove it
-			if now.Sub(buffer.ReceivedTime) > time.Hour && !buffer.IsComplete {
-				fmt.Printf("Cleaning up stale message buffer for device %s\n", serialNumber)
-				delete(messageBuffers, serialNumber)
-			}
-
-			// If buffer is complete and older than 5 minutes, remove it
-			if buffer.IsComplete && now.Sub(buffer.ReceivedTime) > 5*time.Minute {
-				delete(messageBuffers, serialNumber)
-			}
+		saved, err := m.spool.Replay(func(entry *data.DeviceData) error {
+			return m.processDeviceData(context.Background(), entry)
+		})
+		if saved > 0 {
+			m.log.Info("saved spooled device data", "count", saved)
+		}
+		if err != nil && !errors.Is(err, data.ErrUnavailable) {
+			m.log.Error("failed to replay spooled device data", "error", err)
 		}
 	}
 }
 
+// monitorConnection logs when the connection state changes. The state
+// itself is exported as the mqtt_connected metric.
 func (m *MQTTClient) monitorConnection() {
 	ticker := time.NewTicker(30 * time.Second)
+	connected := m.IsConnected()
 	for range ticker.C {
-		if m.client != nil {
-			if m.client.IsConnected() {
-				fmt.Printf("MQTT connection status: CONNECTED\n")
-			} else {
-				fmt.Printf("MQTT connection status: DISCONNECTED - attempting to reconnect...\n")
-			}
+		if m.IsConnected() == connected {
+			continue
+		}
+		connected = !connected
+		if connected {
+			m.log.Info("connection status changed", "connected", true)
 		} else {
-			fmt.Printf("MQTT client is nil\n")
+			m.log.Warn("connection status changed, reconnecting", "connected", false)
 		}
 	}
 }
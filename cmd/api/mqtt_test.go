@@ -0,0 +1,264 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mqtt/data"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeMessage is a received MQTT message that records its acknowledgement.
+// onAck, if set, runs when it is acknowledged.
+type fakeMessage struct {
+	topic   string
+	qos     byte
+	payload []byte
+	onAck   func()
+	acks    atomic.Int32
+}
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return m.qos }
+func (m *fakeMessage) Retained() bool    { return false }
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) MessageID() uint16 { return 1 }
+func (m *fakeMessage) Payload() []byte   { return m.payload }
+
+func (m *fakeMessage) Ack() {
+	if m.onAck != nil {
+		m.onAck()
+	}
+	m.acks.Add(1)
+}
+
+// fakeTelemetryStore saves readings in memory, failing the first ones as if
+// the database were down
+type fakeTelemetryStore struct {
+	data.DeviceDataModel
+
+	mu       sync.Mutex
+	failures int
+	saved    []*data.DeviceData
+}
+
+func (f *fakeTelemetryStore) CreateLog(entry *data.DeviceData) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return data.ErrUnavailable
+	}
+	f.saved = append(f.saved, entry)
+	return nil
+}
+
+func (f *fakeTelemetryStore) setFailures(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = n
+}
+
+func (f *fakeTelemetryStore) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.saved)
+}
+
+func newTestMQTTClient(t *testing.T, store *fakeTelemetryStore, spool *telemetrySpool) *MQTTClient {
+	t.Helper()
+	m := &MQTTClient{
+		spool:        spool,
+		messageRetry: time.Millisecond,
+		queue:        make(chan mqtt.Message, messageQueueSize),
+		stopped:      make(chan struct{}),
+		models: &data.Models{
+			Device:     &fakeDeviceStore{devices: map[uint]*data.Device{1: {ID: 1, SerialNumber: "SN-1"}}},
+			DeviceData: store,
+		},
+		events: NewEventBus(discardLogger()),
+		log:    discardLogger(),
+		msgLog: discardLogger(),
+	}
+	routes, err := newSubscriptions([]SubscriptionConfig{
+		{Topic: "device/logs/{serial}/data", QoS: 1, Handler: HandlerTelemetry},
+	}, map[string]messageHandlerSpec{HandlerTelemetry: {handle: m.handleDeviceData}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.routes = routes
+	return m
+}
+
+func TestHandleMessageAcksAfterCommit(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		spool    bool
+		// saved and spooled are the readings in the database and the spool
+		// when the message is acknowledged
+		saved   int
+		spooled int
+	}{
+		{name: "saved", saved: 1},
+		{name: "database down without a spool", failures: 3, saved: 1},
+		{name: "database down with a spool", failures: 1, spool: true, spooled: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeTelemetryStore{failures: tt.failures}
+			var spool *telemetrySpool
+			if tt.spool {
+				spool, _ = newTelemetrySpool(t.TempDir())
+			}
+			m := newTestMQTTClient(t, store, spool)
+
+			msg := &fakeMessage{topic: "device/logs/SN-1/data", payload: []byte("bv=12.5")}
+			msg.onAck = func() {
+				if n := store.count(); n != tt.saved {
+					t.Errorf("acknowledged with %d readings saved, want %d", n, tt.saved)
+				}
+				if spool != nil && spool.Len() != tt.spooled {
+					t.Errorf("acknowledged with %d readings spooled, want %d", spool.Len(), tt.spooled)
+				}
+			}
+			m.handleMessage(msg)
+			if n := msg.acks.Load(); n != 1 {
+				t.Fatalf("acknowledged %d times, want once", n)
+			}
+		})
+	}
+}
+
+func TestHandleMessageDropsUnsaveable(t *testing.T) {
+	store := &fakeTelemetryStore{}
+	m := newTestMQTTClient(t, store, nil)
+	for _, msg := range []*fakeMessage{
+		// For another device than the topic's
+		{topic: "device/logs/SN-1/data", payload: []byte("imei=SN-2&bv=12.5")},
+		// No subscription
+		{topic: "device/other", payload: []byte("bv=12.5")},
+	} {
+		m.handleMessage(msg)
+		if msg.acks.Load() != 1 {
+			t.Fatalf("message on %s was not acknowledged", msg.topic)
+		}
+	}
+	if n := store.count(); n != 0 {
+		t.Fatalf("saved %d readings", n)
+	}
+}
+
+func TestHandleMessageStopsRetryingOnClose(t *testing.T) {
+	store := &fakeTelemetryStore{failures: 1 << 30}
+	m := newTestMQTTClient(t, store, nil)
+	msg := &fakeMessage{topic: "device/logs/SN-1/data", payload: []byte("bv=12.5")}
+
+	done := make(chan struct{})
+	go func() {
+		m.handleMessage(msg)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(m.stopped)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleMessage kept retrying after close")
+	}
+	if msg.acks.Load() != 0 {
+		t.Fatal("an unsaved message was acknowledged")
+	}
+}
+
+func TestDispatchDoesNotWaitForHandler(t *testing.T) {
+	store := &fakeTelemetryStore{failures: 1 << 30}
+	m := newTestMQTTClient(t, store, nil)
+	go m.processMessages()
+	defer close(m.stopped)
+
+	// The database is down, so the worker keeps retrying the first message
+	// while the callback goes on receiving
+	var acked []int
+	var mu sync.Mutex
+	var msgs []*fakeMessage
+	for i := range 3 {
+		msg := &fakeMessage{topic: "device/logs/SN-1/data", qos: 1, payload: []byte("bv=12.5")}
+		msg.onAck = func() {
+			mu.Lock()
+			acked = append(acked, i)
+			mu.Unlock()
+		}
+		msgs = append(msgs, msg)
+
+		done := make(chan struct{})
+		go func() {
+			m.dispatch(nil, msg)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("dispatch waited for a failing handler")
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	for _, msg := range msgs {
+		if msg.acks.Load() != 0 {
+			t.Fatal("an unsaved message was acknowledged")
+		}
+	}
+
+	store.setFailures(0)
+	waitFor(t, "the queued messages", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(acked) == 3
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if acked[0] != 0 || acked[1] != 1 || acked[2] != 2 || store.count() != 3 {
+		t.Fatalf("acknowledged %v with %d readings saved, want [0 1 2] after 3", acked, store.count())
+	}
+}
+
+func TestDispatchDropsQoS0WhenFull(t *testing.T) {
+	m := newTestMQTTClient(t, &fakeTelemetryStore{}, nil)
+	m.queue = make(chan mqtt.Message, 1)
+
+	done := make(chan struct{})
+	go func() {
+		// No worker is running: the first message fills the queue and the
+		// second is dropped rather than waited on
+		m.dispatch(nil, &fakeMessage{topic: "device/logs/SN-1/data", payload: []byte("bv=1")})
+		m.dispatch(nil, &fakeMessage{topic: "device/logs/SN-1/data", payload: []byte("bv=2")})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dispatch blocked on a full queue for a QoS 0 message")
+	}
+	if n := len(m.queue); n != 1 {
+		t.Fatalf("%d messages queued, want 1", n)
+	}
+
+	// A QoS 1 message waits for room instead, until the client is closed
+	go func() {
+		m.dispatch(nil, &fakeMessage{topic: "device/logs/SN-1/data", qos: 1, payload: []byte("bv=3")})
+	}()
+	if msg := <-m.queue; string(msg.Payload()) != "bv=1" {
+		t.Fatalf("got %s first", msg.Payload())
+	}
+	select {
+	case msg := <-m.queue:
+		if string(msg.Payload()) != "bv=3" {
+			t.Fatalf("got %s, want the QoS 1 message", msg.Payload())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the QoS 1 message was not queued")
+	}
+}
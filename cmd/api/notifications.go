@@ -0,0 +1,613 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"mqtt/data"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	notificationTimeout     = 10 * time.Second
+	notificationBatchSize   = 50
+	notificationBaseBackoff = 30 * time.Second
+	notificationMaxBackoff  = time.Hour
+)
+
+// Alert changes a channel can be notified of
+var notificationEvents = []string{"opened", "acknowledged", "resolved"}
+
+var defaultNotificationEvents = []string{"opened", "resolved"}
+
+// Built-in message templates, used when a channel has none of its own
+const (
+	defaultSubjectTemplate = `[{{.Alert.Severity}}] {{.RuleName}} {{.Event}} on {{.Alert.SerialNumber}}`
+	defaultBodyTemplate    = `{{.Alert.Message}}
+
+Device: {{.Alert.SerialNumber}}
+Severity: {{.Alert.Severity}}
+Status: {{.Alert.Status}}
+Opened: {{.Alert.OpenedAt.Format "2006-01-02 15:04:05 MST"}}
+{{- if .Alert.AcknowledgedAt}}
+Acknowledged: {{.Alert.AcknowledgedAt.Format "2006-01-02 15:04:05 MST"}}{{if .Alert.AcknowledgedBy}} by {{.Alert.AcknowledgedBy}}{{end}}
+{{- end}}
+{{- if .Alert.ResolvedAt}}
+Resolved: {{.Alert.ResolvedAt.Format "2006-01-02 15:04:05 MST"}}
+{{- end}}`
+)
+
+// notificationData is what message templates are executed with
+type notificationData struct {
+	Event    string
+	RuleName string
+	Alert    *data.Alert
+	Rule     *data.AlertRule
+}
+
+// notificationPayload is the JSON body posted to generic webhooks
+type notificationPayload struct {
+	Event     string          `json:"event"`
+	Subject   string          `json:"subject"`
+	Text      string          `json:"text"`
+	Alert     *data.Alert     `json:"alert"`
+	Rule      *data.AlertRule `json:"rule,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+// NotificationService tells people about alerts. Alert changes are turned
+// into one delivery per matching channel, which Run sends and retries with
+// exponential backoff.
+type NotificationService struct {
+	models      *data.Models
+	log         *slog.Logger
+	client      *http.Client
+	smtp        smtpConfig
+	maxAttempts int
+	wake        chan struct{}
+}
+
+// NewNotificationService creates the notification service and subscribes
+// it to alert changes
+func NewNotificationService(models *data.Models, events *EventBus, cfg Config, logger *slog.Logger) *NotificationService {
+	s := &NotificationService{
+		models: models,
+		log:    logger.With("component", "notifications"),
+		client: &http.Client{Timeout: notificationTimeout},
+		smtp: smtpConfig{
+			host:     cfg.SMTPHost,
+			port:     cfg.SMTPPort,
+			username: cfg.SMTPUsername,
+			password: cfg.SMTPPassword,
+			from:     cfg.SMTPFrom,
+		},
+		maxAttempts: cfg.NotificationMaxAttempts,
+		wake:        make(chan struct{}, 1),
+	}
+	events.Subscribe("notifications", []string{"alert.*"}, 0, s.handleEvent)
+	return s
+}
+
+// handleEvent records a delivery for every channel routed the alert change.
+// Deliveries for silenced alerts are recorded as suppressed.
+func (s *NotificationService) handleEvent(event Event) error {
+	payload, ok := event.Payload.(AlertEvent)
+	if !ok {
+		return nil
+	}
+	alert := payload.Alert
+	change := strings.TrimPrefix(event.Topic, "alert.")
+
+	channels, err := s.models.Notification.GetChannels()
+	if err != nil {
+		return fmt.Errorf("failed to load notification channels: %v", err)
+	}
+
+	now := time.Now()
+	var suppressed string
+	checked, queued := false, false
+	for _, channel := range channels {
+		if !channelRoutes(channel, alert, change) {
+			continue
+		}
+		if !checked {
+			suppressed = s.suppression(alert, now)
+			checked = true
+		}
+
+		delivery, err := renderNotification(channel, change, payload.Alert, payload.Rule, now)
+		switch {
+		case err != nil:
+			delivery.Status = data.DeliveryStatusFailed
+			delivery.LastError = err.Error()
+		case suppressed != "":
+			delivery.Status = data.DeliveryStatusSuppressed
+			delivery.LastError = suppressed
+		default:
+			delivery.Status = data.DeliveryStatusPending
+			delivery.NextAttemptAt = &now
+			queued = true
+		}
+		if err := s.models.Notification.CreateDelivery(delivery); err != nil {
+			s.log.Error("failed to record notification", "alert_id", alert.ID, "channel_id", channel.ID, "error", err)
+		}
+	}
+
+	if queued {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// channelRoutes reports whether a channel wants an alert change
+func channelRoutes(channel *data.NotificationChannel, alert *data.Alert, change string) bool {
+	if !channel.Enabled {
+		return false
+	}
+	if len(channel.Events) > 0 && !slices.Contains(channel.Events, change) {
+		return false
+	}
+	if len(channel.Severities) > 0 && !slices.Contains(channel.Severities, alert.Severity) {
+		return false
+	}
+	return len(channel.RuleIDs) == 0 || slices.Contains(channel.RuleIDs, int(alert.RuleID))
+}
+
+// renderNotification executes a channel's templates for an alert change.
+// The returned delivery is usable even when rendering fails.
+func renderNotification(channel *data.NotificationChannel, change string, alert *data.Alert, rule *data.AlertRule, now time.Time) (*data.NotificationDelivery, error) {
+	delivery := &data.NotificationDelivery{
+		ChannelID: channel.ID,
+		AlertID:   alert.ID,
+		Event:     change,
+		Severity:  alert.Severity,
+	}
+
+	values := notificationData{Event: change, Alert: alert, Rule: rule, RuleName: fmt.Sprintf("Rule %d", alert.RuleID)}
+	if rule != nil {
+		values.RuleName = rule.Name
+	}
+
+	subjectTemplate, bodyTemplate := channel.SubjectTemplate, channel.BodyTemplate
+	if subjectTemplate == "" {
+		subjectTemplate = defaultSubjectTemplate
+	}
+	if bodyTemplate == "" {
+		bodyTemplate = defaultBodyTemplate
+	}
+	subject, err := executeTemplate("subject", subjectTemplate, values)
+	if err != nil {
+		return delivery, err
+	}
+	body, err := executeTemplate("body", bodyTemplate, values)
+	if err != nil {
+		return delivery, err
+	}
+	delivery.Subject = strings.Join(strings.Fields(subject), " ")
+	delivery.Body = body
+
+	payload, err := json.Marshal(notificationPayload{
+		Event:     "alert." + change,
+		Subject:   delivery.Subject,
+		Text:      delivery.Body,
+		Alert:     alert,
+		Rule:      rule,
+		Timestamp: now.UTC(),
+	})
+	if err != nil {
+		return delivery, err
+	}
+	delivery.Payload = data.JSON(payload)
+	return delivery, nil
+}
+
+func executeTemplate(name, text string, values interface{}) (string, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s template: %v", name, err)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, values); err != nil {
+		return "", fmt.Errorf("failed to render %s template: %v", name, err)
+	}
+	return out.String(), nil
+}
+
+// Run sends due deliveries every 10 seconds, and right away when new ones
+// are queued. Only the leader sends; deliveries queued on another instance
+// wait for its next tick.
+func (s *NotificationService) Run(leader Leadership) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.wake:
+		}
+		if !leader.IsLeader() {
+			continue
+		}
+		s.sendDue()
+	}
+}
+
+func (s *NotificationService) sendDue() {
+	deliveries, err := s.models.Notification.GetDueDeliveries(time.Now(), notificationBatchSize)
+	if err != nil {
+		s.log.Error("failed to load due notifications", "error", err)
+		return
+	}
+
+	for _, delivery := range deliveries {
+		channel, err := s.models.Notification.GetChannel(delivery.ChannelID)
+		if errors.Is(err, data.ErrNotFound) {
+			delivery.Status = data.DeliveryStatusFailed
+			delivery.NextAttemptAt = nil
+			delivery.LastError = "channel was deleted"
+			s.models.Notification.UpdateDelivery(delivery)
+			continue
+		}
+		if err != nil {
+			s.log.Error("failed to load notification channel", "channel_id", delivery.ChannelID, "error", err)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+		err = s.deliver(ctx, channel, delivery)
+		cancel()
+
+		now := time.Now()
+		delivery.Attempts++
+		switch {
+		case err == nil:
+			delivery.Status = data.DeliveryStatusSent
+			delivery.SentAt = &now
+			delivery.NextAttemptAt = nil
+			delivery.LastError = ""
+		case delivery.Attempts >= s.maxAttempts:
+			delivery.Status = data.DeliveryStatusFailed
+			delivery.NextAttemptAt = nil
+			delivery.LastError = err.Error()
+		default:
+			next := now.Add(retryBackoff(delivery.Attempts, notificationBaseBackoff, notificationMaxBackoff))
+			delivery.NextAttemptAt = &next
+			delivery.LastError = err.Error()
+		}
+		if err != nil {
+			s.log.Warn("notification failed", "delivery_id", delivery.ID, "channel", channel.Name, "attempt", delivery.Attempts, "error", err)
+		}
+		if err := s.models.Notification.UpdateDelivery(delivery); err != nil {
+			s.log.Error("failed to update notification", "delivery_id", delivery.ID, "error", err)
+		}
+	}
+}
+
+// retryBackoff is the wait after a failed attempt: base, then doubling up
+// to limit
+func retryBackoff(attempts int, base, limit time.Duration) time.Duration {
+	backoff := base
+	for i := 1; i < attempts && backoff < limit; i++ {
+		backoff *= 2
+	}
+	return min(backoff, limit)
+}
+
+// channelInput is the body of POST and PUT /notification-channels
+type channelInput struct {
+	Name            string   `json:"name"`
+	Type            string   `json:"type"`
+	URL             string   `json:"url"`
+	Secret          *string  `json:"secret"`
+	Recipients      []string `json:"recipients"`
+	Severities      []string `json:"severities"`
+	RuleIDs         []int    `json:"rule_ids"`
+	Events          []string `json:"events"`
+	SubjectTemplate string   `json:"subject_template"`
+	BodyTemplate    string   `json:"body_template"`
+	Enabled         *bool    `json:"enabled"`
+}
+
+// validate trims and checks the input
+func (in *channelInput) validate(smtp smtpConfig) fieldErrors {
+	errs := fieldErrors{}
+	in.Name = strings.TrimSpace(in.Name)
+	in.Type = strings.ToLower(strings.TrimSpace(in.Type))
+	in.URL = strings.TrimSpace(in.URL)
+
+	switch {
+	case in.Name == "":
+		errs["name"] = "is required"
+	case len(in.Name) > 100:
+		errs["name"] = "must be at most 100 characters"
+	}
+
+	if !slices.Contains(data.ChannelTypes, in.Type) {
+		errs["type"] = fmt.Sprintf("must be one of %s", strings.Join(data.ChannelTypes, ", "))
+	}
+	if in.Type == data.ChannelTypeEmail {
+		if !smtp.configured() {
+			errs["type"] = "email channels need SMTP_HOST and SMTP_FROM to be configured"
+		}
+		if len(in.Recipients) == 0 {
+			errs["recipients"] = "is required for email channels"
+		}
+		for i, recipient := range in.Recipients {
+			address, err := mail.ParseAddress(strings.TrimSpace(recipient))
+			if err != nil {
+				errs["recipients"] = fmt.Sprintf("%q is not a valid email address", recipient)
+				break
+			}
+			in.Recipients[i] = address.Address
+		}
+	} else if in.Type != "" {
+		target, err := url.Parse(in.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" || len(in.URL) > 500 {
+			errs["url"] = "must be an http or https URL of at most 500 characters"
+		}
+		in.Recipients = nil
+	}
+	if in.Secret != nil && len(*in.Secret) > 200 {
+		errs["secret"] = "must be at most 200 characters"
+	}
+
+	for _, severity := range in.Severities {
+		if !slices.Contains(data.AlertSeverities, severity) {
+			errs["severities"] = fmt.Sprintf("must only contain %s", strings.Join(data.AlertSeverities, ", "))
+		}
+	}
+	for _, id := range in.RuleIDs {
+		if id < 1 {
+			errs["rule_ids"] = "must only contain alert rule IDs"
+		}
+	}
+	if in.Events == nil {
+		in.Events = defaultNotificationEvents
+	}
+	for _, event := range in.Events {
+		if !slices.Contains(notificationEvents, event) {
+			errs["events"] = fmt.Sprintf("must only contain %s", strings.Join(notificationEvents, ", "))
+		}
+	}
+
+	if len(in.SubjectTemplate) > 500 {
+		errs["subject_template"] = "must be at most 500 characters"
+	} else if _, err := template.New("subject").Parse(in.SubjectTemplate); err != nil {
+		errs["subject_template"] = err.Error()
+	}
+	if _, err := template.New("body").Parse(in.BodyTemplate); err != nil {
+		errs["body_template"] = err.Error()
+	}
+
+	if in.Enabled == nil {
+		enabled := true
+		in.Enabled = &enabled
+	}
+	return errs
+}
+
+// applyTo copies the input onto a channel. The secret is only changed when
+// the input has one.
+func (in *channelInput) applyTo(channel *data.NotificationChannel) {
+	channel.Name = in.Name
+	channel.Type = in.Type
+	channel.URL = in.URL
+	if in.Type == data.ChannelTypeEmail {
+		channel.URL = ""
+	}
+	if in.Secret != nil {
+		channel.Secret = *in.Secret
+	}
+	channel.Recipients = in.Recipients
+	channel.Severities = in.Severities
+	channel.RuleIDs = in.RuleIDs
+	channel.Events = in.Events
+	channel.SubjectTemplate = in.SubjectTemplate
+	channel.BodyTemplate = in.BodyTemplate
+	channel.Enabled = *in.Enabled
+}
+
+// getNotificationChannels lists all notification channels
+func (h *APIHandler) getNotificationChannels(w http.ResponseWriter, r *http.Request) {
+	channels, err := h.modelsFor(r).Notification.GetChannels()
+	if err != nil {
+		writeDataError(w, r, err, "Failed to get notification channels")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"channels": channels,
+		"count":    len(channels),
+	})
+}
+
+// getNotificationChannel returns one notification channel
+func (h *APIHandler) getNotificationChannel(w http.ResponseWriter, r *http.Request) {
+	channel, ok := h.channelFromURL(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, channel)
+}
+
+// createNotificationChannel creates a notification channel
+func (h *APIHandler) createNotificationChannel(w http.ResponseWriter, r *http.Request) {
+	channel := &data.NotificationChannel{}
+	if !h.saveNotificationChannel(w, r, channel) {
+		return
+	}
+	writeJSON(w, http.StatusCreated, channel)
+}
+
+// updateNotificationChannel replaces a notification channel. Leaving out
+// "secret" keeps the current one.
+func (h *APIHandler) updateNotificationChannel(w http.ResponseWriter, r *http.Request) {
+	channel, ok := h.channelFromURL(w, r)
+	if !ok {
+		return
+	}
+	if !h.saveNotificationChannel(w, r, channel) {
+		return
+	}
+	writeJSON(w, http.StatusOK, channel)
+}
+
+// saveNotificationChannel decodes and validates a channel from the request
+// body and saves it. It writes the error response and returns false if that
+// fails.
+func (h *APIHandler) saveNotificationChannel(w http.ResponseWriter, r *http.Request, channel *data.NotificationChannel) bool {
+	var input channelInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return false
+	}
+	if errs := input.validate(h.notifications.smtp); len(errs) > 0 {
+		writeValidationError(w, r, errs)
+		return false
+	}
+
+	isNew := channel.ID == 0
+	input.applyTo(channel)
+	var err error
+	if isNew {
+		err = h.modelsFor(r).Notification.CreateChannel(channel)
+	} else {
+		err = h.modelsFor(r).Notification.UpdateChannel(channel)
+	}
+	if err != nil {
+		if errors.Is(err, data.ErrConflict) {
+			writeError(w, r, http.StatusConflict, fmt.Sprintf("A channel named %q already exists", channel.Name))
+			return false
+		}
+		writeDataError(w, r, err, "Failed to save notification channel")
+		return false
+	}
+	return true
+}
+
+// deleteNotificationChannel removes a notification channel. Its delivery
+// log is kept.
+func (h *APIHandler) deleteNotificationChannel(w http.ResponseWriter, r *http.Request) {
+	channel, ok := h.channelFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.modelsFor(r).Notification.DeleteChannel(channel.ID); err != nil {
+		writeDataError(w, r, err, "Failed to delete notification channel")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Notification channel deleted successfully"})
+}
+
+// testNotificationChannel sends a sample notification straight away and
+// reports the result. Test messages are not recorded in the delivery log.
+func (h *APIHandler) testNotificationChannel(w http.ResponseWriter, r *http.Request) {
+	channel, ok := h.channelFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	alert := &data.Alert{
+		SerialNumber: "TEST",
+		Severity:     data.AlertSeverityInfo,
+		Status:       data.AlertStatusOpen,
+		Message:      "Test notification from the MQTT backend",
+		OpenedAt:     now,
+	}
+	rule := &data.AlertRule{Name: "Test"}
+	delivery, err := renderNotification(channel, "opened", alert, rule, now)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(r.Context(), notificationTimeout)
+		err = h.notifications.deliver(ctx, channel, delivery)
+		cancel()
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadGateway, fmt.Sprintf("Test notification failed: %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Test notification sent"})
+}
+
+// getNotificationDeliveries lists the delivery log, newest first.
+// ?channel_id, ?alert_id, ?status and ?limit filter the list.
+func (h *APIHandler) getNotificationDeliveries(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := data.DeliveryFilter{Status: query.Get("status"), Limit: 100}
+
+	switch filter.Status {
+	case "", data.DeliveryStatusPending, data.DeliveryStatusSent, data.DeliveryStatusFailed, data.DeliveryStatusSuppressed:
+	default:
+		writeError(w, r, http.StatusBadRequest, "status must be pending, sent, failed or suppressed")
+		return
+	}
+	for name, target := range map[string]*uint{"channel_id": &filter.ChannelID, "alert_id": &filter.AlertID} {
+		if value := query.Get(name); value != "" {
+			id, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid %s", name))
+				return
+			}
+			*target = uint(id)
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 1000 {
+			writeError(w, r, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		filter.Limit = n
+	}
+
+	deliveries, err := h.modelsFor(r).Notification.GetDeliveries(filter)
+	if err != nil {
+		writeDataError(w, r, err, "Failed to get notification deliveries")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"deliveries": deliveries,
+		"count":      len(deliveries),
+	})
+}
+
+// channelFromURL loads the channel named by the channelID URL parameter. It
+// writes the error response and returns false if that fails.
+func (h *APIHandler) channelFromURL(w http.ResponseWriter, r *http.Request) (*data.NotificationChannel, bool) {
+	channelID, err := strconv.ParseUint(chi.URLParam(r, "channelID"), 10, 32)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid notification channel ID")
+		return nil, false
+	}
+
+	channel, err := h.modelsFor(r).Notification.GetChannel(uint(channelID))
+	if err != nil {
+		if errors.Is(err, data.ErrNotFound) {
+			writeError(w, r, http.StatusNotFound, "Notification channel not found")
+			return nil, false
+		}
+		writeDataError(w, r, err, "Failed to get notification channel")
+		return nil, false
+	}
+	return channel, true
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mqtt/data"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: 30 * time.Second},
+		{attempts: 2, want: time.Minute},
+		{attempts: 3, want: 2 * time.Minute},
+		{attempts: 7, want: 32 * time.Minute},
+		{attempts: 8, want: time.Hour},
+		{attempts: 50, want: time.Hour},
+	}
+	for _, tt := range tests {
+		if got := retryBackoff(tt.attempts, notificationBaseBackoff, notificationMaxBackoff); got != tt.want {
+			t.Errorf("retryBackoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// fakeNotificationStore keeps channels and deliveries in memory
+type fakeNotificationStore struct {
+	data.NotificationModel
+
+	channels   map[uint]*data.NotificationChannel
+	deliveries map[uint]*data.NotificationDelivery
+	silences   []*data.Silence
+	windows    []*data.MaintenanceWindow
+}
+
+func (f *fakeNotificationStore) GetChannel(id uint) (*data.NotificationChannel, error) {
+	channel, ok := f.channels[id]
+	if !ok {
+		return nil, data.ErrNotFound
+	}
+	return channel, nil
+}
+
+func (f *fakeNotificationStore) GetDueDeliveries(now time.Time, limit int) ([]*data.NotificationDelivery, error) {
+	var due []*data.NotificationDelivery
+	for _, delivery := range f.deliveries {
+		if delivery.Status == data.DeliveryStatusPending && !delivery.NextAttemptAt.After(now) {
+			copied := *delivery
+			due = append(due, &copied)
+		}
+	}
+	return due, nil
+}
+
+func (f *fakeNotificationStore) UpdateDelivery(delivery *data.NotificationDelivery) error {
+	f.deliveries[delivery.ID] = delivery
+	return nil
+}
+
+func (f *fakeNotificationStore) GetSilences(activeAt *time.Time) ([]*data.Silence, error) {
+	var active []*data.Silence
+	for _, silence := range f.silences {
+		if !activeAt.Before(silence.StartsAt) && activeAt.Before(silence.EndsAt) {
+			active = append(active, silence)
+		}
+	}
+	return active, nil
+}
+
+func (f *fakeNotificationStore) GetWindows() ([]*data.MaintenanceWindow, error) {
+	return f.windows, nil
+}
+
+func TestSendDueSignsAndRetries(t *testing.T) {
+	var mu sync.Mutex
+	statuses := []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write([]byte(r.Header.Get(signatureTimestampHeader) + "." + string(body)))
+		if r.Header.Get(signatureHeader) != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		timestamp, _ := strconv.ParseInt(r.Header.Get(signatureTimestampHeader), 10, 64)
+		if time.Since(time.Unix(timestamp, 0)) > time.Minute {
+			http.Error(w, "stale timestamp", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		status := statuses[0]
+		statuses = statuses[1:]
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	past := time.Now().Add(-time.Second)
+	store := &fakeNotificationStore{
+		channels: map[uint]*data.NotificationChannel{
+			1: {ID: 1, Name: "ops", Type: data.ChannelTypeWebhook, URL: server.URL, Secret: "s3cret"},
+		},
+		deliveries: map[uint]*data.NotificationDelivery{
+			1: {ID: 1, ChannelID: 1, Status: data.DeliveryStatusPending, NextAttemptAt: &past, Payload: data.JSON(`{"event":"alert.opened"}`)},
+			2: {ID: 2, ChannelID: 9, Status: data.DeliveryStatusPending, NextAttemptAt: &past},
+		},
+	}
+	s := &NotificationService{models: &data.Models{Notification: store}, log: discardLogger(), client: server.Client(), maxAttempts: 5}
+
+	for attempt, backoff := range []time.Duration{30 * time.Second, time.Minute} {
+		started := time.Now()
+		s.sendDue()
+		delivery := store.deliveries[1]
+		if delivery.Status != data.DeliveryStatusPending || delivery.Attempts != attempt+1 || delivery.LastError == "" {
+			t.Fatalf("after failure %d: %+v", attempt+1, delivery)
+		}
+		if wait := delivery.NextAttemptAt.Sub(started); wait < backoff || wait > backoff+time.Second {
+			t.Fatalf("after failure %d the next attempt is in %s, want %s", attempt+1, wait, backoff)
+		}
+		delivery.NextAttemptAt = &past
+	}
+
+	s.sendDue()
+	if delivery := store.deliveries[1]; delivery.Status != data.DeliveryStatusSent || delivery.Attempts != 3 || delivery.SentAt == nil || delivery.LastError != "" {
+		t.Fatalf("after success: %+v", delivery)
+	}
+	if delivery := store.deliveries[2]; delivery.Status != data.DeliveryStatusFailed || delivery.LastError != "channel was deleted" {
+		t.Fatalf("delivery to a deleted channel: %+v", delivery)
+	}
+}
+
+func TestSendDueGivesUp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	past := time.Now().Add(-time.Second)
+	store := &fakeNotificationStore{
+		channels:   map[uint]*data.NotificationChannel{1: {ID: 1, Type: data.ChannelTypeSlack, URL: server.URL}},
+		deliveries: map[uint]*data.NotificationDelivery{1: {ID: 1, ChannelID: 1, Status: data.DeliveryStatusPending, Attempts: 2, NextAttemptAt: &past}},
+	}
+	s := &NotificationService{models: &data.Models{Notification: store}, log: discardLogger(), client: server.Client(), maxAttempts: 3}
+
+	s.sendDue()
+	delivery := store.deliveries[1]
+	if delivery.Status != data.DeliveryStatusFailed || delivery.NextAttemptAt != nil || !strings.Contains(delivery.LastError, "503") {
+		t.Fatalf("delivery = %+v, want it failed after the last attempt", delivery)
+	}
+}
+
+// fakeSMTPServer accepts one SMTP session without extensions and records the
+// envelope and message. If silent, it never answers.
+func fakeSMTPServer(t *testing.T, silent bool) (host string, port int, received chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	received = make(chan string, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if silent {
+			io.Copy(io.Discard, conn)
+			return
+		}
+
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+		var session strings.Builder
+		reply("220 localhost ESMTP")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.Fields(line + " ")[0])
+			switch command {
+			case "EHLO", "HELO", "MAIL", "RCPT":
+				session.WriteString(line)
+				reply("250 OK")
+			case "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					session.WriteString(line)
+				}
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				received <- session.String()
+				return
+			default:
+				reply("502 not implemented")
+			}
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, received
+}
+
+func TestSendEmail(t *testing.T) {
+	host, port, received := fakeSMTPServer(t, false)
+	s := &NotificationService{smtp: smtpConfig{host: host, port: port, from: "alerts@example.com"}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.sendEmail(ctx, []string{"ops@example.com", "oncall@example.com"}, "Battery low", "SN-1\nis low"); err != nil {
+		t.Fatal(err)
+	}
+	session := <-received
+	for _, want := range []string{
+		"MAIL FROM:<alerts@example.com>",
+		"RCPT TO:<ops@example.com>",
+		"RCPT TO:<oncall@example.com>",
+		"To: ops@example.com, oncall@example.com\r\n",
+		"Subject: Battery low\r\n",
+		"\r\nSN-1\r\nis low",
+	} {
+		if !strings.Contains(session, want) {
+			t.Errorf("session is missing %q:\n%s", want, session)
+		}
+	}
+}
+
+func TestSendEmailDeadline(t *testing.T) {
+	host, port, _ := fakeSMTPServer(t, true)
+	s := &NotificationService{smtp: smtpConfig{host: host, port: port, from: "alerts@example.com"}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if err := s.sendEmail(ctx, []string{"ops@example.com"}, "Battery low", "SN-1"); err == nil {
+		t.Fatal("a server that never answers was accepted")
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Fatalf("sendEmail returned after %s, want it bounded by the context", elapsed)
+	}
+}
+
+func TestWindowActive(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone data")
+	}
+	// Wednesday 2024-05-01 is UTC+2 in Berlin
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 5, day, hour, minute, 0, 0, berlin)
+	}
+	tests := []struct {
+		name   string
+		window data.MaintenanceWindow
+		now    time.Time
+		want   bool
+	}{
+		{name: "inside", window: data.MaintenanceWindow{StartTime: "02:00", DurationMinutes: 60, Timezone: "Europe/Berlin"}, now: at(1, 2, 30), want: true},
+		{name: "at the start", window: data.MaintenanceWindow{StartTime: "02:00", DurationMinutes: 60, Timezone: "Europe/Berlin"}, now: at(1, 2, 0), want: true},
+		{name: "at the end", window: data.MaintenanceWindow{StartTime: "02:00", DurationMinutes: 60, Timezone: "Europe/Berlin"}, now: at(1, 3, 0)},
+		{name: "other time zone", window: data.MaintenanceWindow{StartTime: "02:00", DurationMinutes: 60, Timezone: "UTC"}, now: at(1, 2, 30)},
+		{name: "over midnight", window: data.MaintenanceWindow{StartTime: "23:00", DurationMinutes: 120, Timezone: "Europe/Berlin"}, now: at(2, 0, 30), want: true},
+		{name: "weekday", window: data.MaintenanceWindow{StartTime: "02:00", DurationMinutes: 60, Timezone: "Europe/Berlin", Weekdays: data.IntList{3}}, now: at(1, 2, 30), want: true},
+		{name: "other weekday", window: data.MaintenanceWindow{StartTime: "02:00", DurationMinutes: 60, Timezone: "Europe/Berlin", Weekdays: data.IntList{4}}, now: at(1, 2, 30)},
+		// Opened on Tuesday and still running on Wednesday
+		{name: "started the day before", window: data.MaintenanceWindow{StartTime: "22:00", DurationMinutes: 6 * 60, Timezone: "Europe/Berlin", Weekdays: data.IntList{2}}, now: at(1, 1, 0), want: true},
+		{name: "multi-day", window: data.MaintenanceWindow{StartTime: "00:00", DurationMinutes: 3 * 24 * 60, Timezone: "Europe/Berlin", Weekdays: data.IntList{1}}, now: at(1, 12, 0), want: true},
+		{name: "invalid start", window: data.MaintenanceWindow{StartTime: "25:00", DurationMinutes: 60, Timezone: "Europe/Berlin"}, now: at(1, 2, 30)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := windowActive(&tt.window, tt.now); got != tt.want {
+				t.Fatalf("windowActive = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSuppression(t *testing.T) {
+	now := time.Now()
+	rule, device := uint(3), uint(1)
+	devices := &fakeDeviceStore{devices: map[uint]*data.Device{
+		1: {ID: 1, DeviceType: "logger", Tags: data.StringList{"site-a"}},
+		2: {ID: 2, DeviceType: "meter"},
+	}}
+	always := func(tags ...string) *data.MaintenanceWindow {
+		return &data.MaintenanceWindow{Name: "always", StartTime: "00:00", DurationMinutes: 7 * 24 * 60, Timezone: "UTC", Tags: tags}
+	}
+	tests := []struct {
+		name     string
+		silences []*data.Silence
+		windows  []*data.MaintenanceWindow
+		alert    data.Alert
+		want     string
+	}{
+		{name: "nothing", alert: data.Alert{RuleID: 3, DeviceID: 1}},
+		{name: "silenced rule", silences: []*data.Silence{{ID: 5, RuleID: &rule, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Hour)}}, alert: data.Alert{RuleID: 3, DeviceID: 1}, want: "silenced by silence 5"},
+		{name: "expired silence", silences: []*data.Silence{{ID: 5, RuleID: &rule, StartsAt: now.Add(-2 * time.Hour), EndsAt: now.Add(-time.Hour)}}, alert: data.Alert{RuleID: 3, DeviceID: 1}},
+		{name: "silence of another device", silences: []*data.Silence{{ID: 5, DeviceID: &device, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Hour)}}, alert: data.Alert{RuleID: 3, DeviceID: 2}},
+		{name: "silenced device type", silences: []*data.Silence{{ID: 6, DeviceType: "meter", StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Hour)}}, alert: data.Alert{RuleID: 3, DeviceID: 2}, want: "silenced by silence 6"},
+		{name: "silenced severity", silences: []*data.Silence{{ID: 7, Severity: data.AlertSeverityInfo, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Hour)}}, alert: data.Alert{RuleID: 3, DeviceID: 1, Severity: data.AlertSeverityCritical}},
+		{name: "maintenance window", windows: []*data.MaintenanceWindow{always("site-a")}, alert: data.Alert{RuleID: 3, DeviceID: 1}, want: `in maintenance window "always"`},
+		{name: "window for other tags", windows: []*data.MaintenanceWindow{always("site-b")}, alert: data.Alert{RuleID: 3, DeviceID: 1}},
+		{name: "tagged window for a deleted device", windows: []*data.MaintenanceWindow{always("site-a")}, alert: data.Alert{RuleID: 3, DeviceID: 9}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeNotificationStore{silences: tt.silences, windows: tt.windows}
+			s := &NotificationService{models: &data.Models{Notification: store, Device: devices}, log: discardLogger()}
+			if got := s.suppression(&tt.alert, now); got != tt.want {
+				t.Fatalf("suppression = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
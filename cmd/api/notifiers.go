@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"mqtt/data"
+)
+
+// Headers carrying the HMAC signature of signed webhook requests
+const (
+	signatureHeader          = "X-Signature-256"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+)
+
+// signPayload returns the signature of a webhook body sent at timestamp:
+// "sha256=" followed by the hex HMAC-SHA256 of "{timestamp}.{body}". The
+// timestamp is covered so receivers can reject replayed requests.
+func signPayload(secret string, timestamp int64, body []byte) string {
+	message := strconv.FormatInt(timestamp, 10) + "." + string(body)
+	return "sha256=" + hex.EncodeToString(hmacSHA256([]byte(secret), message))
+}
+
+// setSignatureHeaders signs req with secret. Requests are left unsigned
+// when secret is empty.
+func setSignatureHeaders(req *http.Request, secret string, body []byte, now time.Time) {
+	if secret == "" {
+		return
+	}
+	timestamp := now.Unix()
+	req.Header.Set(signatureTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(signatureHeader, signPayload(secret, timestamp, body))
+}
+
+// postJSON posts body to url with extra headers, signed with secret, and
+// fails on non-2xx responses. It returns the response status, or 0 if there
+// was no response.
+func postJSON(ctx context.Context, client *http.Client, url string, body []byte, secret string, headers http.Header) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mqtt-backend")
+	setSignatureHeaders(req, secret, body, time.Now())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+// teamsColors are the MessageCard theme colors per severity
+var teamsColors = map[string]string{
+	data.AlertSeverityInfo:     "0078D7",
+	data.AlertSeverityWarning:  "FFB900",
+	data.AlertSeverityCritical: "D13438",
+}
+
+// deliver sends a rendered notification to its channel
+func (s *NotificationService) deliver(ctx context.Context, channel *data.NotificationChannel, delivery *data.NotificationDelivery) error {
+	var err error
+	switch channel.Type {
+	case data.ChannelTypeWebhook:
+		_, err = postJSON(ctx, s.client, channel.URL, delivery.Payload, channel.Secret, nil)
+
+	case data.ChannelTypeSlack:
+		body, _ := json.Marshal(map[string]string{
+			"text": fmt.Sprintf("*%s*\n%s", delivery.Subject, delivery.Body),
+		})
+		_, err = postJSON(ctx, s.client, channel.URL, body, "", nil)
+
+	case data.ChannelTypeTeams:
+		body, _ := json.Marshal(map[string]string{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"summary":    delivery.Subject,
+			"title":      delivery.Subject,
+			"text":       strings.ReplaceAll(delivery.Body, "\n", "  \n"),
+			"themeColor": teamsColors[delivery.Severity],
+		})
+		_, err = postJSON(ctx, s.client, channel.URL, body, "", nil)
+
+	case data.ChannelTypeEmail:
+		err = s.sendEmail(ctx, channel.Recipients, delivery.Subject, delivery.Body)
+
+	default:
+		err = fmt.Errorf("unknown channel type %q", channel.Type)
+	}
+	return err
+}
+
+// smtpConfig is the outgoing mail server used by email channels
+type smtpConfig struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     string
+}
+
+func (c smtpConfig) configured() bool {
+	return c.host != "" && c.from != ""
+}
+
+// sendEmail sends a plain-text message through the SMTP server. The
+// connection is upgraded with STARTTLS when the server offers it. The whole
+// exchange is bounded by ctx, so a server that stops answering cannot hold
+// up the send loop.
+func (s *NotificationService) sendEmail(ctx context.Context, recipients []string, subject, body string) error {
+	if !s.smtp.configured() {
+		return fmt.Errorf("SMTP_HOST and SMTP_FROM are not configured")
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", s.smtp.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(recipients, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var dialer net.Dialer
+	addr := net.JoinHostPort(s.smtp.host, strconv.Itoa(s.smtp.port))
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Cancelling ctx also ends the exchange
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	client, err := smtp.NewClient(conn, s.smtp.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: s.smtp.host}); err != nil {
+			return err
+		}
+	}
+	if s.smtp.username != "" {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return fmt.Errorf("SMTP server does not support authentication")
+		}
+		if err := client.Auth(smtp.PlainAuth("", s.smtp.username, s.smtp.password, s.smtp.host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(s.smtp.from); err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, msg.String()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
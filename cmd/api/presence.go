@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"mqtt/data"
+)
+
+const presenceCheckInterval = time.Minute
+
+// Reasons recorded with presence changes
+const (
+	PresenceReasonTelemetry = "telemetry"
+	PresenceReasonBirth     = "birth"
+	PresenceReasonLWT       = "lwt"
+	PresenceReasonTimeout   = "timeout"
+)
+
+// PresenceService tracks whether devices are alive. Any telemetry or birth
+// message marks a device online; a last will message, or silence for longer
+// than its type's expected report interval allows, marks it offline.
+type PresenceService struct {
+	models          *data.Models
+	log             *slog.Logger
+	events          *EventBus
+	defaultInterval time.Duration
+	intervals       map[string]time.Duration
+	missedReports   int
+}
+
+// NewPresenceService creates a presence service and subscribes it to saved
+// telemetry
+func NewPresenceService(models *data.Models, events *EventBus, cfg Config, logger *slog.Logger) *PresenceService {
+	s := &PresenceService{
+		models:          models,
+		log:             logger.With("component", "presence"),
+		events:          events,
+		defaultInterval: cfg.PresenceDefaultInterval,
+		intervals:       cfg.PresenceIntervals,
+		missedReports:   cfg.PresenceMissedReports,
+	}
+	if s.missedReports < 1 {
+		s.missedReports = 1
+	}
+	events.Subscribe("presence", []string{TopicTelemetrySaved}, 0, s.handleTelemetry)
+	return s
+}
+
+// reportInterval returns how often devices of deviceType are expected to report
+func (s *PresenceService) reportInterval(deviceType string) time.Duration {
+	if interval, ok := s.intervals[deviceType]; ok {
+		return interval
+	}
+	return s.defaultInterval
+}
+
+// offlineAfter returns how long a device of deviceType may stay silent
+// before it is considered offline
+func (s *PresenceService) offlineAfter(deviceType string) time.Duration {
+	return s.reportInterval(deviceType) * time.Duration(s.missedReports)
+}
+
+// Seen records that a device was just heard from
+func (s *PresenceService) Seen(device *data.Device, reason string) error {
+	now := time.Now()
+	cameOnline, err := s.models.Device.MarkSeen(device.ID, now)
+	if err != nil {
+		return fmt.Errorf("failed to mark device %s seen: %v", device.SerialNumber, err)
+	}
+	if cameOnline {
+		s.record(device, true, reason, &now)
+	}
+	return nil
+}
+
+// Offline marks a device offline
+func (s *PresenceService) Offline(device *data.Device, reason string) error {
+	return s.offline(device, reason, time.Time{})
+}
+
+// offline marks a device offline unless it has been seen since seenBefore,
+// if given
+func (s *PresenceService) offline(device *data.Device, reason string, seenBefore time.Time) error {
+	wentOffline, err := s.models.Device.MarkOffline(device.ID, seenBefore)
+	if err != nil {
+		return fmt.Errorf("failed to mark device %s offline: %v", device.SerialNumber, err)
+	}
+	if wentOffline {
+		s.record(device, false, reason, device.LastSeenAt)
+	}
+	return nil
+}
+
+// record stores a presence change in the history and publishes it
+func (s *PresenceService) record(device *data.Device, online bool, reason string, lastSeenAt *time.Time) {
+	event := &data.PresenceEvent{
+		DeviceID:     device.ID,
+		SerialNumber: device.SerialNumber,
+		Online:       online,
+		Reason:       reason,
+		LastSeenAt:   lastSeenAt,
+	}
+	if err := s.models.Presence.CreateEvent(event); err != nil {
+		s.log.Error("failed to record presence", "imei", device.SerialNumber, "error", err)
+	}
+
+	topic := TopicDeviceOffline
+	if online {
+		topic = TopicDeviceOnline
+	}
+	s.events.Publish(topic, device.SerialNumber, event)
+}
+
+// handleTelemetry marks the sender of every saved reading as online
+func (s *PresenceService) handleTelemetry(event Event) error {
+	entry, ok := event.Payload.(*data.DeviceData)
+	if !ok {
+		return nil
+	}
+	return s.Seen(&data.Device{ID: entry.DeviceID, SerialNumber: entry.SerialNumber}, PresenceReasonTelemetry)
+}
+
+// Run marks silent devices offline while this instance is the leader, until
+// the process exits
+func (s *PresenceService) Run(leader Leadership) {
+	ticker := time.NewTicker(presenceCheckInterval)
+	for range ticker.C {
+		if !leader.IsLeader() {
+			continue
+		}
+		s.sweep()
+	}
+}
+
+func (s *PresenceService) sweep() {
+	devices, err := s.models.Device.GetDevicesByPresence(true)
+	if err != nil {
+		s.log.Error("failed to load online devices", "error", err)
+		return
+	}
+
+	now := time.Now()
+	for _, device := range devices {
+		cutoff := now.Add(-s.offlineAfter(device.DeviceType))
+		if device.LastSeenAt != nil && !device.LastSeenAt.Before(cutoff) {
+			continue
+		}
+		// A message may have arrived since the device was loaded
+		if err := s.offline(device, PresenceReasonTimeout, cutoff); err != nil {
+			s.log.Error("failed to mark device offline", "imei", device.SerialNumber, "error", err)
+		}
+	}
+}
+
+// deviceBySerial looks up the sender of an MQTT message, logging failures
+func (m *MQTTClient) deviceBySerial(msg *deviceMessage) (*data.Device, bool) {
+	device, err := m.models.Device.GetBySerialNumber(msg.SerialNumber)
+	if errors.Is(err, data.ErrNotFound) {
+		m.msgLog.Warn("ignoring message from unknown device", "topic", msg.Topic(), "imei", msg.SerialNumber)
+		return nil, false
+	}
+	if err != nil {
+		m.log.Error("failed to load device", "topic", msg.Topic(), "imei", msg.SerialNumber, "error", err)
+		return nil, false
+	}
+	return device, true
+}
+
+// handleBirth marks a device online when it announces it has connected and
+// flushes its command queue
+func (m *MQTTClient) handleBirth(ctx context.Context, msg *deviceMessage) error {
+	if msg.SerialNumber == "" {
+		return nil
+	}
+	m.commands.DeviceAwake(msg.SerialNumber)
+
+	if device, ok := m.deviceBySerial(msg); ok {
+		if err := m.presence.Seen(device, PresenceReasonBirth); err != nil {
+			m.log.Error("failed to mark device online", "imei", device.SerialNumber, "error", err)
+		}
+	}
+	return nil
+}
+
+// handleLWT marks a device offline when the broker publishes its last will
+func (m *MQTTClient) handleLWT(ctx context.Context, msg *deviceMessage) error {
+	if device, ok := m.deviceBySerial(msg); ok {
+		if err := m.presence.Offline(device, PresenceReasonLWT); err != nil {
+			m.log.Error("failed to mark device offline", "imei", device.SerialNumber, "error", err)
+		}
+	}
+	return nil
+}
+
+// getDevicePresence returns whether a device is online, how long it may stay
+// silent and its recent presence history
+func (h *APIHandler) getDevicePresence(w http.ResponseWriter, r *http.Request) {
+	device, ok := h.deviceFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 1000 {
+			writeError(w, r, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		limit = n
+	}
+
+	history, err := h.modelsFor(r).Presence.GetEventsByDevice(device.ID, limit)
+	if err != nil {
+		writeDataError(w, r, err, "Failed to get presence history")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"device_id":               device.ID,
+		"serial_number":           device.SerialNumber,
+		"online":                  device.Online,
+		"last_seen_at":            device.LastSeenAt,
+		"report_interval_seconds": int(h.presence.reportInterval(device.DeviceType).Seconds()),
+		"offline_after_seconds":   int(h.presence.offlineAfter(device.DeviceType).Seconds()),
+		"history":                 history,
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"mqtt/data"
+)
+
+// fakePresenceStore holds devices in memory and marks them offline the way
+// the database does
+type fakePresenceStore struct {
+	data.DeviceModel
+
+	devices map[uint]*data.Device
+	// seenDuringSweep, if set, is a device heard from between the sweep
+	// loading it and marking it offline
+	seenDuringSweep uint
+}
+
+func (f *fakePresenceStore) GetDevicesByPresence(online bool) ([]*data.Device, error) {
+	var devices []*data.Device
+	for _, device := range f.devices {
+		if device.Online == online {
+			copied := *device
+			devices = append(devices, &copied)
+		}
+	}
+	if device, ok := f.devices[f.seenDuringSweep]; ok {
+		now := time.Now()
+		device.LastSeenAt = &now
+	}
+	return devices, nil
+}
+
+func (f *fakePresenceStore) MarkOffline(id uint, seenBefore time.Time) (bool, error) {
+	device := f.devices[id]
+	if !device.Online {
+		return false, nil
+	}
+	if !seenBefore.IsZero() && device.LastSeenAt != nil && !device.LastSeenAt.Before(seenBefore) {
+		return false, nil
+	}
+	device.Online = false
+	return true, nil
+}
+
+type fakePresenceHistory struct {
+	data.PresenceModel
+
+	events []*data.PresenceEvent
+}
+
+func (f *fakePresenceHistory) CreateEvent(event *data.PresenceEvent) error {
+	f.events = append(f.events, event)
+	return nil
+}
+
+func TestPresenceSweep(t *testing.T) {
+	ago := func(d time.Duration) *time.Time {
+		at := time.Now().Add(-d)
+		return &at
+	}
+	devices := &fakePresenceStore{
+		devices: map[uint]*data.Device{
+			1: {ID: 1, SerialNumber: "SN-1", Online: true, LastSeenAt: ago(time.Minute)},
+			2: {ID: 2, SerialNumber: "SN-2", Online: true, LastSeenAt: ago(time.Hour)},
+			3: {ID: 3, SerialNumber: "SN-3", Online: true},
+			// Silent for longer than the default allows, but its type
+			// reports only every six hours
+			4: {ID: 4, SerialNumber: "SN-4", DeviceType: "logger", Online: true, LastSeenAt: ago(2 * time.Hour)},
+			5: {ID: 5, SerialNumber: "SN-5", Online: true, LastSeenAt: ago(time.Hour)},
+		},
+		seenDuringSweep: 5,
+	}
+	history := &fakePresenceHistory{}
+	cfg := Config{
+		PresenceDefaultInterval: 5 * time.Minute,
+		PresenceIntervals:       map[string]time.Duration{"logger": 6 * time.Hour},
+		PresenceMissedReports:   3,
+	}
+	s := NewPresenceService(&data.Models{Device: devices, Presence: history}, NewEventBus(discardLogger()), cfg, discardLogger())
+
+	s.sweep()
+	want := map[uint]bool{1: true, 2: false, 3: false, 4: true, 5: true}
+	for id, online := range want {
+		if devices.devices[id].Online != online {
+			t.Errorf("device %d online = %v, want %v", id, devices.devices[id].Online, online)
+		}
+	}
+	if len(history.events) != 2 {
+		t.Fatalf("recorded %d presence changes, want 2", len(history.events))
+	}
+	for _, event := range history.events {
+		if event.Online || event.Reason != PresenceReasonTimeout {
+			t.Errorf("presence change = %+v", event)
+		}
+	}
+}
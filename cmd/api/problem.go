@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"mqtt/data"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// problemContentType is the media type of RFC 7807 problem details
+const problemContentType = "application/problem+json"
+
+// problem is an RFC 7807 problem details object
+type problem struct {
+	Type      string            `json:"type"`
+	Title     string            `json:"title"`
+	Status    int               `json:"status"`
+	Detail    string            `json:"detail,omitempty"`
+	Instance  string            `json:"instance,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	Errors    map[string]string `json:"errors,omitempty"`
+}
+
+// writeProblem writes an RFC 7807 problem details response
+func writeProblem(w http.ResponseWriter, r *http.Request, p problem) {
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	p.Instance = r.URL.Path
+	p.RequestID = middleware.GetReqID(r.Context())
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// writeError writes an error response with a client-safe message
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	writeProblem(w, r, problem{Status: status, Detail: message})
+}
+
+// writeValidationError writes a 422 response listing the invalid fields
+func writeValidationError(w http.ResponseWriter, r *http.Request, errs fieldErrors) {
+	writeProblem(w, r, problem{
+		Status: http.StatusUnprocessableEntity,
+		Detail: "Validation failed",
+		Errors: errs,
+	})
+}
+
+// writeDataError maps an error returned by the data package onto a problem
+// response. Unexpected errors are logged with the request ID and reported
+// to the client as message alone, so SQL errors never leak.
+func writeDataError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	var validationErr *data.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		writeValidationError(w, r, validationErr.Fields)
+	case errors.Is(err, data.ErrValidation):
+		writeError(w, r, http.StatusUnprocessableEntity, "Validation failed")
+	case errors.Is(err, data.ErrNotFound):
+		writeError(w, r, http.StatusNotFound, "Resource not found")
+	case errors.Is(err, data.ErrConflict):
+		writeError(w, r, http.StatusConflict, "Resource conflicts with an existing record")
+	case errors.Is(err, data.ErrPreconditionFailed):
+		writeError(w, r, http.StatusPreconditionFailed, "Resource has been modified since it was read")
+	case errors.Is(err, data.ErrUnavailable):
+		requestLogger(r).Error(message, "method", r.Method, "path", r.URL.Path, "error", err)
+		writeError(w, r, http.StatusServiceUnavailable, "Database unavailable, try again later")
+	default:
+		requestLogger(r).Error(message, "method", r.Method, "path", r.URL.Path, "error", err)
+		writeError(w, r, http.StatusInternalServerError, message)
+	}
+}
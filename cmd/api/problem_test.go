@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"mqtt/data"
+)
+
+func TestWriteDataError(t *testing.T) {
+	invalid := (&data.Device{SerialNumber: "SN/1", DeviceType: "logger", Status: "broken"}).Validate()
+
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		fields []string
+	}{
+		{name: "invalid device", err: invalid, status: http.StatusUnprocessableEntity, fields: []string{"serial_number", "status"}},
+		{name: "wrapped invalid device", err: fmt.Errorf("invalid device SN/1: %w", invalid), status: http.StatusUnprocessableEntity, fields: []string{"serial_number", "status"}},
+		{name: "validation sentinel", err: fmt.Errorf("%w: bad row", data.ErrValidation), status: http.StatusUnprocessableEntity},
+		{name: "not found", err: data.ErrNotFound, status: http.StatusNotFound},
+		{name: "conflict", err: fmt.Errorf("%w: duplicate key", data.ErrConflict), status: http.StatusConflict},
+		{name: "precondition failed", err: data.ErrPreconditionFailed, status: http.StatusPreconditionFailed},
+		{name: "unexpected", err: errors.New("syntax error at or near"), status: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/api/v1/devices/1", nil)
+			r = r.WithContext(context.WithValue(r.Context(), loggerKey{}, discardLogger()))
+			w := httptest.NewRecorder()
+			writeDataError(w, r, tt.err, "Failed to update device")
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != problemContentType {
+				t.Fatalf("content type = %q", ct)
+			}
+			var p problem
+			if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+				t.Fatal(err)
+			}
+			if len(p.Errors) != len(tt.fields) {
+				t.Fatalf("errors = %v, want %v", p.Errors, tt.fields)
+			}
+			for _, field := range tt.fields {
+				if p.Errors[field] == "" {
+					t.Fatalf("errors = %v, want %s", p.Errors, field)
+				}
+			}
+		})
+	}
+}
+
+func TestDeviceValidate(t *testing.T) {
+	valid := data.Device{SerialNumber: "SN-1", DeviceType: "auto_registered"}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Validate = %v", err)
+	}
+
+	err := (&data.Device{SerialNumber: "SN 1"}).Validate()
+	if !errors.Is(err, data.ErrValidation) {
+		t.Fatalf("Validate = %v, want ErrValidation", err)
+	}
+	want := "validation failed: device_type is required; serial_number must not contain whitespace or MQTT topic characters"
+	if err.Error() != want {
+		t.Fatalf("Validate = %q, want %q", err, want)
+	}
+}
@@ -2,9 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"mqtt/data"
@@ -12,16 +17,54 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // APIHandler handles HTTP API requests
 type APIHandler struct {
-	models *data.Models
+	models        *data.Models
+	events        *EventBus
+	commands      *CommandService
+	shadows       *ShadowService
+	firmware      *FirmwareService
+	presence      *PresenceService
+	alerts        *AlertService
+	notifications *NotificationService
+	webhooks      *WebhookService
+	health        *HealthChecker
+	broker        Broker
+	stream        *streamHub
+	feed          *eventFeed
+	apiToken      string
+	log           *slog.Logger
 }
 
-// NewAPIHandler creates a new API handler
-func NewAPIHandler(models *data.Models) *APIHandler {
-	return &APIHandler{models: models}
+// NewAPIHandler creates a new API handler. The WebSocket and SSE streams
+// subscribe to the event bus here.
+func NewAPIHandler(models *data.Models, events *EventBus, commands *CommandService, shadows *ShadowService, firmware *FirmwareService, presence *PresenceService, alerts *AlertService, notifications *NotificationService, webhooks *WebhookService, health *HealthChecker, broker Broker, apiToken string, logger *slog.Logger) *APIHandler {
+	return &APIHandler{
+		models:        models,
+		events:        events,
+		commands:      commands,
+		shadows:       shadows,
+		firmware:      firmware,
+		presence:      presence,
+		alerts:        alerts,
+		notifications: notifications,
+		webhooks:      webhooks,
+		health:        health,
+		broker:        broker,
+		stream:        newStreamHub(events, logger),
+		feed:          newEventFeed(events, eventReplaySize),
+		apiToken:      apiToken,
+		log:           logger.With("component", "http"),
+	}
+}
+
+// modelsFor returns the models for a request, so its queries are traced as
+// children of the request span
+func (h *APIHandler) modelsFor(r *http.Request) *data.Models {
+	return h.models.WithContext(r.Context())
 }
 
 // SetupRoutes configures all the routes
@@ -29,56 +72,177 @@ func (h *APIHandler) SetupRoutes() *chi.Mux {
 	r := chi.NewRouter()
 
 	// Middleware
-	r.Use(middleware.Logger)
-	r.Use(middleware.Recoverer)
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
-	r.Use(middleware.Timeout(60 * time.Second))
+	r.Use(traceRequests)
+	r.Use(h.logRequests)
+	r.Use(middleware.Recoverer)
+	r.Use(instrumentRequests)
 
 	// CORS middleware
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "If-Match"},
+		ExposedHeaders:   []string{"Link", "ETag"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
-	// Root route
-	r.Get("/", h.rootHandler)
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.Timeout(60 * time.Second))
+
+		// Root route
+		r.Get("/", h.rootHandler)
 
-	// Health check
-	r.Get("/health", h.healthCheck)
+		// Liveness and readiness; /health is kept for existing monitors
+		r.Get("/health", h.readiness)
+		r.Get("/health/live", h.liveness)
+		r.Get("/health/ready", h.readiness)
+
+		// Prometheus metrics
+		r.Method(http.MethodGet, "/metrics", promhttp.Handler())
+	})
 
 	// API routes
 	r.Route("/api/v1", func(r chi.Router) {
-		// Device routes
-		r.Route("/devices", func(r chi.Router) {
-			r.Get("/", h.getAllDevices)
-			r.Post("/", h.createDevice)
-			r.Route("/{deviceID}", func(r chi.Router) {
-				r.Get("/", h.getDeviceByID)
-				r.Put("/", h.updateDevice)
-				r.Delete("/", h.deleteDevice)
-				r.Get("/logs", h.getDeviceLogs)
-				r.Get("/logs/latest", h.getLatestDeviceLog)
-			})
-			r.Get("/serial/{serialNumber}", h.getDeviceBySerialNumber)
-			r.Get("/serial/{serialNumber}/logs", h.getDeviceLogsBySerialNumber)
+		// Long-lived streaming routes are kept out of the request timeout
+		r.Group(func(r chi.Router) {
+			r.Use(h.requireToken)
+			r.Get("/stream", h.streamTelemetry)
+			r.Get("/events", h.streamEvents)
 		})
 
-		// Device logs routes
-		r.Route("/logs", func(r chi.Router) {
-			r.Get("/", h.getAllLogs)
-			r.Get("/imei/{imei}", h.getLogsByIMEI)
-			r.Get("/serial/{serialNumber}", h.getLogsBySerialNumber)
-		})
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.Timeout(60 * time.Second))
+
+			// Device routes
+			r.Route("/devices", func(r chi.Router) {
+				r.Get("/", h.getAllDevices)
+				r.Post("/", h.createDevice)
+				r.Post("/import", h.importDevices)
+				r.Get("/export", h.exportDevices)
+				r.Route("/{deviceID}", func(r chi.Router) {
+					r.Get("/", h.getDeviceByID)
+					r.Put("/", h.updateDevice)
+					r.Patch("/", h.patchDevice)
+					r.Delete("/", h.deleteDevice)
+					r.Post("/restore", h.restoreDevice)
+					r.Get("/logs", h.getDeviceLogs)
+					r.Get("/logs/latest", h.getLatestDeviceLog)
+					r.Post("/commands", h.createDeviceCommand)
+					r.Get("/commands", h.getDeviceCommands)
+					r.Get("/commands/queue", h.getDeviceCommandQueue)
+					r.Get("/commands/{commandID}", h.getDeviceCommand)
+					r.Get("/presence", h.getDevicePresence)
+					r.Get("/shadow", h.getDeviceShadow)
+					r.Patch("/shadow/desired", h.patchDeviceShadowDesired)
+				})
+				r.Get("/serial/{serialNumber}", h.getDeviceBySerialNumber)
+				r.Get("/serial/{serialNumber}/logs", h.getDeviceLogsBySerialNumber)
+			})
+
+			// Device logs routes
+			r.Route("/logs", func(r chi.Router) {
+				r.Get("/", h.getAllLogs)
+				r.Get("/imei/{imei}", h.getLogsByIMEI)
+				r.Get("/serial/{serialNumber}", h.getLogsBySerialNumber)
+			})
+
+			// Firmware images and OTA update campaigns
+			r.Route("/firmware", func(r chi.Router) {
+				r.Get("/", h.getFirmwareArtifacts)
+				r.Post("/", h.uploadFirmware)
+				r.Route("/{artifactID}", func(r chi.Router) {
+					r.Get("/", h.getFirmwareArtifact)
+					r.Delete("/", h.deleteFirmwareArtifact)
+					r.Get("/download", h.downloadFirmware)
+				})
+			})
+			r.Route("/campaigns", func(r chi.Router) {
+				r.Get("/", h.getCampaigns)
+				r.Post("/", h.createCampaign)
+				r.Route("/{campaignID}", func(r chi.Router) {
+					r.Get("/", h.getCampaign)
+					r.Get("/devices", h.getCampaignDevices)
+					r.Post("/start", h.startCampaign)
+					r.Post("/pause", h.pauseCampaign)
+					r.Post("/resume", h.resumeCampaign)
+					r.Post("/cancel", h.cancelCampaign)
+				})
+			})
 
-		// MQTT test routes
-		r.Route("/mqtt", func(r chi.Router) {
-			r.Post("/publish", h.publishMQTTMessage)
-			r.Get("/status", h.getMQTTStatus)
+			// Alert rules and the alerts they raise
+			r.Route("/alert-rules", func(r chi.Router) {
+				r.Get("/", h.getAlertRules)
+				r.Post("/", h.createAlertRule)
+				r.Route("/{ruleID}", func(r chi.Router) {
+					r.Get("/", h.getAlertRule)
+					r.Put("/", h.updateAlertRule)
+					r.Delete("/", h.deleteAlertRule)
+				})
+			})
+			r.Route("/alerts", func(r chi.Router) {
+				r.Get("/", h.getAlerts)
+				r.Route("/{alertID}", func(r chi.Router) {
+					r.Get("/", h.getAlert)
+					r.Post("/acknowledge", h.acknowledgeAlert)
+					r.Post("/resolve", h.resolveAlert)
+				})
+			})
+
+			// Alert notifications
+			r.Route("/notification-channels", func(r chi.Router) {
+				r.Get("/", h.getNotificationChannels)
+				r.Post("/", h.createNotificationChannel)
+				r.Route("/{channelID}", func(r chi.Router) {
+					r.Get("/", h.getNotificationChannel)
+					r.Put("/", h.updateNotificationChannel)
+					r.Delete("/", h.deleteNotificationChannel)
+					r.Post("/test", h.testNotificationChannel)
+				})
+			})
+			r.Get("/notification-deliveries", h.getNotificationDeliveries)
+			r.Route("/silences", func(r chi.Router) {
+				r.Get("/", h.getSilences)
+				r.Post("/", h.createSilence)
+				r.Get("/{silenceID}", h.getSilence)
+				r.Delete("/{silenceID}", h.expireSilence)
+			})
+			r.Route("/maintenance-windows", func(r chi.Router) {
+				r.Get("/", h.getMaintenanceWindows)
+				r.Post("/", h.createMaintenanceWindow)
+				r.Route("/{windowID}", func(r chi.Router) {
+					r.Get("/", h.getMaintenanceWindow)
+					r.Put("/", h.updateMaintenanceWindow)
+					r.Delete("/", h.deleteMaintenanceWindow)
+				})
+			})
+
+			// Outbound webhooks
+			r.Route("/webhooks", func(r chi.Router) {
+				r.Get("/", h.getWebhooks)
+				r.Post("/", h.createWebhook)
+				r.Route("/deliveries/{deliveryID}", func(r chi.Router) {
+					r.Get("/", h.getWebhookDelivery)
+					r.Post("/replay", h.replayWebhookDelivery)
+				})
+				r.Route("/{webhookID}", func(r chi.Router) {
+					r.Get("/", h.getWebhook)
+					r.Put("/", h.updateWebhook)
+					r.Delete("/", h.deleteWebhook)
+					r.Get("/deliveries", h.getWebhookDeliveries)
+					r.Post("/replay", h.replayWebhook)
+				})
+			})
+
+			r.Get("/events/stats", h.getEventStats)
+
+			// MQTT test routes
+			r.Route("/mqtt", func(r chi.Router) {
+				r.Post("/publish", h.publishMQTTMessage)
+				r.Get("/status", h.getMQTTStatus)
+			})
 		})
 	})
 
@@ -93,28 +257,34 @@ func (h *APIHandler) rootHandler(w http.ResponseWriter, r *http.Request) {
 		"status":    "running",
 		"timestamp": time.Now().UTC(),
 		"endpoints": map[string]string{
-			"health": "/health",
-			"api":    "/api/v1",
+			"live":  "/health/live",
+			"ready": "/health/ready",
+			"api":   "/api/v1",
 		},
 	}
 	writeJSON(w, http.StatusOK, response)
 }
 
-// healthCheck returns a simple health check response
-func (h *APIHandler) healthCheck(w http.ResponseWriter, r *http.Request) {
-	response := map[string]interface{}{
-		"status":    "healthy",
-		"timestamp": time.Now().UTC(),
-		"service":   "mqtt-backend",
-	}
-	writeJSON(w, http.StatusOK, response)
-}
-
-// getAllDevices returns all devices
+// getAllDevices returns all devices, or only soft-deleted ones with ?deleted=true
 func (h *APIHandler) getAllDevices(w http.ResponseWriter, r *http.Request) {
-	devices, err := h.models.Device.GetAllDevices()
+	var devices []*data.Device
+	var err error
+	online := r.URL.Query().Get("online")
+	switch {
+	case parseBoolParam(r.URL.Query().Get("deleted")):
+		devices, err = h.modelsFor(r).Device.GetDeletedDevices()
+	case online != "":
+		isOnline, parseErr := strconv.ParseBool(online)
+		if parseErr != nil {
+			writeError(w, r, http.StatusBadRequest, "online must be true or false")
+			return
+		}
+		devices, err = h.modelsFor(r).Device.GetDevicesByPresence(isOnline)
+	default:
+		devices, err = h.modelsFor(r).Device.GetAllDevices()
+	}
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get devices: %v", err))
+		writeDataError(w, r, err, "Failed to get devices")
 		return
 	}
 
@@ -126,17 +296,27 @@ func (h *APIHandler) getAllDevices(w http.ResponseWriter, r *http.Request) {
 
 // createDevice creates a new device
 func (h *APIHandler) createDevice(w http.ResponseWriter, r *http.Request) {
-	var device data.Device
-	if err := json.NewDecoder(r.Body).Decode(&device); err != nil {
-		writeError(w, http.StatusBadRequest, "Invalid request body")
+	var input deviceInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	input.normalize()
+	if errs := input.validate(); len(errs) > 0 {
+		writeValidationError(w, r, errs)
 		return
 	}
 
-	if err := h.models.Device.CreateDevice(&device); err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to create device: %v", err))
+	device := &data.Device{}
+	input.applyTo(device)
+	if err := h.modelsFor(r).Device.CreateDevice(device); err != nil {
+		writeDeviceError(w, r, err, "Failed to create device")
 		return
 	}
 
+	h.publishDeviceEvent(TopicDeviceCreated, device, EventSourceAPI)
+	w.Header().Set("ETag", deviceETag(device))
 	writeJSON(w, http.StatusCreated, device)
 }
 
@@ -145,72 +325,237 @@ func (h *APIHandler) getDeviceByID(w http.ResponseWriter, r *http.Request) {
 	deviceIDStr := chi.URLParam(r, "deviceID")
 	deviceID, err := strconv.ParseUint(deviceIDStr, 10, 32)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, "Invalid device ID")
+		writeError(w, r, http.StatusBadRequest, "Invalid device ID")
 		return
 	}
 
-	device, err := h.models.Device.GetByID(uint(deviceID))
+	device, err := h.modelsFor(r).Device.GetByID(uint(deviceID))
 	if err != nil {
-		writeError(w, http.StatusNotFound, "Device not found")
+		writeDeviceError(w, r, err, "Failed to get device")
 		return
 	}
 
+	w.Header().Set("ETag", deviceETag(device))
 	writeJSON(w, http.StatusOK, device)
 }
 
-// updateDevice updates a device
+// updateDevice replaces the editable fields of a device
 func (h *APIHandler) updateDevice(w http.ResponseWriter, r *http.Request) {
+	device, ok := h.loadDeviceForUpdate(w, r)
+	if !ok {
+		return
+	}
+
+	var input deviceInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	h.saveDeviceInput(w, r, device, input)
+}
+
+// patchDevice applies a JSON Merge Patch (RFC 7396) to a device
+func (h *APIHandler) patchDevice(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != mergePatchContentType && mediaType != "application/json" {
+		writeError(w, r, http.StatusUnsupportedMediaType, "PATCH requires "+mergePatchContentType)
+		return
+	}
+
+	device, ok := h.loadDeviceForUpdate(w, r)
+	if !ok {
+		return
+	}
+
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	current, err := json.Marshal(deviceInputFrom(device))
+	if err != nil {
+		writeDataError(w, r, err, "Failed to encode device")
+		return
+	}
+
+	patched, err := applyMergePatch(current, patch)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid merge patch: %v", err))
+		return
+	}
+
+	var input deviceInput
+	if err := json.Unmarshal(patched, &input); err != nil {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid merge patch: %v", err))
+		return
+	}
+
+	h.saveDeviceInput(w, r, device, input)
+}
+
+// loadDeviceForUpdate fetches the device named in the URL and checks the
+// If-Match precondition. It writes the error response and returns false if
+// the update must not go ahead.
+func (h *APIHandler) loadDeviceForUpdate(w http.ResponseWriter, r *http.Request) (*data.Device, bool) {
 	deviceIDStr := chi.URLParam(r, "deviceID")
 	deviceID, err := strconv.ParseUint(deviceIDStr, 10, 32)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, "Invalid device ID")
-		return
+		writeError(w, r, http.StatusBadRequest, "Invalid device ID")
+		return nil, false
 	}
 
-	var device data.Device
-	if err := json.NewDecoder(r.Body).Decode(&device); err != nil {
-		writeError(w, http.StatusBadRequest, "Invalid request body")
+	device, err := h.modelsFor(r).Device.GetByID(uint(deviceID))
+	if err != nil {
+		writeDeviceError(w, r, err, "Failed to get device")
+		return nil, false
+	}
+
+	if !ifMatches(r, deviceETag(device)) {
+		writeError(w, r, http.StatusPreconditionFailed, "Device has been modified since it was read")
+		return nil, false
+	}
+
+	return device, true
+}
+
+// saveDeviceInput validates input and writes it to device. When the request
+// carried If-Match the write only succeeds if nobody updated the device in
+// the meantime.
+func (h *APIHandler) saveDeviceInput(w http.ResponseWriter, r *http.Request, device *data.Device, input deviceInput) {
+	input.normalize()
+	if errs := input.validate(); len(errs) > 0 {
+		writeValidationError(w, r, errs)
 		return
 	}
 
-	device.ID = uint(deviceID)
-	if err := h.models.Device.UpdateDevice(&device); err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to update device: %v", err))
+	var unmodifiedSince time.Time
+	if r.Header.Get("If-Match") != "" {
+		unmodifiedSince = device.UpdatedAt
+	}
+
+	input.applyTo(device)
+	if err := h.modelsFor(r).Device.UpdateDeviceFields(device, unmodifiedSince); err != nil {
+		writeDeviceError(w, r, err, "Failed to update device")
 		return
 	}
 
+	h.publishDeviceEvent(TopicDeviceUpdated, device, EventSourceAPI)
+	w.Header().Set("ETag", deviceETag(device))
 	writeJSON(w, http.StatusOK, device)
 }
 
-// deleteDevice deletes a device
+// writeDeviceError maps a device model error onto a problem response with
+// device-specific messages
+func writeDeviceError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	switch {
+	case errors.Is(err, data.ErrNotFound):
+		writeError(w, r, http.StatusNotFound, "Device not found")
+	case errors.Is(err, data.ErrConflict):
+		writeError(w, r, http.StatusConflict, "A device with this serial number already exists")
+	case errors.Is(err, data.ErrPreconditionFailed):
+		writeError(w, r, http.StatusPreconditionFailed, "Device has been modified since it was read")
+	default:
+		writeDataError(w, r, err, message)
+	}
+}
+
+// deviceETag derives an entity tag from the device's last update time
+func deviceETag(device *data.Device) string {
+	return fmt.Sprintf(`"%d-%d"`, device.ID, device.UpdatedAt.UnixMicro())
+}
+
+// ifMatches reports whether the request's If-Match header (if any) matches etag
+func ifMatches(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteDevice soft-deletes a device, or purges it and its logs with ?hard=true
 func (h *APIHandler) deleteDevice(w http.ResponseWriter, r *http.Request) {
 	deviceIDStr := chi.URLParam(r, "deviceID")
 	deviceID, err := strconv.ParseUint(deviceIDStr, 10, 32)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, "Invalid device ID")
+		writeError(w, r, http.StatusBadRequest, "Invalid device ID")
+		return
+	}
+
+	hard := parseBoolParam(r.URL.Query().Get("hard"))
+
+	// Fetch the device first so the deleted event can describe it
+	var device *data.Device
+	if hard {
+		device, err = h.modelsFor(r).Device.GetByIDUnscoped(uint(deviceID))
+	} else {
+		device, err = h.modelsFor(r).Device.GetByID(uint(deviceID))
+	}
+	if err != nil {
+		writeDeviceError(w, r, err, "Failed to get device")
+		return
+	}
+
+	if hard {
+		if err := h.modelsFor(r).Device.PurgeDevice(device.ID); err != nil {
+			writeDeviceError(w, r, err, "Failed to purge device")
+			return
+		}
+		h.events.Publish(TopicDeviceDeleted, device.SerialNumber, DeviceEvent{Device: device, Source: EventSourceAPI, Purged: true})
+		writeJSON(w, http.StatusOK, map[string]string{"message": "Device and its logs permanently deleted"})
 		return
 	}
 
-	if err := h.models.Device.DeleteDevice(uint(deviceID)); err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to delete device: %v", err))
+	if err := h.modelsFor(r).Device.DeleteDevice(device.ID); err != nil {
+		writeDeviceError(w, r, err, "Failed to delete device")
 		return
 	}
 
+	h.publishDeviceEvent(TopicDeviceDeleted, device, EventSourceAPI)
 	writeJSON(w, http.StatusOK, map[string]string{"message": "Device deleted successfully"})
 }
 
+// restoreDevice undoes the soft delete of a device
+func (h *APIHandler) restoreDevice(w http.ResponseWriter, r *http.Request) {
+	deviceIDStr := chi.URLParam(r, "deviceID")
+	deviceID, err := strconv.ParseUint(deviceIDStr, 10, 32)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid device ID")
+		return
+	}
+
+	device, err := h.modelsFor(r).Device.RestoreDevice(uint(deviceID))
+	if err != nil {
+		writeDeviceError(w, r, err, "Failed to restore device")
+		return
+	}
+
+	h.publishDeviceEvent(TopicDeviceRestored, device, EventSourceAPI)
+
+	w.Header().Set("ETag", deviceETag(device))
+	writeJSON(w, http.StatusOK, device)
+}
+
 // getDeviceLogs returns logs for a specific device
 func (h *APIHandler) getDeviceLogs(w http.ResponseWriter, r *http.Request) {
 	deviceIDStr := chi.URLParam(r, "deviceID")
 	deviceID, err := strconv.ParseUint(deviceIDStr, 10, 32)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, "Invalid device ID")
+		writeError(w, r, http.StatusBadRequest, "Invalid device ID")
 		return
 	}
 
-	logs, err := h.models.DeviceData.GetByDeviceID(uint(deviceID))
+	logs, err := h.modelsFor(r).DeviceData.GetByDeviceID(uint(deviceID))
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get device logs: %v", err))
+		writeDataError(w, r, err, "Failed to get device logs")
 		return
 	}
 
@@ -225,13 +570,17 @@ func (h *APIHandler) getLatestDeviceLog(w http.ResponseWriter, r *http.Request)
 	deviceIDStr := chi.URLParam(r, "deviceID")
 	deviceID, err := strconv.ParseUint(deviceIDStr, 10, 32)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, "Invalid device ID")
+		writeError(w, r, http.StatusBadRequest, "Invalid device ID")
 		return
 	}
 
-	log, err := h.models.DeviceData.GetLatestByDeviceID(uint(deviceID))
+	log, err := h.modelsFor(r).DeviceData.GetLatestByDeviceID(uint(deviceID))
 	if err != nil {
-		writeError(w, http.StatusNotFound, "No logs found for device")
+		if errors.Is(err, data.ErrNotFound) {
+			writeError(w, r, http.StatusNotFound, "No logs found for device")
+			return
+		}
+		writeDataError(w, r, err, "Failed to get latest device log")
 		return
 	}
 
@@ -242,13 +591,13 @@ func (h *APIHandler) getLatestDeviceLog(w http.ResponseWriter, r *http.Request)
 func (h *APIHandler) getDeviceBySerialNumber(w http.ResponseWriter, r *http.Request) {
 	serialNumber := chi.URLParam(r, "serialNumber")
 	if serialNumber == "" {
-		writeError(w, http.StatusBadRequest, "Serial number is required")
+		writeError(w, r, http.StatusBadRequest, "Serial number is required")
 		return
 	}
 
-	device, err := h.models.Device.GetBySerialNumber(serialNumber)
+	device, err := h.modelsFor(r).Device.GetBySerialNumber(serialNumber)
 	if err != nil {
-		writeError(w, http.StatusNotFound, "Device not found")
+		writeDeviceError(w, r, err, "Failed to get device")
 		return
 	}
 
@@ -259,13 +608,13 @@ func (h *APIHandler) getDeviceBySerialNumber(w http.ResponseWriter, r *http.Requ
 func (h *APIHandler) getDeviceLogsBySerialNumber(w http.ResponseWriter, r *http.Request) {
 	serialNumber := chi.URLParam(r, "serialNumber")
 	if serialNumber == "" {
-		writeError(w, http.StatusBadRequest, "Serial number is required")
+		writeError(w, r, http.StatusBadRequest, "Serial number is required")
 		return
 	}
 
-	logs, err := h.models.DeviceData.GetBySerialNumber(serialNumber)
+	logs, err := h.modelsFor(r).DeviceData.GetBySerialNumber(serialNumber)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get device logs: %v", err))
+		writeDataError(w, r, err, "Failed to get device logs")
 		return
 	}
 
@@ -277,9 +626,9 @@ func (h *APIHandler) getDeviceLogsBySerialNumber(w http.ResponseWriter, r *http.
 
 // getAllLogs returns all device logs (with pagination)
 func (h *APIHandler) getAllLogs(w http.ResponseWriter, r *http.Request) {
-	logs, err := h.models.DeviceData.GetAllLogs()
+	logs, err := h.modelsFor(r).DeviceData.GetAllLogs()
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get logs: %v", err))
+		writeDataError(w, r, err, "Failed to get logs")
 		return
 	}
 
@@ -293,13 +642,13 @@ func (h *APIHandler) getAllLogs(w http.ResponseWriter, r *http.Request) {
 func (h *APIHandler) getLogsByIMEI(w http.ResponseWriter, r *http.Request) {
 	imei := chi.URLParam(r, "imei")
 	if imei == "" {
-		writeError(w, http.StatusBadRequest, "IMEI is required")
+		writeError(w, r, http.StatusBadRequest, "IMEI is required")
 		return
 	}
 
-	logs, err := h.models.DeviceData.GetByIMEI(imei)
+	logs, err := h.modelsFor(r).DeviceData.GetByIMEI(imei)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get logs by IMEI: %v", err))
+		writeDataError(w, r, err, "Failed to get logs by IMEI")
 		return
 	}
 
@@ -313,13 +662,13 @@ func (h *APIHandler) getLogsByIMEI(w http.ResponseWriter, r *http.Request) {
 func (h *APIHandler) getLogsBySerialNumber(w http.ResponseWriter, r *http.Request) {
 	serialNumber := chi.URLParam(r, "serialNumber")
 	if serialNumber == "" {
-		writeError(w, http.StatusBadRequest, "Serial number is required")
+		writeError(w, r, http.StatusBadRequest, "Serial number is required")
 		return
 	}
 
-	logs, err := h.models.DeviceData.GetBySerialNumber(serialNumber)
+	logs, err := h.modelsFor(r).DeviceData.GetBySerialNumber(serialNumber)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get logs by serial number: %v", err))
+		writeDataError(w, r, err, "Failed to get logs by serial number")
 		return
 	}
 
@@ -341,25 +690,37 @@ func (h *APIHandler) publishMQTTMessage(w http.ResponseWriter, r *http.Request)
 	var request struct {
 		Topic   string `json:"topic"`
 		Message string `json:"message"`
+		// QoS overrides MQTT_PUBLISH_QOS for this message
+		QoS *byte `json:"qos"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		writeError(w, http.StatusBadRequest, "Invalid request body")
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
 	if request.Topic == "" {
-		writeError(w, http.StatusBadRequest, "Topic is required")
+		writeError(w, r, http.StatusBadRequest, "Topic is required")
+		return
+	}
+	if request.QoS != nil && *request.QoS > 2 {
+		writeError(w, r, http.StatusBadRequest, "QoS must be 0, 1 or 2")
 		return
 	}
 
-	if MQTT == nil {
-		writeError(w, http.StatusServiceUnavailable, "MQTT client not available")
+	if !h.broker.IsConnected() {
+		writeError(w, r, http.StatusServiceUnavailable, "MQTT broker not connected")
 		return
 	}
 
-	if err := MQTT.Publish(request.Topic, request.Message); err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to publish message: %v", err))
+	var err error
+	if request.QoS != nil {
+		err = h.broker.PublishMessage(request.Topic, *request.QoS, false, request.Message)
+	} else {
+		err = h.broker.Publish(request.Topic, request.Message)
+	}
+	if err != nil {
+		writeDataError(w, r, err, "Failed to publish message")
 		return
 	}
 
@@ -372,24 +733,8 @@ func (h *APIHandler) publishMQTTMessage(w http.ResponseWriter, r *http.Request)
 
 // getMQTTStatus returns the current MQTT connection status
 func (h *APIHandler) getMQTTStatus(w http.ResponseWriter, r *http.Request) {
-	status := map[string]interface{}{
-		"connected": false,
-		"client":    nil,
-	}
-
-	if MQTT != nil {
-		status["connected"] = MQTT.IsConnected()
-		status["client"] = "available"
-	}
-
-	writeJSON(w, http.StatusOK, status)
-}
-
-// writeError writes an error response
-func writeError(w http.ResponseWriter, status int, message string) {
-	writeJSON(w, status, map[string]interface{}{
-		"error":   message,
-		"status":  status,
-		"message": message,
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"connected": h.broker.IsConnected(),
+		"client":    "available",
 	})
 }
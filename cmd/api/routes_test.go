@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"mqtt/data"
+)
+
+func TestIfMatches(t *testing.T) {
+	device := &data.Device{ID: 3, UpdatedAt: time.UnixMicro(1700000000123456)}
+	etag := deviceETag(device)
+	if etag != `"3-1700000000123456"` {
+		t.Fatalf("deviceETag = %s", etag)
+	}
+
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", true},
+		{"*", true},
+		{etag, true},
+		{"W/" + etag, true},
+		{`"1-1", ` + etag, true},
+		{`"3-1700000000123455"`, false},
+		{`"other"`, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("PATCH", "/api/v1/devices/3", nil)
+		if tt.header != "" {
+			r.Header.Set("If-Match", tt.header)
+		}
+		if got := ifMatches(r, etag); got != tt.want {
+			t.Errorf("ifMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mqtt/data"
+)
+
+// Shadow topics. The server publishes the difference between desired and
+// reported state to device/{serial}/shadow/delta (retained, so a sleeping
+// device gets it when it reconnects) and devices report their state as a
+// JSON merge patch on the shadow_reported subscription
+// (device/{serial}/shadow/reported by default).
+const (
+	shadowDeltaTopicFormat = "device/%s/shadow/delta"
+	shadowDeltaQoS         = 1
+
+	// shadowSaveAttempts bounds retries when another writer updates the
+	// same shadow concurrently
+	shadowSaveAttempts = 3
+)
+
+// TopicShadowUpdated is published on the event bus whenever a shadow changes
+const TopicShadowUpdated = "shadow.updated"
+
+// shadowDocument is a shadow as returned by the API, with the computed delta
+type shadowDocument struct {
+	*data.DeviceShadow
+	Delta  map[string]interface{} `json:"delta"`
+	InSync bool                   `json:"in_sync"`
+}
+
+// shadowDeltaMessage is the retained message published to the device
+type shadowDeltaMessage struct {
+	Version   int64                  `json:"version"`
+	State     map[string]interface{} `json:"state"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+// ShadowService keeps device shadows: operators change the desired state,
+// devices and incoming telemetry change the reported state, and the delta
+// between the two is pushed to the device
+type ShadowService struct {
+	models *data.Models
+	log    *slog.Logger
+	events *EventBus
+	broker Broker
+
+	// mu serialises shadow updates within this process; the version check
+	// in SaveShadow covers concurrent writers elsewhere
+	mu sync.Mutex
+}
+
+// NewShadowService creates a shadow service and subscribes it to saved
+// telemetry, which carries part of the reported state
+func NewShadowService(models *data.Models, events *EventBus, broker Broker, logger *slog.Logger) *ShadowService {
+	s := &ShadowService{
+		models: models,
+		log:    logger.With("component", "shadow"),
+		events: events,
+		broker: broker,
+	}
+	events.Subscribe("shadow", []string{TopicTelemetrySaved}, 0, s.handleTelemetry)
+	return s
+}
+
+// Get returns a device's shadow. A device without one gets an empty shadow
+// at version 0.
+func (s *ShadowService) Get(device *data.Device) (*data.DeviceShadow, error) {
+	shadow, err := s.models.Shadow.GetShadow(device.ID)
+	if errors.Is(err, data.ErrNotFound) {
+		return &data.DeviceShadow{DeviceID: device.ID, SerialNumber: device.SerialNumber}, nil
+	}
+	return shadow, err
+}
+
+// UpdateDesired applies a JSON merge patch to the desired state. If
+// expectedVersion is not negative the update only succeeds while the shadow
+// is still at that version.
+func (s *ShadowService) UpdateDesired(device *data.Device, patch []byte, expectedVersion int64) (*data.DeviceShadow, error) {
+	return s.update(device, expectedVersion, func(shadow *data.DeviceShadow) (bool, error) {
+		changed, err := mergeShadowSection(&shadow.Desired, patch)
+		if changed {
+			now := time.Now()
+			shadow.DesiredUpdatedAt = &now
+		}
+		return changed, err
+	})
+}
+
+// UpdateReported applies a JSON merge patch to the reported state
+func (s *ShadowService) UpdateReported(device *data.Device, patch []byte) (*data.DeviceShadow, error) {
+	return s.update(device, -1, func(shadow *data.DeviceShadow) (bool, error) {
+		changed, err := mergeShadowSection(&shadow.Reported, patch)
+		if changed {
+			now := time.Now()
+			shadow.ReportedUpdatedAt = &now
+		}
+		return changed, err
+	})
+}
+
+// update loads a shadow, applies change and saves it, retrying when another
+// writer got there first. Unchanged shadows are not written. A changed
+// delta is published to the device.
+func (s *ShadowService) update(device *data.Device, expectedVersion int64, change func(*data.DeviceShadow) (bool, error)) (*data.DeviceShadow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		shadow, err := s.Get(device)
+		if err != nil {
+			return nil, err
+		}
+		if expectedVersion >= 0 && shadow.Version != expectedVersion {
+			return nil, data.ErrPreconditionFailed
+		}
+
+		before := shadowDelta(shadow)
+		changed, err := change(shadow)
+		if err != nil {
+			return nil, err
+		}
+		if !changed {
+			return shadow, nil
+		}
+
+		err = s.models.Shadow.SaveShadow(shadow)
+		retryable := errors.Is(err, data.ErrPreconditionFailed) || errors.Is(err, data.ErrConflict)
+		if retryable && expectedVersion < 0 && attempt < shadowSaveAttempts {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		after := shadowDelta(shadow)
+		s.events.Publish(TopicShadowUpdated, shadow.SerialNumber, newShadowDocument(shadow))
+		if !reflect.DeepEqual(before, after) {
+			s.publishDelta(shadow, after)
+		}
+		return shadow, nil
+	}
+}
+
+// publishDelta publishes the retained delta for a device. An empty delta
+// clears the retained message.
+func (s *ShadowService) publishDelta(shadow *data.DeviceShadow, delta map[string]interface{}) {
+	if !s.broker.IsConnected() {
+		s.log.Warn("shadow delta not published", "imei", shadow.SerialNumber, "error", errMQTTUnavailable)
+		return
+	}
+
+	var payload []byte
+	if len(delta) > 0 {
+		var err error
+		payload, err = json.Marshal(shadowDeltaMessage{
+			Version:   shadow.Version,
+			State:     delta,
+			Timestamp: time.Now(),
+		})
+		if err != nil {
+			s.log.Error("failed to encode shadow delta", "imei", shadow.SerialNumber, "error", err)
+			return
+		}
+	}
+
+	topic := fmt.Sprintf(shadowDeltaTopicFormat, shadow.SerialNumber)
+	if err := s.broker.PublishMessage(topic, shadowDeltaQoS, true, payload); err != nil {
+		s.log.Error("failed to publish shadow delta", "imei", shadow.SerialNumber, "topic", topic, "error", err)
+	}
+}
+
+// handleTelemetry copies the configuration carried in every reading into
+// the reported state
+func (s *ShadowService) handleTelemetry(event Event) error {
+	entry, ok := event.Payload.(*data.DeviceData)
+	if !ok {
+		return nil
+	}
+
+	reported := map[string]interface{}{
+		"is_dht22": entry.IsDHT22,
+		"is_ds8":   entry.IsDs8,
+	}
+	if entry.FirmwareVersion != "" {
+		reported["firmware_version"] = entry.FirmwareVersion
+	}
+	patch, err := json.Marshal(reported)
+	if err != nil {
+		return err
+	}
+
+	device := &data.Device{ID: entry.DeviceID, SerialNumber: entry.SerialNumber}
+	_, err = s.UpdateReported(device, patch)
+	return err
+}
+
+// mergeShadowSection applies a merge patch to one section of a shadow and
+// reports whether its content changed
+func mergeShadowSection(section *data.JSON, patch []byte) (bool, error) {
+	patched, err := applyMergePatch(*section, patch)
+	if err != nil {
+		return false, err
+	}
+
+	var before, after interface{}
+	if !section.IsNull() {
+		if err := json.Unmarshal(*section, &before); err != nil {
+			return false, err
+		}
+	}
+	if err := json.Unmarshal(patched, &after); err != nil {
+		return false, err
+	}
+	if before == nil {
+		before = map[string]interface{}{}
+	}
+	if reflect.DeepEqual(before, after) {
+		return false, nil
+	}
+
+	*section = data.JSON(patched)
+	return true, nil
+}
+
+// shadowDelta returns the desired values that the device has not reported
+// yet. Nested objects are compared key by key.
+func shadowDelta(shadow *data.DeviceShadow) map[string]interface{} {
+	var desired, reported map[string]interface{}
+	if !shadow.Desired.IsNull() {
+		json.Unmarshal(shadow.Desired, &desired)
+	}
+	if !shadow.Reported.IsNull() {
+		json.Unmarshal(shadow.Reported, &reported)
+	}
+	return diffObjects(desired, reported)
+}
+
+// diffObjects returns the entries of desired that differ from reported
+func diffObjects(desired, reported map[string]interface{}) map[string]interface{} {
+	delta := make(map[string]interface{})
+	for key, want := range desired {
+		have, ok := reported[key]
+		wantObject, wantIsObject := want.(map[string]interface{})
+		haveObject, haveIsObject := have.(map[string]interface{})
+		switch {
+		case ok && wantIsObject && haveIsObject:
+			if nested := diffObjects(wantObject, haveObject); len(nested) > 0 {
+				delta[key] = nested
+			}
+		case !ok || !reflect.DeepEqual(want, have):
+			delta[key] = want
+		}
+	}
+	return delta
+}
+
+func newShadowDocument(shadow *data.DeviceShadow) shadowDocument {
+	delta := shadowDelta(shadow)
+	return shadowDocument{
+		DeviceShadow: shadow,
+		Delta:        delta,
+		InSync:       len(delta) == 0,
+	}
+}
+
+// shadowETag returns the entity tag of a shadow, derived from its version
+func shadowETag(shadow *data.DeviceShadow) string {
+	return fmt.Sprintf(`"%d"`, shadow.Version)
+}
+
+// ifMatchVersion parses the If-Match header of a shadow update. It returns
+// -1 when any version is acceptable and false if the header names no
+// shadow version.
+func ifMatchVersion(r *http.Request) (int64, bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return -1, true
+	}
+	version, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(header, "W/"), `"`), 10, 64)
+	if err != nil || version < 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+// handleShadowReported records the state a device reports about itself
+func (m *MQTTClient) handleShadowReported(ctx context.Context, msg *deviceMessage) error {
+	serialNumber := msg.SerialNumber
+
+	device, err := m.models.Device.GetBySerialNumber(serialNumber)
+	if errors.Is(err, data.ErrNotFound) {
+		m.msgLog.Warn("ignoring shadow report from unknown device", "topic", msg.Topic(), "imei", serialNumber)
+		return nil
+	}
+	if err != nil {
+		m.log.Error("failed to load device for shadow report", "imei", serialNumber, "error", err)
+		return retryableMessageError(err)
+	}
+
+	if _, err := m.shadows.UpdateReported(device, msg.Payload()); err != nil {
+		m.msgLog.Warn("failed to process shadow report", "topic", msg.Topic(), "imei", serialNumber, "error", err)
+		return retryableMessageError(err)
+	}
+	return nil
+}
+
+// getDeviceShadow returns a device's desired and reported state and the
+// delta between them
+func (h *APIHandler) getDeviceShadow(w http.ResponseWriter, r *http.Request) {
+	device, ok := h.deviceFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	shadow, err := h.shadows.Get(device)
+	if err != nil {
+		writeDataError(w, r, err, "Failed to get shadow")
+		return
+	}
+
+	w.Header().Set("ETag", shadowETag(shadow))
+	writeJSON(w, http.StatusOK, newShadowDocument(shadow))
+}
+
+// patchDeviceShadowDesired merges a JSON merge patch into the desired state.
+// If-Match with the shadow's ETag makes the update conditional.
+func (h *APIHandler) patchDeviceShadowDesired(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != mergePatchContentType && mediaType != "application/json" {
+		writeError(w, r, http.StatusUnsupportedMediaType, "PATCH requires "+mergePatchContentType)
+		return
+	}
+
+	device, ok := h.deviceFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	expectedVersion, ok := ifMatchVersion(r)
+	if !ok {
+		writeError(w, r, http.StatusPreconditionFailed, "If-Match does not name a shadow version")
+		return
+	}
+
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(patch, &object); err != nil || object == nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid merge patch: must be a JSON object")
+		return
+	}
+
+	shadow, err := h.shadows.UpdateDesired(device, patch, expectedVersion)
+	if err != nil {
+		if errors.Is(err, data.ErrPreconditionFailed) {
+			writeError(w, r, http.StatusPreconditionFailed, "Shadow has been modified since it was read")
+			return
+		}
+		writeDataError(w, r, err, "Failed to update shadow")
+		return
+	}
+
+	w.Header().Set("ETag", shadowETag(shadow))
+	writeJSON(w, http.StatusOK, newShadowDocument(shadow))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"mqtt/data"
+)
+
+func TestShadowDelta(t *testing.T) {
+	tests := []struct {
+		name     string
+		desired  string
+		reported string
+		want     string
+	}{
+		{name: "empty shadow", want: `{}`},
+		{name: "nothing reported", desired: `{"led":"on"}`, want: `{"led":"on"}`},
+		{name: "in sync", desired: `{"led":"on","rate":5}`, reported: `{"led":"on","rate":5,"battery":90}`, want: `{}`},
+		{name: "changed value", desired: `{"led":"on","rate":5}`, reported: `{"led":"off","rate":5}`, want: `{"led":"on"}`},
+		{name: "number equality", desired: `{"rate":5}`, reported: `{"rate":5.0}`, want: `{}`},
+		{name: "nested key", desired: `{"net":{"apn":"iot","band":3}}`, reported: `{"net":{"apn":"iot","band":20}}`, want: `{"net":{"band":3}}`},
+		{name: "nested in sync", desired: `{"net":{"apn":"iot"}}`, reported: `{"net":{"apn":"iot","rssi":-70}}`, want: `{}`},
+		{name: "object against scalar", desired: `{"net":{"apn":"iot"}}`, reported: `{"net":"none"}`, want: `{"net":{"apn":"iot"}}`},
+		{name: "arrays compared whole", desired: `{"ports":[1,2]}`, reported: `{"ports":[1,2,3]}`, want: `{"ports":[1,2]}`},
+		{name: "null desired", desired: `{"led":null}`, reported: `{"led":"on"}`, want: `{"led":null}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shadow := &data.DeviceShadow{}
+			if tt.desired != "" {
+				shadow.Desired = data.JSON(tt.desired)
+			}
+			if tt.reported != "" {
+				shadow.Reported = data.JSON(tt.reported)
+			}
+			got, err := json.Marshal(shadowDelta(shadow))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !jsonEqual(t, got, []byte(tt.want)) {
+				t.Fatalf("delta = %s, want %s", got, tt.want)
+			}
+			if document := newShadowDocument(shadow); document.InSync != (tt.want == `{}`) {
+				t.Fatalf("in sync = %v for delta %s", document.InSync, got)
+			}
+		})
+	}
+}
+
+func TestMergeShadowSection(t *testing.T) {
+	tests := []struct {
+		name    string
+		section string
+		patch   string
+		want    string
+		changed bool
+		wantErr bool
+	}{
+		{name: "first value", patch: `{"led":"on"}`, want: `{"led":"on"}`, changed: true},
+		{name: "empty patch on empty section", patch: `{}`, changed: false},
+		{name: "same value", section: `{"led":"on"}`, patch: `{"led":"on"}`, want: `{"led":"on"}`, changed: false},
+		{name: "new key", section: `{"led":"on"}`, patch: `{"rate":5}`, want: `{"led":"on","rate":5}`, changed: true},
+		{name: "removed key", section: `{"led":"on","rate":5}`, patch: `{"rate":null}`, want: `{"led":"on"}`, changed: true},
+		{name: "removing a missing key", section: `{"led":"on"}`, patch: `{"rate":null}`, want: `{"led":"on"}`, changed: false},
+		{name: "nested", section: `{"net":{"apn":"iot"}}`, patch: `{"net":{"band":3}}`, want: `{"net":{"apn":"iot","band":3}}`, changed: true},
+		{name: "not an object", section: `{"led":"on"}`, patch: `["led"]`, want: `{"led":"on"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var section data.JSON
+			if tt.section != "" {
+				section = data.JSON(tt.section)
+			}
+			changed, err := mergeShadowSection(&section, []byte(tt.patch))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mergeShadowSection = %v, want error %v", err, tt.wantErr)
+			}
+			if changed != tt.changed {
+				t.Fatalf("changed = %v, want %v", changed, tt.changed)
+			}
+			if tt.want == "" {
+				if !section.IsNull() {
+					t.Fatalf("section = %s, want it left empty", section)
+				}
+				return
+			}
+			if !jsonEqual(t, section, []byte(tt.want)) {
+				t.Fatalf("section = %s, want %s", section, tt.want)
+			}
+		})
+	}
+}
+
+func TestIfMatchVersion(t *testing.T) {
+	tests := []struct {
+		header  string
+		version int64
+		ok      bool
+	}{
+		{"", -1, true},
+		{"*", -1, true},
+		{`"4"`, 4, true},
+		{`W/"4"`, 4, true},
+		{"4", 4, true},
+		{`"-1"`, 0, false},
+		{`"3-1700000000123456"`, 0, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("PATCH", "/", nil)
+		if tt.header != "" {
+			r.Header.Set("If-Match", tt.header)
+		}
+		version, ok := ifMatchVersion(r)
+		if version != tt.version || ok != tt.ok {
+			t.Errorf("ifMatchVersion(%q) = %d, %v, want %d, %v", tt.header, version, ok, tt.version, tt.ok)
+		}
+	}
+	if etag := shadowETag(&data.DeviceShadow{Version: 4}); etag != `"4"` {
+		t.Errorf("shadowETag = %s", etag)
+	}
+}
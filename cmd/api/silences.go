@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"mqtt/data"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	maxSilenceDuration     = 90 * 24 * time.Hour
+	maxMaintenanceDuration = 7 * 24 * 60
+)
+
+// suppression returns why notifications for an alert are suppressed at now,
+// or "" if they are not
+func (s *NotificationService) suppression(alert *data.Alert, now time.Time) string {
+	// The device may have been deleted since the alert opened; scopes that
+	// need it then no longer match
+	device, _ := s.models.Device.GetByID(alert.DeviceID)
+
+	silences, err := s.models.Notification.GetSilences(&now)
+	if err != nil {
+		s.log.Error("failed to load silences", "error", err)
+	}
+	for _, silence := range silences {
+		if silenceMatches(silence, alert, device) {
+			return fmt.Sprintf("silenced by silence %d", silence.ID)
+		}
+	}
+
+	windows, err := s.models.Notification.GetWindows()
+	if err != nil {
+		s.log.Error("failed to load maintenance windows", "error", err)
+	}
+	for _, window := range windows {
+		if windowMatches(window, alert.DeviceID, device) && windowActive(window, now) {
+			return fmt.Sprintf("in maintenance window %q", window.Name)
+		}
+	}
+	return ""
+}
+
+// silenceMatches reports whether every matcher of a silence matches an alert
+func silenceMatches(silence *data.Silence, alert *data.Alert, device *data.Device) bool {
+	if silence.RuleID != nil && *silence.RuleID != alert.RuleID {
+		return false
+	}
+	if silence.DeviceID != nil && *silence.DeviceID != alert.DeviceID {
+		return false
+	}
+	if silence.Severity != "" && silence.Severity != alert.Severity {
+		return false
+	}
+	return silence.DeviceType == "" || (device != nil && device.DeviceType == silence.DeviceType)
+}
+
+// windowMatches reports whether a device is in a maintenance window's scope
+func windowMatches(window *data.MaintenanceWindow, deviceID uint, device *data.Device) bool {
+	if window.DeviceID != nil && *window.DeviceID != deviceID {
+		return false
+	}
+	if window.DeviceType == "" && len(window.Tags) == 0 {
+		return true
+	}
+	if device == nil || (window.DeviceType != "" && device.DeviceType != window.DeviceType) {
+		return false
+	}
+	for _, tag := range window.Tags {
+		if !slices.Contains(device.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// windowActive reports whether a maintenance window is open at now. A
+// window that started on an earlier day may still be running.
+func windowActive(window *data.MaintenanceWindow, now time.Time) bool {
+	location, err := time.LoadLocation(window.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	start, err := time.Parse("15:04", window.StartTime)
+	if err != nil {
+		return false
+	}
+	duration := time.Duration(window.DurationMinutes) * time.Minute
+	local := now.In(location)
+
+	for days := 0; days <= maxMaintenanceDuration/(24*60); days++ {
+		day := local.AddDate(0, 0, -days)
+		opens := time.Date(day.Year(), day.Month(), day.Day(), start.Hour(), start.Minute(), 0, 0, location)
+		if len(window.Weekdays) > 0 && !slices.Contains(window.Weekdays, int(opens.Weekday())) {
+			continue
+		}
+		if !local.Before(opens) && local.Before(opens.Add(duration)) {
+			return true
+		}
+	}
+	return false
+}
+
+// silenceInput is the body of POST /silences. The end is given either as
+// ends_at or as a duration such as "2h".
+type silenceInput struct {
+	RuleID     *uint      `json:"rule_id"`
+	DeviceID   *uint      `json:"device_id"`
+	DeviceType string     `json:"device_type"`
+	Severity   string     `json:"severity"`
+	StartsAt   *time.Time `json:"starts_at"`
+	EndsAt     *time.Time `json:"ends_at"`
+	Duration   string     `json:"duration"`
+	Comment    string     `json:"comment"`
+	CreatedBy  string     `json:"created_by"`
+}
+
+// silence validates the input and builds the silence
+func (in *silenceInput) silence(now time.Time) (*data.Silence, fieldErrors) {
+	errs := fieldErrors{}
+	silence := &data.Silence{
+		RuleID:     in.RuleID,
+		DeviceID:   in.DeviceID,
+		DeviceType: strings.TrimSpace(in.DeviceType),
+		Severity:   strings.ToLower(strings.TrimSpace(in.Severity)),
+		StartsAt:   now,
+		Comment:    strings.TrimSpace(in.Comment),
+		CreatedBy:  strings.TrimSpace(in.CreatedBy),
+	}
+	if in.StartsAt != nil {
+		silence.StartsAt = *in.StartsAt
+	}
+
+	switch {
+	case in.EndsAt != nil && in.Duration != "":
+		errs["ends_at"] = "cannot be combined with duration"
+	case in.EndsAt != nil:
+		silence.EndsAt = *in.EndsAt
+	case in.Duration != "":
+		d, err := time.ParseDuration(in.Duration)
+		if err != nil || d <= 0 {
+			errs["duration"] = `must be a positive duration such as "2h"`
+		}
+		silence.EndsAt = silence.StartsAt.Add(d)
+	default:
+		errs["ends_at"] = "ends_at or duration is required"
+	}
+	if len(errs) == 0 {
+		switch {
+		case !silence.EndsAt.After(silence.StartsAt):
+			errs["ends_at"] = "must be after starts_at"
+		case !silence.EndsAt.After(now):
+			errs["ends_at"] = "must be in the future"
+		case silence.EndsAt.Sub(silence.StartsAt) > maxSilenceDuration:
+			errs["ends_at"] = "silences can last at most 90 days"
+		}
+	}
+
+	if silence.Severity != "" && !slices.Contains(data.AlertSeverities, silence.Severity) {
+		errs["severity"] = fmt.Sprintf("must be one of %s", strings.Join(data.AlertSeverities, ", "))
+	}
+	if len(silence.DeviceType) > 50 {
+		errs["device_type"] = "must be at most 50 characters"
+	}
+	if len(silence.Comment) > 500 {
+		errs["comment"] = "must be at most 500 characters"
+	}
+	if len(silence.CreatedBy) > 100 {
+		errs["created_by"] = "must be at most 100 characters"
+	}
+	return silence, errs
+}
+
+// getSilences lists silences, newest first; ?active=true only returns the
+// ones in effect now
+func (h *APIHandler) getSilences(w http.ResponseWriter, r *http.Request) {
+	var activeAt *time.Time
+	if value := r.URL.Query().Get("active"); value != "" {
+		active, err := strconv.ParseBool(value)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "active must be true or false")
+			return
+		}
+		if active {
+			now := time.Now()
+			activeAt = &now
+		}
+	}
+
+	silences, err := h.modelsFor(r).Notification.GetSilences(activeAt)
+	if err != nil {
+		writeDataError(w, r, err, "Failed to get silences")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"silences": silences,
+		"count":    len(silences),
+	})
+}
+
+// getSilence returns one silence
+func (h *APIHandler) getSilence(w http.ResponseWriter, r *http.Request) {
+	silence, ok := h.silenceFromURL(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, silence)
+}
+
+// createSilence suppresses notifications for matching alerts for a while
+func (h *APIHandler) createSilence(w http.ResponseWriter, r *http.Request) {
+	var input silenceInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	silence, errs := input.silence(time.Now())
+	if len(errs) > 0 {
+		writeValidationError(w, r, errs)
+		return
+	}
+
+	if err := h.modelsFor(r).Notification.CreateSilence(silence); err != nil {
+		writeDataError(w, r, err, "Failed to create silence")
+		return
+	}
+	writeJSON(w, http.StatusCreated, silence)
+}
+
+// expireSilence ends a silence now. It is kept for reference.
+func (h *APIHandler) expireSilence(w http.ResponseWriter, r *http.Request) {
+	silence, ok := h.silenceFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	if silence.EndsAt.After(now) {
+		silence.EndsAt = now
+		if silence.StartsAt.After(now) {
+			silence.StartsAt = now
+		}
+		if err := h.modelsFor(r).Notification.UpdateSilence(silence); err != nil {
+			writeDataError(w, r, err, "Failed to expire silence")
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Silence expired successfully"})
+}
+
+// maintenanceWindowInput is the body of POST and PUT /maintenance-windows
+type maintenanceWindowInput struct {
+	Name            string   `json:"name"`
+	DeviceID        *uint    `json:"device_id"`
+	DeviceType      string   `json:"device_type"`
+	Tags            []string `json:"tags"`
+	Weekdays        []int    `json:"weekdays"`
+	StartTime       string   `json:"start_time"`
+	DurationMinutes int      `json:"duration_minutes"`
+	Timezone        string   `json:"timezone"`
+}
+
+// validate trims and checks the input
+func (in *maintenanceWindowInput) validate() fieldErrors {
+	errs := fieldErrors{}
+	in.Name = strings.TrimSpace(in.Name)
+	in.DeviceType = strings.TrimSpace(in.DeviceType)
+	in.Tags = normalizeTags(in.Tags)
+	in.StartTime = strings.TrimSpace(in.StartTime)
+	in.Timezone = strings.TrimSpace(in.Timezone)
+	if in.Timezone == "" {
+		in.Timezone = "UTC"
+	}
+
+	switch {
+	case in.Name == "":
+		errs["name"] = "is required"
+	case len(in.Name) > 100:
+		errs["name"] = "must be at most 100 characters"
+	}
+	if len(in.DeviceType) > 50 {
+		errs["device_type"] = "must be at most 50 characters"
+	}
+	for _, tag := range in.Tags {
+		if !tagPattern.MatchString(tag) {
+			errs["tags"] = fmt.Sprintf("invalid tag %q", tag)
+			break
+		}
+	}
+	for _, day := range in.Weekdays {
+		if day < 0 || day > 6 {
+			errs["weekdays"] = "must only contain 0 (Sunday) to 6 (Saturday)"
+		}
+	}
+	if _, err := time.Parse("15:04", in.StartTime); err != nil {
+		errs["start_time"] = `must be a time of day such as "02:30"`
+	}
+	if in.DurationMinutes < 1 || in.DurationMinutes > maxMaintenanceDuration {
+		errs["duration_minutes"] = fmt.Sprintf("must be between 1 and %d", maxMaintenanceDuration)
+	}
+	if _, err := time.LoadLocation(in.Timezone); err != nil {
+		errs["timezone"] = `must be an IANA time zone such as "Africa/Kampala"`
+	}
+	return errs
+}
+
+// applyTo copies the input onto a maintenance window
+func (in *maintenanceWindowInput) applyTo(window *data.MaintenanceWindow) {
+	window.Name = in.Name
+	window.DeviceID = in.DeviceID
+	window.DeviceType = in.DeviceType
+	window.Tags = in.Tags
+	window.Weekdays = in.Weekdays
+	window.StartTime = in.StartTime
+	window.DurationMinutes = in.DurationMinutes
+	window.Timezone = in.Timezone
+}
+
+// maintenanceWindowResponse adds whether the window is open now
+type maintenanceWindowResponse struct {
+	*data.MaintenanceWindow
+	Active bool `json:"active"`
+}
+
+func newMaintenanceWindowResponse(window *data.MaintenanceWindow, now time.Time) maintenanceWindowResponse {
+	return maintenanceWindowResponse{MaintenanceWindow: window, Active: windowActive(window, now)}
+}
+
+// getMaintenanceWindows lists all maintenance windows
+func (h *APIHandler) getMaintenanceWindows(w http.ResponseWriter, r *http.Request) {
+	windows, err := h.modelsFor(r).Notification.GetWindows()
+	if err != nil {
+		writeDataError(w, r, err, "Failed to get maintenance windows")
+		return
+	}
+
+	now := time.Now()
+	response := make([]maintenanceWindowResponse, len(windows))
+	for i, window := range windows {
+		response[i] = newMaintenanceWindowResponse(window, now)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"windows": response,
+		"count":   len(response),
+	})
+}
+
+// getMaintenanceWindow returns one maintenance window
+func (h *APIHandler) getMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	window, ok := h.windowFromURL(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, newMaintenanceWindowResponse(window, time.Now()))
+}
+
+// createMaintenanceWindow creates a maintenance window
+func (h *APIHandler) createMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	window := &data.MaintenanceWindow{}
+	if !h.saveMaintenanceWindow(w, r, window) {
+		return
+	}
+	writeJSON(w, http.StatusCreated, newMaintenanceWindowResponse(window, time.Now()))
+}
+
+// updateMaintenanceWindow replaces a maintenance window
+func (h *APIHandler) updateMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	window, ok := h.windowFromURL(w, r)
+	if !ok {
+		return
+	}
+	if !h.saveMaintenanceWindow(w, r, window) {
+		return
+	}
+	writeJSON(w, http.StatusOK, newMaintenanceWindowResponse(window, time.Now()))
+}
+
+// saveMaintenanceWindow decodes and validates a window from the request body
+// and saves it. It writes the error response and returns false if that
+// fails.
+func (h *APIHandler) saveMaintenanceWindow(w http.ResponseWriter, r *http.Request, window *data.MaintenanceWindow) bool {
+	var input maintenanceWindowInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return false
+	}
+	if errs := input.validate(); len(errs) > 0 {
+		writeValidationError(w, r, errs)
+		return false
+	}
+
+	isNew := window.ID == 0
+	input.applyTo(window)
+	var err error
+	if isNew {
+		err = h.modelsFor(r).Notification.CreateWindow(window)
+	} else {
+		err = h.modelsFor(r).Notification.UpdateWindow(window)
+	}
+	if err != nil {
+		writeDataError(w, r, err, "Failed to save maintenance window")
+		return false
+	}
+	return true
+}
+
+// deleteMaintenanceWindow removes a maintenance window
+func (h *APIHandler) deleteMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	window, ok := h.windowFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.modelsFor(r).Notification.DeleteWindow(window.ID); err != nil {
+		writeDataError(w, r, err, "Failed to delete maintenance window")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Maintenance window deleted successfully"})
+}
+
+// silenceFromURL loads the silence named by the silenceID URL parameter. It
+// writes the error response and returns false if that fails.
+func (h *APIHandler) silenceFromURL(w http.ResponseWriter, r *http.Request) (*data.Silence, bool) {
+	silenceID, err := strconv.ParseUint(chi.URLParam(r, "silenceID"), 10, 32)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid silence ID")
+		return nil, false
+	}
+
+	silence, err := h.modelsFor(r).Notification.GetSilence(uint(silenceID))
+	if err != nil {
+		if errors.Is(err, data.ErrNotFound) {
+			writeError(w, r, http.StatusNotFound, "Silence not found")
+			return nil, false
+		}
+		writeDataError(w, r, err, "Failed to get silence")
+		return nil, false
+	}
+	return silence, true
+}
+
+// windowFromURL loads the maintenance window named by the windowID URL
+// parameter. It writes the error response and returns false if that fails.
+func (h *APIHandler) windowFromURL(w http.ResponseWriter, r *http.Request) (*data.MaintenanceWindow, bool) {
+	windowID, err := strconv.ParseUint(chi.URLParam(r, "windowID"), 10, 32)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid maintenance window ID")
+		return nil, false
+	}
+
+	window, err := h.modelsFor(r).Notification.GetWindow(uint(windowID))
+	if err != nil {
+		if errors.Is(err, data.ErrNotFound) {
+			writeError(w, r, http.StatusNotFound, "Maintenance window not found")
+			return nil, false
+		}
+		writeDataError(w, r, err, "Failed to get maintenance window")
+		return nil, false
+	}
+	return window, true
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mqtt/data"
+)
+
+const (
+	spoolReplayInterval = 10 * time.Second
+	spoolFileSuffix     = ".json"
+	// spoolBadSuffix marks entries that can never be saved, kept for
+	// inspection instead of being replayed forever
+	spoolBadSuffix = ".bad"
+)
+
+// telemetrySpool keeps readings that could not be saved while the database
+// was unavailable, one file per reading, so the MQTT message can still be
+// acknowledged. Entries are replayed in the order they were written.
+type telemetrySpool struct {
+	dir string
+	seq atomic.Uint64
+	// mu keeps replays from running concurrently
+	mu sync.Mutex
+}
+
+// newTelemetrySpool creates a spool in dir
+func newTelemetrySpool(dir string) (*telemetrySpool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %v", err)
+	}
+	return &telemetrySpool{dir: dir}, nil
+}
+
+// Add durably writes a reading to the spool. Once it returns nil, the
+// reading survives a crash.
+func (s *telemetrySpool) Add(entry *data.DeviceData) error {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// Names sort in write order; the sequence separates readings spooled
+	// within the same nanosecond
+	name := fmt.Sprintf("%020d-%010d%s", time.Now().UnixNano(), s.seq.Add(1), spoolFileSuffix)
+	tmp, err := os.CreateTemp(s.dir, ".spool-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(payload); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, name)); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// Len returns the number of readings waiting in the spool
+func (s *telemetrySpool) Len() int {
+	names, err := s.entries()
+	if err != nil {
+		return 0
+	}
+	return len(names)
+}
+
+// Replay hands spooled readings to save, oldest first, removing each one
+// that is saved. It stops at the first data.ErrUnavailable so readings stay
+// in order; readings failing for any other reason are set aside with a
+// .bad suffix. It returns how many readings were saved.
+func (s *telemetrySpool) Replay(save func(*data.DeviceData) error) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names, err := s.entries()
+	if err != nil {
+		return 0, err
+	}
+	saved := 0
+	for _, name := range names {
+		path := filepath.Join(s.dir, name)
+		payload, err := os.ReadFile(path)
+		if err != nil {
+			return saved, err
+		}
+		var entry data.DeviceData
+		if err := json.Unmarshal(payload, &entry); err != nil {
+			s.setAside(path)
+			return saved, fmt.Errorf("corrupt spool entry %s: %v", name, err)
+		}
+		if err := save(&entry); err != nil {
+			if errors.Is(err, data.ErrUnavailable) {
+				return saved, err
+			}
+			s.setAside(path)
+			return saved, fmt.Errorf("spool entry %s cannot be saved: %v", name, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return saved, err
+		}
+		saved++
+	}
+	return saved, nil
+}
+
+// entries returns the names of spooled readings, oldest first
+func (s *telemetrySpool) entries() ([]string, error) {
+	dirEntries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range dirEntries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), spoolFileSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *telemetrySpool) setAside(path string) {
+	os.Rename(path, path+spoolBadSuffix)
+}
+
+// syncDir flushes a directory so a file renamed into it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
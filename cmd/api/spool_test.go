@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"mqtt/data"
+)
+
+func TestSpoolReplayOrder(t *testing.T) {
+	spool, err := newTelemetrySpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if err := spool.Add(&data.DeviceData{SerialNumber: fmt.Sprintf("SN-%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := spool.Len(); n != 5 {
+		t.Fatalf("Len = %d, want 5", n)
+	}
+
+	// The database goes away again after two readings
+	var saved []string
+	saved2, err := spool.Replay(func(entry *data.DeviceData) error {
+		if len(saved) == 2 {
+			return data.ErrUnavailable
+		}
+		saved = append(saved, entry.SerialNumber)
+		return nil
+	})
+	if !errors.Is(err, data.ErrUnavailable) || saved2 != 2 {
+		t.Fatalf("Replay = %d, %v; want 2, ErrUnavailable", saved2, err)
+	}
+	if n := spool.Len(); n != 3 {
+		t.Fatalf("Len = %d after a partial replay, want 3", n)
+	}
+
+	// Readings spooled meanwhile come after the older ones
+	spool.Add(&data.DeviceData{SerialNumber: "SN-6"})
+	if _, err := spool.Replay(func(entry *data.DeviceData) error {
+		saved = append(saved, entry.SerialNumber)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"SN-1", "SN-2", "SN-3", "SN-4", "SN-5", "SN-6"}; !slices.Equal(saved, want) {
+		t.Fatalf("saved %v, want %v", saved, want)
+	}
+	if n := spool.Len(); n != 0 {
+		t.Fatalf("Len = %d after a full replay", n)
+	}
+}
+
+func TestSpoolSetsAsideBadEntries(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := newTelemetrySpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool.Add(&data.DeviceData{SerialNumber: "SN-1"})
+	spool.Add(&data.DeviceData{SerialNumber: "SN-2"})
+
+	if _, err := spool.Replay(func(entry *data.DeviceData) error {
+		if entry.SerialNumber == "SN-1" {
+			return errors.New("device was deleted")
+		}
+		return nil
+	}); err == nil || !strings.Contains(err.Error(), "cannot be saved") {
+		t.Fatalf("Replay = %v, want the failing entry reported", err)
+	}
+	// The rest is replayed on the next run
+	var saved []string
+	if _, err := spool.Replay(func(entry *data.DeviceData) error {
+		saved = append(saved, entry.SerialNumber)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(saved, []string{"SN-2"}) {
+		t.Fatalf("saved %v", saved)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000000-0000000000.json"), []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := spool.Replay(func(*data.DeviceData) error { return nil }); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Fatalf("Replay = %v, want the corrupt entry reported", err)
+	}
+	bad, _ := filepath.Glob(filepath.Join(dir, "*"+spoolBadSuffix))
+	if len(bad) != 2 || spool.Len() != 0 {
+		t.Fatalf("set aside %v, %d left", bad, spool.Len())
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"mqtt/data"
+)
+
+const (
+	eventReplaySize      = 1024
+	sseConnectionQueue   = 256
+	sseHeartbeatInterval = 15 * time.Second
+	sseRetryMillis       = 3000
+
+	// sseResyncEvent tells a client that its Last-Event-ID cannot be
+	// resumed and it must reload its state
+	sseResyncEvent = "resync"
+)
+
+// sseTopics are the bus topics forwarded to Server-Sent Events clients
+var sseTopics = []string{
+	TopicTelemetrySaved,
+	"device.*",
+	"command.*",
+	"shadow.*",
+	"campaign.*",
+	"alert.*",
+}
+
+// eventFeed relays bus events to SSE connections and keeps the most recent
+// ones in a ring buffer so clients can resume after a disconnect
+type eventFeed struct {
+	mu       sync.Mutex
+	ring     []Event
+	ringNext int
+	ringFull bool
+	clients  map[chan Event]struct{}
+}
+
+// newEventFeed creates a feed and subscribes it to the bus
+func newEventFeed(bus *EventBus, replaySize int) *eventFeed {
+	feed := &eventFeed{
+		ring:    make([]Event, replaySize),
+		clients: make(map[chan Event]struct{}),
+	}
+	bus.Subscribe("sse", sseTopics, 0, feed.handle)
+	return feed
+}
+
+// handle records an event and fans it out. Connections whose queue is full
+// are closed so they resume from the replay buffer instead of stalling
+// the feed.
+func (f *eventFeed) handle(event Event) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.ring[f.ringNext] = event
+	f.ringNext = (f.ringNext + 1) % len(f.ring)
+	if f.ringNext == 0 {
+		f.ringFull = true
+	}
+
+	for ch := range f.clients {
+		select {
+		case ch <- event:
+		default:
+			delete(f.clients, ch)
+			close(ch)
+		}
+	}
+	return nil
+}
+
+// subscribe returns the buffered events newer than lastID followed by a
+// channel of live events. Replay and subscription happen atomically so no
+// event is missed or duplicated. resumed is false when lastID is set but no
+// longer buffered, or was never issued by this instance, so the events in
+// between cannot be replayed. The returned function unsubscribes.
+func (f *eventFeed) subscribe(lastID uint64) (replay []Event, resumed bool, events <-chan Event, cancel func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	resumed = true
+	if lastID > 0 {
+		replay, resumed = f.since(lastID)
+	}
+
+	ch := make(chan Event, sseConnectionQueue)
+	f.clients[ch] = struct{}{}
+
+	cancel = func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.clients[ch]; ok {
+			delete(f.clients, ch)
+			close(ch)
+		}
+	}
+	return replay, resumed, ch, cancel
+}
+
+// since returns the buffered events with an ID greater than lastID, oldest
+// first, and whether lastID itself is still buffered. Event IDs are not
+// contiguous, since the feed skips some topics, so only a buffered lastID
+// proves that nothing after it was evicted. The caller must hold f.mu.
+func (f *eventFeed) since(lastID uint64) ([]Event, bool) {
+	start, count := 0, f.ringNext
+	if f.ringFull {
+		start, count = f.ringNext, len(f.ring)
+	}
+
+	var events []Event
+	found := false
+	for i := 0; i < count; i++ {
+		event := f.ring[(start+i)%len(f.ring)]
+		switch {
+		case event.ID == lastID:
+			found = true
+		case event.ID > lastID:
+			events = append(events, event)
+		}
+	}
+	if !found {
+		return nil, false
+	}
+	return events, true
+}
+
+// latestID returns the ID of the newest buffered event, or 0 if there is
+// none
+func (f *eventFeed) latestID() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.ringFull && f.ringNext == 0 {
+		return 0
+	}
+	return f.ring[(f.ringNext+len(f.ring)-1)%len(f.ring)].ID
+}
+
+// streamEvents serves bus events as a Server-Sent Events stream. The SSE
+// event name is the bus topic. The types and devices query parameters
+// (comma-separated) filter the stream, and Last-Event-ID (header or
+// last_event_id parameter) resumes it. The replay buffer is per instance,
+// so an ID this instance cannot resume from gets a resync event instead.
+func (h *APIHandler) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	types := splitList(r.URL.Query().Get("types"))
+	devices := splitList(r.URL.Query().Get("devices"))
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var lastID uint64
+	if lastEventID != "" {
+		id, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid Last-Event-ID")
+			return
+		}
+		lastID = id
+	}
+
+	replay, resumed, events, cancel := h.feed.subscribe(lastID)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetryMillis)
+
+	send := func(event Event) error {
+		if len(types) > 0 && !containsTopic(types, event.Topic) {
+			return nil
+		}
+		if len(devices) > 0 && !containsString(devices, event.Device) {
+			return nil
+		}
+		payload, err := json.Marshal(sseEvent(event))
+		if err != nil {
+			return nil
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Topic, payload)
+		return err
+	}
+
+	if !resumed {
+		// Events since lastID are gone, or were published on another
+		// instance. Clients reload their state over REST and carry on from
+		// the newest event here; an empty id clears Last-Event-ID when there
+		// is none yet.
+		id := ""
+		if latest := h.feed.latestID(); latest > 0 {
+			id = strconv.FormatUint(latest, 10)
+		}
+		payload, _ := json.Marshal(map[string]string{"last_event_id": lastEventID})
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", id, sseResyncEvent, payload); err != nil {
+			return
+		}
+	}
+	for _, event := range replay {
+		if err := send(event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				// Dropped for falling behind; the client reconnects with
+				// Last-Event-ID and catches up from the replay buffer
+				return
+			}
+			if err := send(event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// sseEvent prepares an event for the wire, flattening telemetry readings
+// the same way the WebSocket stream does
+func sseEvent(event Event) Event {
+	if entry, ok := event.Payload.(*data.DeviceData); ok {
+		event.Payload = telemetryFields(entry)
+	}
+	return event
+}
+
+// containsTopic reports whether topic matches any of the patterns
+func containsTopic(patterns []string, topic string) bool {
+	for _, pattern := range patterns {
+		if topicMatches(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
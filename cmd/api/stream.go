@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"mqtt/data"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	streamWriteWait      = 10 * time.Second
+	streamPongWait       = 60 * time.Second
+	streamPingInterval   = 30 * time.Second
+	streamSendBufferSize = 64
+	streamMaxMessageSize = 4096
+)
+
+// streamMessage is the envelope of every message pushed to stream clients
+type streamMessage struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// streamFilter selects which telemetry a stream client receives
+type streamFilter struct {
+	Devices []string `json:"devices"`
+	Fields  []string `json:"fields"`
+}
+
+// matches reports whether the reading belongs to one of the filtered devices
+func (f *streamFilter) matches(entry *data.DeviceData) bool {
+	if len(f.Devices) == 0 {
+		return true
+	}
+	for _, device := range f.Devices {
+		if device == entry.SerialNumber || device == entry.IMEI {
+			return true
+		}
+	}
+	return false
+}
+
+// project keeps only the requested fields of a reading. The identifying
+// fields are always included so clients can tell readings apart.
+func (f *streamFilter) project(fields map[string]interface{}) map[string]interface{} {
+	if len(f.Fields) == 0 {
+		return fields
+	}
+	projected := map[string]interface{}{
+		"device_id":     fields["device_id"],
+		"serial_number": fields["serial_number"],
+		"timestamp":     fields["timestamp"],
+	}
+	for _, name := range f.Fields {
+		if value, ok := fields[name]; ok {
+			projected[name] = value
+		}
+	}
+	return projected
+}
+
+// validate rejects unknown field names
+func (f *streamFilter) validate() error {
+	for _, name := range f.Fields {
+		if _, ok := telemetryFieldNames[name]; !ok {
+			return fmt.Errorf("unknown field %q", name)
+		}
+	}
+	return nil
+}
+
+// telemetryFieldNames holds the JSON names of the DeviceData fields that can
+// be selected in a stream filter
+var telemetryFieldNames = func() map[string]struct{} {
+	encoded, _ := json.Marshal(telemetryFields(&data.DeviceData{}))
+	var fields map[string]interface{}
+	json.Unmarshal(encoded, &fields)
+
+	names := make(map[string]struct{}, len(fields))
+	for name := range fields {
+		names[name] = struct{}{}
+	}
+	return names
+}()
+
+// telemetryFields converts a reading into a map of its JSON fields, without
+// the embedded device relationship
+func telemetryFields(entry *data.DeviceData) map[string]interface{} {
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return nil
+	}
+	delete(fields, "device")
+	delete(fields, "deleted_at")
+	return fields
+}
+
+// streamClient is a single WebSocket subscriber
+type streamClient struct {
+	hub  *streamHub
+	conn *websocket.Conn
+	send chan []byte
+
+	// dropped is set by the hub before it closes send for a slow client
+	dropped bool
+
+	mu     sync.RWMutex
+	filter streamFilter
+}
+
+func (c *streamClient) currentFilter() streamFilter {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.filter
+}
+
+func (c *streamClient) setFilter(filter streamFilter) {
+	c.mu.Lock()
+	c.filter = filter
+	c.mu.Unlock()
+}
+
+// streamHub fans telemetry out to connected WebSocket clients. Clients that
+// cannot keep up are disconnected rather than allowed to slow ingestion.
+type streamHub struct {
+	mu      sync.Mutex
+	clients map[*streamClient]struct{}
+	log     *slog.Logger
+}
+
+// newStreamHub creates a hub fed by the telemetry.saved topic of the bus
+func newStreamHub(bus *EventBus, logger *slog.Logger) *streamHub {
+	hub := &streamHub{clients: make(map[*streamClient]struct{}), log: logger.With("component", "stream")}
+	bus.Subscribe("websocket", []string{TopicTelemetrySaved}, 0, func(event Event) error {
+		if entry, ok := event.Payload.(*data.DeviceData); ok {
+			hub.Broadcast(entry)
+		}
+		return nil
+	})
+	return hub
+}
+
+func (h *streamHub) register(c *streamClient) {
+	h.mu.Lock()
+	h.clients[c] = struct{}{}
+	h.mu.Unlock()
+}
+
+// unregister removes a client and closes its send channel. It is safe to
+// call more than once.
+func (h *streamHub) unregister(c *streamClient) {
+	h.mu.Lock()
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c.send)
+	}
+	h.mu.Unlock()
+}
+
+// Broadcast sends a saved reading to every client whose filter matches it
+func (h *streamHub) Broadcast(entry *data.DeviceData) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.clients) == 0 {
+		return
+	}
+
+	fields := telemetryFields(entry)
+	if fields == nil {
+		return
+	}
+
+	for c := range h.clients {
+		filter := c.currentFilter()
+		if !filter.matches(entry) {
+			continue
+		}
+
+		message, err := json.Marshal(streamMessage{Type: "telemetry", Data: filter.project(fields)})
+		if err != nil {
+			continue
+		}
+
+		select {
+		case c.send <- message:
+		default:
+			// Slow consumer: drop it instead of blocking ingestion
+			h.log.Warn("dropping slow stream client", "remote_addr", c.conn.RemoteAddr().String())
+			c.dropped = true
+			delete(h.clients, c)
+			close(c.send)
+		}
+	}
+}
+
+var streamUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	// CORS is already open for the REST API and requests are authenticated
+	// by token, so any origin may connect
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// streamTelemetry upgrades the request to a WebSocket and pushes telemetry
+// as it is saved. Query parameters devices and fields (comma-separated)
+// set the initial filter; clients can replace it by sending a JSON
+// {"devices": [...], "fields": [...]} message.
+func (h *APIHandler) streamTelemetry(w http.ResponseWriter, r *http.Request) {
+	filter := streamFilter{
+		Devices: splitList(r.URL.Query().Get("devices")),
+		Fields:  splitList(r.URL.Query().Get("fields")),
+	}
+	if err := filter.validate(); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	conn, err := streamUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already written an error response
+		return
+	}
+
+	client := &streamClient{
+		hub:    h.stream,
+		conn:   conn,
+		send:   make(chan []byte, streamSendBufferSize),
+		filter: filter,
+	}
+	h.stream.register(client)
+
+	go client.writePump()
+	client.readPump()
+}
+
+// readPump handles pongs and filter updates until the connection closes
+func (c *streamClient) readPump() {
+	defer func() {
+		c.hub.unregister(c)
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(streamMaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(streamPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(streamPongWait))
+	})
+
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var filter streamFilter
+		if err := json.Unmarshal(message, &filter); err != nil {
+			c.reply(streamMessage{Type: "error", Data: "invalid filter"})
+			continue
+		}
+		if err := filter.validate(); err != nil {
+			c.reply(streamMessage{Type: "error", Data: err.Error()})
+			continue
+		}
+		c.setFilter(filter)
+		c.reply(streamMessage{Type: "subscribed", Data: filter})
+	}
+}
+
+// reply queues a control message for the client without blocking
+func (c *streamClient) reply(message streamMessage) {
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	if _, ok := c.hub.clients[c]; !ok {
+		return
+	}
+	select {
+	case c.send <- encoded:
+	default:
+	}
+}
+
+// writePump writes queued messages and heartbeat pings to the connection
+func (c *streamClient) writePump() {
+	ticker := time.NewTicker(streamPingInterval)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+			if !ok {
+				if c.dropped {
+					c.conn.WriteMessage(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "client too slow"))
+				}
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// requireToken rejects requests that do not carry the configured API token,
+// either as a Bearer token or (for browser WebSockets) an access_token
+// query parameter. It lets everything through when no token is configured.
+func (h *APIHandler) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.apiToken == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := r.URL.Query().Get("access_token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(h.apiToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mqtt-backend"`)
+			writeError(w, r, http.StatusUnauthorized, "Missing or invalid API token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// splitList splits a comma-separated query parameter, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"mqtt/data"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// serialPlaceholder marks the topic segment that holds the device serial
+// number. It is subscribed to as a "+" wildcard.
+const serialPlaceholder = "{serial}"
+
+// Handler names used in the subscription table
+const (
+	HandlerTelemetry      = "telemetry"
+	HandlerCommandAck     = "command_ack"
+	HandlerBirth          = "birth"
+	HandlerLWT            = "lwt"
+	HandlerShadowReported = "shadow_reported"
+	HandlerLEDControl     = "led_control"
+)
+
+// Telemetry decoders used in the subscription table
+const (
+	DecoderAuto = "auto"
+	DecoderForm = "form"
+	DecoderJSON = "json"
+)
+
+// SubscriptionConfig is one entry of the subscription table. Topic is an
+// MQTT filter that may use "+" and "#" wildcards, and {serial} in place of
+// a "+" for the segment holding the device serial number. Decoder only
+// applies to the telemetry handler.
+type SubscriptionConfig struct {
+	Topic   string `json:"topic"`
+	QoS     byte   `json:"qos"`
+	Handler string `json:"handler"`
+	Decoder string `json:"decoder,omitempty"`
+}
+
+// defaultSubscriptions is the subscription table used when
+// MQTT_SUBSCRIPTIONS is not set
+var defaultSubscriptions = []SubscriptionConfig{
+	{Topic: "sensor_data", QoS: 1, Handler: HandlerTelemetry, Decoder: DecoderAuto},
+	{Topic: "device/logs/{serial}/data", QoS: 1, Handler: HandlerTelemetry, Decoder: DecoderAuto},
+	{Topic: "led_control", Handler: HandlerLEDControl},
+	{Topic: "device/{serial}/commands/ack", QoS: 1, Handler: HandlerCommandAck},
+	{Topic: "device/{serial}/birth", QoS: 1, Handler: HandlerBirth},
+	{Topic: "device/{serial}/lwt", QoS: 1, Handler: HandlerLWT},
+	{Topic: "device/{serial}/shadow/reported", QoS: 1, Handler: HandlerShadowReported},
+}
+
+// deviceMessage is a received message with the serial number taken from
+// its topic, or "" if the subscription has no {serial} segment
+type deviceMessage struct {
+	mqtt.Message
+	SerialNumber string
+	decoder      telemetryDecoder
+}
+
+// messageHandler handles a received message. ctx holds the message's span.
+// The message is acknowledged when the handler returns nil; an error means
+// it could not be handled for now, and dispatch calls the handler again.
+type messageHandler func(ctx context.Context, msg *deviceMessage) error
+
+// retryableMessageError returns err if the message is worth delivering
+// again because the database was unavailable, or nil to acknowledge it
+func retryableMessageError(err error) error {
+	if errors.Is(err, data.ErrUnavailable) {
+		return err
+	}
+	return nil
+}
+
+// messageHandlerSpec describes a handler that can be named in the table
+type messageHandlerSpec struct {
+	handle messageHandler
+	// needsSerial handlers only accept topics with a {serial} segment
+	needsSerial bool
+}
+
+// telemetryDecoder parses a telemetry payload
+type telemetryDecoder func(payload []byte) (*data.DeviceData, error)
+
+var telemetryDecoders = map[string]telemetryDecoder{
+	DecoderForm: decodeFormTelemetry,
+	DecoderJSON: decodeJSONTelemetry,
+	DecoderAuto: decodeTelemetry,
+}
+
+// subscription is a validated entry of the subscription table
+type subscription struct {
+	SubscriptionConfig
+	// filter is Topic with {serial} replaced by "+"
+	filter      string
+	serialIndex int
+	handle      messageHandler
+	decoder     telemetryDecoder
+}
+
+// SubscriptionStatus is the result of the last subscribe to a filter
+type SubscriptionStatus struct {
+	Topic   string
+	Handler string
+	Err     error
+}
+
+// newSubscriptions validates the subscription table against the handlers
+func newSubscriptions(table []SubscriptionConfig, handlers map[string]messageHandlerSpec) ([]*subscription, error) {
+	if len(table) == 0 {
+		return nil, errors.New("no MQTT subscriptions configured")
+	}
+	subscriptions := make([]*subscription, 0, len(table))
+	filters := make(map[string]bool)
+	for _, entry := range table {
+		sub, err := newSubscription(entry, handlers)
+		if err != nil {
+			return nil, fmt.Errorf("subscription %q: %v", entry.Topic, err)
+		}
+		if filters[sub.filter] {
+			return nil, fmt.Errorf("subscription %q: filter %s is subscribed twice", entry.Topic, sub.filter)
+		}
+		filters[sub.filter] = true
+		subscriptions = append(subscriptions, sub)
+	}
+	return subscriptions, nil
+}
+
+func newSubscription(entry SubscriptionConfig, handlers map[string]messageHandlerSpec) (*subscription, error) {
+	if entry.Topic == "" {
+		return nil, errors.New("empty topic")
+	}
+	spec, ok := handlers[entry.Handler]
+	if !ok {
+		return nil, fmt.Errorf("unknown handler %q", entry.Handler)
+	}
+	if entry.QoS > 2 {
+		return nil, fmt.Errorf("invalid QoS %d", entry.QoS)
+	}
+
+	if strings.HasPrefix(entry.Topic, "$share/") {
+		return nil, errors.New("shared subscriptions are set with MQTT_SHARED_GROUP, not in the topic")
+	}
+
+	sub := &subscription{SubscriptionConfig: entry, serialIndex: -1, handle: spec.handle}
+	segments := strings.Split(entry.Topic, "/")
+	for i, segment := range segments {
+		switch {
+		case segment == serialPlaceholder:
+			if sub.serialIndex >= 0 {
+				return nil, fmt.Errorf("%s appears more than once", serialPlaceholder)
+			}
+			sub.serialIndex = i
+			segments[i] = "+"
+		case segment == "#":
+			if i != len(segments)-1 {
+				return nil, errors.New("# must be the last segment")
+			}
+		case segment != "+" && strings.ContainsAny(segment, "+#"):
+			return nil, errors.New("wildcards must take up a whole segment")
+		}
+	}
+	sub.filter = strings.Join(segments, "/")
+	if spec.needsSerial && sub.serialIndex < 0 {
+		return nil, fmt.Errorf("handler %s needs a %s segment in the topic", entry.Handler, serialPlaceholder)
+	}
+
+	if entry.Handler == HandlerTelemetry {
+		name := entry.Decoder
+		if name == "" {
+			name = DecoderAuto
+		}
+		if sub.decoder, ok = telemetryDecoders[name]; !ok {
+			return nil, fmt.Errorf("unknown decoder %q", entry.Decoder)
+		}
+	} else if entry.Decoder != "" {
+		return nil, fmt.Errorf("handler %s does not take a decoder", entry.Handler)
+	}
+	return sub, nil
+}
+
+// match reports whether topic matches the subscription's filter and returns
+// the serial number from its {serial} segment
+func (s *subscription) match(topic string) (string, bool) {
+	filter := strings.Split(s.filter, "/")
+	segments := strings.Split(topic, "/")
+	for i, part := range filter {
+		if part == "#" {
+			// "a/#" also matches "a"; wildcards never match $-topics at the root
+			return s.serial(segments), i > 0 || !strings.HasPrefix(topic, "$")
+		}
+		if i >= len(segments) {
+			return "", false
+		}
+		if part == "+" {
+			if i == 0 && strings.HasPrefix(segments[0], "$") {
+				return "", false
+			}
+			continue
+		}
+		if part != segments[i] {
+			return "", false
+		}
+	}
+	if len(segments) != len(filter) {
+		return "", false
+	}
+	return s.serial(segments), true
+}
+
+func (s *subscription) serial(segments []string) string {
+	if s.serialIndex < 0 || s.serialIndex >= len(segments) {
+		return ""
+	}
+	return segments[s.serialIndex]
+}
+
+// subscribe subscribes to every filter in the table with one SUBSCRIBE
+// packet. It runs on every connection.
+func (m *MQTTClient) subscribe() {
+	filters := make(map[string]byte, len(m.routes))
+	for _, sub := range m.routes {
+		filters[m.subscribedFilter(sub)] = sub.QoS
+	}
+
+	// No per-filter callback: every message goes to dispatch once through
+	// the default handler, even when filters overlap
+	token := m.client.SubscribeMultiple(filters, nil)
+	token.Wait()
+	var granted map[string]byte
+	if subscribeToken, ok := token.(*mqtt.SubscribeToken); ok {
+		granted = subscribeToken.Result()
+	}
+
+	statuses := make([]SubscriptionStatus, 0, len(m.routes))
+	for _, sub := range m.routes {
+		filter := m.subscribedFilter(sub)
+		var err error
+		if token.Error() != nil {
+			err = fmt.Errorf("subscribe error: %v", token.Error())
+		} else if qos, ok := granted[filter]; ok && qos == 0x80 {
+			err = errors.New("subscription refused by broker")
+		}
+		statuses = append(statuses, SubscriptionStatus{Topic: filter, Handler: sub.Handler, Err: err})
+		if err != nil {
+			m.log.Error("failed to subscribe", "topic", filter, "handler", sub.Handler, "error", err)
+		} else {
+			m.log.Info("subscribed", "topic", filter, "handler", sub.Handler, "qos", sub.QoS)
+		}
+	}
+
+	m.subscriptionsMu.Lock()
+	m.subscriptions = statuses
+	m.subscriptionsMu.Unlock()
+}
+
+// subscribedFilter returns the filter sent to the broker for sub. In a
+// shared group, the broker hands each message to one member of the group;
+// messages still arrive with their own topic, so matching is unchanged.
+func (m *MQTTClient) subscribedFilter(sub *subscription) string {
+	if m.sharedGroup == "" {
+		return sub.filter
+	}
+	return "$share/" + m.sharedGroup + "/" + sub.filter
+}
+
+// dispatch is the client's message callback. It only queues the message
+// for processMessages: paho calls it on the goroutine that also reads from
+// the connection, so a handler waiting there would stall keepalives and get
+// the client disconnected. When the queue is full, QoS 0 messages are
+// dropped and the others wait for room.
+func (m *MQTTClient) dispatch(client mqtt.Client, msg mqtt.Message) {
+	m.lastMessage.Store(time.Now().UnixNano())
+	if msg.Qos() == 0 {
+		select {
+		case m.queue <- msg:
+		default:
+			mqttMessagesDropped.Inc()
+			m.msgLog.Warn("message queue full, dropping QoS 0 message", "topic", msg.Topic())
+		}
+		return
+	}
+	select {
+	case m.queue <- msg:
+	case <-m.stopped:
+	}
+}
+
+// processMessages handles queued messages one at a time, in the order they
+// arrived, until the client is closed. Messages still queued then are left
+// unacknowledged for the next session.
+func (m *MQTTClient) processMessages() {
+	for {
+		select {
+		case <-m.stopped:
+			return
+		case msg := <-m.queue:
+			m.handleMessage(msg)
+		}
+	}
+}
+
+// handleMessage hands a message to the first subscription in the table
+// whose filter matches its topic. Messages are counted per filter and each
+// is handled in its own span. Acknowledgements are manual: a message is
+// acked once its handler has finished with it, and messages no entry
+// matches, such as those of filters left over in the persistent session,
+// are acked and dropped.
+//
+// While a handler fails, typically because the database is unavailable,
+// handleMessage retries it with backoff instead of returning, so every
+// message is acked once it is handled. The messages queued behind it wait,
+// and the broker stops sending once its inflight limit is reached. On
+// shutdown the message is left unacked for the next session.
+func (m *MQTTClient) handleMessage(msg mqtt.Message) {
+	for _, sub := range m.routes {
+		serialNumber, ok := sub.match(msg.Topic())
+		if !ok {
+			continue
+		}
+		mqttMessagesReceived.WithLabelValues(sub.filter).Inc()
+		ctx, span := tracer.Start(context.Background(), "process "+sub.filter, trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				attribute.String("messaging.system", "mqtt"),
+				attribute.String("messaging.destination.name", msg.Topic()),
+				attribute.Int("messaging.message.body.size", len(msg.Payload())),
+				attribute.Int("messaging.mqtt.qos", int(msg.Qos())),
+			))
+		defer span.End()
+		message := &deviceMessage{Message: msg, SerialNumber: serialNumber, decoder: sub.decoder}
+		for attempt := 1; ; attempt++ {
+			err := sub.handle(ctx, message)
+			if err == nil {
+				break
+			}
+			backoff := retryBackoff(attempt, m.messageRetry, messageRetryMaxBackoff)
+			m.msgLog.Warn("failed to handle message, retrying", "topic", msg.Topic(), "attempt", attempt, "retry_in", backoff, "error", err)
+			select {
+			case <-time.After(backoff):
+			case <-m.stopped:
+				return
+			}
+		}
+		msg.Ack()
+		return
+	}
+	m.msgLog.Debug("no subscription for topic", "topic", msg.Topic())
+	msg.Ack()
+}
+
+// decodeFormTelemetry parses the URL-encoded device format
+func decodeFormTelemetry(payload []byte) (*data.DeviceData, error) {
+	return parseDeviceData(string(payload))
+}
+
+// decodeJSONTelemetry parses a JSON reading
+func decodeJSONTelemetry(payload []byte) (*data.DeviceData, error) {
+	var deviceData data.DeviceData
+	if err := json.Unmarshal(payload, &deviceData); err != nil {
+		return nil, err
+	}
+	return &deviceData, nil
+}
+
+// decodeTelemetry decodes JSON objects as JSON and anything else as the
+// URL-encoded device format. Form parsing accepts almost any text, so it
+// cannot be tried first and fall back on failure.
+func decodeTelemetry(payload []byte) (*data.DeviceData, error) {
+	if trimmed := bytes.TrimSpace(payload); len(trimmed) > 0 && trimmed[0] == '{' {
+		return decodeJSONTelemetry(payload)
+	}
+	return decodeFormTelemetry(payload)
+}
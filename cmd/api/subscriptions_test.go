@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// testHandlers are the handler specs the table is validated against
+var testHandlers = map[string]messageHandlerSpec{
+	HandlerTelemetry:  {handle: func(context.Context, *deviceMessage) error { return nil }},
+	HandlerCommandAck: {handle: func(context.Context, *deviceMessage) error { return nil }, needsSerial: true},
+}
+
+func TestNewSubscription(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   SubscriptionConfig
+		filter  string
+		serial  int
+		wantErr string
+	}{
+		{name: "plain", entry: SubscriptionConfig{Topic: "sensor_data", Handler: HandlerTelemetry}, filter: "sensor_data", serial: -1},
+		{name: "serial", entry: SubscriptionConfig{Topic: "device/{serial}/commands/ack", QoS: 1, Handler: HandlerCommandAck}, filter: "device/+/commands/ack", serial: 1},
+		{name: "wildcards", entry: SubscriptionConfig{Topic: "+/logs/{serial}/#", Handler: HandlerTelemetry, Decoder: DecoderJSON}, filter: "+/logs/+/#", serial: 2},
+		{name: "empty topic", entry: SubscriptionConfig{Handler: HandlerTelemetry}, wantErr: "empty topic"},
+		{name: "unknown handler", entry: SubscriptionConfig{Topic: "a", Handler: "nope"}, wantErr: "unknown handler"},
+		{name: "invalid qos", entry: SubscriptionConfig{Topic: "a", QoS: 3, Handler: HandlerTelemetry}, wantErr: "invalid QoS"},
+		{name: "shared", entry: SubscriptionConfig{Topic: "$share/api/sensor_data", Handler: HandlerTelemetry}, wantErr: "MQTT_SHARED_GROUP"},
+		{name: "two serials", entry: SubscriptionConfig{Topic: "{serial}/{serial}", Handler: HandlerTelemetry}, wantErr: "more than once"},
+		{name: "hash not last", entry: SubscriptionConfig{Topic: "a/#/b", Handler: HandlerTelemetry}, wantErr: "last segment"},
+		{name: "partial wildcard", entry: SubscriptionConfig{Topic: "a/b+", Handler: HandlerTelemetry}, wantErr: "whole segment"},
+		{name: "missing serial", entry: SubscriptionConfig{Topic: "acks", Handler: HandlerCommandAck}, wantErr: "needs a {serial}"},
+		{name: "unknown decoder", entry: SubscriptionConfig{Topic: "a", Handler: HandlerTelemetry, Decoder: "xml"}, wantErr: "unknown decoder"},
+		{name: "decoder on another handler", entry: SubscriptionConfig{Topic: "device/{serial}/ack", Handler: HandlerCommandAck, Decoder: DecoderJSON}, wantErr: "does not take a decoder"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, err := newSubscription(tt.entry, testHandlers)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sub.filter != tt.filter || sub.serialIndex != tt.serial {
+				t.Fatalf("filter %s with serial at %d, want %s at %d", sub.filter, sub.serialIndex, tt.filter, tt.serial)
+			}
+			if tt.entry.Handler == HandlerTelemetry && sub.decoder == nil {
+				t.Fatal("telemetry subscription without a decoder")
+			}
+		})
+	}
+}
+
+func TestNewSubscriptions(t *testing.T) {
+	if _, err := newSubscriptions(nil, testHandlers); err == nil {
+		t.Fatal("an empty table was accepted")
+	}
+	table := []SubscriptionConfig{
+		{Topic: "device/{serial}/data", Handler: HandlerTelemetry},
+		{Topic: "device/+/data", Handler: HandlerTelemetry},
+	}
+	if _, err := newSubscriptions(table, testHandlers); err == nil || !strings.Contains(err.Error(), "subscribed twice") {
+		t.Fatalf("error = %v, want the duplicate filter rejected", err)
+	}
+	subs, err := newSubscriptions(defaultSubscriptions, mqttHandlerSpecs(t))
+	if err != nil {
+		t.Fatalf("default table: %v", err)
+	}
+	if len(subs) != len(defaultSubscriptions) {
+		t.Fatalf("got %d subscriptions", len(subs))
+	}
+}
+
+// mqttHandlerSpecs accepts every handler name of the default table
+func mqttHandlerSpecs(t *testing.T) map[string]messageHandlerSpec {
+	t.Helper()
+	specs := map[string]messageHandlerSpec{}
+	for _, entry := range defaultSubscriptions {
+		specs[entry.Handler] = messageHandlerSpec{handle: func(context.Context, *deviceMessage) error { return nil }}
+	}
+	return specs
+}
+
+func TestSubscriptionMatch(t *testing.T) {
+	tests := []struct {
+		topic   string
+		match   string
+		matches bool
+		serial  string
+	}{
+		{topic: "device/{serial}/commands/ack", match: "device/SN-1/commands/ack", matches: true, serial: "SN-1"},
+		{topic: "device/{serial}/commands/ack", match: "device/SN-1/commands"},
+		{topic: "device/{serial}/commands/ack", match: "device/SN-1/commands/ack/x"},
+		{topic: "device/{serial}/commands/ack", match: "device//commands/ack", matches: true},
+		{topic: "sensor_data", match: "sensor_data", matches: true},
+		{topic: "sensor_data", match: "sensor_data/x"},
+		{topic: "device/logs/{serial}/#", match: "device/logs/SN-2/data/raw", matches: true, serial: "SN-2"},
+		{topic: "device/logs/{serial}/#", match: "device/logs/SN-2", matches: true, serial: "SN-2"},
+		{topic: "device/#", match: "device", matches: true},
+		{topic: "#", match: "anything/at/all", matches: true},
+		{topic: "#", match: "$SYS/broker/uptime"},
+		{topic: "+/status", match: "$SYS/status"},
+		{topic: "$SYS/#", match: "$SYS/broker/uptime", matches: true},
+	}
+	for _, tt := range tests {
+		sub, err := newSubscription(SubscriptionConfig{Topic: tt.topic, Handler: HandlerTelemetry}, testHandlers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serial, ok := sub.match(tt.match)
+		if ok != tt.matches || (ok && serial != tt.serial) {
+			t.Errorf("%s matching %s = %q, %v; want %q, %v", tt.topic, tt.match, serial, ok, tt.serial, tt.matches)
+		}
+	}
+}
+
+func TestSubscribedFilter(t *testing.T) {
+	sub, _ := newSubscription(SubscriptionConfig{Topic: "device/{serial}/birth", Handler: HandlerTelemetry}, testHandlers)
+	if got := (&MQTTClient{}).subscribedFilter(sub); got != "device/+/birth" {
+		t.Errorf("filter = %s", got)
+	}
+	if got := (&MQTTClient{sharedGroup: "api"}).subscribedFilter(sub); got != "$share/api/device/+/birth" {
+		t.Errorf("shared filter = %s", got)
+	}
+}
+
+func TestDecodeTelemetry(t *testing.T) {
+	form, err := decodeTelemetry([]byte("imei=SN-1&bv=12.5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	json, err := decodeTelemetry([]byte(`{"serial_number":"SN-1","battery_voltage":12.5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form.SerialNumber != "SN-1" || json.SerialNumber != "SN-1" || form.BatteryVoltage != 12.5 || json.BatteryVoltage != 12.5 {
+		t.Fatalf("form %+v, json %+v", form, json)
+	}
+	if _, err := decodeJSONTelemetry([]byte("imei=SN-1")); err == nil {
+		t.Fatal("the json decoder accepted form data")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// tlsReloadInterval is how often the certificate files are checked for
+// changes
+const tlsReloadInterval = time.Minute
+
+// brokerSchemes are the broker URL schemes accepted in MQTT_BROKER, and
+// whether each one uses TLS
+var brokerSchemes = map[string]bool{
+	"tcp":   false,
+	"mqtt":  false,
+	"ws":    false,
+	"ssl":   true,
+	"tls":   true,
+	"mqtts": true,
+	"wss":   true,
+}
+
+// brokerTLS holds the TLS settings of the broker connection. The CA bundle
+// and client certificate are read again when their files change and are
+// used from the next connection on, so certificates can be rotated without
+// a restart.
+type brokerTLS struct {
+	caFile   string
+	certFile string
+	keyFile  string
+	// serverName is the name the broker's certificate must be valid for:
+	// MQTT_TLS_SERVER_NAME, or else the host of MQTT_BROKER, which may be
+	// an IP address
+	serverName string
+	// pins are SHA-256 hashes of public keys, one of which must appear in
+	// the broker's verified chain
+	pins [][]byte
+	log  *slog.Logger
+
+	mu sync.RWMutex
+	// roots is nil to trust the system roots
+	roots *x509.CertPool
+	cert  *tls.Certificate
+	// modTimes are the modification times of the files last loaded
+	modTimes map[string]time.Time
+}
+
+// newBrokerTLS checks the broker URL and returns its TLS settings, or nil
+// for a plain connection
+func newBrokerTLS(cfg Config, logger *slog.Logger) (*brokerTLS, error) {
+	broker, err := url.Parse(cfg.MQTTBroker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MQTT_BROKER: %v", err)
+	}
+	secure, ok := brokerSchemes[broker.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported MQTT_BROKER scheme %q, use tcp, ssl, tls, mqtts, ws or wss", broker.Scheme)
+	}
+	configured := cfg.MQTTTLSCAFile != "" || cfg.MQTTTLSCertFile != "" || cfg.MQTTTLSKeyFile != "" ||
+		cfg.MQTTTLSServerName != "" || len(cfg.MQTTTLSPins) > 0
+	if !secure {
+		if configured {
+			return nil, fmt.Errorf("MQTT_TLS_* settings need a TLS broker URL, not %s://", broker.Scheme)
+		}
+		return nil, nil
+	}
+	if (cfg.MQTTTLSCertFile == "") != (cfg.MQTTTLSKeyFile == "") {
+		return nil, errors.New("MQTT_TLS_CERT_FILE and MQTT_TLS_KEY_FILE must be set together")
+	}
+	serverName := cfg.MQTTTLSServerName
+	if serverName == "" {
+		serverName = broker.Hostname()
+	}
+
+	t := &brokerTLS{
+		caFile:     cfg.MQTTTLSCAFile,
+		certFile:   cfg.MQTTTLSCertFile,
+		keyFile:    cfg.MQTTTLSKeyFile,
+		serverName: serverName,
+		log:        logger,
+	}
+	for _, pin := range cfg.MQTTTLSPins {
+		sum, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid MQTT_TLS_PINS entry %q, expected a base64 SHA-256 hash", pin)
+		}
+		t.pins = append(t.pins, sum)
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Config returns the tls.Config for the broker connection. Verification
+// is done by verifyConnection against the current CA bundle, since the
+// bundle given to crypto/tls could not be replaced once loaded.
+func (t *brokerTLS) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		ServerName:           t.serverName,
+		InsecureSkipVerify:   true,
+		VerifyConnection:     t.verifyConnection,
+		GetClientCertificate: t.clientCertificate,
+	}
+}
+
+// load reads the CA bundle and client certificate. On error, the ones
+// loaded before stay in use.
+func (t *brokerTLS) load() error {
+	modTimes, err := t.stat()
+	if err != nil {
+		return err
+	}
+
+	var roots *x509.CertPool
+	if t.caFile != "" {
+		pem, err := os.ReadFile(t.caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in CA bundle %s", t.caFile)
+		}
+	}
+	var cert *tls.Certificate
+	if t.certFile != "" {
+		pair, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		cert = &pair
+		t.log.Info("loaded client certificate", "subject", pair.Leaf.Subject.String(), "not_after", pair.Leaf.NotAfter)
+	}
+
+	t.mu.Lock()
+	t.roots = roots
+	t.cert = cert
+	t.modTimes = modTimes
+	t.mu.Unlock()
+	return nil
+}
+
+// stat returns the modification times of the certificate files
+func (t *brokerTLS) stat() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, name := range []string{t.caFile, t.certFile, t.keyFile} {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[name] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// watch reloads the certificates whenever one of their files changes,
+// until the process exits
+func (t *brokerTLS) watch() {
+	ticker := time.NewTicker(tlsReloadInterval)
+	for range ticker.C {
+		modTimes, err := t.stat()
+		if err != nil {
+			t.log.Error("failed to check certificate files", "error", err)
+			continue
+		}
+		t.mu.RLock()
+		changed := !maps.Equal(modTimes, t.modTimes)
+		t.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := t.load(); err != nil {
+			t.log.Error("failed to reload certificates, keeping the previous ones", "error", err)
+			continue
+		}
+		t.log.Info("reloaded certificates, used from the next connection")
+	}
+}
+
+// verifyConnection verifies the broker's certificate chain against the
+// current CA bundle and its name against serverName, then checks the pins.
+// The name is not taken from the connection state, which has none for an
+// IP address.
+func (t *brokerTLS) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("broker sent no certificate")
+	}
+	t.mu.RLock()
+	roots := t.roots
+	t.mu.RUnlock()
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       t.serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	chains, err := cs.PeerCertificates[0].Verify(opts)
+	if err != nil {
+		return err
+	}
+	if len(t.pins) == 0 {
+		return nil
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if slices.ContainsFunc(t.pins, func(pin []byte) bool { return bytes.Equal(pin, sum[:]) }) {
+				return nil
+			}
+		}
+	}
+	return errors.New("broker certificate matches no pinned key")
+}
+
+// clientCertificate returns the current client certificate, or none when
+// mutual TLS is not configured
+func (t *brokerTLS) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.cert == nil {
+		return &tls.Certificate{}, nil
+	}
+	return t.cert, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority that issues certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a broker certificate valid for hosts, which are DNS names
+// or IP addresses
+func (ca *testCA) issue(t *testing.T, hosts ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "broker"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key}
+}
+
+// pin returns the MQTT_TLS_PINS entry of the CA's key
+func (ca *testCA) pin() string {
+	sum := sha256.Sum256(ca.cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// writeFile writes the CA certificate as a PEM bundle to path
+func (ca *testCA) writeFile(t *testing.T, path string) {
+	t.Helper()
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	if err := os.WriteFile(path, bundle, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handshake connects a client using the broker TLS settings to a server
+// presenting cert and returns the client's handshake error
+func handshake(t *testing.T, settings *brokerTLS, cert tls.Certificate) error {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	server := tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{cert}})
+	go func() {
+		server.Handshake()
+		serverConn.Close()
+	}()
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	return tls.Client(clientConn, settings.Config()).Handshake()
+}
+
+func TestBrokerTLSVerification(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca.writeFile(t, caFile)
+
+	tests := []struct {
+		name       string
+		broker     string
+		serverName string
+		pins       []string
+		cert       tls.Certificate
+		wantErr    string
+	}{
+		{name: "host name", broker: "ssl://broker.example.com:8883", cert: ca.issue(t, "broker.example.com")},
+		{name: "ip address", broker: "ssl://127.0.0.1:8883", cert: ca.issue(t, "127.0.0.1")},
+		{name: "ipv6 address", broker: "mqtts://[::1]:8883", cert: ca.issue(t, "::1")},
+		{name: "ip address not in certificate", broker: "ssl://10.0.0.5:8883", cert: ca.issue(t, "broker.example.com"), wantErr: "10.0.0.5"},
+		{name: "wrong host", broker: "ssl://other.example.com:8883", cert: ca.issue(t, "broker.example.com"), wantErr: "other.example.com"},
+		{name: "server name for an ip address", broker: "ssl://10.0.0.5:8883", serverName: "broker.example.com", cert: ca.issue(t, "broker.example.com")},
+		{name: "wrong server name", broker: "ssl://broker.example.com:8883", serverName: "mqtt.example.com", cert: ca.issue(t, "broker.example.com"), wantErr: "mqtt.example.com"},
+		{name: "untrusted ca", broker: "ssl://broker.example.com:8883", cert: other.issue(t, "broker.example.com"), wantErr: "unknown authority"},
+		{name: "pinned ca", broker: "ssl://broker.example.com:8883", pins: []string{ca.pin()}, cert: ca.issue(t, "broker.example.com")},
+		{name: "pin mismatch", broker: "ssl://broker.example.com:8883", pins: []string{other.pin()}, cert: ca.issue(t, "broker.example.com"), wantErr: "no pinned key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings, err := newBrokerTLS(Config{
+				MQTTBroker:        tt.broker,
+				MQTTTLSCAFile:     caFile,
+				MQTTTLSServerName: tt.serverName,
+				MQTTTLSPins:       tt.pins,
+			}, discardLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = handshake(t, settings, tt.cert)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("handshake: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("handshake = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewBrokerTLS(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		secure  bool
+		wantErr string
+	}{
+		{name: "plain", cfg: Config{MQTTBroker: "tcp://localhost:1883"}},
+		{name: "tls", cfg: Config{MQTTBroker: "ssl://localhost:8883"}, secure: true},
+		{name: "unknown scheme", cfg: Config{MQTTBroker: "http://localhost"}, wantErr: "unsupported"},
+		{name: "tls settings on a plain url", cfg: Config{MQTTBroker: "tcp://localhost:1883", MQTTTLSServerName: "broker"}, wantErr: "need a TLS broker URL"},
+		{name: "certificate without key", cfg: Config{MQTTBroker: "ssl://localhost:8883", MQTTTLSCertFile: "client.pem"}, wantErr: "set together"},
+		{name: "invalid pin", cfg: Config{MQTTBroker: "ssl://localhost:8883", MQTTTLSPins: []string{"abc"}}, wantErr: "invalid MQTT_TLS_PINS"},
+		{name: "missing ca file", cfg: Config{MQTTBroker: "ssl://localhost:8883", MQTTTLSCAFile: "/nonexistent/ca.pem"}, wantErr: "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings, err := newBrokerTLS(tt.cfg, discardLogger())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (settings != nil) != tt.secure {
+				t.Fatalf("settings = %v, want TLS %v", settings, tt.secure)
+			}
+		})
+	}
+}
+
+func TestBrokerTLSReload(t *testing.T) {
+	oldCA, newCA := newTestCA(t), newTestCA(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	oldCA.writeFile(t, caFile)
+
+	settings, err := newBrokerTLS(Config{MQTTBroker: "ssl://127.0.0.1:8883", MQTTTLSCAFile: caFile}, discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed := newCA.issue(t, "127.0.0.1")
+	if err := handshake(t, settings, renewed); err == nil {
+		t.Fatal("certificate of a CA not yet trusted was accepted")
+	}
+
+	// The CA is rotated on disk and picked up for the next connection
+	newCA.writeFile(t, caFile)
+	if err := settings.load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(t, settings, renewed); err != nil {
+		t.Fatalf("handshake after reload: %v", err)
+	}
+
+	// A bundle that does not load leaves the current one in use
+	if err := os.WriteFile(caFile, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.load(); err == nil {
+		t.Fatal("an invalid bundle loaded")
+	}
+	if err := handshake(t, settings, renewed); err != nil {
+		t.Fatalf("handshake after a failed reload: %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"mqtt/data"
+)
+
+// fieldErrors maps a JSON field name to a validation message
+type fieldErrors map[string]string
+
+var (
+	deviceTypePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	tagPattern        = regexp.MustCompile(`^[a-z0-9][a-z0-9_.:-]{0,29}$`)
+)
+
+// maxDeviceTags limits how many tags a device can carry
+const maxDeviceTags = 20
+
+// deviceInput holds the user-editable fields of a device
+type deviceInput struct {
+	SerialNumber string   `json:"serial_number"`
+	DeviceType   string   `json:"device_type"`
+	Name         string   `json:"name"`
+	Description  string   `json:"description"`
+	Status       string   `json:"status"`
+	Tags         []string `json:"tags"`
+}
+
+// deviceInputFrom copies the editable fields of an existing device
+func deviceInputFrom(device *data.Device) deviceInput {
+	return deviceInput{
+		SerialNumber: device.SerialNumber,
+		DeviceType:   device.DeviceType,
+		Name:         device.Name,
+		Description:  device.Description,
+		Status:       device.Status,
+		Tags:         normalizeTags(device.Tags),
+	}
+}
+
+// equal reports whether two inputs would store the same device
+func (in *deviceInput) equal(other deviceInput) bool {
+	return in.SerialNumber == other.SerialNumber &&
+		in.DeviceType == other.DeviceType &&
+		in.Name == other.Name &&
+		in.Description == other.Description &&
+		in.Status == other.Status &&
+		slices.Equal(in.Tags, other.Tags)
+}
+
+// normalize trims whitespace and fills in defaults
+func (in *deviceInput) normalize() {
+	in.SerialNumber = strings.TrimSpace(in.SerialNumber)
+	in.DeviceType = strings.TrimSpace(in.DeviceType)
+	in.Name = strings.TrimSpace(in.Name)
+	in.Description = strings.TrimSpace(in.Description)
+	in.Status = strings.ToLower(strings.TrimSpace(in.Status))
+	if in.Status == "" {
+		in.Status = data.DeviceStatusActive
+	}
+	in.Tags = normalizeTags(in.Tags)
+}
+
+// normalizeTags lowercases, sorts and de-duplicates tags and drops empty ones
+func normalizeTags(tags []string) []string {
+	var normalized []string
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	slices.Sort(normalized)
+	return normalized
+}
+
+// validate checks the input and returns one message per invalid field
+func (in *deviceInput) validate() fieldErrors {
+	errs := fieldErrors{}
+
+	switch {
+	case in.SerialNumber == "":
+		errs["serial_number"] = "is required"
+	case len(in.SerialNumber) > 50:
+		errs["serial_number"] = "must be at most 50 characters"
+	case strings.ContainsAny(in.SerialNumber, " \t\r\n/#+"):
+		errs["serial_number"] = "must not contain whitespace or MQTT topic characters"
+	}
+
+	switch {
+	case in.DeviceType == "":
+		errs["device_type"] = "is required"
+	case len(in.DeviceType) > 50:
+		errs["device_type"] = "must be at most 50 characters"
+	case !deviceTypePattern.MatchString(in.DeviceType):
+		errs["device_type"] = "may only contain letters, digits, '.', '_' and '-'"
+	}
+
+	if len(in.Name) > 100 {
+		errs["name"] = "must be at most 100 characters"
+	}
+	if len(in.Description) > 500 {
+		errs["description"] = "must be at most 500 characters"
+	}
+	if !data.IsValidDeviceStatus(in.Status) {
+		errs["status"] = fmt.Sprintf("must be one of %s", strings.Join(data.DeviceStatuses, ", "))
+	}
+
+	if len(in.Tags) > maxDeviceTags {
+		errs["tags"] = fmt.Sprintf("must have at most %d entries", maxDeviceTags)
+	}
+	for _, tag := range in.Tags {
+		if !tagPattern.MatchString(tag) {
+			errs["tags"] = fmt.Sprintf("invalid tag %q: use up to 30 lowercase letters, digits, '.', '_', ':' or '-'", tag)
+			break
+		}
+	}
+
+	return errs
+}
+
+// applyTo copies the input onto a device model
+func (in *deviceInput) applyTo(device *data.Device) {
+	device.SerialNumber = in.SerialNumber
+	device.DeviceType = in.DeviceType
+	device.Name = in.Name
+	device.Description = in.Description
+	device.Status = in.Status
+	device.Tags = in.Tags
+}
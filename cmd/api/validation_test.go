@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"mqtt/data"
+)
+
+func TestDeviceInputValidate(t *testing.T) {
+	valid := func() deviceInput {
+		return deviceInput{SerialNumber: "SN-1", DeviceType: "logger"}
+	}
+	tests := []struct {
+		name   string
+		modify func(*deviceInput)
+		field  string
+	}{
+		{"valid", func(*deviceInput) {}, ""},
+		{"missing serial", func(in *deviceInput) { in.SerialNumber = " " }, "serial_number"},
+		{"topic characters in serial", func(in *deviceInput) { in.SerialNumber = "a/b" }, "serial_number"},
+		{"long serial", func(in *deviceInput) { in.SerialNumber = strings.Repeat("x", 51) }, "serial_number"},
+		{"missing type", func(in *deviceInput) { in.DeviceType = "" }, "device_type"},
+		{"bad type", func(in *deviceInput) { in.DeviceType = "a b" }, "device_type"},
+		{"long name", func(in *deviceInput) { in.Name = strings.Repeat("x", 101) }, "name"},
+		{"bad status", func(in *deviceInput) { in.Status = "broken" }, "status"},
+		{"bad tag", func(in *deviceInput) { in.Tags = []string{"-x"} }, "tags"},
+		{"too many tags", func(in *deviceInput) {
+			for i := 0; i <= maxDeviceTags; i++ {
+				in.Tags = append(in.Tags, "t"+strings.Repeat("x", i))
+			}
+		}, "tags"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := valid()
+			tt.modify(&in)
+			in.normalize()
+			errs := in.validate()
+			if tt.field == "" {
+				if len(errs) > 0 {
+					t.Fatalf("errors = %v", errs)
+				}
+				return
+			}
+			if errs[tt.field] == "" || len(errs) != 1 {
+				t.Fatalf("errors = %v, want one for %s", errs, tt.field)
+			}
+		})
+	}
+}
+
+func TestDeviceInputNormalize(t *testing.T) {
+	in := deviceInput{SerialNumber: " SN-1 ", DeviceType: "logger", Status: " Active ", Tags: []string{"B", " a", "b", ""}}
+	in.normalize()
+	want := deviceInput{SerialNumber: "SN-1", DeviceType: "logger", Status: data.DeviceStatusActive, Tags: []string{"a", "b"}}
+	if !reflect.DeepEqual(in, want) {
+		t.Fatalf("normalize = %+v, want %+v", in, want)
+	}
+	if !in.equal(deviceInputFrom(&data.Device{SerialNumber: "SN-1", DeviceType: "logger", Status: "active", Tags: []string{"b", "a"}})) {
+		t.Fatal("inputs differing only in tag order are not equal")
+	}
+}
@@ -0,0 +1,742 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mqtt/data"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// webhookTopics are the bus topics webhook subscriptions can receive
+var webhookTopics = []string{
+	TopicTelemetrySaved,
+	TopicDeviceCreated,
+	TopicDeviceUpdated,
+	TopicDeviceDeleted,
+	TopicDeviceRestored,
+	TopicDeviceOnline,
+	TopicDeviceOffline,
+}
+
+const (
+	webhookTimeout     = 10 * time.Second
+	webhookBatchSize   = 200
+	webhookBaseBackoff = 10 * time.Second
+	webhookMaxBackoff  = time.Hour
+	maxWebhookReplay   = 1000
+
+	// webhookRefreshInterval is how often each instance reloads the
+	// subscriptions, so that changes made through another instance apply
+	// within it
+	webhookRefreshInterval = 10 * time.Second
+
+	// Telemetry arrives in bursts, so the bus queue is larger than usual
+	// to avoid dropping events before they are recorded
+	webhookQueueSize = 4096
+
+	webhookEventHeader    = "X-Webhook-Event"
+	webhookDeliveryHeader = "X-Webhook-Delivery"
+)
+
+// webhookPayload is the JSON body posted to subscribers
+type webhookPayload struct {
+	ID     uint64      `json:"id"`
+	Event  string      `json:"event"`
+	Device string      `json:"device,omitempty"`
+	Time   time.Time   `json:"time"`
+	Data   interface{} `json:"data"`
+}
+
+// WebhookService records matching bus events as deliveries for each webhook
+// subscription, and Run sends them with retries and a per-subscription
+// circuit breaker. Each subscription is served by a worker of its own, so a
+// slow or busy endpoint only holds up its own deliveries.
+type WebhookService struct {
+	models           *data.Models
+	log              *slog.Logger
+	client           *http.Client
+	maxAttempts      int
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	retention        time.Duration
+	wake             chan struct{}
+
+	// subscriptions caches the subscriptions for matching events; Refresh
+	// reloads it
+	mu            sync.RWMutex
+	subscriptions []*data.WebhookSubscription
+
+	// workers holds the wake channel of each running worker, by
+	// subscription ID
+	workersMu sync.Mutex
+	workers   map[uint]chan struct{}
+}
+
+// NewWebhookService loads the subscriptions and subscribes the service to
+// telemetry and device events
+func NewWebhookService(models *data.Models, events *EventBus, cfg Config, logger *slog.Logger) (*WebhookService, error) {
+	s := &WebhookService{
+		models:           models,
+		log:              logger.With("component", "webhooks"),
+		client:           &http.Client{Timeout: webhookTimeout},
+		maxAttempts:      cfg.WebhookMaxAttempts,
+		breakerThreshold: cfg.WebhookBreakerThreshold,
+		breakerCooldown:  cfg.WebhookBreakerCooldown,
+		retention:        cfg.WebhookLogRetention,
+		wake:             make(chan struct{}, 1),
+		workers:          make(map[uint]chan struct{}),
+	}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	events.Subscribe("webhooks", webhookTopics, webhookQueueSize, s.handleEvent)
+	return s, nil
+}
+
+// reload refreshes the cached subscriptions
+func (s *WebhookService) reload() error {
+	subscriptions, err := s.models.Webhook.GetSubscriptions()
+	if err != nil {
+		return fmt.Errorf("failed to load webhook subscriptions: %v", err)
+	}
+	s.mu.Lock()
+	s.subscriptions = subscriptions
+	s.mu.Unlock()
+	return nil
+}
+
+// Refresh reloads the subscriptions every webhookRefreshInterval until the
+// process exits
+func (s *WebhookService) Refresh() {
+	ticker := time.NewTicker(webhookRefreshInterval)
+	for range ticker.C {
+		if err := s.reload(); err != nil {
+			s.log.Error("failed to reload webhook subscriptions", "error", err)
+		}
+	}
+}
+
+// handleEvent records a delivery for every subscription that wants event
+func (s *WebhookService) handleEvent(event Event) error {
+	s.mu.RLock()
+	var matching []*data.WebhookSubscription
+	for _, subscription := range s.subscriptions {
+		if subscriptionWants(subscription, event) {
+			matching = append(matching, subscription)
+		}
+	}
+	s.mu.RUnlock()
+	if len(matching) == 0 {
+		return nil
+	}
+
+	wire := sseEvent(event)
+	payload, err := json.Marshal(webhookPayload{
+		ID:     event.ID,
+		Event:  event.Topic,
+		Device: event.Device,
+		Time:   event.Time.UTC(),
+		Data:   wire.Payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	deliveries := make([]*data.WebhookDelivery, len(matching))
+	for i, subscription := range matching {
+		deliveries[i] = &data.WebhookDelivery{
+			SubscriptionID: subscription.ID,
+			EventID:        event.ID,
+			Event:          event.Topic,
+			Device:         event.Device,
+			Payload:        data.JSON(payload),
+			Status:         data.WebhookDeliveryPending,
+			NextAttemptAt:  &now,
+		}
+	}
+	if err := s.models.Webhook.CreateDeliveries(deliveries); err != nil {
+		return fmt.Errorf("failed to record webhook deliveries: %v", err)
+	}
+
+	for _, subscription := range matching {
+		s.notify(subscription.ID)
+	}
+	return nil
+}
+
+// notify wakes the worker of a subscription without blocking. Without a
+// worker, Run is woken to start one.
+func (s *WebhookService) notify(subscriptionID uint) {
+	s.workersMu.Lock()
+	wake, ok := s.workers[subscriptionID]
+	s.workersMu.Unlock()
+	if !ok {
+		wake = s.wake
+	}
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// subscriptionWants reports whether a subscription receives an event
+func subscriptionWants(subscription *data.WebhookSubscription, event Event) bool {
+	if !subscription.Enabled || !containsTopic(subscription.Events, event.Topic) {
+		return false
+	}
+	return len(subscription.Devices) == 0 || slices.Contains(subscription.Devices, event.Device)
+}
+
+// Run starts a worker for every subscription every 5 seconds, and right
+// away when deliveries are recorded for one without a worker. Finished
+// deliveries older than the retention are purged hourly. Only the leader
+// sends and purges; deliveries recorded on another instance wait for the
+// worker's next tick.
+func (s *WebhookService) Run(leader Leadership) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	var lastPurge time.Time
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.wake:
+		}
+		if !leader.IsLeader() {
+			continue
+		}
+		s.startWorkers(leader)
+
+		if time.Since(lastPurge) >= time.Hour {
+			lastPurge = time.Now()
+			purged, err := s.models.Webhook.PurgeDeliveries(lastPurge.Add(-s.retention))
+			if err != nil {
+				s.log.Error("failed to purge webhook deliveries", "error", err)
+			} else if purged > 0 {
+				s.log.Info("purged old webhook deliveries", "count", purged)
+			}
+		}
+	}
+}
+
+// startWorkers starts a worker for each subscription that has none. The
+// subscriptions are read from the database, so ones created on another
+// instance are served too.
+func (s *WebhookService) startWorkers(leader Leadership) {
+	subscriptions, err := s.models.Webhook.GetSubscriptions()
+	if err != nil {
+		s.log.Error("failed to load webhook subscriptions", "error", err)
+		return
+	}
+
+	s.workersMu.Lock()
+	defer s.workersMu.Unlock()
+	for _, subscription := range subscriptions {
+		if _, ok := s.workers[subscription.ID]; ok {
+			continue
+		}
+		wake := make(chan struct{}, 1)
+		wake <- struct{}{}
+		s.workers[subscription.ID] = wake
+		go s.work(subscription.ID, wake, leader)
+	}
+}
+
+// work sends a subscription's due deliveries every 5 seconds, and right away
+// when woken, until the subscription is deleted or this instance stops
+// leading
+func (s *WebhookService) work(subscriptionID uint, wake chan struct{}, leader Leadership) {
+	defer func() {
+		s.workersMu.Lock()
+		delete(s.workers, subscriptionID)
+		s.workersMu.Unlock()
+	}()
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-wake:
+		}
+		if !leader.IsLeader() {
+			return
+		}
+		more, ok := s.sendDue(subscriptionID)
+		if !ok {
+			return
+		}
+		if more {
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// sendDue sends up to a batch of a subscription's due deliveries in order.
+// more reports whether the batch was full; ok is false once the
+// subscription has been deleted, along with its deliveries.
+func (s *WebhookService) sendDue(subscriptionID uint) (more, ok bool) {
+	subscription, err := s.models.Webhook.GetSubscription(subscriptionID)
+	if errors.Is(err, data.ErrNotFound) {
+		return false, false
+	}
+	if err != nil {
+		s.log.Error("failed to load webhook subscription", "webhook_id", subscriptionID, "error", err)
+		return false, true
+	}
+	deliveries, err := s.models.Webhook.GetDueDeliveries(subscriptionID, time.Now(), webhookBatchSize)
+	if err != nil {
+		s.log.Error("failed to load due webhook deliveries", "webhook_id", subscriptionID, "error", err)
+		return false, true
+	}
+
+	for _, delivery := range deliveries {
+		now := time.Now()
+		switch {
+		case !subscription.Enabled:
+			s.finish(delivery, data.WebhookDeliveryFailed, "subscription is disabled")
+			continue
+		case subscription.CircuitOpenUntil != nil && subscription.CircuitOpenUntil.After(now):
+			// Wait for the circuit to close without using up an attempt
+			delivery.NextAttemptAt = subscription.CircuitOpenUntil
+			s.models.Webhook.UpdateDelivery(delivery)
+			continue
+		}
+
+		err := s.send(subscription, delivery)
+		s.recordResult(subscription, err)
+	}
+	return len(deliveries) == webhookBatchSize, true
+}
+
+// send makes one delivery attempt and records its outcome
+func (s *WebhookService) send(subscription *data.WebhookSubscription, delivery *data.WebhookDelivery) error {
+	headers := http.Header{}
+	headers.Set(webhookEventHeader, delivery.Event)
+	headers.Set(webhookDeliveryHeader, strconv.FormatUint(uint64(delivery.ID), 10))
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	status, err := postJSON(ctx, s.client, subscription.URL, delivery.Payload, subscription.Secret, headers)
+	cancel()
+
+	now := time.Now()
+	delivery.Attempts++
+	delivery.ResponseStatus = status
+	switch {
+	case err == nil:
+		delivery.Status = data.WebhookDeliveryDelivered
+		delivery.DeliveredAt = &now
+		delivery.NextAttemptAt = nil
+		delivery.LastError = ""
+	case delivery.Attempts >= s.maxAttempts:
+		delivery.Status = data.WebhookDeliveryFailed
+		delivery.NextAttemptAt = nil
+		delivery.LastError = err.Error()
+	default:
+		next := now.Add(retryBackoff(delivery.Attempts, webhookBaseBackoff, webhookMaxBackoff))
+		delivery.NextAttemptAt = &next
+		delivery.LastError = err.Error()
+	}
+	if err := s.models.Webhook.UpdateDelivery(delivery); err != nil {
+		s.log.Error("failed to update webhook delivery", "delivery_id", delivery.ID, "error", err)
+	}
+	return err
+}
+
+// finish ends a delivery without sending it
+func (s *WebhookService) finish(delivery *data.WebhookDelivery, status, reason string) {
+	delivery.Status = status
+	delivery.NextAttemptAt = nil
+	delivery.LastError = reason
+	if err := s.models.Webhook.UpdateDelivery(delivery); err != nil {
+		s.log.Error("failed to update webhook delivery", "delivery_id", delivery.ID, "error", err)
+	}
+}
+
+// recordResult updates a subscription's circuit breaker after an attempt.
+// Once the circuit has opened and the cooldown passed, the next attempt is
+// a probe: success closes the circuit and failure opens it again.
+func (s *WebhookService) recordResult(subscription *data.WebhookSubscription, err error) {
+	if err == nil {
+		if subscription.ConsecutiveFailures == 0 && subscription.CircuitOpenUntil == nil {
+			return
+		}
+		if subscription.CircuitOpenUntil != nil {
+			s.log.Info("webhook recovered, closing circuit", "webhook", subscription.Name)
+		}
+		subscription.ConsecutiveFailures = 0
+		subscription.CircuitOpenUntil = nil
+	} else {
+		subscription.ConsecutiveFailures++
+		if subscription.ConsecutiveFailures >= s.breakerThreshold {
+			openUntil := time.Now().Add(s.breakerCooldown)
+			subscription.CircuitOpenUntil = &openUntil
+			s.log.Warn("webhook failing, pausing deliveries", "webhook", subscription.Name,
+				"consecutive_failures", subscription.ConsecutiveFailures, "until", openUntil)
+		}
+	}
+
+	if err := s.models.Webhook.UpdateCircuit(subscription.ID, subscription.ConsecutiveFailures, subscription.CircuitOpenUntil); err != nil {
+		s.log.Error("failed to update webhook circuit", "webhook_id", subscription.ID, "error", err)
+	}
+}
+
+// replay queues a new delivery of the same event
+func (s *WebhookService) replay(originals []*data.WebhookDelivery) ([]*data.WebhookDelivery, error) {
+	now := time.Now()
+	copies := make([]*data.WebhookDelivery, len(originals))
+	for i, original := range originals {
+		copies[i] = &data.WebhookDelivery{
+			SubscriptionID: original.SubscriptionID,
+			EventID:        original.EventID,
+			Event:          original.Event,
+			Device:         original.Device,
+			Payload:        original.Payload,
+			ReplayOf:       &original.ID,
+			Status:         data.WebhookDeliveryPending,
+			NextAttemptAt:  &now,
+		}
+	}
+	if err := s.models.Webhook.CreateDeliveries(copies); err != nil {
+		return nil, err
+	}
+	for _, delivery := range copies {
+		s.notify(delivery.SubscriptionID)
+	}
+	return copies, nil
+}
+
+// webhookInput is the body of POST and PUT /webhooks
+type webhookInput struct {
+	Name    string   `json:"name"`
+	URL     string   `json:"url"`
+	Secret  *string  `json:"secret"`
+	Events  []string `json:"events"`
+	Devices []string `json:"devices"`
+	Enabled *bool    `json:"enabled"`
+}
+
+// validate trims and checks the input
+func (in *webhookInput) validate() fieldErrors {
+	errs := fieldErrors{}
+	in.Name = strings.TrimSpace(in.Name)
+	in.URL = strings.TrimSpace(in.URL)
+
+	switch {
+	case in.Name == "":
+		errs["name"] = "is required"
+	case len(in.Name) > 100:
+		errs["name"] = "must be at most 100 characters"
+	}
+	target, err := url.Parse(in.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" || len(in.URL) > 500 {
+		errs["url"] = "must be an http or https URL of at most 500 characters"
+	}
+	if in.Secret != nil && len(*in.Secret) > 200 {
+		errs["secret"] = "must be at most 200 characters"
+	}
+
+	if len(in.Events) == 0 {
+		errs["events"] = fmt.Sprintf("is required; use topics such as %s", strings.Join(webhookTopics, ", "))
+	}
+	for i, pattern := range in.Events {
+		pattern = strings.TrimSpace(pattern)
+		in.Events[i] = pattern
+		if !slices.ContainsFunc(webhookTopics, func(topic string) bool { return topicMatches(pattern, topic) }) {
+			errs["events"] = fmt.Sprintf("%q matches none of %s", pattern, strings.Join(webhookTopics, ", "))
+			break
+		}
+	}
+
+	devices := make([]string, 0, len(in.Devices))
+	for _, device := range in.Devices {
+		if device = strings.TrimSpace(device); device != "" && !slices.Contains(devices, device) {
+			devices = append(devices, device)
+		}
+	}
+	in.Devices = devices
+	if len(in.Devices) > 1000 {
+		errs["devices"] = "must have at most 1000 entries"
+	}
+
+	if in.Enabled == nil {
+		enabled := true
+		in.Enabled = &enabled
+	}
+	return errs
+}
+
+// getWebhooks lists all webhook subscriptions
+func (h *APIHandler) getWebhooks(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := h.modelsFor(r).Webhook.GetSubscriptions()
+	if err != nil {
+		writeDataError(w, r, err, "Failed to get webhooks")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"webhooks": subscriptions,
+		"count":    len(subscriptions),
+	})
+}
+
+// getWebhook returns one webhook subscription
+func (h *APIHandler) getWebhook(w http.ResponseWriter, r *http.Request) {
+	subscription, ok := h.webhookFromURL(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, subscription)
+}
+
+// createWebhook creates a webhook subscription
+func (h *APIHandler) createWebhook(w http.ResponseWriter, r *http.Request) {
+	subscription := &data.WebhookSubscription{}
+	if !h.saveWebhook(w, r, subscription) {
+		return
+	}
+	writeJSON(w, http.StatusCreated, subscription)
+}
+
+// updateWebhook replaces a webhook subscription. Leaving out "secret" keeps
+// the current one, and saving closes the circuit breaker.
+func (h *APIHandler) updateWebhook(w http.ResponseWriter, r *http.Request) {
+	subscription, ok := h.webhookFromURL(w, r)
+	if !ok {
+		return
+	}
+	if !h.saveWebhook(w, r, subscription) {
+		return
+	}
+	writeJSON(w, http.StatusOK, subscription)
+}
+
+// saveWebhook decodes and validates a subscription from the request body and
+// saves it. It writes the error response and returns false if that fails.
+func (h *APIHandler) saveWebhook(w http.ResponseWriter, r *http.Request, subscription *data.WebhookSubscription) bool {
+	var input webhookInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return false
+	}
+	if errs := input.validate(); len(errs) > 0 {
+		writeValidationError(w, r, errs)
+		return false
+	}
+
+	subscription.Name = input.Name
+	subscription.URL = input.URL
+	if input.Secret != nil {
+		subscription.Secret = *input.Secret
+	}
+	subscription.Events = input.Events
+	subscription.Devices = input.Devices
+	subscription.Enabled = *input.Enabled
+	subscription.ConsecutiveFailures = 0
+	subscription.CircuitOpenUntil = nil
+
+	var err error
+	if subscription.ID == 0 {
+		err = h.modelsFor(r).Webhook.CreateSubscription(subscription)
+	} else {
+		err = h.modelsFor(r).Webhook.UpdateSubscription(subscription)
+	}
+	if err != nil {
+		writeDataError(w, r, err, "Failed to save webhook")
+		return false
+	}
+	if err := h.webhooks.reload(); err != nil {
+		requestLogger(r).Error("failed to reload webhooks", "error", err)
+	}
+	return true
+}
+
+// deleteWebhook removes a webhook subscription and its delivery log
+func (h *APIHandler) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	subscription, ok := h.webhookFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.modelsFor(r).Webhook.DeleteSubscription(subscription.ID); err != nil {
+		writeDataError(w, r, err, "Failed to delete webhook")
+		return
+	}
+	if err := h.webhooks.reload(); err != nil {
+		requestLogger(r).Error("failed to reload webhooks", "error", err)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Webhook deleted successfully"})
+}
+
+// getWebhookDeliveries lists a subscription's delivery log, newest first.
+// ?status, ?since (RFC 3339) and ?limit filter the list.
+func (h *APIHandler) getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	subscription, ok := h.webhookFromURL(w, r)
+	if !ok {
+		return
+	}
+	filter, ok := webhookDeliveryFilter(w, r, subscription.ID, 100)
+	if !ok {
+		return
+	}
+
+	deliveries, err := h.modelsFor(r).Webhook.GetDeliveries(filter)
+	if err != nil {
+		writeDataError(w, r, err, "Failed to get webhook deliveries")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"deliveries": deliveries,
+		"count":      len(deliveries),
+	})
+}
+
+// replayWebhook queues the subscription's failed deliveries again. ?status,
+// ?since and ?limit select other deliveries to replay.
+func (h *APIHandler) replayWebhook(w http.ResponseWriter, r *http.Request) {
+	subscription, ok := h.webhookFromURL(w, r)
+	if !ok {
+		return
+	}
+	filter, ok := webhookDeliveryFilter(w, r, subscription.ID, maxWebhookReplay)
+	if !ok {
+		return
+	}
+	if filter.Status == "" {
+		filter.Status = data.WebhookDeliveryFailed
+	}
+
+	originals, err := h.modelsFor(r).Webhook.GetDeliveries(filter)
+	if err != nil {
+		writeDataError(w, r, err, "Failed to get webhook deliveries")
+		return
+	}
+	// Replay in the order the events happened
+	slices.Reverse(originals)
+	deliveries, err := h.webhooks.replay(originals)
+	if err != nil {
+		writeDataError(w, r, err, "Failed to replay webhook deliveries")
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"deliveries": deliveries,
+		"count":      len(deliveries),
+	})
+}
+
+// getWebhookDelivery returns one delivery with its payload
+func (h *APIHandler) getWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	delivery, ok := h.webhookDeliveryFromURL(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, delivery)
+}
+
+// replayWebhookDelivery queues a new delivery of the same event
+func (h *APIHandler) replayWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	delivery, ok := h.webhookDeliveryFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	deliveries, err := h.webhooks.replay([]*data.WebhookDelivery{delivery})
+	if err != nil {
+		writeDataError(w, r, err, "Failed to replay webhook delivery")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, deliveries[0])
+}
+
+// webhookDeliveryFilter parses ?status, ?since and ?limit. It writes the
+// error response and returns false if they are invalid.
+func webhookDeliveryFilter(w http.ResponseWriter, r *http.Request, subscriptionID uint, limit int) (data.WebhookDeliveryFilter, bool) {
+	query := r.URL.Query()
+	filter := data.WebhookDeliveryFilter{SubscriptionID: subscriptionID, Status: query.Get("status"), Limit: limit}
+
+	switch filter.Status {
+	case "", data.WebhookDeliveryPending, data.WebhookDeliveryDelivered, data.WebhookDeliveryFailed:
+	default:
+		writeError(w, r, http.StatusBadRequest, "status must be pending, delivered or failed")
+		return filter, false
+	}
+	if value := query.Get("since"); value != "" {
+		since, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "since must be an RFC 3339 time")
+			return filter, false
+		}
+		filter.Since = since
+	}
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxWebhookReplay {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxWebhookReplay))
+			return filter, false
+		}
+		filter.Limit = n
+	}
+	return filter, true
+}
+
+// webhookFromURL loads the subscription named by the webhookID URL
+// parameter. It writes the error response and returns false if that fails.
+func (h *APIHandler) webhookFromURL(w http.ResponseWriter, r *http.Request) (*data.WebhookSubscription, bool) {
+	webhookID, err := strconv.ParseUint(chi.URLParam(r, "webhookID"), 10, 32)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid webhook ID")
+		return nil, false
+	}
+
+	subscription, err := h.modelsFor(r).Webhook.GetSubscription(uint(webhookID))
+	if err != nil {
+		if errors.Is(err, data.ErrNotFound) {
+			writeError(w, r, http.StatusNotFound, "Webhook not found")
+			return nil, false
+		}
+		writeDataError(w, r, err, "Failed to get webhook")
+		return nil, false
+	}
+	return subscription, true
+}
+
+// webhookDeliveryFromURL loads the delivery named by the deliveryID URL
+// parameter. It writes the error response and returns false if that fails.
+func (h *APIHandler) webhookDeliveryFromURL(w http.ResponseWriter, r *http.Request) (*data.WebhookDelivery, bool) {
+	deliveryID, err := strconv.ParseUint(chi.URLParam(r, "deliveryID"), 10, 32)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid delivery ID")
+		return nil, false
+	}
+
+	delivery, err := h.modelsFor(r).Webhook.GetDelivery(uint(deliveryID))
+	if err != nil {
+		if errors.Is(err, data.ErrNotFound) {
+			writeError(w, r, http.StatusNotFound, "Webhook delivery not found")
+			return nil, false
+		}
+		writeDataError(w, r, err, "Failed to get webhook delivery")
+		return nil, false
+	}
+	return delivery, true
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mqtt/data"
+)
+
+// fakeLeader is a Leadership that can be switched by tests
+type fakeLeader struct {
+	leading atomic.Bool
+}
+
+func (l *fakeLeader) IsLeader() bool {
+	return l.leading.Load()
+}
+
+// fakeWebhookStore keeps subscriptions and deliveries in memory
+type fakeWebhookStore struct {
+	data.WebhookModel
+
+	mu            sync.Mutex
+	subscriptions map[uint]*data.WebhookSubscription
+	deliveries    map[uint]*data.WebhookDelivery
+}
+
+func (f *fakeWebhookStore) GetSubscription(id uint) (*data.WebhookSubscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	subscription, ok := f.subscriptions[id]
+	if !ok {
+		return nil, data.ErrNotFound
+	}
+	copied := *subscription
+	return &copied, nil
+}
+
+func (f *fakeWebhookStore) GetSubscriptions() ([]*data.WebhookSubscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var subscriptions []*data.WebhookSubscription
+	for _, subscription := range f.subscriptions {
+		copied := *subscription
+		subscriptions = append(subscriptions, &copied)
+	}
+	return subscriptions, nil
+}
+
+func (f *fakeWebhookStore) UpdateCircuit(id uint, failures int, openUntil *time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subscriptions[id].ConsecutiveFailures = failures
+	f.subscriptions[id].CircuitOpenUntil = openUntil
+	return nil
+}
+
+func (f *fakeWebhookStore) addDeliveries(subscriptionID uint, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	for range n {
+		id := uint(len(f.deliveries) + 1)
+		f.deliveries[id] = &data.WebhookDelivery{ID: id, SubscriptionID: subscriptionID, Status: data.WebhookDeliveryPending, NextAttemptAt: &now, Payload: data.JSON(`{}`)}
+	}
+}
+
+func (f *fakeWebhookStore) GetDueDeliveries(subscriptionID uint, now time.Time, limit int) ([]*data.WebhookDelivery, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var due []*data.WebhookDelivery
+	for id := uint(1); id <= uint(len(f.deliveries)) && len(due) < limit; id++ {
+		delivery := f.deliveries[id]
+		if delivery.SubscriptionID == subscriptionID && delivery.Status == data.WebhookDeliveryPending && !delivery.NextAttemptAt.After(now) {
+			copied := *delivery
+			due = append(due, &copied)
+		}
+	}
+	return due, nil
+}
+
+func (f *fakeWebhookStore) UpdateDelivery(delivery *data.WebhookDelivery) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	copied := *delivery
+	f.deliveries[delivery.ID] = &copied
+	return nil
+}
+
+// count returns how many of a subscription's deliveries have a status
+func (f *fakeWebhookStore) count(subscriptionID uint, status string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, delivery := range f.deliveries {
+		if delivery.SubscriptionID == subscriptionID && delivery.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+func newTestWebhookService(store *fakeWebhookStore) *WebhookService {
+	return &WebhookService{
+		models:           &data.Models{Webhook: store},
+		log:              discardLogger(),
+		client:           &http.Client{Timeout: webhookTimeout},
+		maxAttempts:      8,
+		breakerThreshold: 2,
+		breakerCooldown:  time.Minute,
+		wake:             make(chan struct{}, 1),
+		workers:          make(map[uint]chan struct{}),
+	}
+}
+
+// waitFor polls cond for up to 5 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestWebhookWorkersAreIndependent(t *testing.T) {
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	unblock := func() { releaseOnce.Do(func() { close(release) }) }
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer unblock()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+
+	store := &fakeWebhookStore{
+		subscriptions: map[uint]*data.WebhookSubscription{
+			1: {ID: 1, Name: "slow", URL: slow.URL, Enabled: true},
+			2: {ID: 2, Name: "fast", URL: fast.URL, Enabled: true},
+		},
+		deliveries: map[uint]*data.WebhookDelivery{},
+	}
+	// More than a batch for the slow endpoint, queued first
+	store.addDeliveries(1, webhookBatchSize+50)
+	store.addDeliveries(2, 1)
+
+	s := newTestWebhookService(store)
+	leader := &fakeLeader{}
+	leader.leading.Store(true)
+	defer leader.leading.Store(false)
+	s.startWorkers(leader)
+
+	waitFor(t, "the fast endpoint's delivery", func() bool {
+		return store.count(2, data.WebhookDeliveryDelivered) == 1
+	})
+
+	// Deliveries recorded later are sent without waiting for the tick
+	store.addDeliveries(2, 3)
+	s.notify(2)
+	waitFor(t, "deliveries recorded later", func() bool {
+		return store.count(2, data.WebhookDeliveryDelivered) == 4
+	})
+	if n := store.count(1, data.WebhookDeliveryDelivered); n != 0 {
+		t.Fatalf("%d deliveries to the blocked endpoint finished", n)
+	}
+
+	// A full batch is followed by the rest right away
+	unblock()
+	waitFor(t, "the slow endpoint's deliveries", func() bool {
+		return store.count(1, data.WebhookDeliveryDelivered) == webhookBatchSize+50
+	})
+}
+
+func TestWebhookWorkerStops(t *testing.T) {
+	store := &fakeWebhookStore{
+		subscriptions: map[uint]*data.WebhookSubscription{1: {ID: 1, Enabled: true}},
+		deliveries:    map[uint]*data.WebhookDelivery{},
+	}
+	s := newTestWebhookService(store)
+	leader := &fakeLeader{}
+	leader.leading.Store(true)
+	s.startWorkers(leader)
+
+	hasWorker := func() bool {
+		s.workersMu.Lock()
+		defer s.workersMu.Unlock()
+		_, ok := s.workers[1]
+		return ok
+	}
+	if !hasWorker() {
+		t.Fatal("no worker was started")
+	}
+	store.mu.Lock()
+	delete(store.subscriptions, 1)
+	store.mu.Unlock()
+	s.notify(1)
+	waitFor(t, "the worker of a deleted subscription to stop", func() bool { return !hasWorker() })
+
+	store.mu.Lock()
+	store.subscriptions[2] = &data.WebhookSubscription{ID: 2, Enabled: true}
+	store.mu.Unlock()
+	s.startWorkers(leader)
+	leader.leading.Store(false)
+	s.notify(2)
+	waitFor(t, "the worker of a follower to stop", func() bool {
+		s.workersMu.Lock()
+		defer s.workersMu.Unlock()
+		return len(s.workers) == 0
+	})
+}
+
+func TestWebhookCircuitBreaker(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	store := &fakeWebhookStore{
+		subscriptions: map[uint]*data.WebhookSubscription{1: {ID: 1, URL: server.URL, Enabled: true}},
+		deliveries:    map[uint]*data.WebhookDelivery{},
+	}
+	store.addDeliveries(1, 3)
+	s := newTestWebhookService(store)
+
+	if more, ok := s.sendDue(1); more || !ok {
+		t.Fatalf("sendDue = %v, %v", more, ok)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Fatalf("sent %d requests, want 2 before the circuit opened", n)
+	}
+	subscription := store.subscriptions[1]
+	if subscription.ConsecutiveFailures != 2 || subscription.CircuitOpenUntil == nil {
+		t.Fatalf("circuit = %d failures, open until %v", subscription.ConsecutiveFailures, subscription.CircuitOpenUntil)
+	}
+	waiting := store.deliveries[3]
+	if waiting.Attempts != 0 || !waiting.NextAttemptAt.Equal(*subscription.CircuitOpenUntil) {
+		t.Fatalf("delivery behind the open circuit = %+v", waiting)
+	}
+	for _, id := range []uint{1, 2} {
+		if delivery := store.deliveries[id]; delivery.Attempts != 1 || delivery.ResponseStatus != http.StatusInternalServerError {
+			t.Fatalf("failed delivery = %+v", delivery)
+		}
+	}
+
+	// The probe after the cooldown closes the circuit on success
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	past := time.Now().Add(-time.Second)
+	subscription.CircuitOpenUntil = &past
+	waiting.NextAttemptAt = &past
+	s.sendDue(1)
+	if subscription.ConsecutiveFailures != 0 || subscription.CircuitOpenUntil != nil {
+		t.Fatalf("circuit still open after a successful probe: %+v", subscription)
+	}
+	if n := store.count(1, data.WebhookDeliveryDelivered); n != 1 {
+		t.Fatalf("%d deliveries delivered, want the probe", n)
+	}
+}
+
+func TestSubscriptionWants(t *testing.T) {
+	tests := []struct {
+		name         string
+		subscription data.WebhookSubscription
+		event        Event
+		want         bool
+	}{
+		{name: "topic", subscription: data.WebhookSubscription{Enabled: true, Events: data.StringList{TopicDeviceOnline}}, event: Event{Topic: TopicDeviceOnline, Device: "SN-1"}, want: true},
+		{name: "pattern", subscription: data.WebhookSubscription{Enabled: true, Events: data.StringList{"device.*"}}, event: Event{Topic: TopicDeviceOffline, Device: "SN-1"}, want: true},
+		{name: "other topic", subscription: data.WebhookSubscription{Enabled: true, Events: data.StringList{"device.*"}}, event: Event{Topic: TopicTelemetrySaved, Device: "SN-1"}},
+		{name: "disabled", subscription: data.WebhookSubscription{Events: data.StringList{"device.*"}}, event: Event{Topic: TopicDeviceOnline, Device: "SN-1"}},
+		{name: "listed device", subscription: data.WebhookSubscription{Enabled: true, Events: data.StringList{"device.*"}, Devices: data.StringList{"SN-1", "SN-2"}}, event: Event{Topic: TopicDeviceOnline, Device: "SN-2"}, want: true},
+		{name: "other device", subscription: data.WebhookSubscription{Enabled: true, Events: data.StringList{"device.*"}, Devices: data.StringList{"SN-1"}}, event: Event{Topic: TopicDeviceOnline, Device: "SN-3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := subscriptionWants(&tt.subscription, tt.event); got != tt.want {
+				t.Fatalf("subscriptionWants = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookInputValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       webhookInput
+		errField string
+	}{
+		{name: "valid", in: webhookInput{Name: "erp", URL: "https://erp.example.com/hook", Events: []string{"device.*"}}},
+		{name: "missing name", in: webhookInput{URL: "https://erp.example.com/hook", Events: []string{"device.*"}}, errField: "name"},
+		{name: "not http", in: webhookInput{Name: "erp", URL: "ftp://erp.example.com", Events: []string{"device.*"}}, errField: "url"},
+		{name: "no events", in: webhookInput{Name: "erp", URL: "https://erp.example.com/hook"}, errField: "events"},
+		{name: "unknown event", in: webhookInput{Name: "erp", URL: "https://erp.example.com/hook", Events: []string{"alert.*"}}, errField: "events"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := tt.in.validate()
+			if tt.errField == "" {
+				if len(errs) > 0 {
+					t.Fatalf("errors = %v", errs)
+				}
+				return
+			}
+			if errs[tt.errField] == "" {
+				t.Fatalf("errors = %v, want one for %s", errs, tt.errField)
+			}
+		})
+	}
+
+	in := webhookInput{Name: "erp", URL: "https://erp.example.com/hook", Events: []string{"device.*"}, Devices: []string{" SN-1", "SN-1", "", "SN-2"}}
+	in.validate()
+	if !slices.Equal(in.Devices, []string{"SN-1", "SN-2"}) || in.Enabled == nil || !*in.Enabled {
+		t.Fatalf("input not normalized: %+v", in)
+	}
+}
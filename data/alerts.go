@@ -0,0 +1,269 @@
+package data
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Alert rule operators. Comparisons test each reading against Threshold;
+// increased and decreased compare it with the device's previous reading and
+// fire when the change is larger than Threshold.
+const (
+	AlertOperatorLess         = "<"
+	AlertOperatorLessEqual    = "<="
+	AlertOperatorGreater      = ">"
+	AlertOperatorGreaterEqual = ">="
+	AlertOperatorEqual        = "=="
+	AlertOperatorNotEqual     = "!="
+	AlertOperatorIncreased    = "increased"
+	AlertOperatorDecreased    = "decreased"
+)
+
+// AlertOperators lists every supported rule operator
+var AlertOperators = []string{
+	AlertOperatorLess, AlertOperatorLessEqual, AlertOperatorGreater, AlertOperatorGreaterEqual,
+	AlertOperatorEqual, AlertOperatorNotEqual, AlertOperatorIncreased, AlertOperatorDecreased,
+}
+
+// Alert severities
+const (
+	AlertSeverityInfo     = "info"
+	AlertSeverityWarning  = "warning"
+	AlertSeverityCritical = "critical"
+)
+
+// AlertSeverities lists every alert severity, least severe first
+var AlertSeverities = []string{AlertSeverityInfo, AlertSeverityWarning, AlertSeverityCritical}
+
+// AlertRule is a user-defined condition on one telemetry metric
+type AlertRule struct {
+	ID          uint    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name        string  `json:"name" gorm:"size:100"`
+	Description string  `json:"description,omitempty" gorm:"size:500"`
+	Metric      string  `json:"metric" gorm:"size:50"`
+	Operator    string  `json:"operator" gorm:"size:10"`
+	Threshold   float64 `json:"threshold"`
+
+	// DurationSeconds is how long the condition must hold before an alert
+	// opens
+	DurationSeconds int `json:"duration_seconds"`
+	// ClearThreshold adds hysteresis to comparison rules: an open alert only
+	// resolves once the value is back on the other side of it
+	ClearThreshold *float64 `json:"clear_threshold,omitempty"`
+
+	Severity string `json:"severity" gorm:"size:20"`
+
+	// Scope; empty fields match every device
+	DeviceID   *uint  `json:"device_id,omitempty" gorm:"index"`
+	DeviceType string `json:"device_type,omitempty" gorm:"size:50"`
+
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// Alert status values. Open and acknowledged alerts are active.
+const (
+	AlertStatusOpen         = "open"
+	AlertStatusAcknowledged = "acknowledged"
+	AlertStatusResolved     = "resolved"
+)
+
+// Alert is raised when a rule's condition holds for a device. A rule has at
+// most one active alert per device, which a partial unique index enforces
+// across instances.
+type Alert struct {
+	ID           uint    `json:"id" gorm:"primaryKey;autoIncrement"`
+	RuleID       uint    `json:"rule_id" gorm:"index;uniqueIndex:idx_alerts_active,where:status <> 'resolved'"`
+	DeviceID     uint    `json:"device_id" gorm:"index;uniqueIndex:idx_alerts_active"`
+	SerialNumber string  `json:"serial_number" gorm:"size:50"`
+	Severity     string  `json:"severity" gorm:"size:20"`
+	Status       string  `json:"status" gorm:"size:20;index"`
+	Message      string  `json:"message" gorm:"size:500"`
+	Value        float64 `json:"value"`
+
+	OpenedAt       time.Time  `json:"opened_at"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	AcknowledgedBy string     `json:"acknowledged_by,omitempty" gorm:"size:100"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+	ResolvedValue  *float64   `json:"resolved_value,omitempty"`
+	UpdatedAt      time.Time  `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// IsActive reports whether the alert still needs attention
+func (a *Alert) IsActive() bool {
+	return a.Status == AlertStatusOpen || a.Status == AlertStatusAcknowledged
+}
+
+// AlertState is what is remembered of one rule for one device between
+// readings: since when its condition has held and the metric's previous
+// value. It is kept in the database so every instance evaluates a reading
+// against the same state.
+type AlertState struct {
+	RuleID       uint       `json:"rule_id" gorm:"primaryKey;autoIncrement:false"`
+	DeviceID     uint       `json:"device_id" gorm:"primaryKey;autoIncrement:false;index"`
+	PendingSince *time.Time `json:"pending_since,omitempty"`
+	LastValue    *float64   `json:"last_value,omitempty"`
+	UpdatedAt    time.Time  `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// AlertFilter selects alerts; zero fields match everything. Status "active"
+// matches open and acknowledged alerts.
+type AlertFilter struct {
+	Status   string
+	RuleID   uint
+	DeviceID uint
+	Limit    int
+}
+
+// AlertModel interface for alert rule and alert database operations
+type AlertModel interface {
+	CreateRule(*AlertRule) error
+	GetRule(id uint) (*AlertRule, error)
+	GetRules() ([]*AlertRule, error)
+	UpdateRule(*AlertRule) error
+	DeleteRule(id uint) error
+
+	CreateAlert(*Alert) error
+	GetAlert(id uint) (*Alert, error)
+	GetAlerts(filter AlertFilter) ([]*Alert, error)
+	UpdateAlertStatus(alert *Alert, from ...string) error
+
+	LockDevice(deviceID uint, fn func() error) error
+	GetAlertStates(deviceID uint) ([]*AlertState, error)
+	SaveAlertState(*AlertState) error
+	ResetAlertStates(ruleID uint) error
+}
+
+// AlertModelImpl implementation
+type AlertModelImpl struct {
+	db *gorm.DB
+}
+
+func NewAlertModel(db *gorm.DB) AlertModel {
+	return &AlertModelImpl{db: db}
+}
+
+func (m *AlertModelImpl) CreateRule(rule *AlertRule) error {
+	return translateError(m.db.Create(rule).Error)
+}
+
+func (m *AlertModelImpl) GetRule(id uint) (*AlertRule, error) {
+	var rule AlertRule
+	if err := m.db.First(&rule, id).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &rule, nil
+}
+
+func (m *AlertModelImpl) GetRules() ([]*AlertRule, error) {
+	var rules []*AlertRule
+	err := m.db.Order("id").Find(&rules).Error
+	return rules, err
+}
+
+func (m *AlertModelImpl) UpdateRule(rule *AlertRule) error {
+	return translateError(m.db.Save(rule).Error)
+}
+
+// DeleteRule removes a rule and its evaluation state; its alerts are kept
+// as history. It returns ErrNotFound if the rule does not exist.
+func (m *AlertModelImpl) DeleteRule(id uint) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("rule_id = ?", id).Delete(&AlertState{}).Error; err != nil {
+			return translateError(err)
+		}
+		result := tx.Delete(&AlertRule{}, id)
+		if result.Error != nil {
+			return translateError(result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (m *AlertModelImpl) CreateAlert(alert *Alert) error {
+	return translateError(m.db.Create(alert).Error)
+}
+
+func (m *AlertModelImpl) GetAlert(id uint) (*Alert, error) {
+	var alert Alert
+	if err := m.db.First(&alert, id).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &alert, nil
+}
+
+// GetAlerts returns the alerts matching filter, newest first
+func (m *AlertModelImpl) GetAlerts(filter AlertFilter) ([]*Alert, error) {
+	var alerts []*Alert
+	tx := m.db
+	switch filter.Status {
+	case "":
+	case "active":
+		tx = tx.Where("status IN ?", []string{AlertStatusOpen, AlertStatusAcknowledged})
+	default:
+		tx = tx.Where("status = ?", filter.Status)
+	}
+	if filter.RuleID != 0 {
+		tx = tx.Where("rule_id = ?", filter.RuleID)
+	}
+	if filter.DeviceID != 0 {
+		tx = tx.Where("device_id = ?", filter.DeviceID)
+	}
+	if filter.Limit > 0 {
+		tx = tx.Limit(filter.Limit)
+	}
+	err := tx.Order("id DESC").Find(&alerts).Error
+	return alerts, err
+}
+
+// UpdateAlertStatus saves an alert's status and the acknowledgement and
+// resolution fields, provided its stored status is still one of from.
+// Otherwise ErrPreconditionFailed is returned and nothing is written, so an
+// alert resolved in the meantime is never brought back.
+func (m *AlertModelImpl) UpdateAlertStatus(alert *Alert, from ...string) error {
+	result := m.db.Model(alert).
+		Where("status IN ?", from).
+		Select("status", "acknowledged_at", "acknowledged_by", "resolved_at", "resolved_value", "updated_at").
+		Updates(alert)
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// LockDevice runs fn while holding a lock on the device's alert state that
+// every instance shares, so readings of one device are evaluated one at a
+// time
+func (m *AlertModelImpl) LockDevice(deviceID uint, fn func() error) error {
+	return withXactLock(m.db, fmt.Sprintf("alert-state/%d", deviceID), fn)
+}
+
+// GetAlertStates returns the state kept for every rule of a device
+func (m *AlertModelImpl) GetAlertStates(deviceID uint) ([]*AlertState, error) {
+	var states []*AlertState
+	err := m.db.Where("device_id = ?", deviceID).Find(&states).Error
+	return states, translateError(err)
+}
+
+// SaveAlertState creates or replaces the state of a rule for a device
+func (m *AlertModelImpl) SaveAlertState(state *AlertState) error {
+	return translateError(m.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(state).Error)
+}
+
+// ResetAlertStates forgets since when a rule's condition has held, for
+// every device, so a changed rule starts timing afresh. Previous values are
+// kept.
+func (m *AlertModelImpl) ResetAlertStates(ruleID uint) error {
+	err := m.db.Model(&AlertState{}).Where("rule_id = ?", ruleID).Update("pending_since", nil).Error
+	return translateError(err)
+}
@@ -0,0 +1,193 @@
+package data
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Command status values. Queued commands wait for the device to wake up;
+// pending ones are due for delivery as soon as the broker is reachable.
+const (
+	CommandStatusQueued  = "queued"
+	CommandStatusPending = "pending"
+	CommandStatusSent    = "sent"
+	CommandStatusAcked   = "acked"
+	CommandStatusFailed  = "failed"
+	CommandStatusExpired = "expired"
+)
+
+// Command is a downlink instruction sent to a device over MQTT
+type Command struct {
+	ID           uint   `json:"id" gorm:"primaryKey;autoIncrement"`
+	DeviceID     uint   `json:"device_id" gorm:"index"`
+	SerialNumber string `json:"serial_number" gorm:"size:50;index"`
+	Type         string `json:"type" gorm:"size:50"`
+	Payload      JSON   `json:"payload" gorm:"type:jsonb"`
+	Status       string `json:"status" gorm:"size:20;index"`
+	QoS          byte   `json:"qos"`
+	Attempts     int    `json:"attempts"`
+
+	// DedupKey collapses repeated requests for the same action while a
+	// command is still in flight
+	DedupKey string `json:"dedup_key,omitempty" gorm:"size:100;index"`
+
+	// TraceParent is the W3C trace context of the request that created the
+	// command, so deliveries, including retries, join its trace
+	TraceParent string `json:"-" gorm:"size:55"`
+
+	// Result is the optional body of the device's acknowledgement
+	Result JSON   `json:"result,omitempty" gorm:"type:jsonb"`
+	Error  string `json:"error,omitempty" gorm:"size:500"`
+
+	CreatedAt time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt time.Time  `json:"updated_at" gorm:"autoUpdateTime"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+	AckedAt   *time.Time `json:"acked_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" gorm:"index"`
+}
+
+// activeCommandStatuses are the statuses of commands that may still be delivered
+var activeCommandStatuses = []string{CommandStatusQueued, CommandStatusPending, CommandStatusSent}
+
+// IsFinal reports whether the command has reached a terminal status
+func (c *Command) IsFinal() bool {
+	switch c.Status {
+	case CommandStatusAcked, CommandStatusFailed, CommandStatusExpired:
+		return true
+	}
+	return false
+}
+
+// CommandModel interface for command database operations
+type CommandModel interface {
+	CreateCommand(*Command) error
+	GetCommand(id uint) (*Command, error)
+	GetCommandsByDevice(deviceID uint, status string, limit int) ([]*Command, error)
+	UpdateCommandStatus(command *Command, from ...string) error
+	GetRetryableCommands(sentBefore time.Time) ([]*Command, error)
+	ExpireCommands(now time.Time) ([]*Command, error)
+	GetQueuedCommands(serialNumber string) ([]*Command, error)
+	CountQueuedCommands(serialNumber string) (int64, error)
+	GetActiveCommandByDedupKey(deviceID uint, dedupKey string) (*Command, error)
+	LockQueue(serialNumber string, fn func() error) error
+}
+
+// CommandModelImpl implementation
+type CommandModelImpl struct {
+	db *gorm.DB
+}
+
+func NewCommandModel(db *gorm.DB) CommandModel {
+	return &CommandModelImpl{db: db}
+}
+
+func (m *CommandModelImpl) CreateCommand(command *Command) error {
+	return translateError(m.db.Create(command).Error)
+}
+
+func (m *CommandModelImpl) GetCommand(id uint) (*Command, error) {
+	var command Command
+	if err := m.db.First(&command, id).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &command, nil
+}
+
+// GetCommandsByDevice returns a device's commands, newest first, optionally
+// filtered by status
+func (m *CommandModelImpl) GetCommandsByDevice(deviceID uint, status string, limit int) ([]*Command, error) {
+	var commands []*Command
+	tx := m.db.Where("device_id = ?", deviceID)
+	if status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	if limit > 0 {
+		tx = tx.Limit(limit)
+	}
+	err := tx.Order("id DESC").Find(&commands).Error
+	return commands, err
+}
+
+// UpdateCommandStatus saves a command's delivery state, i.e. its status,
+// attempts, error, result and timestamps, provided its status in the
+// database is still one of from. Otherwise ErrPreconditionFailed is
+// returned and nothing is written, so an ack or expiry that happened since
+// the command was read is never overwritten.
+func (m *CommandModelImpl) UpdateCommandStatus(command *Command, from ...string) error {
+	result := m.db.Model(command).
+		Where("status IN ?", from).
+		Select("status", "attempts", "error", "result", "sent_at", "acked_at", "updated_at").
+		Updates(command)
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// GetRetryableCommands returns commands that still need to be delivered:
+// pending ones, and sent ones not acknowledged since sentBefore
+func (m *CommandModelImpl) GetRetryableCommands(sentBefore time.Time) ([]*Command, error) {
+	var commands []*Command
+	err := m.db.
+		Where("status = ? OR (status = ? AND sent_at < ?)", CommandStatusPending, CommandStatusSent, sentBefore).
+		Order("id").
+		Find(&commands).Error
+	return commands, err
+}
+
+// ExpireCommands marks undelivered and unacknowledged commands whose expiry
+// has passed as expired and returns them. It is a single statement, so a
+// command acknowledged meanwhile is left alone.
+func (m *CommandModelImpl) ExpireCommands(now time.Time) ([]*Command, error) {
+	var commands []*Command
+	err := m.db.Model(&commands).
+		Clauses(clause.Returning{}).
+		Where("status IN ? AND expires_at < ?", activeCommandStatuses, now).
+		Update("status", CommandStatusExpired).Error
+	return commands, translateError(err)
+}
+
+// GetQueuedCommands returns the commands waiting for a device to wake up,
+// in the order they were created
+func (m *CommandModelImpl) GetQueuedCommands(serialNumber string) ([]*Command, error) {
+	var commands []*Command
+	err := m.db.
+		Where("serial_number = ? AND status = ?", serialNumber, CommandStatusQueued).
+		Order("id").
+		Find(&commands).Error
+	return commands, err
+}
+
+// CountQueuedCommands returns the depth of a device's command queue
+func (m *CommandModelImpl) CountQueuedCommands(serialNumber string) (int64, error) {
+	var count int64
+	err := m.db.Model(&Command{}).
+		Where("serial_number = ? AND status = ?", serialNumber, CommandStatusQueued).
+		Count(&count).Error
+	return count, err
+}
+
+// GetActiveCommandByDedupKey returns the device's oldest command with
+// dedupKey that has not reached a final status
+func (m *CommandModelImpl) GetActiveCommandByDedupKey(deviceID uint, dedupKey string) (*Command, error) {
+	var command Command
+	err := m.db.
+		Where("device_id = ? AND dedup_key = ? AND status IN ?", deviceID, dedupKey, activeCommandStatuses).
+		Order("id").
+		First(&command).Error
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return &command, nil
+}
+
+// LockQueue runs fn while holding a lock on the device's command queue that
+// every instance shares, so queue changes and flushes happen one at a time
+func (m *CommandModelImpl) LockQueue(serialNumber string, fn func() error) error {
+	return withXactLock(m.db, "command-queue/"+serialNumber, fn)
+}
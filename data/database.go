@@ -1,13 +1,14 @@
 package data
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"time"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
-	"gorm.io/gorm/logger"
 )
 
 // Database represents the database connection and models
@@ -15,15 +16,17 @@ type Database struct {
 	DB *gorm.DB
 }
 
-// NewDatabase creates a new database connection
-func NewDatabase(dsn string) (*Database, error) {
+// NewDatabase creates a new database connection. Failed queries and
+// queries slower than slowQuery are logged to log.
+func NewDatabase(dsn string, log *slog.Logger, slowQuery time.Duration) (*Database, error) {
 	var db *gorm.DB
 	var err error
 	attempt := 0
 	// Try to connect up to 5 times with exponential backoff
 	for {
 		db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{
-			Logger: logger.Default.LogMode(logger.Info),
+			Logger:         newGormLogger(log, slowQuery),
+			TranslateError: true,
 		})
 		if err == nil {
 			break // Successfully connected
@@ -33,14 +36,24 @@ func NewDatabase(dsn string) (*Database, error) {
 			return nil, fmt.Errorf("failed to connect to database after 5 attempts: %v", err)
 		}
 
-		fmt.Printf("Database connection attempt %d failed, retrying in 1 second...\n", attempt)
+		log.Warn("database connection failed, retrying in 1 second", "attempt", attempt, "error", err)
 
 		time.Sleep(1 * time.Second)
 		attempt++
 	}
 
+	if err := registerQueryMetrics(db); err != nil {
+		return nil, fmt.Errorf("failed to register query metrics: %v", err)
+	}
+	if err := registerQueryTracing(db); err != nil {
+		return nil, fmt.Errorf("failed to register query tracing: %v", err)
+	}
+
 	// Auto migrate the schema
-	if err := db.AutoMigrate(&Device{}, &DeviceData{}); err != nil {
+	if err := db.AutoMigrate(&Device{}, &DeviceData{}, &Command{}, &DeviceShadow{},
+		&FirmwareArtifact{}, &FirmwareCampaign{}, &FirmwareUpdate{}, &PresenceEvent{},
+		&AlertRule{}, &Alert{}, &AlertState{}, &NotificationChannel{}, &NotificationDelivery{}, &Silence{},
+		&MaintenanceWindow{}, &WebhookSubscription{}, &WebhookDelivery{}); err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %v", err)
 	}
 
@@ -71,7 +84,7 @@ func (m *DeviceDataModelImpl) CreateLog(logEntry *DeviceData) error {
 		logEntry.Sensor3 = string(sensor3JSON)
 	}
 
-	return m.db.Create(logEntry).Error
+	return translateError(m.db.Create(logEntry).Error)
 }
 
 func (m *DeviceDataModelImpl) GetByDeviceID(deviceID uint) ([]*DeviceData, error) {
@@ -96,7 +109,7 @@ func (m *DeviceDataModelImpl) GetLatestByDeviceID(deviceID uint) (*DeviceData, e
 	var logEntry DeviceData
 	err := m.db.Where("device_id = ?", deviceID).Order("timestamp DESC").First(&logEntry).Error
 	if err != nil {
-		return nil, err
+		return nil, translateError(err)
 	}
 	return &logEntry, nil
 }
@@ -117,29 +130,104 @@ func NewDeviceModel(db *gorm.DB) DeviceModel {
 }
 
 func (m *DeviceModelImpl) CreateDevice(device *Device) error {
-	return m.db.Create(device).Error
+	if err := device.Validate(); err != nil {
+		return err
+	}
+	return translateError(m.db.Create(device).Error)
 }
 
 func (m *DeviceModelImpl) GetBySerialNumber(serialNumber string) (*Device, error) {
 	var device Device
 	err := m.db.Where("serial_number = ?", serialNumber).First(&device).Error
 	if err != nil {
-		return nil, err
+		return nil, translateError(err)
 	}
 	return &device, nil
 }
 
+// GetBySerialNumbers returns the devices matching any of the given serial
+// numbers, including soft-deleted ones, since those still hold the serial
+// number in the unique index
+func (m *DeviceModelImpl) GetBySerialNumbers(serialNumbers []string) ([]*Device, error) {
+	var devices []*Device
+	if len(serialNumbers) == 0 {
+		return devices, nil
+	}
+	err := m.db.Unscoped().Where("serial_number IN ?", serialNumbers).Find(&devices).Error
+	return devices, err
+}
+
 func (m *DeviceModelImpl) GetByID(id uint) (*Device, error) {
 	var device Device
 	err := m.db.First(&device, id).Error
 	if err != nil {
-		return nil, err
+		return nil, translateError(err)
 	}
 	return &device, nil
 }
 
+// presenceColumns are maintained by MarkSeen and MarkOffline only, so a
+// device saved from a stale copy cannot overwrite them
+var presenceColumns = []string{"Online", "LastSeenAt"}
+
 func (m *DeviceModelImpl) UpdateDevice(device *Device) error {
-	return m.db.Save(device).Error
+	if err := device.Validate(); err != nil {
+		return err
+	}
+	return translateError(m.db.Omit(presenceColumns...).Save(device).Error)
+}
+
+// SaveDevices creates or updates all devices in a single transaction.
+// Devices without an ID are created, the rest are saved in place. Nothing is
+// written if any device fails validation.
+func (m *DeviceModelImpl) SaveDevices(devices []*Device) error {
+	for _, device := range devices {
+		if err := device.Validate(); err != nil {
+			return fmt.Errorf("invalid device %s: %w", device.SerialNumber, err)
+		}
+	}
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		for _, device := range devices {
+			var err error
+			if device.ID == 0 {
+				err = tx.Create(device).Error
+			} else {
+				err = tx.Omit(presenceColumns...).Save(device).Error
+			}
+			if err != nil {
+				return fmt.Errorf("failed to save device %s: %w", device.SerialNumber, translateError(err))
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateDeviceFields writes the user-editable fields of device and reloads
+// it. When unmodifiedSince is non-zero the update only applies if the stored
+// updated_at still equals it, otherwise ErrPreconditionFailed is returned.
+// Invalid fields are reported as a *ValidationError without a write.
+func (m *DeviceModelImpl) UpdateDeviceFields(device *Device, unmodifiedSince time.Time) error {
+	if err := device.Validate(); err != nil {
+		return err
+	}
+
+	tx := m.db.Model(&Device{}).Where("id = ?", device.ID)
+	if !unmodifiedSince.IsZero() {
+		tx = tx.Where("updated_at = ?", unmodifiedSince)
+	}
+
+	result := tx.Select("serial_number", "device_type", "name", "description", "status", "tags").Updates(device)
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		if err := m.db.Select("id").First(&Device{}, device.ID).Error; err != nil {
+			return translateError(err)
+		}
+		return ErrPreconditionFailed
+	}
+
+	return translateError(m.db.First(device, device.ID).Error)
 }
 
 func (m *DeviceModelImpl) GetAllDevices() ([]*Device, error) {
@@ -148,20 +236,199 @@ func (m *DeviceModelImpl) GetAllDevices() ([]*Device, error) {
 	return devices, err
 }
 
+// GetDevicesByTypeAndTags returns the devices of deviceType (any type if
+// empty) that carry every one of tags
+func (m *DeviceModelImpl) GetDevicesByTypeAndTags(deviceType string, tags []string) ([]*Device, error) {
+	var devices []*Device
+	tx := m.db
+	if deviceType != "" {
+		tx = tx.Where("device_type = ?", deviceType)
+	}
+	if len(tags) > 0 {
+		tx = tx.Where("tags @> ?", StringList(tags))
+	}
+	err := tx.Order("id").Find(&devices).Error
+	return devices, err
+}
+
+// GetDevicesByPresence returns the devices that are online, or offline.
+// Offline devices come longest-silent first, never-seen ones leading.
+func (m *DeviceModelImpl) GetDevicesByPresence(online bool) ([]*Device, error) {
+	var devices []*Device
+	err := m.db.Where("online = ?", online).Order("last_seen_at ASC NULLS FIRST, id").Find(&devices).Error
+	return devices, err
+}
+
+// CountDevicesByPresence counts the devices that are online, or offline
+func (m *DeviceModelImpl) CountDevicesByPresence(online bool) (int64, error) {
+	var count int64
+	err := m.db.Model(&Device{}).Where("online = ?", online).Count(&count).Error
+	return count, err
+}
+
+// MarkSeen records that a device was heard from at seenAt and marks it
+// online, reporting whether it was offline before. Neither column touches
+// updated_at, so device ETags are unaffected.
+func (m *DeviceModelImpl) MarkSeen(id uint, seenAt time.Time) (bool, error) {
+	result := m.db.Model(&Device{}).
+		Where("id = ? AND online = ?", id, false).
+		UpdateColumns(map[string]interface{}{"online": true, "last_seen_at": seenAt})
+	if result.Error != nil {
+		return false, translateError(result.Error)
+	}
+	if result.RowsAffected > 0 {
+		return true, nil
+	}
+
+	err := m.db.Model(&Device{}).Where("id = ?", id).UpdateColumn("last_seen_at", seenAt).Error
+	return false, translateError(err)
+}
+
+// MarkOffline marks a device offline, reporting whether it was online. A
+// non-zero seenBefore only marks it offline if it has not been seen since
+// then, so a device heard from after it was found silent stays online.
+func (m *DeviceModelImpl) MarkOffline(id uint, seenBefore time.Time) (bool, error) {
+	tx := m.db.Model(&Device{}).Where("id = ? AND online = ?", id, true)
+	if !seenBefore.IsZero() {
+		tx = tx.Where("(last_seen_at IS NULL OR last_seen_at < ?)", seenBefore)
+	}
+	result := tx.UpdateColumn("online", false)
+	return result.RowsAffected > 0, translateError(result.Error)
+}
+
+// DeleteDevice soft-deletes a device. Its DeviceData rows are kept so
+// telemetry stays queryable and is still linked if the device is restored.
+// It returns ErrNotFound if no device with that ID exists.
 func (m *DeviceModelImpl) DeleteDevice(id uint) error {
-	return m.db.Delete(&Device{}, id).Error
+	result := m.db.Delete(&Device{}, id)
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetDeletedDevices returns all soft-deleted devices
+func (m *DeviceModelImpl) GetDeletedDevices() ([]*Device, error) {
+	var devices []*Device
+	err := m.db.Unscoped().Where("deleted_at IS NOT NULL").Find(&devices).Error
+	return devices, err
+}
+
+// GetByIDUnscoped returns a device by ID whether or not it is soft-deleted
+func (m *DeviceModelImpl) GetByIDUnscoped(id uint) (*Device, error) {
+	var device Device
+	err := m.db.Unscoped().First(&device, id).Error
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return &device, nil
+}
+
+// GetDeletedBySerialNumber returns the soft-deleted device with the given
+// serial number
+func (m *DeviceModelImpl) GetDeletedBySerialNumber(serialNumber string) (*Device, error) {
+	var device Device
+	err := m.db.Unscoped().Where("serial_number = ? AND deleted_at IS NOT NULL", serialNumber).First(&device).Error
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return &device, nil
+}
+
+// RestoreDevice undoes a soft delete. Restoring a device that is not
+// deleted is a no-op; ErrNotFound is returned if the ID does not exist.
+func (m *DeviceModelImpl) RestoreDevice(id uint) (*Device, error) {
+	err := m.db.Unscoped().Model(&Device{}).
+		Where("id = ? AND deleted_at IS NOT NULL", id).
+		Update("deleted_at", nil).Error
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return m.GetByID(id)
+}
+
+// PurgeDevice permanently removes a device, soft-deleted or not, together
+// with everything that refers to it: its DeviceData rows, shadow, presence
+// history, commands, firmware updates, alerts and their notification
+// deliveries, alert state, and the alert rules, silences and maintenance windows scoped
+// to it
+func (m *DeviceModelImpl) PurgeDevice(id uint) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		alerts := tx.Model(&Alert{}).Select("id").Where("device_id = ?", id)
+		if err := tx.Where("alert_id IN (?)", alerts).Delete(&NotificationDelivery{}).Error; err != nil {
+			return translateError(err)
+		}
+		if err := tx.Unscoped().Where("device_id = ?", id).Delete(&DeviceData{}).Error; err != nil {
+			return translateError(err)
+		}
+		for _, model := range []any{
+			&DeviceShadow{}, &PresenceEvent{}, &Command{}, &FirmwareUpdate{},
+			&Alert{}, &AlertState{}, &AlertRule{}, &Silence{}, &MaintenanceWindow{},
+		} {
+			if err := tx.Where("device_id = ?", id).Delete(model).Error; err != nil {
+				return translateError(err)
+			}
+		}
+		result := tx.Unscoped().Delete(&Device{}, id)
+		if result.Error != nil {
+			return translateError(result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
 }
 
 // Models holds all database models
 type Models struct {
-	Device     DeviceModel
-	DeviceData DeviceDataModel
+	Device       DeviceModel
+	DeviceData   DeviceDataModel
+	Command      CommandModel
+	Shadow       ShadowModel
+	Firmware     FirmwareModel
+	Presence     PresenceModel
+	Alert        AlertModel
+	Notification NotificationModel
+	Webhook      WebhookModel
+
+	db *gorm.DB
 }
 
 // NewModels creates new model instances
 func NewModels(db *gorm.DB) *Models {
 	return &Models{
-		Device:     NewDeviceModel(db),
-		DeviceData: NewDeviceDataModel(db),
+		db:           db,
+		Device:       NewDeviceModel(db),
+		DeviceData:   NewDeviceDataModel(db),
+		Command:      NewCommandModel(db),
+		Shadow:       NewShadowModel(db),
+		Firmware:     NewFirmwareModel(db),
+		Presence:     NewPresenceModel(db),
+		Alert:        NewAlertModel(db),
+		Notification: NewNotificationModel(db),
+		Webhook:      NewWebhookModel(db),
+	}
+}
+
+// WithContext returns models whose queries run with ctx, so they are traced
+// as children of the span in ctx. Models assembled without a database, such
+// as in-memory ones, are returned as they are.
+func (m *Models) WithContext(ctx context.Context) *Models {
+	if m.db == nil {
+		return m
+	}
+	return NewModels(m.db.WithContext(ctx))
+}
+
+// Ping checks that the database is reachable
+func (m *Models) Ping(ctx context.Context) error {
+	sqlDB, err := m.db.WithContext(ctx).DB()
+	if err != nil {
+		return err
 	}
+	return sqlDB.PingContext(ctx)
 }
@@ -0,0 +1,97 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+// Sentinel errors returned by the models. Callers should test for them with
+// errors.Is; the wrapped error may carry more detail for logging.
+var (
+	// ErrNotFound is returned when the requested record does not exist
+	ErrNotFound = errors.New("record not found")
+
+	// ErrConflict is returned when a write clashes with existing data,
+	// e.g. a duplicate serial number
+	ErrConflict = errors.New("record conflicts with existing data")
+
+	// ErrValidation is returned when a record fails validation
+	ErrValidation = errors.New("validation failed")
+
+	// ErrPreconditionFailed is returned when a conditional update finds the
+	// record was modified since it was read
+	ErrPreconditionFailed = errors.New("record was modified by another request")
+
+	// ErrUnavailable is returned when the database could not be reached or
+	// could not run the query for now, e.g. a lost connection, a restart or
+	// a deadlock. The same call may succeed if retried.
+	ErrUnavailable = errors.New("database unavailable")
+)
+
+// ValidationError lists the invalid fields of a record, keyed by their JSON
+// name. It matches ErrValidation with errors.Is.
+type ValidationError struct {
+	Fields map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for field, message := range e.Fields {
+		fields = append(fields, field+" "+message)
+	}
+	sort.Strings(fields)
+	return fmt.Sprintf("%s: %s", ErrValidation, strings.Join(fields, "; "))
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// translateError maps GORM errors onto the package's sentinel errors
+func translateError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return ErrNotFound
+	case errors.Is(err, gorm.ErrDuplicatedKey), errors.Is(err, gorm.ErrForeignKeyViolated):
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	case isTransient(err):
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return err
+}
+
+// transientCodes are the PostgreSQL error codes, or code classes, worth
+// retrying: connection exceptions, insufficient resources, server shutdown
+// or restart, serialization failures and deadlocks
+var transientCodes = []string{"08", "53", "57P", "40001", "40P01"}
+
+// isTransient reports whether err is a connection failure or a PostgreSQL
+// error that goes away on retry, rather than a problem with the query or
+// its data
+func isTransient(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		for _, prefix := range transientCodes {
+			if strings.HasPrefix(pgErr.Code, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	var netErr net.Error
+	var connectErr *pgconn.ConnectError
+	return errors.As(err, &netErr) || errors.As(err, &connectErr) ||
+		errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err)
+}
@@ -0,0 +1,375 @@
+package data
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// FirmwareArtifact is an uploaded firmware image for one device type
+type FirmwareArtifact struct {
+	ID         uint   `json:"id" gorm:"primaryKey;autoIncrement"`
+	DeviceType string `json:"device_type" gorm:"size:50;uniqueIndex:idx_firmware_type_version"`
+	Version    string `json:"version" gorm:"size:20;uniqueIndex:idx_firmware_type_version"`
+	Filename   string `json:"filename" gorm:"size:255"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256" gorm:"size:64"`
+	Signature  string `json:"signature,omitempty" gorm:"type:text"`
+	StorageKey string `json:"-" gorm:"size:255"`
+	Notes      string `json:"notes,omitempty" gorm:"size:1000"`
+
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+}
+
+// Campaign status values
+const (
+	CampaignStatusDraft     = "draft"
+	CampaignStatusRunning   = "running"
+	CampaignStatusPaused    = "paused"
+	CampaignStatusHalted    = "halted"
+	CampaignStatusCompleted = "completed"
+	CampaignStatusCancelled = "cancelled"
+)
+
+// FirmwareCampaign rolls a firmware artifact out to the devices matching its
+// target in percentage waves
+type FirmwareCampaign struct {
+	ID         uint             `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name       string           `json:"name" gorm:"size:100"`
+	ArtifactID uint             `json:"artifact_id" gorm:"index"`
+	Artifact   FirmwareArtifact `json:"artifact" gorm:"foreignKey:ArtifactID"`
+
+	// Target; empty fields match every device
+	DeviceType   string     `json:"device_type" gorm:"size:50"`
+	FromVersions StringList `json:"from_versions" gorm:"type:jsonb"`
+	Tags         StringList `json:"tags" gorm:"type:jsonb"`
+
+	// Waves are cumulative percentages of the target, e.g. [5, 25, 100]
+	Waves       IntList `json:"waves" gorm:"type:jsonb"`
+	CurrentWave int     `json:"current_wave"`
+
+	// FailureThreshold is the failed fraction of released devices (0-1)
+	// above which the campaign halts
+	FailureThreshold float64 `json:"failure_threshold"`
+	// UpdateTimeout is how long a device has to report the new version
+	UpdateTimeoutSeconds int `json:"update_timeout_seconds"`
+
+	Status      string     `json:"status" gorm:"size:20;index"`
+	HaltReason  string     `json:"halt_reason,omitempty" gorm:"size:500"`
+	CreatedAt   time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt   time.Time  `json:"updated_at" gorm:"autoUpdateTime"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// Firmware update status values
+const (
+	FirmwareUpdatePending = "pending"
+	FirmwareUpdateSent    = "sent"
+	FirmwareUpdateUpdated = "updated"
+	FirmwareUpdateFailed  = "failed"
+	FirmwareUpdateSkipped = "skipped"
+)
+
+// FirmwareUpdate tracks one device within a campaign
+type FirmwareUpdate struct {
+	ID           uint   `json:"id" gorm:"primaryKey;autoIncrement"`
+	CampaignID   uint   `json:"campaign_id" gorm:"uniqueIndex:idx_firmware_update_device"`
+	DeviceID     uint   `json:"device_id" gorm:"uniqueIndex:idx_firmware_update_device"`
+	SerialNumber string `json:"serial_number" gorm:"size:50;index"`
+	Wave         int    `json:"wave"`
+	FromVersion  string `json:"from_version" gorm:"size:20"`
+	Status       string `json:"status" gorm:"size:20;index"`
+	CommandID    uint   `json:"command_id,omitempty" gorm:"index"`
+	Error        string `json:"error,omitempty" gorm:"size:500"`
+
+	SentAt      *time.Time `json:"sent_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt   time.Time  `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// IsFinal reports whether the device's update has finished either way
+func (u *FirmwareUpdate) IsFinal() bool {
+	switch u.Status {
+	case FirmwareUpdateUpdated, FirmwareUpdateFailed, FirmwareUpdateSkipped:
+		return true
+	}
+	return false
+}
+
+// CampaignProgress counts a campaign's devices by update status
+type CampaignProgress struct {
+	Total   int64 `json:"total"`
+	Pending int64 `json:"pending"`
+	Sent    int64 `json:"sent"`
+	Updated int64 `json:"updated"`
+	Failed  int64 `json:"failed"`
+	Skipped int64 `json:"skipped"`
+}
+
+// FirmwareModel interface for firmware artifact and campaign operations
+type FirmwareModel interface {
+	CreateArtifact(*FirmwareArtifact) error
+	GetArtifact(id uint) (*FirmwareArtifact, error)
+	GetArtifacts(deviceType string) ([]*FirmwareArtifact, error)
+	DeleteArtifact(id uint) error
+
+	CreateCampaign(*FirmwareCampaign) error
+	GetCampaign(id uint) (*FirmwareCampaign, error)
+	GetCampaigns() ([]*FirmwareCampaign, error)
+	GetCampaignsByStatus(status string) ([]*FirmwareCampaign, error)
+	ChangeCampaign(campaign *FirmwareCampaign, from []string, columns ...string) ([]*Command, error)
+	AdvanceCampaignWave(campaign *FirmwareCampaign) error
+
+	CreateUpdates(updates []*FirmwareUpdate) error
+	GetUpdates(campaignID uint, status string) ([]*FirmwareUpdate, error)
+	GetUpdatesByWave(campaignID uint, wave int, status string) ([]*FirmwareUpdate, error)
+	GetSentUpdatesBySerialNumber(serialNumber string) ([]*FirmwareUpdate, error)
+	GetUpdateByCommandID(commandID uint) (*FirmwareUpdate, error)
+	UpdateUpdate(*FirmwareUpdate) error
+	GetProgress(campaignID uint, maxWave int) (*CampaignProgress, error)
+}
+
+// FirmwareModelImpl implementation
+type FirmwareModelImpl struct {
+	db *gorm.DB
+}
+
+func NewFirmwareModel(db *gorm.DB) FirmwareModel {
+	return &FirmwareModelImpl{db: db}
+}
+
+func (m *FirmwareModelImpl) CreateArtifact(artifact *FirmwareArtifact) error {
+	return translateError(m.db.Create(artifact).Error)
+}
+
+func (m *FirmwareModelImpl) GetArtifact(id uint) (*FirmwareArtifact, error) {
+	var artifact FirmwareArtifact
+	if err := m.db.First(&artifact, id).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &artifact, nil
+}
+
+// GetArtifacts returns the artifacts for deviceType (all if empty), newest first
+func (m *FirmwareModelImpl) GetArtifacts(deviceType string) ([]*FirmwareArtifact, error) {
+	var artifacts []*FirmwareArtifact
+	tx := m.db
+	if deviceType != "" {
+		tx = tx.Where("device_type = ?", deviceType)
+	}
+	err := tx.Order("id DESC").Find(&artifacts).Error
+	return artifacts, err
+}
+
+// DeleteArtifact removes an artifact. Artifacts used by a campaign cannot be
+// deleted and return ErrConflict.
+func (m *FirmwareModelImpl) DeleteArtifact(id uint) error {
+	var campaigns int64
+	if err := m.db.Model(&FirmwareCampaign{}).Where("artifact_id = ?", id).Count(&campaigns).Error; err != nil {
+		return err
+	}
+	if campaigns > 0 {
+		return ErrConflict
+	}
+
+	result := m.db.Delete(&FirmwareArtifact{}, id)
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *FirmwareModelImpl) CreateCampaign(campaign *FirmwareCampaign) error {
+	return translateError(m.db.Omit("Artifact").Create(campaign).Error)
+}
+
+func (m *FirmwareModelImpl) GetCampaign(id uint) (*FirmwareCampaign, error) {
+	var campaign FirmwareCampaign
+	if err := m.db.Preload("Artifact").First(&campaign, id).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &campaign, nil
+}
+
+func (m *FirmwareModelImpl) GetCampaigns() ([]*FirmwareCampaign, error) {
+	var campaigns []*FirmwareCampaign
+	err := m.db.Preload("Artifact").Order("id DESC").Find(&campaigns).Error
+	return campaigns, err
+}
+
+func (m *FirmwareModelImpl) GetCampaignsByStatus(status string) ([]*FirmwareCampaign, error) {
+	var campaigns []*FirmwareCampaign
+	err := m.db.Preload("Artifact").Where("status = ?", status).Order("id").Find(&campaigns).Error
+	return campaigns, err
+}
+
+// ChangeCampaign writes campaign's status and the given columns provided
+// its stored status is still one of from, then reloads campaign. Otherwise
+// nothing is written, campaign is reloaded to show the current status and
+// ErrPreconditionFailed is returned, so a change made by another request or
+// instance since the campaign was read is never rolled back.
+//
+// When the new status stops delivery (paused, halted or cancelled), the ota
+// commands of the campaign still waiting in a device queue are expired in
+// the same transaction and returned. Their updates go back to pending to be
+// sent again on resume, or are skipped if the campaign was cancelled.
+func (m *FirmwareModelImpl) ChangeCampaign(campaign *FirmwareCampaign, from []string, columns ...string) ([]*Command, error) {
+	var withdrawn []*Command
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&FirmwareCampaign{}).
+			Where("id = ? AND status IN ?", campaign.ID, from).
+			Select(append(columns, "status", "updated_at")).
+			Updates(campaign)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrPreconditionFailed
+		}
+
+		var reason string
+		switch campaign.Status {
+		case CampaignStatusPaused, CampaignStatusHalted:
+			reason = "withdrawn, campaign " + campaign.Status
+		case CampaignStatusCancelled:
+			reason = "withdrawn, campaign cancelled"
+		default:
+			return nil
+		}
+
+		sent := tx.Model(&FirmwareUpdate{}).Select("command_id").
+			Where("campaign_id = ? AND status = ?", campaign.ID, FirmwareUpdateSent)
+		err := tx.Model(&withdrawn).
+			Clauses(clause.Returning{}).
+			Where("id IN (?) AND status IN ?", sent, []string{CommandStatusQueued, CommandStatusPending}).
+			Updates(map[string]interface{}{"status": CommandStatusExpired, "error": reason}).Error
+		if err != nil || len(withdrawn) == 0 {
+			return err
+		}
+
+		ids := make([]uint, len(withdrawn))
+		for i, command := range withdrawn {
+			ids[i] = command.ID
+		}
+		reset := map[string]interface{}{"status": FirmwareUpdatePending, "command_id": 0, "sent_at": nil}
+		if campaign.Status == CampaignStatusCancelled {
+			reset = map[string]interface{}{"status": FirmwareUpdateSkipped, "error": "campaign cancelled before delivery", "completed_at": time.Now()}
+		}
+		return tx.Model(&FirmwareUpdate{}).
+			Where("campaign_id = ? AND command_id IN ?", campaign.ID, ids).
+			Updates(reset).Error
+	})
+	if reload := m.db.Preload("Artifact").First(campaign, campaign.ID).Error; err == nil {
+		err = reload
+	}
+	return withdrawn, translateError(err)
+}
+
+// AdvanceCampaignWave releases the wave after campaign.CurrentWave and
+// reloads campaign. It returns ErrPreconditionFailed, leaving the stored
+// campaign alone, if the campaign is no longer running or is no longer at
+// that wave because another instance moved it on.
+func (m *FirmwareModelImpl) AdvanceCampaignWave(campaign *FirmwareCampaign) error {
+	result := m.db.Model(&FirmwareCampaign{}).
+		Where("id = ? AND status = ? AND current_wave = ?", campaign.ID, CampaignStatusRunning, campaign.CurrentWave).
+		Updates(map[string]interface{}{"current_wave": gorm.Expr("current_wave + 1"), "updated_at": time.Now()})
+	err := result.Error
+	if err == nil && result.RowsAffected == 0 {
+		err = ErrPreconditionFailed
+	}
+	if reload := m.db.Preload("Artifact").First(campaign, campaign.ID).Error; err == nil {
+		err = reload
+	}
+	return translateError(err)
+}
+
+// CreateUpdates stores a campaign's device list in one transaction
+func (m *FirmwareModelImpl) CreateUpdates(updates []*FirmwareUpdate) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	return translateError(m.db.CreateInBatches(updates, 500).Error)
+}
+
+// GetUpdates returns a campaign's device updates, optionally filtered by status
+func (m *FirmwareModelImpl) GetUpdates(campaignID uint, status string) ([]*FirmwareUpdate, error) {
+	var updates []*FirmwareUpdate
+	tx := m.db.Where("campaign_id = ?", campaignID)
+	if status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	err := tx.Order("wave, id").Find(&updates).Error
+	return updates, err
+}
+
+// GetUpdatesByWave returns the updates released in waves up to and including
+// wave, optionally filtered by status
+func (m *FirmwareModelImpl) GetUpdatesByWave(campaignID uint, wave int, status string) ([]*FirmwareUpdate, error) {
+	var updates []*FirmwareUpdate
+	tx := m.db.Where("campaign_id = ? AND wave <= ?", campaignID, wave)
+	if status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	err := tx.Order("wave, id").Find(&updates).Error
+	return updates, err
+}
+
+// GetSentUpdatesBySerialNumber returns a device's updates that are waiting
+// for it to report a new firmware version
+func (m *FirmwareModelImpl) GetSentUpdatesBySerialNumber(serialNumber string) ([]*FirmwareUpdate, error) {
+	var updates []*FirmwareUpdate
+	err := m.db.Where("serial_number = ? AND status = ?", serialNumber, FirmwareUpdateSent).Find(&updates).Error
+	return updates, err
+}
+
+func (m *FirmwareModelImpl) GetUpdateByCommandID(commandID uint) (*FirmwareUpdate, error) {
+	var update FirmwareUpdate
+	if err := m.db.Where("command_id = ?", commandID).First(&update).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &update, nil
+}
+
+func (m *FirmwareModelImpl) UpdateUpdate(update *FirmwareUpdate) error {
+	return translateError(m.db.Save(update).Error)
+}
+
+// GetProgress counts a campaign's devices by status. Only devices in waves
+// up to maxWave are counted unless maxWave is negative.
+func (m *FirmwareModelImpl) GetProgress(campaignID uint, maxWave int) (*CampaignProgress, error) {
+	var rows []struct {
+		Status string
+		Count  int64
+	}
+	tx := m.db.Model(&FirmwareUpdate{}).Where("campaign_id = ?", campaignID)
+	if maxWave >= 0 {
+		tx = tx.Where("wave <= ?", maxWave)
+	}
+	if err := tx.Select("status, COUNT(*) AS count").Group("status").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	progress := &CampaignProgress{}
+	for _, row := range rows {
+		progress.Total += row.Count
+		switch row.Status {
+		case FirmwareUpdatePending:
+			progress.Pending = row.Count
+		case FirmwareUpdateSent:
+			progress.Sent = row.Count
+		case FirmwareUpdateUpdated:
+			progress.Updated = row.Count
+		case FirmwareUpdateFailed:
+			progress.Failed = row.Count
+		case FirmwareUpdateSkipped:
+			progress.Skipped = row.Count
+		}
+	}
+	return progress, nil
+}
@@ -0,0 +1,114 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"io"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// AdvisoryLock is a Postgres session-level advisory lock shared by every
+// instance using the same name. It is held on a connection of its own, so
+// the database releases it when the holder dies or loses its connection.
+type AdvisoryLock struct {
+	db  *gorm.DB
+	key int64
+
+	mu sync.Mutex
+	// conn is the session holding the lock, or nil
+	conn *sql.Conn
+}
+
+// AdvisoryLock returns the lock named name. It is not taken until
+// TryAcquire is called.
+func (m *Models) AdvisoryLock(name string) *AdvisoryLock {
+	return &AdvisoryLock{db: m.db, key: lockKey(name)}
+}
+
+// lockKey maps a lock name to the key Postgres advisory locks take
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// withXactLock runs fn while holding the transaction-level advisory lock
+// named name, waiting while another session holds it. The lock's
+// transaction only holds the lock; fn runs its queries on other connections
+// of the pool, and the lock is released when it returns.
+func withXactLock(db *gorm.DB, name string, fn func() error) error {
+	var fnErr error
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", lockKey(name)).Error; err != nil {
+			return err
+		}
+		fnErr = fn()
+		return nil
+	})
+	if err != nil {
+		return translateError(err)
+	}
+	return fnErr
+}
+
+// TryAcquire takes the lock if no other session holds it and reports
+// whether it is held. While held, it checks that the session holding it is
+// still connected; if not, the lock has been lost and false is returned.
+func (l *AdvisoryLock) TryAcquire(ctx context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn != nil {
+		if err := l.conn.PingContext(ctx); err != nil {
+			closeSession(l.conn)
+			l.conn = nil
+			return false, translateError(err)
+		}
+		return true, nil
+	}
+
+	sqlDB, err := l.db.DB()
+	if err != nil {
+		return false, err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return false, translateError(err)
+	}
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", l.key).Scan(&acquired); err != nil {
+		closeSession(conn)
+		return false, translateError(err)
+	}
+	if !acquired {
+		conn.Close()
+		return false, nil
+	}
+	l.conn = conn
+	return true, nil
+}
+
+// Release gives up the lock if it is held
+func (l *AdvisoryLock) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn != nil {
+		closeSession(l.conn)
+		l.conn = nil
+	}
+}
+
+// closeSession closes the connection itself rather than returning it to the
+// pool, which ends the session and releases its advisory locks
+func closeSession(conn *sql.Conn) {
+	conn.Raw(func(driverConn any) error {
+		if closer, ok := driverConn.(io.Closer); ok {
+			return closer.Close()
+		}
+		return nil
+	})
+	conn.Close()
+}
@@ -0,0 +1,74 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// gormLogger sends GORM's output to slog. Only failed and slow queries are
+// logged, and SQL is logged with placeholders instead of its values, which
+// may hold secrets such as webhook signing keys.
+type gormLogger struct {
+	log   *slog.Logger
+	slow  time.Duration
+	level logger.LogLevel
+}
+
+func newGormLogger(log *slog.Logger, slow time.Duration) *gormLogger {
+	return &gormLogger{log: log.With("component", "database"), slow: slow, level: logger.Warn}
+}
+
+func (l *gormLogger) LogMode(level logger.LogLevel) logger.Interface {
+	copied := *l
+	copied.level = level
+	return &copied
+}
+
+func (l *gormLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= logger.Info {
+		l.log.InfoContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *gormLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= logger.Warn {
+		l.log.WarnContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *gormLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= logger.Error {
+		l.log.ErrorContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && l.level >= logger.Error && !errors.Is(err, gorm.ErrRecordNotFound):
+		l.log.ErrorContext(ctx, "query failed", queryAttrs(elapsed, fc, slog.Any("error", err))...)
+	case l.slow > 0 && elapsed > l.slow && l.level >= logger.Warn:
+		l.log.WarnContext(ctx, "slow query", queryAttrs(elapsed, fc)...)
+	}
+}
+
+// ParamsFilter drops the query values so they are never logged
+func (l *gormLogger) ParamsFilter(ctx context.Context, sql string, params ...interface{}) (string, []interface{}) {
+	return sql, nil
+}
+
+func queryAttrs(elapsed time.Duration, fc func() (string, int64), extra ...any) []any {
+	sql, rows := fc()
+	attrs := []any{
+		slog.String("sql", sql),
+		slog.Int64("rows", rows),
+		slog.Float64("duration_ms", float64(elapsed.Microseconds())/1000),
+	}
+	return append(attrs, extra...)
+}
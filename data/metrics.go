@@ -0,0 +1,78 @@
+package data
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gorm.io/gorm"
+)
+
+var queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "db_query_duration_seconds",
+	Help:    "Database query latency by table and operation.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"table", "operation"})
+
+const queryStartKey = "metrics:query_start"
+
+// registerQueryMetrics times every query with gorm callbacks, labelled
+// with the table and the operation of the callback that ran it
+func registerQueryMetrics(db *gorm.DB) error {
+	start := func(tx *gorm.DB, operation string) {
+		tx.InstanceSet(queryStartKey, time.Now())
+	}
+	finish := func(tx *gorm.DB, operation string) {
+		started, ok := tx.InstanceGet(queryStartKey)
+		if !ok {
+			return
+		}
+		queryDuration.WithLabelValues(queryTable(tx), operation).Observe(time.Since(started.(time.Time)).Seconds())
+	}
+
+	return registerAround(db, "metrics", start, finish)
+}
+
+// queryOperations names the operation each gorm callback runs. Row covers
+// Row and Rows, raw covers Raw and Exec.
+var queryOperations = map[string]string{
+	"create": "insert",
+	"query":  "select",
+	"update": "update",
+	"delete": "delete",
+	"row":    "select",
+	"raw":    "raw",
+}
+
+// registerAround registers before and after to run around every create,
+// query, update, delete, row and raw statement, passing the operation
+func registerAround(db *gorm.DB, name string, before, after func(tx *gorm.DB, operation string)) error {
+	callbacks := db.Callback()
+	type registerFunc func(string, func(*gorm.DB)) error
+	for kind, register := range map[string][2]registerFunc{
+		"create": {callbacks.Create().Before("*").Register, callbacks.Create().After("*").Register},
+		"query":  {callbacks.Query().Before("*").Register, callbacks.Query().After("*").Register},
+		"update": {callbacks.Update().Before("*").Register, callbacks.Update().After("*").Register},
+		"delete": {callbacks.Delete().Before("*").Register, callbacks.Delete().After("*").Register},
+		"row":    {callbacks.Row().Before("*").Register, callbacks.Row().After("*").Register},
+		"raw":    {callbacks.Raw().Before("*").Register, callbacks.Raw().After("*").Register},
+	} {
+		operation := queryOperations[kind]
+		if err := register[0](name+":before_"+kind, func(tx *gorm.DB) { before(tx, operation) }); err != nil {
+			return err
+		}
+		if err := register[1](name+":after_"+kind, func(tx *gorm.DB) { after(tx, operation) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryTable returns the table a statement runs against, or "none" for raw
+// SQL without a model
+func queryTable(tx *gorm.DB) string {
+	if tx.Statement.Table == "" {
+		return "none"
+	}
+	return tx.Statement.Table
+}
@@ -1,6 +1,8 @@
 package data
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -61,6 +63,32 @@ type DeviceData struct {
 	Device Device `json:"device,omitempty" gorm:"foreignKey:DeviceID"`
 }
 
+// Device status values accepted by the API
+const (
+	DeviceStatusActive         = "active"
+	DeviceStatusInactive       = "inactive"
+	DeviceStatusMaintenance    = "maintenance"
+	DeviceStatusDecommissioned = "decommissioned"
+)
+
+// DeviceStatuses lists every allowed device status
+var DeviceStatuses = []string{
+	DeviceStatusActive,
+	DeviceStatusInactive,
+	DeviceStatusMaintenance,
+	DeviceStatusDecommissioned,
+}
+
+// IsValidDeviceStatus reports whether status is an allowed device status
+func IsValidDeviceStatus(status string) bool {
+	for _, s := range DeviceStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
 // Device represents a device in the system
 type Device struct {
 	ID           uint           `json:"id" gorm:"primaryKey;autoIncrement"`
@@ -69,6 +97,9 @@ type Device struct {
 	Name         string         `json:"name" gorm:"size:100"`
 	Description  string         `json:"description" gorm:"size:500"`
 	Status       string         `json:"status" gorm:"size:20;default:'active'"`
+	Tags         StringList     `json:"tags" gorm:"type:jsonb;default:'[]'"`
+	Online       bool           `json:"online" gorm:"default:false;index"`
+	LastSeenAt   *time.Time     `json:"last_seen_at" gorm:"index"`
 	CreatedAt    time.Time      `json:"created_at" gorm:"autoCreateTime"`
 	UpdatedAt    time.Time      `json:"updated_at" gorm:"autoUpdateTime"`
 	DeletedAt    gorm.DeletedAt `json:"deleted_at,omitempty" gorm:"index"`
@@ -77,6 +108,41 @@ type Device struct {
 	DeviceData []DeviceData `json:"device_data,omitempty" gorm:"foreignKey:DeviceID"`
 }
 
+// Validate checks the fields the database constrains and returns a
+// *ValidationError listing every invalid one
+func (d *Device) Validate() error {
+	fields := map[string]string{}
+
+	switch {
+	case d.SerialNumber == "":
+		fields["serial_number"] = "is required"
+	case len(d.SerialNumber) > 50:
+		fields["serial_number"] = "must be at most 50 characters"
+	case strings.ContainsAny(d.SerialNumber, " \t\r\n/#+"):
+		fields["serial_number"] = "must not contain whitespace or MQTT topic characters"
+	}
+	switch {
+	case d.DeviceType == "":
+		fields["device_type"] = "is required"
+	case len(d.DeviceType) > 50:
+		fields["device_type"] = "must be at most 50 characters"
+	}
+	if len(d.Name) > 100 {
+		fields["name"] = "must be at most 100 characters"
+	}
+	if len(d.Description) > 500 {
+		fields["description"] = "must be at most 500 characters"
+	}
+	if d.Status != "" && !IsValidDeviceStatus(d.Status) {
+		fields["status"] = fmt.Sprintf("must be one of %s", strings.Join(DeviceStatuses, ", "))
+	}
+
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
 // DeviceDataModel interface for database operations
 type DeviceDataModel interface {
 	CreateLog(*DeviceData) error
@@ -92,7 +158,20 @@ type DeviceModel interface {
 	CreateDevice(*Device) error
 	GetBySerialNumber(serialNumber string) (*Device, error)
 	GetByID(id uint) (*Device, error)
+	GetBySerialNumbers(serialNumbers []string) ([]*Device, error)
 	GetAllDevices() ([]*Device, error)
+	GetDevicesByTypeAndTags(deviceType string, tags []string) ([]*Device, error)
+	GetDevicesByPresence(online bool) ([]*Device, error)
+	CountDevicesByPresence(online bool) (int64, error)
+	MarkSeen(id uint, seenAt time.Time) (cameOnline bool, err error)
+	MarkOffline(id uint, seenBefore time.Time) (wentOffline bool, err error)
 	UpdateDevice(*Device) error
+	UpdateDeviceFields(device *Device, unmodifiedSince time.Time) error
+	SaveDevices(devices []*Device) error
 	DeleteDevice(id uint) error
+	GetByIDUnscoped(id uint) (*Device, error)
+	GetDeletedDevices() ([]*Device, error)
+	GetDeletedBySerialNumber(serialNumber string) (*Device, error)
+	RestoreDevice(id uint) (*Device, error)
+	PurgeDevice(id uint) error
 }
@@ -0,0 +1,300 @@
+package data
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Notification channel types
+const (
+	ChannelTypeWebhook = "webhook"
+	ChannelTypeEmail   = "email"
+	ChannelTypeSlack   = "slack"
+	ChannelTypeTeams   = "teams"
+)
+
+// ChannelTypes lists every notification channel type
+var ChannelTypes = []string{ChannelTypeWebhook, ChannelTypeEmail, ChannelTypeSlack, ChannelTypeTeams}
+
+// NotificationChannel is a destination for alert notifications
+type NotificationChannel struct {
+	ID   uint   `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name string `json:"name" gorm:"size:100;uniqueIndex"`
+	Type string `json:"type" gorm:"size:20"`
+
+	// URL is the webhook, Slack or Teams endpoint
+	URL string `json:"url,omitempty" gorm:"size:500"`
+	// Secret signs generic webhook payloads; it is never returned by the API
+	Secret string `json:"-" gorm:"size:200"`
+	// Recipients are the email addresses of an email channel
+	Recipients StringList `json:"recipients" gorm:"type:jsonb"`
+
+	// Routing; empty lists match every alert
+	Severities StringList `json:"severities" gorm:"type:jsonb"`
+	RuleIDs    IntList    `json:"rule_ids" gorm:"type:jsonb"`
+	// Events are the alert changes sent: opened, acknowledged and resolved
+	Events StringList `json:"events" gorm:"type:jsonb"`
+
+	// SubjectTemplate and BodyTemplate are Go text/template strings; empty
+	// uses the built-in messages
+	SubjectTemplate string `json:"subject_template,omitempty" gorm:"size:500"`
+	BodyTemplate    string `json:"body_template,omitempty" gorm:"type:text"`
+
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// Notification delivery status values
+const (
+	DeliveryStatusPending    = "pending"
+	DeliveryStatusSent       = "sent"
+	DeliveryStatusFailed     = "failed"
+	DeliveryStatusSuppressed = "suppressed"
+)
+
+// NotificationDelivery records one notification to one channel
+type NotificationDelivery struct {
+	ID        uint   `json:"id" gorm:"primaryKey;autoIncrement"`
+	ChannelID uint   `json:"channel_id" gorm:"index"`
+	AlertID   uint   `json:"alert_id" gorm:"index"`
+	Event     string `json:"event" gorm:"size:50"`
+	Severity  string `json:"severity" gorm:"size:20"`
+	Subject   string `json:"subject" gorm:"size:500"`
+	Body      string `json:"body" gorm:"type:text"`
+	// Payload is the JSON document posted to generic webhooks
+	Payload JSON `json:"payload,omitempty" gorm:"type:jsonb"`
+
+	Status        string     `json:"status" gorm:"size:20;index"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty" gorm:"index"`
+	// LastError holds the last failure, or why the notification was
+	// suppressed
+	LastError string     `json:"last_error,omitempty" gorm:"size:1000"`
+	CreatedAt time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+}
+
+// DeliveryFilter selects deliveries; zero fields match everything
+type DeliveryFilter struct {
+	ChannelID uint
+	AlertID   uint
+	Status    string
+	Limit     int
+}
+
+// Silence suppresses notifications for matching alerts between StartsAt and
+// EndsAt. Empty matchers match every alert.
+type Silence struct {
+	ID         uint      `json:"id" gorm:"primaryKey;autoIncrement"`
+	RuleID     *uint     `json:"rule_id,omitempty"`
+	DeviceID   *uint     `json:"device_id,omitempty"`
+	DeviceType string    `json:"device_type,omitempty" gorm:"size:50"`
+	Severity   string    `json:"severity,omitempty" gorm:"size:20"`
+	StartsAt   time.Time `json:"starts_at"`
+	EndsAt     time.Time `json:"ends_at" gorm:"index"`
+	Comment    string    `json:"comment,omitempty" gorm:"size:500"`
+	CreatedBy  string    `json:"created_by,omitempty" gorm:"size:100"`
+	CreatedAt  time.Time `json:"created_at" gorm:"autoCreateTime"`
+}
+
+// MaintenanceWindow suppresses notifications for matching devices during a
+// weekly recurring period
+type MaintenanceWindow struct {
+	ID   uint   `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name string `json:"name" gorm:"size:100"`
+
+	// Scope; empty fields match every device
+	DeviceID   *uint      `json:"device_id,omitempty"`
+	DeviceType string     `json:"device_type,omitempty" gorm:"size:50"`
+	Tags       StringList `json:"tags" gorm:"type:jsonb"`
+
+	// Weekdays are 0 (Sunday) to 6; empty means every day. StartTime is
+	// "HH:MM" in Timezone.
+	Weekdays        IntList `json:"weekdays" gorm:"type:jsonb"`
+	StartTime       string  `json:"start_time" gorm:"size:5"`
+	DurationMinutes int     `json:"duration_minutes"`
+	Timezone        string  `json:"timezone" gorm:"size:50"`
+
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// NotificationModel interface for notification database operations
+type NotificationModel interface {
+	CreateChannel(*NotificationChannel) error
+	GetChannel(id uint) (*NotificationChannel, error)
+	GetChannels() ([]*NotificationChannel, error)
+	UpdateChannel(*NotificationChannel) error
+	DeleteChannel(id uint) error
+
+	CreateDelivery(*NotificationDelivery) error
+	GetDelivery(id uint) (*NotificationDelivery, error)
+	GetDeliveries(filter DeliveryFilter) ([]*NotificationDelivery, error)
+	GetDueDeliveries(now time.Time, limit int) ([]*NotificationDelivery, error)
+	UpdateDelivery(*NotificationDelivery) error
+
+	CreateSilence(*Silence) error
+	GetSilence(id uint) (*Silence, error)
+	GetSilences(activeAt *time.Time) ([]*Silence, error)
+	UpdateSilence(*Silence) error
+
+	CreateWindow(*MaintenanceWindow) error
+	GetWindow(id uint) (*MaintenanceWindow, error)
+	GetWindows() ([]*MaintenanceWindow, error)
+	UpdateWindow(*MaintenanceWindow) error
+	DeleteWindow(id uint) error
+}
+
+// NotificationModelImpl implementation
+type NotificationModelImpl struct {
+	db *gorm.DB
+}
+
+func NewNotificationModel(db *gorm.DB) NotificationModel {
+	return &NotificationModelImpl{db: db}
+}
+
+func (m *NotificationModelImpl) CreateChannel(channel *NotificationChannel) error {
+	return translateError(m.db.Create(channel).Error)
+}
+
+func (m *NotificationModelImpl) GetChannel(id uint) (*NotificationChannel, error) {
+	var channel NotificationChannel
+	if err := m.db.First(&channel, id).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &channel, nil
+}
+
+func (m *NotificationModelImpl) GetChannels() ([]*NotificationChannel, error) {
+	var channels []*NotificationChannel
+	err := m.db.Order("id").Find(&channels).Error
+	return channels, err
+}
+
+func (m *NotificationModelImpl) UpdateChannel(channel *NotificationChannel) error {
+	return translateError(m.db.Save(channel).Error)
+}
+
+// DeleteChannel removes a channel; its deliveries are kept as history. It
+// returns ErrNotFound if the channel does not exist.
+func (m *NotificationModelImpl) DeleteChannel(id uint) error {
+	result := m.db.Delete(&NotificationChannel{}, id)
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *NotificationModelImpl) CreateDelivery(delivery *NotificationDelivery) error {
+	return translateError(m.db.Create(delivery).Error)
+}
+
+func (m *NotificationModelImpl) GetDelivery(id uint) (*NotificationDelivery, error) {
+	var delivery NotificationDelivery
+	if err := m.db.First(&delivery, id).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &delivery, nil
+}
+
+// GetDeliveries returns the deliveries matching filter, newest first
+func (m *NotificationModelImpl) GetDeliveries(filter DeliveryFilter) ([]*NotificationDelivery, error) {
+	var deliveries []*NotificationDelivery
+	tx := m.db
+	if filter.ChannelID != 0 {
+		tx = tx.Where("channel_id = ?", filter.ChannelID)
+	}
+	if filter.AlertID != 0 {
+		tx = tx.Where("alert_id = ?", filter.AlertID)
+	}
+	if filter.Status != "" {
+		tx = tx.Where("status = ?", filter.Status)
+	}
+	if filter.Limit > 0 {
+		tx = tx.Limit(filter.Limit)
+	}
+	err := tx.Order("id DESC").Find(&deliveries).Error
+	return deliveries, err
+}
+
+// GetDueDeliveries returns pending deliveries whose next attempt is due,
+// oldest first
+func (m *NotificationModelImpl) GetDueDeliveries(now time.Time, limit int) ([]*NotificationDelivery, error) {
+	var deliveries []*NotificationDelivery
+	err := m.db.Where("status = ? AND next_attempt_at <= ?", DeliveryStatusPending, now).
+		Order("id").Limit(limit).Find(&deliveries).Error
+	return deliveries, err
+}
+
+func (m *NotificationModelImpl) UpdateDelivery(delivery *NotificationDelivery) error {
+	return translateError(m.db.Save(delivery).Error)
+}
+
+func (m *NotificationModelImpl) CreateSilence(silence *Silence) error {
+	return translateError(m.db.Create(silence).Error)
+}
+
+func (m *NotificationModelImpl) GetSilence(id uint) (*Silence, error) {
+	var silence Silence
+	if err := m.db.First(&silence, id).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &silence, nil
+}
+
+// GetSilences returns all silences, or only those active at activeAt when
+// it is set, newest first
+func (m *NotificationModelImpl) GetSilences(activeAt *time.Time) ([]*Silence, error) {
+	var silences []*Silence
+	tx := m.db
+	if activeAt != nil {
+		tx = tx.Where("starts_at <= ? AND ends_at > ?", *activeAt, *activeAt)
+	}
+	err := tx.Order("id DESC").Find(&silences).Error
+	return silences, err
+}
+
+func (m *NotificationModelImpl) UpdateSilence(silence *Silence) error {
+	return translateError(m.db.Save(silence).Error)
+}
+
+func (m *NotificationModelImpl) CreateWindow(window *MaintenanceWindow) error {
+	return translateError(m.db.Create(window).Error)
+}
+
+func (m *NotificationModelImpl) GetWindow(id uint) (*MaintenanceWindow, error) {
+	var window MaintenanceWindow
+	if err := m.db.First(&window, id).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &window, nil
+}
+
+func (m *NotificationModelImpl) GetWindows() ([]*MaintenanceWindow, error) {
+	var windows []*MaintenanceWindow
+	err := m.db.Order("id").Find(&windows).Error
+	return windows, err
+}
+
+func (m *NotificationModelImpl) UpdateWindow(window *MaintenanceWindow) error {
+	return translateError(m.db.Save(window).Error)
+}
+
+// DeleteWindow removes a maintenance window. It returns ErrNotFound if the
+// window does not exist.
+func (m *NotificationModelImpl) DeleteWindow(id uint) error {
+	result := m.db.Delete(&MaintenanceWindow{}, id)
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package data
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PresenceEvent records a device going online or offline
+type PresenceEvent struct {
+	ID           uint       `json:"id" gorm:"primaryKey;autoIncrement"`
+	DeviceID     uint       `json:"device_id" gorm:"index"`
+	SerialNumber string     `json:"serial_number" gorm:"size:50"`
+	Online       bool       `json:"online"`
+	Reason       string     `json:"reason" gorm:"size:20"`
+	LastSeenAt   *time.Time `json:"last_seen_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at" gorm:"autoCreateTime;index"`
+}
+
+// PresenceModel interface for presence history operations
+type PresenceModel interface {
+	CreateEvent(*PresenceEvent) error
+	GetEventsByDevice(deviceID uint, limit int) ([]*PresenceEvent, error)
+}
+
+// PresenceModelImpl implementation
+type PresenceModelImpl struct {
+	db *gorm.DB
+}
+
+func NewPresenceModel(db *gorm.DB) PresenceModel {
+	return &PresenceModelImpl{db: db}
+}
+
+func (m *PresenceModelImpl) CreateEvent(event *PresenceEvent) error {
+	return translateError(m.db.Create(event).Error)
+}
+
+// GetEventsByDevice returns a device's presence history, newest first
+func (m *PresenceModelImpl) GetEventsByDevice(deviceID uint, limit int) ([]*PresenceEvent, error) {
+	var events []*PresenceEvent
+	tx := m.db.Where("device_id = ?", deviceID).Order("id DESC")
+	if limit > 0 {
+		tx = tx.Limit(limit)
+	}
+	err := tx.Find(&events).Error
+	return events, err
+}
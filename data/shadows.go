@@ -0,0 +1,89 @@
+package data
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DeviceShadow holds the configuration an operator wants a device to have
+// (Desired) next to the state the device last reported (Reported). Version
+// increases with every change to either section.
+type DeviceShadow struct {
+	ID           uint   `json:"-" gorm:"primaryKey;autoIncrement"`
+	DeviceID     uint   `json:"device_id" gorm:"uniqueIndex"`
+	SerialNumber string `json:"serial_number" gorm:"size:50;index"`
+	Desired      JSON   `json:"desired" gorm:"type:jsonb"`
+	Reported     JSON   `json:"reported" gorm:"type:jsonb"`
+	Version      int64  `json:"version"`
+
+	DesiredUpdatedAt  *time.Time `json:"desired_updated_at,omitempty"`
+	ReportedUpdatedAt *time.Time `json:"reported_updated_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt         time.Time  `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// ShadowModel interface for device shadow database operations
+type ShadowModel interface {
+	GetShadow(deviceID uint) (*DeviceShadow, error)
+	GetShadows(deviceIDs []uint) ([]*DeviceShadow, error)
+	SaveShadow(shadow *DeviceShadow) error
+}
+
+// ShadowModelImpl implementation
+type ShadowModelImpl struct {
+	db *gorm.DB
+}
+
+func NewShadowModel(db *gorm.DB) ShadowModel {
+	return &ShadowModelImpl{db: db}
+}
+
+// GetShadow returns a device's shadow, or ErrNotFound if it has none yet
+func (m *ShadowModelImpl) GetShadow(deviceID uint) (*DeviceShadow, error) {
+	var shadow DeviceShadow
+	if err := m.db.Where("device_id = ?", deviceID).First(&shadow).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &shadow, nil
+}
+
+// GetShadows returns the shadows of the given devices; devices without one
+// are left out
+func (m *ShadowModelImpl) GetShadows(deviceIDs []uint) ([]*DeviceShadow, error) {
+	var shadows []*DeviceShadow
+	if len(deviceIDs) == 0 {
+		return shadows, nil
+	}
+	err := m.db.Where("device_id IN ?", deviceIDs).Find(&shadows).Error
+	return shadows, err
+}
+
+// SaveShadow stores shadow and increments its version. A shadow that was
+// loaded earlier is only written if its version is still current; otherwise
+// ErrPreconditionFailed is returned and the caller should reload and retry.
+// Creating a shadow that already exists returns ErrConflict.
+func (m *ShadowModelImpl) SaveShadow(shadow *DeviceShadow) error {
+	if shadow.ID == 0 {
+		shadow.Version = 1
+		return translateError(m.db.Create(shadow).Error)
+	}
+
+	result := m.db.Model(&DeviceShadow{}).
+		Where("id = ? AND version = ?", shadow.ID, shadow.Version).
+		Updates(map[string]interface{}{
+			"desired":             shadow.Desired,
+			"reported":            shadow.Reported,
+			"desired_updated_at":  shadow.DesiredUpdatedAt,
+			"reported_updated_at": shadow.ReportedUpdatedAt,
+			"version":             gorm.Expr("version + 1"),
+		})
+	if result.Error != nil {
+		return translateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrPreconditionFailed
+	}
+
+	return translateError(m.db.First(shadow, shadow.ID).Error)
+}
@@ -0,0 +1,68 @@
+package data
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+var tracer = otel.Tracer("mqtt/data")
+
+const querySpanKey = "tracing:span"
+
+// querySpan is a running query span and the context it replaced
+type querySpan struct {
+	span   trace.Span
+	parent context.Context
+}
+
+// registerQueryTracing records a span for every query whose context, set
+// with Models.WithContext, already holds a span. Queries from background
+// loops are not traced on their own. Spans carry the SQL with placeholders,
+// never its values.
+func registerQueryTracing(db *gorm.DB) error {
+	start := func(tx *gorm.DB, operation string) {
+		ctx := tx.Statement.Context
+		if ctx == nil || !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+			return
+		}
+		name := operation
+		if tx.Statement.Table != "" {
+			name += " " + tx.Statement.Table
+		}
+		spanCtx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.system.name", "postgresql"),
+				attribute.String("db.operation.name", operation),
+			))
+		tx.Statement.Context = spanCtx
+		tx.InstanceSet(querySpanKey, querySpan{span: span, parent: ctx})
+	}
+	finish := func(tx *gorm.DB, operation string) {
+		value, ok := tx.InstanceGet(querySpanKey)
+		if !ok || value.(querySpan).span == nil {
+			return
+		}
+		query := value.(querySpan)
+		tx.InstanceSet(querySpanKey, querySpan{})
+		tx.Statement.Context = query.parent
+		span := query.span
+		span.SetAttributes(
+			attribute.String("db.collection.name", tx.Statement.Table),
+			attribute.String("db.query.text", tx.Statement.SQL.String()),
+			attribute.Int64("db.response.returned_rows", tx.RowsAffected),
+		)
+		if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			span.RecordError(tx.Error)
+			span.SetStatus(codes.Error, tx.Error.Error())
+		}
+		span.End()
+	}
+
+	return registerAround(db, "tracing", start, finish)
+}
@@ -0,0 +1,193 @@
+package data
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// WebhookSubscription pushes matching events to a partner URL
+type WebhookSubscription struct {
+	ID   uint   `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name string `json:"name" gorm:"size:100"`
+	URL  string `json:"url" gorm:"size:500"`
+	// Secret signs every request; it is never returned by the API
+	Secret string `json:"-" gorm:"size:200"`
+
+	// Events are event bus topics or "prefix.*" patterns
+	Events StringList `json:"events" gorm:"type:jsonb"`
+	// Devices are serial numbers to forward; empty forwards every device
+	Devices StringList `json:"devices" gorm:"type:jsonb"`
+	Enabled bool       `json:"enabled"`
+
+	// Circuit breaker state: after too many consecutive failures no
+	// deliveries are attempted until CircuitOpenUntil
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	CircuitOpenUntil    *time.Time `json:"circuit_open_until,omitempty"`
+
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// Webhook delivery status values
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// WebhookDelivery records one event sent to one subscription
+type WebhookDelivery struct {
+	ID             uint   `json:"id" gorm:"primaryKey;autoIncrement"`
+	SubscriptionID uint   `json:"subscription_id" gorm:"index"`
+	EventID        uint64 `json:"event_id"`
+	Event          string `json:"event" gorm:"size:50"`
+	Device         string `json:"device,omitempty" gorm:"size:50"`
+	Payload        JSON   `json:"payload" gorm:"type:jsonb"`
+	// ReplayOf is the delivery this one was replayed from
+	ReplayOf *uint `json:"replay_of,omitempty"`
+
+	Status         string     `json:"status" gorm:"size:20;index"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty" gorm:"index"`
+	ResponseStatus int        `json:"response_status,omitempty"`
+	LastError      string     `json:"last_error,omitempty" gorm:"size:1000"`
+	CreatedAt      time.Time  `json:"created_at" gorm:"autoCreateTime;index"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+// WebhookDeliveryFilter selects deliveries; zero fields match everything
+type WebhookDeliveryFilter struct {
+	SubscriptionID uint
+	Status         string
+	Since          time.Time
+	Limit          int
+}
+
+// WebhookModel interface for webhook database operations
+type WebhookModel interface {
+	CreateSubscription(*WebhookSubscription) error
+	GetSubscription(id uint) (*WebhookSubscription, error)
+	GetSubscriptions() ([]*WebhookSubscription, error)
+	UpdateSubscription(*WebhookSubscription) error
+	UpdateCircuit(id uint, failures int, openUntil *time.Time) error
+	DeleteSubscription(id uint) error
+
+	CreateDeliveries([]*WebhookDelivery) error
+	GetDelivery(id uint) (*WebhookDelivery, error)
+	GetDeliveries(filter WebhookDeliveryFilter) ([]*WebhookDelivery, error)
+	GetDueDeliveries(subscriptionID uint, now time.Time, limit int) ([]*WebhookDelivery, error)
+	UpdateDelivery(*WebhookDelivery) error
+	PurgeDeliveries(before time.Time) (int64, error)
+}
+
+// WebhookModelImpl implementation
+type WebhookModelImpl struct {
+	db *gorm.DB
+}
+
+func NewWebhookModel(db *gorm.DB) WebhookModel {
+	return &WebhookModelImpl{db: db}
+}
+
+func (m *WebhookModelImpl) CreateSubscription(subscription *WebhookSubscription) error {
+	return translateError(m.db.Create(subscription).Error)
+}
+
+func (m *WebhookModelImpl) GetSubscription(id uint) (*WebhookSubscription, error) {
+	var subscription WebhookSubscription
+	if err := m.db.First(&subscription, id).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &subscription, nil
+}
+
+func (m *WebhookModelImpl) GetSubscriptions() ([]*WebhookSubscription, error) {
+	var subscriptions []*WebhookSubscription
+	err := m.db.Order("id").Find(&subscriptions).Error
+	return subscriptions, err
+}
+
+func (m *WebhookModelImpl) UpdateSubscription(subscription *WebhookSubscription) error {
+	return translateError(m.db.Save(subscription).Error)
+}
+
+// UpdateCircuit stores the circuit breaker state without touching the rest
+// of the subscription or its updated_at
+func (m *WebhookModelImpl) UpdateCircuit(id uint, failures int, openUntil *time.Time) error {
+	return translateError(m.db.Model(&WebhookSubscription{}).Where("id = ?", id).
+		UpdateColumns(map[string]interface{}{
+			"consecutive_failures": failures,
+			"circuit_open_until":   openUntil,
+		}).Error)
+}
+
+// DeleteSubscription removes a subscription and its delivery log. It
+// returns ErrNotFound if the subscription does not exist.
+func (m *WebhookModelImpl) DeleteSubscription(id uint) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Delete(&WebhookSubscription{}, id)
+		if result.Error != nil {
+			return translateError(result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return translateError(tx.Where("subscription_id = ?", id).Delete(&WebhookDelivery{}).Error)
+	})
+}
+
+func (m *WebhookModelImpl) CreateDeliveries(deliveries []*WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return translateError(m.db.Create(deliveries).Error)
+}
+
+func (m *WebhookModelImpl) GetDelivery(id uint) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	if err := m.db.First(&delivery, id).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &delivery, nil
+}
+
+// GetDeliveries returns the deliveries matching filter, newest first
+func (m *WebhookModelImpl) GetDeliveries(filter WebhookDeliveryFilter) ([]*WebhookDelivery, error) {
+	var deliveries []*WebhookDelivery
+	tx := m.db
+	if filter.SubscriptionID != 0 {
+		tx = tx.Where("subscription_id = ?", filter.SubscriptionID)
+	}
+	if filter.Status != "" {
+		tx = tx.Where("status = ?", filter.Status)
+	}
+	if !filter.Since.IsZero() {
+		tx = tx.Where("created_at >= ?", filter.Since)
+	}
+	if filter.Limit > 0 {
+		tx = tx.Limit(filter.Limit)
+	}
+	err := tx.Order("id DESC").Find(&deliveries).Error
+	return deliveries, err
+}
+
+// GetDueDeliveries returns a subscription's pending deliveries whose next
+// attempt is due, oldest first
+func (m *WebhookModelImpl) GetDueDeliveries(subscriptionID uint, now time.Time, limit int) ([]*WebhookDelivery, error) {
+	var deliveries []*WebhookDelivery
+	err := m.db.Where("subscription_id = ? AND status = ? AND next_attempt_at <= ?", subscriptionID, WebhookDeliveryPending, now).
+		Order("id").Limit(limit).Find(&deliveries).Error
+	return deliveries, err
+}
+
+func (m *WebhookModelImpl) UpdateDelivery(delivery *WebhookDelivery) error {
+	return translateError(m.db.Save(delivery).Error)
+}
+
+// PurgeDeliveries deletes finished deliveries created before a time and
+// returns how many were removed
+func (m *WebhookModelImpl) PurgeDeliveries(before time.Time) (int64, error) {
+	result := m.db.Where("status <> ? AND created_at < ?", WebhookDeliveryPending, before).Delete(&WebhookDelivery{})
+	return result.RowsAffected, translateError(result.Error)
+}